@@ -133,6 +133,8 @@ var (
 		utils.CacheGCFlag,
 		utils.CacheSnapshotFlag,
 		// utils.CacheNoPrefetchFlag,
+		utils.CachePrefetchThreadsFlag,
+		utils.CachePrefetchSkipTransfersFlag,
 		utils.CachePreimagesFlag,
 		utils.PruneAncientDataFlag, // deprecated
 		utils.CacheLogSizeFlag,
@@ -151,6 +153,9 @@ var (
 		utils.MinerRecommitIntervalFlag,
 		utils.MinerNewPayloadTimeoutFlag, // deprecated
 		utils.MinerDelayLeftoverFlag,
+		utils.MinerPrefetchBufferFlag,
+		utils.MinerPrefetchStaggerFlag,
+		utils.MinerPrefetchAbortFlag,
 		// utils.MinerNewPayloadTimeout,
 		utils.NATFlag,
 		utils.NoDiscoverFlag,
@@ -621,6 +621,16 @@ var (
 		Usage:    "Disable heuristic state prefetch during block import (less CPU and disk IO, more time waiting for data)",
 		Category: flags.PerfCategory,
 	}
+	CachePrefetchThreadsFlag = &cli.IntFlag{
+		Name:     "cache.prefetch.threads",
+		Usage:    "Number of state prefetch workers used during block import and mining (default = scaled by the CPU count)",
+		Category: flags.PerfCategory,
+	}
+	CachePrefetchSkipTransfersFlag = &cli.BoolFlag{
+		Name:     "cache.prefetch.skiptransfers",
+		Usage:    "Skip prefetching plain value transfers to accounts without code during block import and mining",
+		Category: flags.PerfCategory,
+	}
 	CachePreimagesFlag = &cli.BoolFlag{
 		Name:     "cache.preimages",
 		Usage:    "Enable recording the SHA3/keccak preimages of trie keys",
@@ -684,6 +694,21 @@ var (
 		Value:    *ethconfig.Defaults.Miner.DelayLeftOver,
 		Category: flags.MinerCategory,
 	}
+	MinerPrefetchBufferFlag = &cli.IntFlag{
+		Name:     "miner.prefetch.buffer",
+		Usage:    "Number of transactions queued ahead of the mining prefetch workers (default = worker count)",
+		Category: flags.MinerCategory,
+	}
+	MinerPrefetchStaggerFlag = &cli.DurationFlag{
+		Name:     "miner.prefetch.stagger",
+		Usage:    "Delay between the startup of two consecutive mining prefetch workers, spreading out their state copies",
+		Category: flags.MinerCategory,
+	}
+	MinerPrefetchAbortFlag = &cli.BoolFlag{
+		Name:     "miner.prefetch.abortonovertake",
+		Usage:    "Stop mining prefetch once block building catches up with the transactions not yet prefetched",
+		Category: flags.MinerCategory,
+	}
 
 	// Account settings
 	UnlockedAccountFlag = &cli.StringFlag{
@@ -1998,6 +2023,21 @@ func setMiner(ctx *cli.Context, cfg *minerconfig.Config) {
 	if ctx.Bool(DisableVoteAttestationFlag.Name) {
 		cfg.DisableVoteAttestation = true
 	}
+	if ctx.IsSet(CachePrefetchThreadsFlag.Name) {
+		cfg.PrefetchThreads = ctx.Int(CachePrefetchThreadsFlag.Name)
+	}
+	if ctx.IsSet(CachePrefetchSkipTransfersFlag.Name) {
+		cfg.PrefetchSkipPlainTransfers = ctx.Bool(CachePrefetchSkipTransfersFlag.Name)
+	}
+	if ctx.IsSet(MinerPrefetchBufferFlag.Name) {
+		cfg.PrefetchDispatchBuffer = ctx.Int(MinerPrefetchBufferFlag.Name)
+	}
+	if ctx.IsSet(MinerPrefetchStaggerFlag.Name) {
+		cfg.PrefetchWorkerStagger = ctx.Duration(MinerPrefetchStaggerFlag.Name)
+	}
+	if ctx.IsSet(MinerPrefetchAbortFlag.Name) {
+		cfg.PrefetchAbortOnOvertake = ctx.Bool(MinerPrefetchAbortFlag.Name)
+	}
 	if ctx.IsSet(MinerTxGasLimitFlag.Name) {
 		log.Warn("The flag --miner.txgaslimit is deprecated and has no effect; per-transaction gas limit is now enforced by EIP-7825")
 	}
@@ -2125,6 +2165,12 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *ethconfig.Config) {
 	if ctx.IsSet(CacheNoPrefetchFlag.Name) {
 		cfg.NoPrefetch = ctx.Bool(CacheNoPrefetchFlag.Name)
 	}
+	if ctx.IsSet(CachePrefetchThreadsFlag.Name) {
+		cfg.PrefetchThreads = ctx.Int(CachePrefetchThreadsFlag.Name)
+	}
+	if ctx.IsSet(CachePrefetchSkipTransfersFlag.Name) {
+		cfg.PrefetchSkipPlainTransfers = ctx.Bool(CachePrefetchSkipTransfersFlag.Name)
+	}
 	// Read the value from the flag no matter if it's set or not.
 	cfg.Preimages = ctx.Bool(CachePreimagesFlag.Name)
 	if cfg.NoPruning && !cfg.Preimages {
@@ -121,10 +121,22 @@ var (
 
 	blockRecvTimeDiffGauge = metrics.NewRegisteredGauge("chain/block/recvtimediff", nil)
 
-	blockPrefetchExecuteTimer    = metrics.NewRegisteredResettingTimer("chain/prefetch/executes", nil)
-	blockPrefetchInterruptMeter  = metrics.NewRegisteredMeter("chain/prefetch/interrupts", nil)
-	blockPrefetchTxsInvalidMeter = metrics.NewRegisteredMeter("chain/prefetch/txs/invalid", nil)
-	blockPrefetchTxsValidMeter   = metrics.NewRegisteredMeter("chain/prefetch/txs/valid", nil)
+	blockPrefetchExecuteTimer          = metrics.NewRegisteredResettingTimer("chain/prefetch/executes", nil)
+	blockPrefetchInterruptMeter        = metrics.NewRegisteredMeter("chain/prefetch/interrupts", nil)
+	blockPrefetchTxsInvalidMeter       = metrics.NewRegisteredMeter("chain/prefetch/txs/invalid", nil)
+	blockPrefetchTxsValidMeter         = metrics.NewRegisteredMeter("chain/prefetch/txs/valid", nil)
+	blockPrefetchTxsSkippedMeter       = metrics.NewRegisteredMeter("chain/prefetch/txs/skipped", nil)
+	blockPrefetchTxsInterruptedMeter   = metrics.NewRegisteredMeter("chain/prefetch/txs/interrupted", nil)
+	blockPrefetchTxsUnconvertibleMeter = metrics.NewRegisteredMeter("chain/prefetch/txs/unconvertible", nil)
+
+	blockPrefetchExecSuccessMeter  = metrics.NewRegisteredMeter("chain/prefetch/exec/success", nil)
+	blockPrefetchExecRevertMeter   = metrics.NewRegisteredMeter("chain/prefetch/exec/revert", nil)
+	blockPrefetchExecOutOfGasMeter = metrics.NewRegisteredMeter("chain/prefetch/exec/outofgas", nil)
+	blockPrefetchExecOtherMeter    = metrics.NewRegisteredMeter("chain/prefetch/exec/other", nil)
+
+	blockPrefetchDispatchBlockedMeter = metrics.NewRegisteredMeter("chain/prefetch/mining/dispatch/blocked", nil)
+	blockPrefetchOvertakenMeter       = metrics.NewRegisteredMeter("chain/prefetch/mining/overtaken", nil)
+	blockPrefetchMiningAbortedMeter   = metrics.NewRegisteredMeter("chain/prefetch/mining/aborted", nil)
 
 	errInsertionInterrupted = errors.New("insertion is interrupted")
 	errChainStopped         = errors.New("blockchain is stopped")
@@ -218,9 +230,11 @@ type BlockChainConfig struct {
 	ChainHistoryMode history.HistoryMode
 
 	// Misc options
-	NoPrefetch bool            // Whether to disable heuristic state prefetching when processing blocks
-	Overrides  *ChainOverrides // Optional chain config overrides
-	VmConfig   vm.Config       // Config options for the EVM Interpreter
+	NoPrefetch                 bool            // Whether to disable heuristic state prefetching when processing blocks
+	PrefetchThreads            int             // Number of state prefetch workers, zero for the defaults
+	PrefetchSkipPlainTransfers bool            // Whether to skip prefetching plain value transfers to accounts without code
+	Overrides                  *ChainOverrides // Optional chain config overrides
+	VmConfig                   vm.Config       // Config options for the EVM Interpreter
 
 	// TxLookupLimit specifies the maximum number of blocks from head for which
 	// transaction hashes will be indexed.
@@ -515,7 +529,12 @@ func NewBlockChain(db ethdb.Database, genesis *Genesis, engine consensus.Engine,
 	bc.forker = NewForkChoice(bc)
 	bc.statedb = state.NewDatabase(bc.triedb, nil)
 	bc.validator = NewBlockValidator(chainConfig, bc)
-	bc.prefetcher = NewStatePrefetcher(chainConfig, bc.hc)
+	prefetcher := NewStatePrefetcher(chainConfig, bc.hc)
+	prefetcher.SetThreads(cfg.PrefetchThreads)
+	if cfg.PrefetchSkipPlainTransfers {
+		prefetcher.SetTxFilter(SkipPlainTransfers)
+	}
+	bc.prefetcher = prefetcher
 	bc.processor = NewStateProcessor(bc.hc)
 
 	genesisHeader := bc.GetHeaderByNumber(0)
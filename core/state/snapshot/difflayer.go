@@ -17,10 +17,14 @@
 package snapshot
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"maps"
 	"math"
+	"math/bits"
 	"math/rand"
 	"slices"
 	"sync"
@@ -28,7 +32,11 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
 	bloomfilter "github.com/holiman/bloomfilter/v2"
 )
@@ -51,6 +59,48 @@ var (
 	// smaller number to be on the safe side.
 	aggregatorItemLimit = aggregatorMemoryLimit / 42
 
+	// diffSkipNoopStorage makes new diff layers drop the storage writes whose
+	// value is identical to what the parent resolves, avoiding the memory and
+	// bloom entries of redundant writes at the cost of a parent lookup each.
+	diffSkipNoopStorage = false
+
+	// diffSkipNoopAccounts makes new diff layers drop the account writes whose
+	// value is identical to what the parent resolves, avoiding the memory and
+	// bloom entries of redundant writes at the cost of a parent lookup each.
+	diffSkipNoopAccounts = false
+
+	// prefixReadCounting makes diff layers count the reads served through them,
+	// bucketed by the first byte of the account hash. All readers of a layer
+	// contend on the same counters, so it is disabled by default.
+	prefixReadCounting = false
+
+	// staleRetryDelay is the time to wait between two attempts of a read which
+	// ran into a layer invalidated by a concurrent flattening.
+	staleRetryDelay = 10 * time.Millisecond
+
+	// pinLongHoldThreshold is the time after which a released layer pin is
+	// reported as long-held, having blocked the consolidation of the layers.
+	pinLongHoldThreshold = time.Minute
+
+	// bloomOverlay makes new diff layers link to the bloom filters of their
+	// ancestors instead of copying them, only tracking their own entries in a
+	// small overlay filter. Lookups consult the chain of linked filters.
+	bloomOverlay = false
+
+	// bloomOverlayMaxDepth is the maximum number of bloom filters linked into a
+	// chain. Once reached, a fresh bloom covering all the ancestors is rebuilt,
+	// bounding both the lookup cost and the compound false positive rate.
+	bloomOverlayMaxDepth = 32
+
+	// bloomVerifyRate is the fraction of bloom filter misses double checked by
+	// walking the diff layer maps, detecting and repairing the reads hitting a
+	// false negative of a corrupted bloom. Zero disables the verification.
+	bloomVerifyRate = 0.0
+
+	// flattenProgressInterval is the number of merged entries after which the
+	// progress callback of a flattening is invoked.
+	flattenProgressInterval = uint64(100_000)
+
 	// bloomTargetError is the target false positive rate when the aggregator
 	// layer is at its fullest. The actual value will probably move around up
 	// and down from this number, it's mostly a ballpark figure.
@@ -62,12 +112,12 @@ var (
 
 	// bloomSize is the ideal bloom filter size given the maximum number of items
 	// it's expected to hold and the target false positive error rate.
-	bloomSize = math.Ceil(float64(aggregatorItemLimit) * math.Log(bloomTargetError) / math.Log(1/math.Pow(2, math.Log(2))))
+	bloomSize = optimalBloomSize(aggregatorItemLimit)
 
 	// bloomFuncs is the ideal number of bits a single entry should set in the
 	// bloom filter to keep its size to a minimum (given it's size and maximum
 	// entry count).
-	bloomFuncs = math.Round((bloomSize / float64(aggregatorItemLimit)) * math.Log(2))
+	bloomFuncs = optimalBloomFuncs(bloomSize, aggregatorItemLimit)
 
 	// the bloom offsets are runtime constants which determines which part of the
 	// account/storage hash the hasher functions looks at, to determine the
@@ -78,12 +128,53 @@ var (
 	bloomStorageHasherOffset = 0
 )
 
+// optimalBloomSize returns the ideal bloom filter size given the maximum number
+// of items it's expected to hold and the target false positive error rate.
+func optimalBloomSize(items uint64) float64 {
+	return math.Ceil(float64(items) * math.Log(bloomTargetError) / math.Log(1/math.Pow(2, math.Log(2))))
+}
+
+// optimalBloomFuncs returns the ideal number of bits a single entry should set
+// in a bloom filter of the given size holding the given number of items.
+func optimalBloomFuncs(size float64, items uint64) float64 {
+	return math.Round((size / float64(items)) * math.Log(2))
+}
+
+// SetAggregatorMemoryLimit sets the maximum size of the bottom-most diff layer
+// aggregating the writes before they are flushed to disk, recomputing the item
+// limit and the bloom filter parameters to match. Raising it on high memory
+// nodes makes them flush less often, at the cost of larger bloom filters in
+// every diff layer.
+//
+// It's meant to be called on startup before the snapshot tree is loaded. Blooms
+// are copied from parent to child layers, so if called with layers already in
+// memory, the new parameters only apply to the blooms built from scratch, which
+// happens for all of them by the next flush to disk.
+func SetAggregatorMemoryLimit(limit uint64) {
+	aggregatorMemoryLimit = limit
+	aggregatorItemLimit = limit / 42
+	bloomSize = optimalBloomSize(aggregatorItemLimit)
+	bloomFuncs = optimalBloomFuncs(bloomSize, aggregatorItemLimit)
+}
+
 func init() {
 	// Init the bloom offsets in the range [0:24] (requires 8 bytes)
 	bloomAccountHasherOffset = rand.Intn(25)
 	bloomStorageHasherOffset = rand.Intn(25)
 }
 
+// setBloomOffsets pins the bloom hasher offsets to the given values instead of
+// the random ones chosen at startup, making the bloom contents reproducible.
+// It's meant to be used by tests only, before any diff layer is created, since
+// existing blooms would not match the new offsets.
+func setBloomOffsets(account, storage int) {
+	if account < 0 || account > 24 || storage < 0 || storage > 24 {
+		panic(fmt.Sprintf("bloom offsets out of range [0:24]: %d, %d", account, storage))
+	}
+	bloomAccountHasherOffset = account
+	bloomStorageHasherOffset = storage
+}
+
 // diffLayer represents a collection of modifications made to a state snapshot
 // after running a block on top. It contains one sorted list for the account trie
 // and one-one list for each storage tries.
@@ -94,16 +185,24 @@ type diffLayer struct {
 	origin *diskLayer // Base disk layer to directly use on bloom misses
 	parent snapshot   // Parent snapshot modified by this one, never nil
 	memory uint64     // Approximate guess as to how much memory we use
+	items  uint64     // Approximate number of account and storage entries held
+
+	root   common.Hash  // Root hash to which this snapshot diff belongs to
+	stale  atomic.Bool  // Signals that the layer became stale (state progressed)
+	merged atomic.Bool  // Signals that the layer was flattened into the bottom-most diff
+	pins   atomic.Int32 // Number of active pins preventing the layer from being flattened
 
-	root  common.Hash // Root hash to which this snapshot diff belongs to
-	stale atomic.Bool // Signals that the layer became stale (state progressed)
+	pinLock sync.Mutex // Lock serializing pinning with the flattening of the layer
 
 	accountData map[common.Hash][]byte                 // Keyed accounts for direct retrieval (nil means deleted)
 	storageData map[common.Hash]map[common.Hash][]byte // Keyed storage slots for direct retrieval. one per account (nil means deleted)
 	accountList []common.Hash                          // List of account for iteration. If it exists, it's sorted, otherwise it's nil
 	storageList map[common.Hash][]common.Hash          // List of storage slots for iterated retrievals, one per account. Any existing lists are sorted if non-nil
 
-	diffed *bloomfilter.Filter // Bloom filter tracking all the diffed items up to the disk layer
+	diffed      *bloomfilter.Filter // Bloom filter tracking all the diffed items up to the disk layer
+	bloomParent *bloomLink          // Ancestor blooms to consult on a miss, if diffed only tracks the local items
+
+	readCounts [256]atomic.Uint64 // Reads served through this layer, bucketed by the first byte of the account hash
 
 	lock sync.RWMutex
 }
@@ -122,6 +221,13 @@ func storageBloomHash(h0, h1 common.Hash) uint64 {
 // newDiffLayer creates a new diff on top of an existing snapshot, whether that's a low
 // level persistent database or a hierarchical diff already.
 func newDiffLayer(parent snapshot, root common.Hash, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) *diffLayer {
+	// If no-op detection is enabled, drop the writes the parent already holds
+	if diffSkipNoopStorage {
+		storage = skipNoopStorage(parent, storage)
+	}
+	if diffSkipNoopAccounts {
+		accounts = skipNoopAccounts(parent, accounts)
+	}
 	// Create the new layer with some pre-allocated data segments
 	dl := &diffLayer{
 		parent:      parent,
@@ -144,6 +250,7 @@ func newDiffLayer(parent snapshot, root common.Hash, accounts map[common.Hash][]
 	for _, blob := range accounts {
 		// Determine memory size and track the dirty writes
 		dl.memory += uint64(common.HashLength + len(blob))
+		dl.items++
 		snapshotDirtyAccountWriteMeter.Mark(int64(len(blob)))
 	}
 	for accountHash, slots := range storage {
@@ -153,12 +260,196 @@ func newDiffLayer(parent snapshot, root common.Hash, accounts map[common.Hash][]
 		// Determine memory size and track the dirty writes
 		for _, data := range slots {
 			dl.memory += uint64(common.HashLength + len(data))
+			dl.items++
 			snapshotDirtyStorageWriteMeter.Mark(int64(len(data)))
 		}
 	}
+	snapshotDirtyAccountGauge.Inc(int64(len(accounts)))
+	snapshotDirtyStorageGauge.Inc(int64(countSlots(storage)))
 	return dl
 }
 
+// SetDiffSkipNoopStorage enables or disables dropping the storage writes of new
+// diff layers whose value is identical to what the parent layer resolves. Each
+// write costs a parent lookup when enabled, so it is disabled by default.
+func SetDiffSkipNoopStorage(enabled bool) {
+	diffSkipNoopStorage = enabled
+}
+
+// SetDiffSkipNoopAccounts enables or disables dropping the account writes of new
+// diff layers whose value is identical to what the parent layer resolves. Each
+// write costs a parent lookup when enabled, so it is disabled by default.
+func SetDiffSkipNoopAccounts(enabled bool) {
+	diffSkipNoopAccounts = enabled
+}
+
+// SetPrefixReadCounting enables or disables counting the reads served through
+// the diff layers per account hash prefix, exposed via ReadCountsByPrefix. The
+// counters are shared by all readers of a layer, adding contention to the read
+// path when enabled, so it is disabled by default.
+func SetPrefixReadCounting(enabled bool) {
+	prefixReadCounting = enabled
+}
+
+// SetBloomOverlay enables or disables linking the bloom filters of new diff
+// layers to the ones of their ancestors instead of copying them. Linking avoids
+// copying the full parent bloom for every layer, at the cost of lookups having
+// to consult multiple filters. It only affects layers (re)bloomed afterwards.
+func SetBloomOverlay(enabled bool) {
+	bloomOverlay = enabled
+}
+
+// SetBloomVerifyRate sets the fraction of bloom filter misses which are double
+// checked by walking the diff layer maps. Blooms never produce false negatives
+// unless corrupted, so any discrepancy is reported and the read is served from
+// the maps instead. Zero (the default) disables the verification.
+func SetBloomVerifyRate(rate float64) {
+	bloomVerifyRate = rate
+}
+
+// sampleBloomMiss reports whether a bloom filter miss should be verified.
+func sampleBloomMiss() bool {
+	return bloomVerifyRate > 0 && rand.Float64() < bloomVerifyRate
+}
+
+// skipNoopStorage returns the storage set to retain in a diff layer built on top
+// of the given parent, dropping the slot writes that resolve to the same value
+// through the parent. Writes the parent fails to resolve are always retained to
+// preserve correctness. The passed maps are not mutated.
+func skipNoopStorage(parent snapshot, storage map[common.Hash]map[common.Hash][]byte) map[common.Hash]map[common.Hash][]byte {
+	var retained map[common.Hash]map[common.Hash][]byte
+	for accountHash, slots := range storage {
+		var kept map[common.Hash][]byte
+		for storageHash, data := range slots {
+			if blob, err := parent.Storage(accountHash, storageHash); err != nil || !bytes.Equal(blob, data) {
+				continue
+			}
+			if kept == nil {
+				kept = maps.Clone(slots)
+			}
+			delete(kept, storageHash)
+			snapshotDirtyStorageNoopMeter.Mark(1)
+		}
+		if kept == nil {
+			continue
+		}
+		if retained == nil {
+			retained = maps.Clone(storage)
+		}
+		if len(kept) == 0 {
+			delete(retained, accountHash)
+		} else {
+			retained[accountHash] = kept
+		}
+	}
+	if retained == nil {
+		return storage
+	}
+	return retained
+}
+
+// skipNoopAccounts returns the account set to retain in a diff layer built on top
+// of the given parent, dropping the writes that resolve to the same value through
+// the parent. Writes the parent fails to resolve are always retained to preserve
+// correctness. The passed map is not mutated.
+func skipNoopAccounts(parent snapshot, accounts map[common.Hash][]byte) map[common.Hash][]byte {
+	var retained map[common.Hash][]byte
+	for accountHash, data := range accounts {
+		if blob, err := parent.AccountRLP(accountHash); err != nil || !bytes.Equal(blob, data) {
+			continue
+		}
+		if retained == nil {
+			retained = maps.Clone(accounts)
+		}
+		delete(retained, accountHash)
+		snapshotDirtyAccountNoopMeter.Mark(1)
+	}
+	if retained == nil {
+		return accounts
+	}
+	return retained
+}
+
+// bloomLink is a link in a chain of bloom filters, each of them tracking the
+// entries of a diff layer whose bloom only tracks its own items, ending with a
+// filter covering all the remaining ancestors. Linked filters are never modified.
+type bloomLink struct {
+	filter *bloomfilter.Filter // Bloom filter of the linked layer
+	parent *bloomLink          // Next link to consult on a miss, nil if the filter covers all ancestors
+	depth  int                 // Number of links in the chain, including this one
+}
+
+// length returns the number of filters in the chain, zero for an empty one.
+func (link *bloomLink) length() int {
+	if link == nil {
+		return 0
+	}
+	return link.depth
+}
+
+// containsHash reports whether any of the filters in the chain contains the hash.
+func (link *bloomLink) containsHash(hash uint64) bool {
+	for ; link != nil; link = link.parent {
+		if link.filter.ContainsHash(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+// items returns the total number of items inserted into the filters of the chain.
+func (link *bloomLink) items() uint64 {
+	var n uint64
+	for ; link != nil; link = link.parent {
+		n += link.filter.N()
+	}
+	return n
+}
+
+// bloomContains reports whether the bloom of the layer, along with the ones of
+// the ancestors linked to it, contains the hash. The caller must hold the lock.
+func (dl *diffLayer) bloomContains(hash uint64) bool {
+	return dl.diffed.ContainsHash(hash) || dl.bloomParent.containsHash(hash)
+}
+
+// newOverlayBloom creates a bloom filter sized to track the given number of
+// items of a single layer. The targeted error is tighter than the one of full
+// blooms, as a lookup may consult a chain of overlays.
+func newOverlayBloom(items int) *bloomfilter.Filter {
+	var (
+		n = uint64(max(items, 1))
+		m = max(bloomfilter.OptimalM(n, bloomTargetError/float64(bloomOverlayMaxDepth)), bloomfilter.MMin)
+	)
+	bloom, _ := bloomfilter.New(m, bloomfilter.OptimalK(m, n))
+	return bloom
+}
+
+// copyBloom duplicates a bloom filter, replaceable for testing failures.
+var copyBloom = func(bloom *bloomfilter.Filter) (*bloomfilter.Filter, error) {
+	return bloom.Copy()
+}
+
+// addBloomEntries adds all the given accounts and storage slots into the bloom.
+func addBloomEntries(bloom *bloomfilter.Filter, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) {
+	for hash := range accounts {
+		bloom.AddHash(accountBloomHash(hash))
+	}
+	for accountHash, slots := range storage {
+		for storageHash := range slots {
+			bloom.AddHash(storageBloomHash(accountHash, storageHash))
+		}
+	}
+}
+
+// countSlots returns the total number of storage slots in the given storage set.
+func countSlots(storage map[common.Hash]map[common.Hash][]byte) int {
+	var n int
+	for _, slots := range storage {
+		n += len(slots)
+	}
+	return n
+}
+
 // rebloom discards the layer's current bloom and rebuilds it from scratch based
 // on the parent's and the local diffs.
 func (dl *diffLayer) rebloom(origin *diskLayer) {
@@ -173,28 +464,67 @@ func (dl *diffLayer) rebloom(origin *diskLayer) {
 	dl.origin = origin
 
 	// Retrieve the parent bloom or create a fresh empty one
+	dl.bloomParent = nil
 	if parent, ok := dl.parent.(*diffLayer); ok {
 		parent.lock.RLock()
-		dl.diffed, _ = parent.diffed.Copy()
+		link := &bloomLink{
+			filter: parent.diffed,
+			parent: parent.bloomParent,
+			depth:  parent.bloomParent.length() + 1,
+		}
+		var (
+			diffed *bloomfilter.Filter
+			err    error
+		)
+		switch {
+		case bloomOverlay && link.depth < bloomOverlayMaxDepth:
+			// Link the ancestor blooms instead of copying, only tracking the local items
+			dl.bloomParent = link
+			diffed = newOverlayBloom(len(dl.accountData) + countSlots(dl.storageData))
+
+		case link.parent == nil:
+			// The parent bloom covers all the ancestors, copy it
+			diffed, err = copyBloom(parent.diffed)
+
+		default:
+			// The parent bloom chain is too deep to extend, collapse it
+			err = errors.New("bloom chain depth limit reached")
+		}
 		parent.lock.RUnlock()
+
+		if err != nil {
+			// The parent bloom couldn't be copied, rebuild it from the ancestors
+			if link.parent == nil {
+				log.Error("Failed to copy parent bloom, rebuilding", "root", dl.root, "err", err)
+			}
+			diffed, _ = bloomfilter.New(uint64(bloomSize), uint64(bloomFuncs))
+			for ancestor := parent; ancestor != nil; {
+				ancestor.lock.RLock()
+				addBloomEntries(diffed, ancestor.accountData, ancestor.storageData)
+				next, _ := ancestor.parent.(*diffLayer)
+				ancestor.lock.RUnlock()
+				ancestor = next
+			}
+		}
+		dl.diffed = diffed
 	} else {
 		dl.diffed, _ = bloomfilter.New(uint64(bloomSize), uint64(bloomFuncs))
 	}
-	for hash := range dl.accountData {
-		dl.diffed.AddHash(accountBloomHash(hash))
-	}
-	for accountHash, slots := range dl.storageData {
-		for storageHash := range slots {
-			dl.diffed.AddHash(storageBloomHash(accountHash, storageHash))
-		}
-	}
+	addBloomEntries(dl.diffed, dl.accountData, dl.storageData)
+
 	// Calculate the current false positive rate and update the error rate meter.
 	// This is a bit cheating because subsequent layers will overwrite it, but it
 	// should be fine, we're only interested in ballpark figures.
-	k := float64(dl.diffed.K())
-	n := float64(dl.diffed.N())
-	m := float64(dl.diffed.M())
-	snapshotBloomErrorGauge.Update(math.Pow(1.0-math.Exp((-k)*(n+0.5)/(m-1)), k))
+	snapshotBloomErrorGauge.Update(bloomError(dl.diffed))
+}
+
+// bloomError estimates the current false positive rate of the given bloom filter
+// based on its number of hash functions, inserted items and bit size.
+func bloomError(filter *bloomfilter.Filter) float64 {
+	k := float64(filter.K())
+	n := float64(filter.N())
+	m := float64(filter.M())
+	return math.Pow(1.0-math.Exp((-k)*(n+0.5)/(m-1)), k)
 }
 
 // Root returns the root hash for which this snapshot was made.
@@ -210,6 +540,173 @@ func (dl *diffLayer) Parent() snapshot {
 	return dl.parent
 }
 
+// ChainRoots returns the roots of all the layers from this one down to and
+// including the disk layer, ordered top to bottom.
+func (dl *diffLayer) ChainRoots() []common.Hash {
+	var roots []common.Hash
+	for layer := snapshot(dl); layer != nil; layer = layer.Parent() {
+		roots = append(roots, layer.Root())
+	}
+	return roots
+}
+
+// Memory returns the approximate number of bytes held by the layer. It's a live
+// figure which grows as the sorted account and storage lists get cached.
+func (dl *diffLayer) Memory() uint64 {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	return dl.memory
+}
+
+// BloomStats contains the parameters and the estimated false positive rate of
+// a diff layer's bloom filter. If the bloom links to the ones of the ancestors,
+// K and M describe the layer's own filter, while N and Error cover the chain.
+type BloomStats struct {
+	K     uint64  // Number of hash functions
+	N     uint64  // Number of items inserted, including the ones of the ancestors
+	M     uint64  // Size of the filter in bits
+	Error float64 // Estimated false positive rate
+	Items uint64  // Number of account and storage entries held by the layer itself
+	Links int     // Number of ancestor blooms consulted on a miss of the layer's own
+}
+
+// BloomStats returns the parameters and the current false positive estimate of
+// the layer's bloom filter, along with the number of items held by the layer.
+func (dl *diffLayer) BloomStats() BloomStats {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	// The chain misses only if all of the filters miss, accumulate the logarithm
+	// of the miss probabilities to retain the precision of tiny error rates
+	pass := math.Log1p(-bloomError(dl.diffed))
+	for link := dl.bloomParent; link != nil; link = link.parent {
+		pass += math.Log1p(-bloomError(link.filter))
+	}
+	return BloomStats{
+		K:     dl.diffed.K(),
+		N:     dl.diffed.N() + dl.bloomParent.items(),
+		M:     dl.diffed.M(),
+		Error: -math.Expm1(pass),
+		Items: dl.items,
+		Links: dl.bloomParent.length(),
+	}
+}
+
+// BloomHeadroom returns approximately how many more entries the layer's bloom
+// filter could hold before its false positive rate exceeds the targeted error,
+// based on the capacity the filter was sized for.
+func (dl *diffLayer) BloomHeadroom() int {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if n := dl.diffed.N() + dl.bloomParent.items(); n < aggregatorItemLimit {
+		return int(aggregatorItemLimit - n)
+	}
+	return 0
+}
+
+// BloomBitHistogram returns the distribution of the set bits of the layer's bloom
+// filter across the given number of equally sized regions. A skewed distribution
+// indicates that the hash offsets cluster the entries into parts of the filter.
+func (dl *diffLayer) BloomBitHistogram(buckets int) []uint64 {
+	if buckets <= 0 {
+		return nil
+	}
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	// The filter doesn't expose its bit array, extract it from the serialized
+	// form: magic, the k, n and m fields, the k keys and finally the bits.
+	blob, err := dl.diffed.MarshalBinary()
+	if err != nil {
+		log.Error("Failed to serialize bloom filter", "err", err)
+		return nil
+	}
+	var (
+		m      = dl.diffed.M()
+		bitmap = blob[12+8*(3+dl.diffed.K()):]
+		words  = (m + 63) / 64
+		hist   = make([]uint64, buckets)
+	)
+	for i := uint64(0); i < words; i++ {
+		word := binary.LittleEndian.Uint64(bitmap[8*i:])
+		for word != 0 {
+			pos := 64*i + uint64(bits.TrailingZeros64(word))
+			hist[pos*uint64(buckets)/m]++
+			word &= word - 1
+		}
+	}
+	return hist
+}
+
+// ReadCountsByPrefix returns the number of account and storage reads served
+// through this layer, bucketed by the first byte of the account hash. Reads are
+// only counted while enabled via SetPrefixReadCounting.
+func (dl *diffLayer) ReadCountsByPrefix() [256]uint64 {
+	var counts [256]uint64
+	for i := range dl.readCounts {
+		counts[i] = dl.readCounts[i].Load()
+	}
+	return counts
+}
+
+// countReads accounts the given number of reads to the bucket of the account
+// hash prefix, if prefix read counting is enabled.
+func (dl *diffLayer) countReads(prefix byte, n uint64) {
+	if prefixReadCounting {
+		dl.readCounts[prefix].Add(n)
+	}
+}
+
+// FindLayer returns the layer with the given root from this one down to and
+// including the disk layer, or nil if no such layer is found.
+func (dl *diffLayer) FindLayer(root common.Hash) snapshot {
+	for layer := snapshot(dl); layer != nil; layer = layer.Parent() {
+		if layer.Root() == root {
+			return layer
+		}
+	}
+	return nil
+}
+
+// Pin prevents the layer from being flattened, and thus becoming stale, until
+// the returned release function is called, giving long-running queries a
+// consistent view without copying. Capping the tree defers flattening any of the
+// pinned layers, so pins must be released promptly to not block consolidation.
+// The release function may be called multiple times. Layers already stale can
+// not be pinned.
+func (dl *diffLayer) Pin() (release func(), err error) {
+	// Take the pin under the pin lock, which flattening holds while checking the
+	// pins, to not race with a concurrent flatten
+	dl.pinLock.Lock()
+	defer dl.pinLock.Unlock()
+
+	if dl.Stale() {
+		return nil, &StaleLayerError{Root: dl.root}
+	}
+	dl.pins.Add(1)
+	snapshotPinActiveGauge.Inc(1)
+
+	var (
+		start = time.Now()
+		once  sync.Once
+	)
+	return func() {
+		once.Do(func() {
+			dl.pins.Add(-1)
+			snapshotPinActiveGauge.Dec(1)
+
+			held := time.Since(start)
+			snapshotPinHoldTimer.Update(held)
+			if held > pinLongHoldThreshold {
+				snapshotPinLongHeldMeter.Mark(1)
+				log.Warn("Snapshot layer pinned for long", "root", dl.root, "held", common.PrettyDuration(held))
+			}
+		})
+	}, nil
+}
+
 // Stale return whether this layer has become stale (was flattened across) or if
 // it's still live.
 func (dl *diffLayer) Stale() bool {
@@ -233,6 +730,20 @@ func (dl *diffLayer) Account(hash common.Hash) (*types.SlimAccount, error) {
 	return account, nil
 }
 
+// AccountNonce retrieves the nonce of the account associated with a particular
+// hash, resolving it through the layer chain. If the account doesn't exist or
+// was deleted, zero is returned along with ErrAccountNotFound.
+func (dl *diffLayer) AccountNonce(hash common.Hash) (uint64, error) {
+	account, err := dl.Account(hash)
+	if err != nil {
+		return 0, err
+	}
+	if account == nil {
+		return 0, ErrAccountNotFound
+	}
+	return account.Nonce, nil
+}
+
 // Accounts directly retrieves all accounts in current snapshot in
 // the snapshot slim data format.
 func (dl *diffLayer) Accounts() (map[common.Hash]*types.SlimAccount, error) {
@@ -256,16 +767,18 @@ func (dl *diffLayer) Accounts() (map[common.Hash]*types.SlimAccount, error) {
 //
 // Note the returned account is not a copy, please don't modify it.
 func (dl *diffLayer) AccountRLP(hash common.Hash) ([]byte, error) {
+	dl.countReads(hash[0], 1)
+
 	// Check staleness before reaching further.
 	dl.lock.RLock()
 	if dl.Stale() {
 		dl.lock.RUnlock()
-		return nil, ErrSnapshotStale
+		return nil, &StaleLayerError{Root: dl.root}
 	}
 	// Check the bloom filter first whether there's even a point in reaching into
 	// all the maps in all the layers below
 	var origin *diskLayer
-	hit := dl.diffed.ContainsHash(accountBloomHash(hash))
+	hit := dl.bloomContains(accountBloomHash(hash))
 	if !hit {
 		origin = dl.origin // extract origin while holding the lock
 	}
@@ -275,12 +788,92 @@ func (dl *diffLayer) AccountRLP(hash common.Hash) ([]byte, error) {
 	// diff layers, reach straight into the bottom persistent disk layer
 	if origin != nil {
 		snapshotBloomAccountMissMeter.Mark(1)
+		if sampleBloomMiss() && dl.tracksAccount(hash) {
+			snapshotBloomFalseNegativeCounter.Inc(1)
+			log.Error("Snapshot bloom filter false negative", "root", dl.root, "account", hash)
+			return dl.accountRLP(hash, 0)
+		}
 		return origin.AccountRLP(hash)
 	}
 	// The bloom filter hit, start poking in the internal maps
 	return dl.accountRLP(hash, 0)
 }
 
+// tracksAccount reports whether the account is tracked by this layer or any diff
+// layer below, without consulting the bloom filters.
+func (dl *diffLayer) tracksAccount(hash common.Hash) bool {
+	for layer := dl; layer != nil; {
+		layer.lock.RLock()
+		_, ok := layer.accountData[hash]
+		parent := layer.parent
+		layer.lock.RUnlock()
+
+		if ok {
+			return true
+		}
+		layer, _ = parent.(*diffLayer)
+	}
+	return false
+}
+
+// AccountRLPCopy retrieves the account RLP associated with a particular hash
+// similarly to AccountRLP, but returns a copy of it which is safe to modify
+// without affecting the snapshot.
+func (dl *diffLayer) AccountRLPCopy(hash common.Hash) ([]byte, error) {
+	data, err := dl.AccountRLP(hash)
+	if err != nil {
+		return nil, err
+	}
+	return common.CopyBytes(data), nil
+}
+
+// AccountRLPNoBloom retrieves the account RLP associated with a particular hash
+// in the snapshot slim data format, always walking the diff layer maps instead
+// of relying on the bloom filter to short circuit to the disk layer. It's meant
+// to be used for verification and to rule out bloom filter issues.
+//
+// Note the returned account is not a copy, please don't modify it.
+func (dl *diffLayer) AccountRLPNoBloom(hash common.Hash) ([]byte, error) {
+	dl.countReads(hash[0], 1)
+	return dl.accountRLP(hash, 0)
+}
+
+// AccountRLPRetryStale retrieves the account RLP associated with a particular
+// hash similarly to AccountRLP, but retries the read up to the given number of
+// times if it runs into a layer invalidated by a concurrent flattening. Every
+// retry resolves from the current parent, which gets relinked to the flattened
+// layer once the flattening completes. Reads from a layer which itself became
+// stale are not retried.
+//
+// Note the returned account is not a copy, please don't modify it.
+func (dl *diffLayer) AccountRLPRetryStale(hash common.Hash, retries int) ([]byte, error) {
+	for i := 0; ; i++ {
+		data, err := dl.AccountRLP(hash)
+		if !errors.Is(err, ErrSnapshotStale) || i >= retries || dl.Stale() {
+			return data, err
+		}
+		time.Sleep(staleRetryDelay)
+	}
+}
+
+// RawLocalAccount retrieves the account RLP associated with a particular hash
+// only if it's tracked by this exact layer, without consulting the bloom filter
+// or any of the parents. The returned flag reports whether the account was found
+// locally; a found account with an empty blob means it was deleted in this layer.
+// Stale layers report nothing, as their maps were merged into by the flattening.
+//
+// Note the returned account is not a copy, please don't modify it.
+func (dl *diffLayer) RawLocalAccount(hash common.Hash) ([]byte, bool) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if dl.Stale() {
+		return nil, false
+	}
+	data, ok := dl.accountData[hash]
+	return data, ok
+}
+
 // accountRLP is an internal version of AccountRLP that skips the bloom filter
 // checks and uses the internal maps to try and retrieve the data. It's meant
 // to be used if a higher layer's bloom filter hit already.
@@ -291,7 +884,12 @@ func (dl *diffLayer) accountRLP(hash common.Hash, depth int) ([]byte, error) {
 	// If the layer was flattened into, consider it invalid (any live reference to
 	// the original should be marked as unusable).
 	if dl.Stale() {
-		return nil, ErrSnapshotStale
+		// A parent going stale while the read descends means a flatten raced
+		// with the walk, bail out instead of resolving from the merged layers.
+		if depth > 0 {
+			snapshotStaleMidWalkCounter.Inc(1)
+		}
+		return nil, &StaleLayerError{Root: dl.root}
 	}
 	// If the account is known locally, return it
 	if data, ok := dl.accountData[hash]; ok {
@@ -314,22 +912,247 @@ func (dl *diffLayer) accountRLP(hash common.Hash, depth int) ([]byte, error) {
 	return dl.parent.AccountRLP(hash)
 }
 
+// HasAccount reports whether an account is present in the snapshot, either live
+// or as a deletion tracked by the diff layers, and whether it is deleted. It
+// follows the same bloom filter and staleness semantics as AccountRLP, without
+// handing out the account data.
+func (dl *diffLayer) HasAccount(hash common.Hash) (present bool, deleted bool, err error) {
+	dl.countReads(hash[0], 1)
+
+	// Check staleness before reaching further.
+	dl.lock.RLock()
+	if dl.Stale() {
+		dl.lock.RUnlock()
+		return false, false, &StaleLayerError{Root: dl.root}
+	}
+	// Check the bloom filter first whether there's even a point in reaching into
+	// all the maps in all the layers below
+	var origin *diskLayer
+	if !dl.bloomContains(accountBloomHash(hash)) {
+		origin = dl.origin // extract origin while holding the lock
+	}
+	dl.lock.RUnlock()
+
+	// If the bloom filter misses, reach straight into the disk layer, which
+	// doesn't track deletions
+	if origin != nil {
+		snapshotBloomAccountMissMeter.Mark(1)
+		data, err := origin.AccountRLP(hash)
+		return len(data) > 0, false, err
+	}
+	// The bloom filter hit, start poking in the internal maps
+	return dl.hasAccount(hash)
+}
+
+// hasAccount is an internal version of HasAccount that skips the bloom filter
+// checks and uses the internal maps to look up the account.
+func (dl *diffLayer) hasAccount(hash common.Hash) (bool, bool, error) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	// If the layer was flattened into, consider it invalid (any live reference to
+	// the original should be marked as unusable).
+	if dl.Stale() {
+		return false, false, &StaleLayerError{Root: dl.root}
+	}
+	// If the account is known locally, report it
+	if data, ok := dl.accountData[hash]; ok {
+		snapshotBloomAccountTrueHitMeter.Mark(1)
+		return true, len(data) == 0, nil
+	}
+	// Account unknown to this diff, resolve from parent
+	if diff, ok := dl.parent.(*diffLayer); ok {
+		return diff.hasAccount(hash)
+	}
+	// Failed to resolve through diff layers, mark a bloom error and use the disk
+	snapshotBloomAccountFalseHitMeter.Mark(1)
+	data, err := dl.parent.AccountRLP(hash)
+	return len(data) > 0, false, err
+}
+
+// LayerRef is a reference to a snapshot layer consulted while resolving an item.
+type LayerRef struct {
+	Root  common.Hash // Root of the consulted layer
+	Found bool        // Whether the item was resolved by the layer
+}
+
+// AccountProofChain returns the sequence of layers consulted to resolve the given
+// account, starting at this layer and ending at the one resolving it, which is
+// the disk layer if no diff layer tracks the account. The bloom filters are not
+// consulted, so every diff layer down to the resolving one is included. Accounts
+// deleted in a diff layer are resolved by that layer; accounts missing from the
+// disk layer are reported as not found there.
+func (dl *diffLayer) AccountProofChain(hash common.Hash) ([]LayerRef, error) {
+	return dl.accountProofChain(hash, nil)
+}
+
+// accountProofChain is the internal version of AccountProofChain, extending the
+// chain of layers already consulted.
+func (dl *diffLayer) accountProofChain(hash common.Hash, chain []LayerRef) ([]LayerRef, error) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	// If the layer was flattened into, consider it invalid (any live reference to
+	// the original should be marked as unusable).
+	if dl.Stale() {
+		return nil, &StaleLayerError{Root: dl.root}
+	}
+	// If the account is known locally, the chain ends here
+	if _, ok := dl.accountData[hash]; ok {
+		return append(chain, LayerRef{Root: dl.root, Found: true}), nil
+	}
+	chain = append(chain, LayerRef{Root: dl.root})
+
+	// Account unknown to this diff, resolve from parent
+	if diff, ok := dl.parent.(*diffLayer); ok {
+		return diff.accountProofChain(hash, chain)
+	}
+	data, err := dl.parent.AccountRLP(hash)
+	if err != nil {
+		return nil, err
+	}
+	return append(chain, LayerRef{Root: dl.parent.Root(), Found: len(data) > 0}), nil
+}
+
+// AccountLastModifiedRoot returns the root of the topmost diff layer, starting
+// at this one, that modified (or deleted) the given account, along with whether
+// any of them did. The disk layer is never reported, and the bloom filters are
+// not consulted. Stale layers are not detected, the caller is responsible for
+// only querying live layers.
+func (dl *diffLayer) AccountLastModifiedRoot(hash common.Hash) (common.Hash, bool) {
+	for layer := dl; layer != nil; {
+		layer.lock.RLock()
+		_, ok := layer.accountData[hash]
+		parent := layer.parent
+		layer.lock.RUnlock()
+
+		if ok {
+			return layer.root, true
+		}
+		layer, _ = parent.(*diffLayer)
+	}
+	return common.Hash{}, false
+}
+
+// AccountsRLP retrieves the account RLPs associated with a batch of hashes. The
+// results are returned in the order of the requested hashes and each of them
+// is identical to what AccountRLP would return. The layer locks are acquired
+// only once per layer for the entire batch. If any of the retrievals fail, the
+// first failure in request order is returned.
+//
+// Note the returned accounts are not copies, please don't modify them.
+func (dl *diffLayer) AccountsRLP(hashes []common.Hash) ([][]byte, error) {
+	for _, hash := range hashes {
+		dl.countReads(hash[0], 1)
+	}
+	var (
+		results = make([][]byte, len(hashes))
+		errs    = make([]error, len(hashes))
+		hits    = make([]int, 0, len(hashes))
+		misses  []int
+	)
+	// Check the bloom filter first for all the accounts, separating the ones that
+	// need to be resolved through the diff layers from the ones that don't
+	dl.lock.RLock()
+	if dl.Stale() {
+		dl.lock.RUnlock()
+		return nil, &StaleLayerError{Root: dl.root}
+	}
+	origin := dl.origin // extract origin while holding the lock
+	for i, hash := range hashes {
+		if dl.bloomContains(accountBloomHash(hash)) {
+			hits = append(hits, i)
+		} else {
+			misses = append(misses, i)
+		}
+	}
+	dl.lock.RUnlock()
+
+	// Bloom misses can be retrieved straight from the disk layer
+	for _, i := range misses {
+		snapshotBloomAccountMissMeter.Mark(1)
+		results[i], errs[i] = origin.AccountRLP(hashes[i])
+	}
+	// The remainder needs to be resolved through the diff layers
+	if len(hits) > 0 {
+		dl.accountsRLP(hashes, hits, results, errs, 0)
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// accountsRLP is an internal version of AccountsRLP that skips the bloom filter
+// checks and resolves the requested (indexed) accounts through the internal maps,
+// passing the unresolved ones down to the parent layer.
+func (dl *diffLayer) accountsRLP(hashes []common.Hash, indexes []int, results [][]byte, errs []error, depth int) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	// If the layer was flattened into, consider it invalid (any live reference to
+	// the original should be marked as unusable).
+	if dl.Stale() {
+		if depth > 0 {
+			snapshotStaleMidWalkCounter.Inc(1)
+		}
+		for _, i := range indexes {
+			errs[i] = &StaleLayerError{Root: dl.root}
+		}
+		return
+	}
+	// Resolve all the accounts known locally, collecting the rest for the parent
+	pending := indexes[:0]
+	for _, i := range indexes {
+		if data, ok := dl.accountData[hashes[i]]; ok {
+			snapshotDirtyAccountHitMeter.Mark(1)
+			snapshotDirtyAccountHitDepthHist.Update(int64(depth))
+			if n := len(data); n > 0 {
+				snapshotDirtyAccountReadMeter.Mark(int64(n))
+			} else {
+				snapshotDirtyAccountInexMeter.Mark(1)
+			}
+			snapshotBloomAccountTrueHitMeter.Mark(1)
+			results[i] = data
+			continue
+		}
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		return
+	}
+	// Accounts unknown to this diff, resolve from parent
+	if diff, ok := dl.parent.(*diffLayer); ok {
+		diff.accountsRLP(hashes, pending, results, errs, depth+1)
+		return
+	}
+	// Failed to resolve through diff layers, mark bloom errors and use the disk
+	for _, i := range pending {
+		snapshotBloomAccountFalseHitMeter.Mark(1)
+		results[i], errs[i] = dl.parent.AccountRLP(hashes[i])
+	}
+}
+
 // Storage directly retrieves the storage data associated with a particular hash,
 // within a particular account. If the slot is unknown to this diff, it's parent
 // is consulted.
 //
 // Note the returned slot is not a copy, please don't modify it.
 func (dl *diffLayer) Storage(accountHash, storageHash common.Hash) ([]byte, error) {
+	dl.countReads(accountHash[0], 1)
+
 	// Check the bloom filter first whether there's even a point in reaching into
 	// all the maps in all the layers below
 	dl.lock.RLock()
 	// Check staleness before reaching further.
 	if dl.Stale() {
 		dl.lock.RUnlock()
-		return nil, ErrSnapshotStale
+		return nil, &StaleLayerError{Root: dl.root}
 	}
 	var origin *diskLayer
-	hit := dl.diffed.ContainsHash(storageBloomHash(accountHash, storageHash))
+	hit := dl.bloomContains(storageBloomHash(accountHash, storageHash))
 	if !hit {
 		origin = dl.origin // extract origin while holding the lock
 	}
@@ -339,12 +1162,34 @@ func (dl *diffLayer) Storage(accountHash, storageHash common.Hash) ([]byte, erro
 	// diff layers, reach straight into the bottom persistent disk layer
 	if origin != nil {
 		snapshotBloomStorageMissMeter.Mark(1)
+		if sampleBloomMiss() && dl.tracksStorage(accountHash, storageHash) {
+			snapshotBloomFalseNegativeCounter.Inc(1)
+			log.Error("Snapshot bloom filter false negative", "root", dl.root, "account", accountHash, "slot", storageHash)
+			return dl.storage(accountHash, storageHash, 0)
+		}
 		return origin.Storage(accountHash, storageHash)
 	}
 	// The bloom filter hit, start poking in the internal maps
 	return dl.storage(accountHash, storageHash, 0)
 }
 
+// tracksStorage reports whether the storage slot is tracked by this layer or any
+// diff layer below, without consulting the bloom filters.
+func (dl *diffLayer) tracksStorage(accountHash, storageHash common.Hash) bool {
+	for layer := dl; layer != nil; {
+		layer.lock.RLock()
+		_, ok := layer.storageData[accountHash][storageHash]
+		parent := layer.parent
+		layer.lock.RUnlock()
+
+		if ok {
+			return true
+		}
+		layer, _ = parent.(*diffLayer)
+	}
+	return false
+}
+
 // storage is an internal version of Storage that skips the bloom filter checks
 // and uses the internal maps to try and retrieve the data. It's meant  to be
 // used if a higher layer's bloom filter hit already.
@@ -355,7 +1200,12 @@ func (dl *diffLayer) storage(accountHash, storageHash common.Hash, depth int) ([
 	// If the layer was flattened into, consider it invalid (any live reference to
 	// the original should be marked as unusable).
 	if dl.Stale() {
-		return nil, ErrSnapshotStale
+		// A parent going stale while the read descends means a flatten raced
+		// with the walk, bail out instead of resolving from the merged layers.
+		if depth > 0 {
+			snapshotStaleMidWalkCounter.Inc(1)
+		}
+		return nil, &StaleLayerError{Root: dl.root}
 	}
 	// If the account is known locally, try to resolve the slot locally
 	if storage, ok := dl.storageData[accountHash]; ok {
@@ -380,6 +1230,105 @@ func (dl *diffLayer) storage(accountHash, storageHash common.Hash, depth int) ([
 	return dl.parent.Storage(accountHash, storageHash)
 }
 
+// StorageBatch retrieves the storage data associated with a batch of storage
+// hashes within a particular account. The results are returned in the order of
+// the requested hashes and each of them follows the semantics of Storage. The
+// layer locks are acquired only once per layer for the entire batch.
+//
+// Note the returned slots are not copies, please don't modify them.
+func (dl *diffLayer) StorageBatch(accountHash common.Hash, storageHashes []common.Hash) ([][]byte, []error) {
+	dl.countReads(accountHash[0], uint64(len(storageHashes)))
+
+	var (
+		results = make([][]byte, len(storageHashes))
+		errs    = make([]error, len(storageHashes))
+		hits    = make([]int, 0, len(storageHashes))
+		misses  []int
+	)
+	// Check the bloom filter first for all the slots, separating the ones that
+	// need to be resolved through the diff layers from the ones that don't
+	dl.lock.RLock()
+	if dl.Stale() {
+		dl.lock.RUnlock()
+		for i := range errs {
+			errs[i] = &StaleLayerError{Root: dl.root}
+		}
+		return results, errs
+	}
+	origin := dl.origin // extract origin while holding the lock
+	for i, storageHash := range storageHashes {
+		if dl.bloomContains(storageBloomHash(accountHash, storageHash)) {
+			hits = append(hits, i)
+		} else {
+			misses = append(misses, i)
+		}
+	}
+	dl.lock.RUnlock()
+
+	// Bloom misses can be retrieved straight from the disk layer
+	for _, i := range misses {
+		snapshotBloomStorageMissMeter.Mark(1)
+		results[i], errs[i] = origin.Storage(accountHash, storageHashes[i])
+	}
+	// The remainder needs to be resolved through the diff layers
+	if len(hits) > 0 {
+		dl.storageBatch(accountHash, storageHashes, hits, results, errs, 0)
+	}
+	return results, errs
+}
+
+// storageBatch is an internal version of StorageBatch that skips the bloom filter
+// checks and resolves the requested (indexed) slots through the internal maps,
+// passing the unresolved ones down to the parent layer.
+func (dl *diffLayer) storageBatch(accountHash common.Hash, storageHashes []common.Hash, indexes []int, results [][]byte, errs []error, depth int) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	// If the layer was flattened into, consider it invalid (any live reference to
+	// the original should be marked as unusable).
+	if dl.Stale() {
+		if depth > 0 {
+			snapshotStaleMidWalkCounter.Inc(1)
+		}
+		for _, i := range indexes {
+			errs[i] = &StaleLayerError{Root: dl.root}
+		}
+		return
+	}
+	// Resolve all the slots known locally, collecting the rest for the parent
+	var (
+		storage = dl.storageData[accountHash]
+		pending = indexes[:0]
+	)
+	for _, i := range indexes {
+		if data, ok := storage[storageHashes[i]]; ok {
+			snapshotDirtyStorageHitMeter.Mark(1)
+			if n := len(data); n > 0 {
+				snapshotDirtyStorageReadMeter.Mark(int64(n))
+			} else {
+				snapshotDirtyStorageInexMeter.Mark(1)
+			}
+			snapshotBloomStorageTrueHitMeter.Mark(1)
+			results[i] = data
+			continue
+		}
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		return
+	}
+	// Storage slots unknown to this diff, resolve from parent
+	if diff, ok := dl.parent.(*diffLayer); ok {
+		diff.storageBatch(accountHash, storageHashes, pending, results, errs, depth+1)
+		return
+	}
+	// Failed to resolve through diff layers, mark bloom errors and use the disk
+	for _, i := range pending {
+		snapshotBloomStorageFalseHitMeter.Mark(1)
+		results[i], errs[i] = dl.parent.Storage(accountHash, storageHashes[i])
+	}
+}
+
 // Update creates a new layer on top of the existing snapshot diff tree with
 // the specified data items.
 func (dl *diffLayer) Update(blockRoot common.Hash, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) *diffLayer {
@@ -389,47 +1338,143 @@ func (dl *diffLayer) Update(blockRoot common.Hash, accounts map[common.Hash][]by
 // flatten pushes all data from this point downwards, flattening everything into
 // a single diff at the bottom. Since usually the lowermost diff is the largest,
 // the flattening builds up from there in reverse.
-func (dl *diffLayer) flatten() snapshot {
+//
+// An error is returned if a parent was already flattened into by another child,
+// which indicates a bug in the layer management, or if any of the layers to be
+// flattened is pinned.
+func (dl *diffLayer) flatten() (snapshot, error) {
+	return dl.flattenWithProgress(nil)
+}
+
+// flattenWithProgress is flatten with an optional progress callback, invoked
+// with the total number of entries merged so far every time the flattening
+// crosses another flattenProgressInterval entries.
+func (dl *diffLayer) flattenWithProgress(progress func(merged uint64)) (snapshot, error) {
+	var merged uint64
+	return dl.flattenTracked(&merged, progress)
+}
+
+// flattenTracked is the internal version of flattenWithProgress, accumulating
+// the number of merged entries across all the flattened parents.
+func (dl *diffLayer) flattenTracked(merged *uint64, progress func(merged uint64)) (snapshot, error) {
+	// Collect the layers to flatten, from this one down to the bottom-most diff
+	layers := []*diffLayer{dl}
+	for {
+		parent, ok := layers[len(layers)-1].parent.(*diffLayer)
+		if !ok {
+			break
+		}
+		layers = append(layers, parent)
+	}
 	// If the parent is not diff, we're the first in line, return unmodified
-	parent, ok := dl.parent.(*diffLayer)
-	if !ok {
-		return dl
+	if len(layers) == 1 {
+		return dl, nil
 	}
-	// Parent is a diff, flatten it first (note, apart from weird corned cases,
-	// flatten will realistically only ever merge 1 layer, so there's no need to
-	// be smarter about grouping flattens together).
-	parent = parent.flatten().(*diffLayer)
-
-	parent.lock.Lock()
-	defer parent.lock.Unlock()
+	// Everything is merged into the bottom-most diff (note, apart from weird corner
+	// cases, flatten will realistically only ever merge 1 layer, so there's no need
+	// to be smarter about grouping flattens together).
+	bottom := layers[len(layers)-1]
 
-	// Before actually writing all our data to the parent, first ensure that the
-	// parent hasn't been 'corrupted' by someone else already flattening into it
-	if parent.stale.Swap(true) {
-		panic("parent diff layer is stale") // we've flattened into the same parent from two children, boo
+	// Block pinning any of the layers until the flattening is done, and ensure
+	// none of them is pinned already, as pinned layers must not be flattened
+	for _, layer := range layers {
+		layer.pinLock.Lock()
 	}
-	maps.Copy(parent.accountData, dl.accountData)
-	// Overwrite all the updated storage slots (individually)
-	for accountHash, storage := range dl.storageData {
-		// If storage didn't exist (or was deleted) in the parent, overwrite blindly
-		if _, ok := parent.storageData[accountHash]; !ok {
-			parent.storageData[accountHash] = storage
-			continue
+	defer func() {
+		for _, layer := range layers {
+			layer.pinLock.Unlock()
 		}
-		// Storage exists in both parent and child, merge the slots
-		maps.Copy(parent.storageData[accountHash], storage)
+	}()
+	for _, layer := range layers {
+		if layer.pins.Load() > 0 {
+			return nil, fmt.Errorf("%w: %#x", errSnapshotPinned, layer.root)
+		}
+	}
+	bottom.lock.Lock()
+	defer bottom.lock.Unlock()
+
+	// Before actually writing any data to the bottom, first ensure that it hasn't
+	// been 'corrupted' by someone else already flattening into it. This must be
+	// checked before modifying anything to not leave the layers half flattened.
+	if bottom.stale.Swap(true) {
+		// We've flattened into the same parent from two children, boo
+		snapshotFlattenConflictMeter.Mark(1)
+		return nil, fmt.Errorf("%w: %#x", errFlattenConflict, bottom.root)
+	}
+	var memory, items uint64
+	for i := len(layers) - 2; i >= 0; i-- {
+		bottom.merge(layers[i], merged, progress)
+		layers[i].merged.Store(true)
+		memory, items = memory+layers[i].memory, items+layers[i].items
 	}
 	// Return the combo parent
 	return &diffLayer{
-		parent:      parent.parent,
-		origin:      parent.origin,
+		parent:      bottom.parent,
+		origin:      bottom.origin,
 		root:        dl.root,
-		accountData: parent.accountData,
-		storageData: parent.storageData,
+		accountData: bottom.accountData,
+		storageData: bottom.storageData,
 		storageList: make(map[common.Hash][]common.Hash),
 		diffed:      dl.diffed,
-		memory:      parent.memory + dl.memory,
+		bloomParent: dl.bloomParent,
+		memory:      bottom.memory + memory,
+		items:       bottom.items + items,
+	}, nil
+}
+
+// merge writes all the data of the given child layer into this one, advancing
+// the number of merged entries.
+//
+// The caller must hold the write lock of this layer.
+func (dl *diffLayer) merge(child *diffLayer, merged *uint64, progress func(merged uint64)) {
+	// Track the time and entry count of merging the child layer
+	defer func(start time.Time, base uint64) {
+		snapshotFlattenTimer.UpdateSince(start)
+		snapshotFlattenItemMeter.Mark(int64(*merged - base))
+	}(time.Now(), *merged)
+	advance := func(n int) {
+		prev := *merged
+		*merged += uint64(n)
+		if progress != nil && prev/flattenProgressInterval != *merged/flattenProgressInterval {
+			progress(*merged)
+		}
+	}
+	// Entries present in both layers are only buffered once after the merge
+	var accounts, slots int64
+	for hash, data := range child.accountData {
+		if _, ok := dl.accountData[hash]; ok {
+			accounts++
+		}
+		dl.accountData[hash] = data
+		advance(1)
+	}
+	// Overwrite all the updated storage slots (individually)
+	for accountHash, storage := range child.storageData {
+		// If storage didn't exist (or was deleted) in the parent, overwrite blindly
+		if _, ok := dl.storageData[accountHash]; !ok {
+			dl.storageData[accountHash] = storage
+			advance(len(storage))
+			continue
+		}
+		// Storage exists in both parent and child, merge the slots
+		for storageHash := range storage {
+			if _, ok := dl.storageData[accountHash][storageHash]; ok {
+				slots++
+			}
+		}
+		maps.Copy(dl.storageData[accountHash], storage)
+		advance(len(storage))
 	}
+	snapshotDirtyAccountGauge.Dec(accounts)
+	snapshotDirtyStorageGauge.Dec(slots)
+}
+
+// untrackDirty removes the entries of the layer from the gauges of dirty entries
+// buffered in memory. It must be called once the layer is dropped from the tree
+// without having been merged into another layer.
+func (dl *diffLayer) untrackDirty() {
+	snapshotDirtyAccountGauge.Dec(int64(len(dl.accountData)))
+	snapshotDirtyStorageGauge.Dec(int64(countSlots(dl.storageData)))
 }
 
 // AccountList returns a sorted list of all accounts in this diffLayer, including
@@ -486,3 +1531,337 @@ func (dl *diffLayer) StorageList(accountHash common.Hash) []common.Hash {
 	dl.memory += uint64(len(dl.storageList)*common.HashLength + common.HashLength)
 	return storageList
 }
+
+// StreamKV writes all the account and storage entries of this single layer into
+// the writer as a stream of key-value pairs, each of them prefixed by its length
+// as an unsigned varint. The keys follow the database snapshot schema, so they
+// can be imported directly. Deleted entries are emitted with an empty value.
+//
+// Accounts are written first in hash order, followed by the storage slots in
+// account and slot hash order.
+func (dl *diffLayer) StreamKV(w io.Writer) error {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	return streamKV(w, dl.accountData, dl.storageData)
+}
+
+// StreamChainKV writes the merged account and storage entries of this layer and
+// its parents down to, but excluding, the given ancestor into the writer, in the
+// same format as StreamKV. Entries modified by multiple layers are written with
+// the value of the topmost one, so the stream holds all the deltas to go from
+// the ancestor's state to this layer's.
+func (dl *diffLayer) StreamChainKV(w io.Writer, ancestorRoot common.Hash) error {
+	var (
+		accounts = make(map[common.Hash][]byte)
+		storage  = make(map[common.Hash]map[common.Hash][]byte)
+	)
+	// Merge the layers top-down, the first layer setting an entry wins
+	merge := func(layer *diffLayer) error {
+		layer.lock.RLock()
+		defer layer.lock.RUnlock()
+
+		if layer.Stale() {
+			return &StaleLayerError{Root: layer.root}
+		}
+		for hash, data := range layer.accountData {
+			if _, ok := accounts[hash]; !ok {
+				accounts[hash] = data
+			}
+		}
+		for accountHash, slots := range layer.storageData {
+			merged, ok := storage[accountHash]
+			if !ok {
+				merged = make(map[common.Hash][]byte, len(slots))
+				storage[accountHash] = merged
+			}
+			for storageHash, data := range slots {
+				if _, ok := merged[storageHash]; !ok {
+					merged[storageHash] = data
+				}
+			}
+		}
+		return nil
+	}
+	var layer snapshot = dl
+	for layer.Root() != ancestorRoot {
+		diff, ok := layer.(*diffLayer)
+		if !ok {
+			return fmt.Errorf("snapshot [%#x] is not an ancestor of [%#x]", ancestorRoot, dl.root)
+		}
+		if err := merge(diff); err != nil {
+			return err
+		}
+		layer = diff.Parent()
+	}
+	return streamKV(w, accounts, storage)
+}
+
+// streamKV writes the given account and storage entries into the writer as a
+// stream of length prefixed key-value pairs, in the format of StreamKV.
+func streamKV(w io.Writer, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) error {
+	var buf [binary.MaxVarintLen64]byte
+	write := func(key, value []byte) error {
+		for _, item := range [][]byte{key, value} {
+			n := binary.PutUvarint(buf[:], uint64(len(item)))
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if _, err := w.Write(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, hash := range slices.SortedFunc(maps.Keys(accounts), common.Hash.Cmp) {
+		key := slices.Concat(rawdb.SnapshotAccountPrefix, hash.Bytes())
+		if err := write(key, accounts[hash]); err != nil {
+			return err
+		}
+	}
+	for _, accountHash := range slices.SortedFunc(maps.Keys(storage), common.Hash.Cmp) {
+		slots := storage[accountHash]
+		for _, storageHash := range slices.SortedFunc(maps.Keys(slots), common.Hash.Cmp) {
+			key := slices.Concat(rawdb.SnapshotStoragePrefix, accountHash.Bytes(), storageHash.Bytes())
+			if err := write(key, slots[storageHash]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyTo writes the account and storage deltas of this single layer into the
+// given database in the snapshot schema, deleting the entries tombstoned in the
+// layer. Applying a sequence of layers bottom-up onto a copy of their disk layer
+// reconstructs the flat state of the topmost one.
+//
+// Note, the layer is keyed by account and slot hashes, so the deltas can't be
+// applied to an address keyed state, only to a snapshot database. A state.StateDB
+// target isn't possible either way, as the state package imports this one.
+func (dl *diffLayer) ApplyTo(db ethdb.KeyValueWriter) error {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	apply := func(key, value []byte) error {
+		if len(value) == 0 {
+			return db.Delete(key)
+		}
+		return db.Put(key, value)
+	}
+	for hash, data := range dl.accountData {
+		if err := apply(slices.Concat(rawdb.SnapshotAccountPrefix, hash.Bytes()), data); err != nil {
+			return err
+		}
+	}
+	for accountHash, slots := range dl.storageData {
+		for storageHash, data := range slots {
+			if err := apply(slices.Concat(rawdb.SnapshotStoragePrefix, accountHash.Bytes(), storageHash.Bytes()), data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ContentHash returns a deterministic hash over the account and storage entries
+// of this single layer, keys and values alike. The entries are hashed in sorted
+// order, so layers with identical content hash equally regardless of their map
+// ordering or block root, allowing them to be compared across nodes.
+func (dl *diffLayer) ContentHash() common.Hash {
+	var (
+		hash   common.Hash
+		hasher = crypto.NewKeccakState()
+	)
+	dl.StreamKV(hasher) // hasher writes never fail
+	hasher.Read(hash[:])
+	return hash
+}
+
+// HasAnyStorage reports for each of the given accounts whether this layer tracks
+// any storage for it, checking all of them in a single locked pass.
+func (dl *diffLayer) HasAnyStorage(accountHashes []common.Hash) map[common.Hash]bool {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	result := make(map[common.Hash]bool, len(accountHashes))
+	for _, hash := range accountHashes {
+		_, ok := dl.storageData[hash]
+		result[hash] = ok
+	}
+	return result
+}
+
+// AccountsWithStorageChanges returns the sorted list of accounts which have any
+// storage entries tracked in this layer, allowing storage to be requested for
+// exactly the accounts whose storage changed.
+func (dl *diffLayer) AccountsWithStorageChanges() []common.Hash {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	return slices.SortedFunc(maps.Keys(dl.storageData), common.Hash.Cmp)
+}
+
+// TombstonedSlotCount returns the number of storage slots of the given account
+// that are deleted (tombstoned) in this layer.
+func (dl *diffLayer) TombstonedSlotCount(accountHash common.Hash) int {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	var count int
+	for _, data := range dl.storageData[accountHash] {
+		if len(data) == 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// storageValueSizeClass is the width of the size classes the storage values are
+// bucketed into by StorageValueSizeHistogram.
+const storageValueSizeClass = 32
+
+// StorageValueSizeHistogram returns the number of storage values in this layer
+// for each size class. Classes are keyed by their inclusive upper bound, so 0
+// counts the deleted slots, 32 the values of 1-32 bytes, 64 the values of 33-64
+// bytes and so on.
+func (dl *diffLayer) StorageValueSizeHistogram() map[int]int {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	hist := make(map[int]int)
+	for _, slots := range dl.storageData {
+		for _, data := range slots {
+			class := (len(data) + storageValueSizeClass - 1) / storageValueSizeClass * storageValueSizeClass
+			hist[class]++
+		}
+	}
+	return hist
+}
+
+// StorageWithPrefix returns the sorted list of storage slot hashes in this
+// diffLayer for the given account which start with the given byte prefix.
+// Deleted slots are included, similarly to StorageList.
+//
+// Note, the returned slice is not a copy, so do not modify it.
+func (dl *diffLayer) StorageWithPrefix(accountHash common.Hash, prefix []byte) []common.Hash {
+	list := dl.StorageList(accountHash)
+
+	// The list is sorted, so all matching slots are in a contiguous range
+	start, _ := slices.BinarySearchFunc(list, prefix, func(h common.Hash, prefix []byte) int {
+		return bytes.Compare(h[:], prefix)
+	})
+	end := start
+	for end < len(list) && bytes.HasPrefix(list[end][:], prefix) {
+		end++
+	}
+	if start == end {
+		return nil
+	}
+	return list[start:end:end]
+}
+
+// DeletedStorageList returns the sorted list of storage slot hashes in this
+// diffLayer for the given account which are deleted (tombstoned), reusing the
+// cached sorted list of StorageList.
+func (dl *diffLayer) DeletedStorageList(accountHash common.Hash) []common.Hash {
+	list := dl.StorageList(accountHash)
+
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	var (
+		storage = dl.storageData[accountHash]
+		deleted []common.Hash
+	)
+	for _, hash := range list {
+		if len(storage[hash]) == 0 {
+			deleted = append(deleted, hash)
+		}
+	}
+	return deleted
+}
+
+// StorageRange returns up to limit storage slots of the given account at or after
+// the start hash in sorted order, along with their values, resolving them across
+// this layer, its parents and the disk layer. Slots set in a layer shadow the
+// ones of the layers below. Slots deleted in the diff layers are included with
+// an empty value, unless skipDeleted is set.
+//
+// Note the returned slots are not copies, please don't modify them.
+func (dl *diffLayer) StorageRange(accountHash, start common.Hash, limit int, skipDeleted bool) ([]common.Hash, [][]byte, error) {
+	it := dl.initBinaryStorageIterator(accountHash, start).(*binaryIterator)
+	defer it.Release()
+
+	var (
+		hashes []common.Hash
+		slots  [][]byte
+	)
+	for len(hashes) < limit {
+		// The public iterator stepping skips the deleted slots, the internal one
+		// retains them
+		if skipDeleted && !it.Next() || !skipDeleted && !it.next() {
+			break
+		}
+		slot := it.Slot()
+		if it.fail != nil {
+			return nil, nil, it.fail
+		}
+		hashes = append(hashes, it.Hash())
+		slots = append(slots, slot)
+	}
+	if it.fail != nil {
+		return nil, nil, it.fail
+	}
+	// The iterators of the individual layers stop silently when the layer goes
+	// stale, make sure the range wasn't cut short by a flattening
+	for layer := dl; layer != nil; layer, _ = layer.parent.(*diffLayer) {
+		if layer.Stale() {
+			return nil, nil, &StaleLayerError{Root: layer.root}
+		}
+	}
+	return hashes, slots, nil
+}
+
+// DiffAccounts compares the accounts tracked locally by two diff layers, e.g. two
+// competing blocks at the same height, and classifies the changes going from a
+// to b: accounts live in b but missing or deleted in a are added, the ones live
+// in a but missing or deleted in b are removed, and the ones live in both with
+// different data are changed. Accounts tracked by the parents are not compared.
+// The returned lists are sorted.
+func DiffAccounts(a, b *diffLayer) (added, changed, removed []common.Hash) {
+	if a == b {
+		return nil, nil, nil
+	}
+	// Lock the layers in root order, so concurrent comparisons of the same pair
+	// can't deadlock on a writer queued between the two read locks
+	first, second := a, b
+	if bytes.Compare(b.root[:], a.root[:]) < 0 {
+		first, second = b, a
+	}
+	first.lock.RLock()
+	defer first.lock.RUnlock()
+	second.lock.RLock()
+	defer second.lock.RUnlock()
+
+	for hash, data := range b.accountData {
+		if len(data) == 0 {
+			continue
+		}
+		switch prev := a.accountData[hash]; {
+		case len(prev) == 0:
+			added = append(added, hash)
+		case !bytes.Equal(prev, data):
+			changed = append(changed, hash)
+		}
+	}
+	for hash, data := range a.accountData {
+		if len(data) > 0 && len(b.accountData[hash]) == 0 {
+			removed = append(removed, hash)
+		}
+	}
+	slices.SortFunc(added, common.Hash.Cmp)
+	slices.SortFunc(changed, common.Hash.Cmp)
+	slices.SortFunc(removed, common.Hash.Cmp)
+	return added, changed, removed
+}
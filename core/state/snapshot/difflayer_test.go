@@ -19,14 +19,25 @@ package snapshot
 import (
 	"bytes"
 	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"maps"
+	"math"
 	"math/rand"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+	bloomfilter "github.com/holiman/bloomfilter/v2"
 )
 
 func copyAccounts(accounts map[common.Hash][]byte) map[common.Hash][]byte {
@@ -75,7 +86,11 @@ func TestMergeBasics(t *testing.T) {
 	child = newDiffLayer(child, common.Hash{}, copyAccounts(accounts), copyStorage(storage))
 
 	// And flatten
-	merged := (child.flatten()).(*diffLayer)
+	flattened, err := child.flatten()
+	if err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	merged := flattened.(*diffLayer)
 
 	{ // Check account lists
 		if have, want := len(merged.accountList), 0; have != want {
@@ -143,7 +158,11 @@ func TestMergeDelete(t *testing.T) {
 	}
 
 	// And flatten
-	merged := (child.flatten()).(*diffLayer)
+	flattened, err := child.flatten()
+	if err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	merged := flattened.(*diffLayer)
 
 	if data, _ := merged.Account(h1); data == nil {
 		t.Errorf("merged layer: expected %x account to be non-nil", h1)
@@ -186,7 +205,11 @@ func TestInsertAndMerge(t *testing.T) {
 		child = newDiffLayer(parent, common.Hash{}, accounts, storage)
 	}
 	// And flatten
-	merged := (child.flatten()).(*diffLayer)
+	flattened, err := child.flatten()
+	if err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	merged := flattened.(*diffLayer)
 	{ // Check that slot value is present
 		have, _ := merged.Storage(acc, slot)
 		if want := []byte{0x01}; !bytes.Equal(have, want) {
@@ -308,7 +331,11 @@ func BenchmarkFlatten(b *testing.B) {
 			if !ok {
 				break
 			}
-			layer = dl.flatten()
+			flattened, err := dl.flatten()
+			if err != nil {
+				b.Fatalf("failed to flatten layers: %v", err)
+			}
+			layer = flattened
 		}
 		b.StopTimer()
 	}
@@ -349,3 +376,1682 @@ func BenchmarkJournal(b *testing.B) {
 		layer.Journal(new(bytes.Buffer))
 	}
 }
+
+// Tests that storage slots can be filtered by their hash prefix.
+func TestStorageWithPrefix(t *testing.T) {
+	var (
+		acc     = common.HexToHash("0x01")
+		slots   = make(map[common.Hash][]byte)
+		storage = map[common.Hash]map[common.Hash][]byte{acc: slots}
+	)
+	for _, key := range []string{
+		"0xaa00000000000000000000000000000000000000000000000000000000000002",
+		"0xaa00000000000000000000000000000000000000000000000000000000000001",
+		"0xab00000000000000000000000000000000000000000000000000000000000001",
+		"0xaabb000000000000000000000000000000000000000000000000000000000000",
+		"0x1100000000000000000000000000000000000000000000000000000000000000",
+	} {
+		slots[common.HexToHash(key)] = []byte{0x01}
+	}
+	layer := newDiffLayer(emptyLayer(), common.Hash{}, make(map[common.Hash][]byte), storage)
+
+	want := []common.Hash{
+		common.HexToHash("0xaa00000000000000000000000000000000000000000000000000000000000001"),
+		common.HexToHash("0xaa00000000000000000000000000000000000000000000000000000000000002"),
+		common.HexToHash("0xaabb000000000000000000000000000000000000000000000000000000000000"),
+	}
+	if have := layer.StorageWithPrefix(acc, []byte{0xaa}); !slices.Equal(have, want) {
+		t.Errorf("prefix 0xaa mismatch: have %x, want %x", have, want)
+	}
+	if have := layer.StorageWithPrefix(acc, []byte{0xaa, 0xbb}); !slices.Equal(have, want[2:]) {
+		t.Errorf("prefix 0xaabb mismatch: have %x, want %x", have, want[2:])
+	}
+	if have := layer.StorageWithPrefix(acc, []byte{0xff}); len(have) != 0 {
+		t.Errorf("prefix 0xff mismatch: have %x, want none", have)
+	}
+	if have := layer.StorageWithPrefix(common.HexToHash("0x02"), []byte{0xaa}); len(have) != 0 {
+		t.Errorf("untracked account mismatch: have %x, want none", have)
+	}
+	if have := layer.StorageWithPrefix(acc, nil); len(have) != len(slots) {
+		t.Errorf("empty prefix mismatch: have %d slots, want %d", len(have), len(slots))
+	}
+}
+
+// Tests that bypassing the bloom filter yields the same results as the regular
+// bloom assisted account retrieval.
+func TestAccountRLPNoBloom(t *testing.T) {
+	var (
+		base    = emptyLayer()
+		members []common.Hash
+	)
+	// Seed some accounts into the disk layer and in the diff layers
+	diskAcc := randomHash()
+	rawdb.WriteAccountSnapshot(base.diskdb, diskAcc, randomAccount())
+	members = append(members, diskAcc)
+
+	var layer snapshot = base
+	for i := 0; i < 8; i++ {
+		accounts := make(map[common.Hash][]byte)
+		for j := 0; j < 16; j++ {
+			h := randomHash()
+			accounts[h] = randomAccount()
+			if j%4 == 0 {
+				accounts[h] = nil
+			}
+			members = append(members, h)
+		}
+		layer = newDiffLayer(layer, randomHash(), accounts, make(map[common.Hash]map[common.Hash][]byte))
+	}
+	head := layer.(*diffLayer)
+
+	check := func(hash common.Hash) {
+		want, err := head.AccountRLP(hash)
+		if err != nil {
+			t.Fatalf("failed to retrieve account %x: %v", hash, err)
+		}
+		have, err := head.AccountRLPNoBloom(hash)
+		if err != nil {
+			t.Fatalf("failed to retrieve account %x without bloom: %v", hash, err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("account %x mismatch: have %x, want %x", hash, have, want)
+		}
+	}
+	for _, hash := range members {
+		check(hash)
+	}
+	for i := 0; i < 100; i++ {
+		check(randomHash())
+	}
+}
+
+// Tests that batched storage retrievals match individual ones.
+func TestStorageBatch(t *testing.T) {
+	var (
+		accountKey = randomHash()
+		slots      []common.Hash
+		layer      snapshot = emptyLayer()
+	)
+	for i := 0; i < 16; i++ {
+		accStorage := make(map[common.Hash][]byte)
+		for j := 0; j < 8; j++ {
+			h := randomHash()
+			value := make([]byte, 32)
+			crand.Read(value)
+			if j%4 == 0 {
+				value = nil
+			}
+			accStorage[h] = value
+			slots = append(slots, h)
+		}
+		layer = newDiffLayer(layer, randomHash(), map[common.Hash][]byte{accountKey: randomAccount()}, map[common.Hash]map[common.Hash][]byte{accountKey: accStorage})
+	}
+	for i := 0; i < 16; i++ {
+		slots = append(slots, randomHash())
+	}
+	head := layer.(*diffLayer)
+
+	results, errs := head.StorageBatch(accountKey, slots)
+	for i, slot := range slots {
+		want, err := head.Storage(accountKey, slot)
+		if err != nil || errs[i] != nil {
+			t.Fatalf("slot %x: retrieval failed: %v, %v", slot, err, errs[i])
+		}
+		if !bytes.Equal(results[i], want) {
+			t.Errorf("slot %x mismatch: have %x, want %x", slot, results[i], want)
+		}
+	}
+}
+
+// Tests that batched account retrievals match individual ones.
+func TestAccountsRLP(t *testing.T) {
+	var (
+		hashes []common.Hash
+		layer  snapshot = emptyLayer()
+	)
+	for i := 0; i < 16; i++ {
+		accounts := make(map[common.Hash][]byte)
+		for j := 0; j < 8; j++ {
+			h := randomHash()
+			accounts[h] = randomAccount()
+			if j%4 == 0 {
+				accounts[h] = nil
+			}
+			hashes = append(hashes, h)
+		}
+		// Overwrite some accounts of earlier layers too
+		if i > 0 {
+			accounts[hashes[rand.Intn(len(hashes)-8)]] = randomAccount()
+		}
+		layer = newDiffLayer(layer, randomHash(), accounts, make(map[common.Hash]map[common.Hash][]byte))
+	}
+	for i := 0; i < 16; i++ {
+		hashes = append(hashes, randomHash())
+	}
+	rand.Shuffle(len(hashes), func(i, j int) { hashes[i], hashes[j] = hashes[j], hashes[i] })
+	head := layer.(*diffLayer)
+
+	results, err := head.AccountsRLP(hashes)
+	if err != nil {
+		t.Fatalf("batch retrieval failed: %v", err)
+	}
+	for i, hash := range hashes {
+		want, err := head.AccountRLP(hash)
+		if err != nil {
+			t.Fatalf("account %x: retrieval failed: %v", hash, err)
+		}
+		if !bytes.Equal(results[i], want) {
+			t.Errorf("account %x mismatch: have %x, want %x", hash, results[i], want)
+		}
+	}
+	// Flatten the layers underneath and ensure the batch fails as a whole
+	if _, err := head.parent.(*diffLayer).flatten(); err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	if _, err := head.AccountsRLP(hashes); !errors.Is(err, ErrSnapshotStale) {
+		t.Fatalf("stale batch error mismatch: have %v, want %v", err, ErrSnapshotStale)
+	}
+}
+
+// Tests that the copied account data can be modified without affecting the layer.
+func TestAccountRLPCopy(t *testing.T) {
+	var (
+		acc      = common.HexToHash("0xa1")
+		accounts = randomAccountSet("0xa1")
+		want     = common.CopyBytes(accounts[acc])
+	)
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, accounts, make(map[common.Hash]map[common.Hash][]byte))
+
+	blob, err := layer.AccountRLPCopy(acc)
+	if err != nil {
+		t.Fatalf("failed to retrieve account: %v", err)
+	}
+	if !bytes.Equal(blob, want) {
+		t.Fatalf("account data mismatch: have %x, want %x", blob, want)
+	}
+	for i := range blob {
+		blob[i] ^= 0xff
+	}
+	if data, _ := layer.AccountRLP(acc); !bytes.Equal(data, want) {
+		t.Fatalf("layer data modified through copy: have %x, want %x", data, want)
+	}
+}
+
+// Tests that account existence checks report live and deleted accounts across
+// the layers and the disk.
+func TestHasAccount(t *testing.T) {
+	var (
+		db      = rawdb.NewMemoryDatabase()
+		onDisk  = common.HexToHash("0xa1")
+		storage = make(map[common.Hash]map[common.Hash][]byte)
+	)
+	rawdb.WriteAccountSnapshot(db, onDisk, randomAccount())
+	base := &diskLayer{
+		diskdb: db,
+		root:   common.Hash{0x01},
+		cache:  fastcache.New(1024 * 500),
+	}
+	bottom := newDiffLayer(base, common.Hash{0x02}, randomAccountSet("0xa2", "0xa3"), storage)
+	top := bottom.Update(common.Hash{0x03}, map[common.Hash][]byte{common.HexToHash("0xa3"): nil}, storage)
+
+	for _, tt := range []struct {
+		hash             string
+		present, deleted bool
+	}{
+		{"0xa1", true, false},
+		{"0xa2", true, false},
+		{"0xa3", true, true},
+		{"0xa4", false, false},
+	} {
+		present, deleted, err := top.HasAccount(common.HexToHash(tt.hash))
+		if err != nil {
+			t.Fatalf("account %s: existence check failed: %v", tt.hash, err)
+		}
+		if present != tt.present || deleted != tt.deleted {
+			t.Errorf("account %s: have present=%v deleted=%v, want present=%v deleted=%v", tt.hash, present, deleted, tt.present, tt.deleted)
+		}
+	}
+	if _, err := top.flatten(); err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	if _, _, err := bottom.HasAccount(common.HexToHash("0xa2")); !errors.Is(err, ErrSnapshotStale) {
+		t.Fatalf("stale layer error mismatch: have %v, want %v", err, ErrSnapshotStale)
+	}
+}
+
+// Tests that the proof chain of an account lists the layers consulted down to
+// the one resolving it.
+func TestAccountProofChain(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	rawdb.WriteAccountSnapshot(db, common.HexToHash("0xa1"), randomAccount())
+
+	base := &diskLayer{
+		diskdb: db,
+		root:   common.Hash{0x01},
+		cache:  fastcache.New(1024 * 500),
+	}
+	bottom := newDiffLayer(base, common.Hash{0x02}, randomAccountSet("0xa2", "0xa3"), make(map[common.Hash]map[common.Hash][]byte))
+	middle := bottom.Update(common.Hash{0x03}, map[common.Hash][]byte{common.HexToHash("0xa3"): nil}, make(map[common.Hash]map[common.Hash][]byte))
+	top := middle.Update(common.Hash{0x04}, randomAccountSet("0xa4"), make(map[common.Hash]map[common.Hash][]byte))
+
+	for _, tt := range []struct {
+		hash string
+		want []LayerRef
+	}{
+		{"0xa4", []LayerRef{{common.Hash{0x04}, true}}},
+		{"0xa3", []LayerRef{{common.Hash{0x04}, false}, {common.Hash{0x03}, true}}},
+		{"0xa2", []LayerRef{{common.Hash{0x04}, false}, {common.Hash{0x03}, false}, {common.Hash{0x02}, true}}},
+		{"0xa1", []LayerRef{{common.Hash{0x04}, false}, {common.Hash{0x03}, false}, {common.Hash{0x02}, false}, {common.Hash{0x01}, true}}},
+		{"0xa5", []LayerRef{{common.Hash{0x04}, false}, {common.Hash{0x03}, false}, {common.Hash{0x02}, false}, {common.Hash{0x01}, false}}},
+	} {
+		chain, err := top.AccountProofChain(common.HexToHash(tt.hash))
+		if err != nil {
+			t.Fatalf("account %s: failed to retrieve proof chain: %v", tt.hash, err)
+		}
+		if !slices.Equal(chain, tt.want) {
+			t.Errorf("account %s: proof chain mismatch: have %v, want %v", tt.hash, chain, tt.want)
+		}
+	}
+	if _, err := top.flatten(); err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	if _, err := top.AccountProofChain(common.HexToHash("0xa1")); !errors.Is(err, ErrSnapshotStale) {
+		t.Fatalf("stale chain error mismatch: have %v, want %v", err, ErrSnapshotStale)
+	}
+}
+
+// Tests that the last modifying layer of an account is the topmost diff layer
+// touching it, and that accounts only in the disk layer are not reported.
+func TestAccountLastModifiedRoot(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	rawdb.WriteAccountSnapshot(db, common.HexToHash("0xa1"), randomAccount())
+
+	base := &diskLayer{
+		diskdb: db,
+		root:   common.Hash{0x01},
+		cache:  fastcache.New(1024 * 500),
+	}
+	bottom := newDiffLayer(base, common.Hash{0x02}, randomAccountSet("0xa2", "0xa3"), make(map[common.Hash]map[common.Hash][]byte))
+	middle := bottom.Update(common.Hash{0x03}, randomAccountSet("0xa2", "0xa4"), make(map[common.Hash]map[common.Hash][]byte))
+	top := middle.Update(common.Hash{0x04}, map[common.Hash][]byte{common.HexToHash("0xa3"): nil}, make(map[common.Hash]map[common.Hash][]byte))
+
+	for _, tt := range []struct {
+		hash  string
+		root  common.Hash
+		found bool
+	}{
+		{"0xa1", common.Hash{}, false},
+		{"0xa2", common.Hash{0x03}, true},
+		{"0xa3", common.Hash{0x04}, true},
+		{"0xa4", common.Hash{0x03}, true},
+		{"0xa5", common.Hash{}, false},
+	} {
+		root, found := top.AccountLastModifiedRoot(common.HexToHash(tt.hash))
+		if root != tt.root || found != tt.found {
+			t.Errorf("account %s: last modified mismatch: have (%x, %v), want (%x, %v)", tt.hash, root, found, tt.root, tt.found)
+		}
+	}
+	// Querying a lower layer ignores the modifications above it
+	if root, found := bottom.AccountLastModifiedRoot(common.HexToHash("0xa2")); root != (common.Hash{0x02}) || !found {
+		t.Errorf("bottom layer last modified mismatch: have (%x, %v), want (%x, true)", root, found, common.Hash{0x02})
+	}
+}
+
+// Tests that reads running into a stale layer report the root of the layer that
+// was found stale, while still matching the staleness sentinel.
+func TestStaleLayerError(t *testing.T) {
+	var (
+		account = common.HexToHash("0xa1")
+		slot    = common.HexToHash("0x01")
+	)
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x02}, randomAccountSet("0xa1"), randomStorageSet([]string{"0xa1"}, [][]string{{"0x01"}}, nil))
+	top := bottom.Update(common.Hash{0x03}, randomAccountSet("0xa2"), make(map[common.Hash]map[common.Hash][]byte))
+
+	// Invalidate the parent only, reads descending into it should blame it
+	bottom.stale.Store(true)
+
+	check := func(name string, err error, root common.Hash) {
+		t.Helper()
+
+		if !errors.Is(err, ErrSnapshotStale) {
+			t.Fatalf("%s: error mismatch: have %v, want %v", name, err, ErrSnapshotStale)
+		}
+		var stale *StaleLayerError
+		if !errors.As(err, &stale) {
+			t.Fatalf("%s: error type mismatch: have %T, want %T", name, err, stale)
+		}
+		if stale.Root != root {
+			t.Errorf("%s: stale root mismatch: have %#x, want %#x", name, stale.Root, root)
+		}
+	}
+	_, err := top.AccountRLP(account)
+	check("deep account", err, bottom.root)
+	_, err = top.Storage(account, slot)
+	check("deep storage", err, bottom.root)
+	_, _, err = top.HasAccount(account)
+	check("deep presence", err, bottom.root)
+	_, err = top.AccountsRLP([]common.Hash{account})
+	check("deep account batch", err, bottom.root)
+	_, errs := top.StorageBatch(account, []common.Hash{slot})
+	check("deep storage batch", errs[0], bottom.root)
+	_, _, err = top.StorageRange(account, common.Hash{}, 10, false)
+	check("deep storage range", err, bottom.root)
+
+	// Invalidate the child too, reads should be rejected upfront
+	top.stale.Store(true)
+
+	_, err = top.AccountRLP(account)
+	check("account", err, top.root)
+	_, err = top.Storage(account, slot)
+	check("storage", err, top.root)
+	_, _, err = top.HasAccount(account)
+	check("presence", err, top.root)
+	_, err = top.AccountsRLP([]common.Hash{account})
+	check("account batch", err, top.root)
+	_, errs = top.StorageBatch(account, []common.Hash{slot})
+	check("storage batch", errs[0], top.root)
+	_, _, err = top.StorageRange(account, common.Hash{}, 10, false)
+	check("storage range", err, top.root)
+}
+
+// BenchmarkStorageBatch compares batched storage retrievals with a loop of the
+// individual ones.
+func BenchmarkStorageBatch(b *testing.B) {
+	var (
+		accountKey = crypto.Keccak256Hash([]byte{0x13, 0x37})
+		slots      []common.Hash
+		layer      snapshot = emptyLayer()
+	)
+	for i := 0; i < 128; i++ {
+		accStorage := make(map[common.Hash][]byte)
+		for j := 0; j < 5; j++ {
+			value := make([]byte, 32)
+			crand.Read(value)
+			h := randomHash()
+			accStorage[h] = value
+			slots = append(slots, h)
+		}
+		layer = newDiffLayer(layer, common.Hash{}, map[common.Hash][]byte{accountKey: randomAccount()}, map[common.Hash]map[common.Hash][]byte{accountKey: accStorage})
+	}
+	head := layer.(*diffLayer)
+
+	b.Run("loop", func(b *testing.B) {
+		for b.Loop() {
+			for _, slot := range slots {
+				head.Storage(accountKey, slot)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for b.Loop() {
+			head.StorageBatch(accountKey, slots)
+		}
+	})
+}
+
+// BenchmarkAccountsRLP compares batched account retrievals with a loop of the
+// individual ones.
+func BenchmarkAccountsRLP(b *testing.B) {
+	var (
+		hashes []common.Hash
+		layer  snapshot = emptyLayer()
+	)
+	for i := 0; i < 128; i++ {
+		accounts := make(map[common.Hash][]byte)
+		for j := 0; j < 5; j++ {
+			h := randomHash()
+			accounts[h] = randomAccount()
+			hashes = append(hashes, h)
+		}
+		layer = newDiffLayer(layer, common.Hash{}, accounts, make(map[common.Hash]map[common.Hash][]byte))
+	}
+	head := layer.(*diffLayer)
+
+	b.Run("loop", func(b *testing.B) {
+		for b.Loop() {
+			for _, hash := range hashes {
+				head.AccountRLP(hash)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for b.Loop() {
+			head.AccountsRLP(hashes)
+		}
+	})
+}
+
+// Tests that account nonces are resolved through the layer chain.
+func TestAccountNonce(t *testing.T) {
+	var (
+		accA = common.HexToHash("0xa1")
+		accB = common.HexToHash("0xa2")
+		accC = common.HexToHash("0xa3")
+	)
+	storage := make(map[common.Hash]map[common.Hash][]byte)
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1", "0xa3"), storage)
+	middle := bottom.Update(common.Hash{0x02}, randomAccountSet("0xa2"), storage)
+	top := middle.Update(common.Hash{0x03}, map[common.Hash][]byte{accC: nil}, storage)
+
+	for _, hash := range []common.Hash{accA, accB} {
+		account, err := top.Account(hash)
+		if err != nil || account == nil {
+			t.Fatalf("failed to retrieve account %x: %v", hash, err)
+		}
+		nonce, err := top.AccountNonce(hash)
+		if err != nil {
+			t.Fatalf("failed to retrieve nonce of %x: %v", hash, err)
+		}
+		if nonce != account.Nonce {
+			t.Errorf("nonce mismatch for %x: have %d, want %d", hash, nonce, account.Nonce)
+		}
+	}
+	// The deleted account must report the missing account error
+	if nonce, err := top.AccountNonce(accC); !errors.Is(err, ErrAccountNotFound) || nonce != 0 {
+		t.Errorf("deleted account: have nonce %d, err %v", nonce, err)
+	}
+	// Below the deletion the account should still resolve
+	account, _ := bottom.Account(accC)
+	if nonce, err := middle.AccountNonce(accC); err != nil || nonce != account.Nonce {
+		t.Errorf("undeleted account: have nonce %d, err %v, want %d", nonce, err, account.Nonce)
+	}
+}
+
+// Tests that the layer roots are listed from the queried layer down to the disk.
+func TestChainRoots(t *testing.T) {
+	base := emptyLayer()
+	base.root = common.Hash{0x01}
+
+	storage := make(map[common.Hash]map[common.Hash][]byte)
+	first := newDiffLayer(base, common.Hash{0x02}, randomAccountSet("0xa1"), storage)
+	second := first.Update(common.Hash{0x03}, randomAccountSet("0xa2"), storage)
+	third := second.Update(common.Hash{0x04}, randomAccountSet("0xa3"), storage)
+
+	if have, want := third.ChainRoots(), []common.Hash{{0x04}, {0x03}, {0x02}, {0x01}}; !slices.Equal(have, want) {
+		t.Errorf("head roots mismatch: have %x, want %x", have, want)
+	}
+	if have, want := first.ChainRoots(), []common.Hash{{0x02}, {0x01}}; !slices.Equal(have, want) {
+		t.Errorf("bottom roots mismatch: have %x, want %x", have, want)
+	}
+}
+
+// Tests that storage writes identical to the parent value are dropped from new
+// diff layers when no-op detection is enabled, while the modified ones are held
+// locally, and that all of them still resolve to the written values.
+func TestDiffSkipNoopStorage(t *testing.T) {
+	defer func(enabled bool) { diffSkipNoopStorage = enabled }(diffSkipNoopStorage)
+	SetDiffSkipNoopStorage(true)
+
+	var (
+		account = common.HexToHash("0xa1")
+		other   = common.HexToHash("0xa2")
+		slots   = make([]common.Hash, 8)
+		parent  = make(map[common.Hash][]byte)
+		child   = make(map[common.Hash][]byte)
+	)
+	for i := range slots {
+		slots[i] = common.Hash{byte(i + 1)}
+		parent[slots[i]] = []byte{0x01, byte(i)}
+		child[slots[i]] = []byte{0x01, byte(i)} // Rewritten with the same value
+	}
+	child[slots[0]] = []byte{0x02} // Modified
+	child[slots[6]] = []byte{0x03} // Modified
+
+	// Slots differing from the disk layer are all modifications, hold them
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1", "0xa2"), map[common.Hash]map[common.Hash][]byte{
+		account: parent,
+		other:   {slots[0]: []byte{0x04}},
+	})
+	if len(bottom.storageData[account]) != len(slots) {
+		t.Fatalf("bottom layer slot count mismatch: have %d, want %d", len(bottom.storageData[account]), len(slots))
+	}
+	noops := snapshotDirtyStorageNoopMeter.Snapshot().Count()
+	top := bottom.Update(common.Hash{0x02}, make(map[common.Hash][]byte), map[common.Hash]map[common.Hash][]byte{
+		account: child,
+		other:   {slots[0]: []byte{0x04}},
+	})
+	if len(child) != len(slots) {
+		t.Fatalf("input storage set mutated: have %d slots, want %d", len(child), len(slots))
+	}
+	if _, ok := top.storageData[other]; ok {
+		t.Errorf("account with only no-op storage writes retained")
+	}
+	if have := snapshotDirtyStorageNoopMeter.Snapshot().Count() - noops; have != 7 {
+		t.Errorf("no-op meter mismatch: have %d, want %d", have, 7)
+	}
+	for i, slot := range slots {
+		_, local := top.storageData[account][slot]
+		switch {
+		case (i == 0 || i == 6) && !local:
+			t.Errorf("modified slot %d not held locally", i)
+		case i != 0 && i != 6 && local:
+			t.Errorf("unchanged slot %d held locally", i)
+		}
+		// Dropped writes must still resolve through the parent
+		blob, err := top.Storage(account, slot)
+		if err != nil {
+			t.Fatalf("failed to retrieve slot %d: %v", i, err)
+		}
+		if !bytes.Equal(blob, child[slot]) {
+			t.Errorf("slot %d mismatch: have %x, want %x", i, blob, child[slot])
+		}
+	}
+}
+
+// Tests that account writes identical to the parent value are dropped from new
+// diff layers when no-op detection is enabled, and counted.
+func TestDiffSkipNoopAccounts(t *testing.T) {
+	defer func(enabled bool) { diffSkipNoopAccounts = enabled }(diffSkipNoopAccounts)
+	SetDiffSkipNoopAccounts(true)
+
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1", "0xa2"), make(map[common.Hash]map[common.Hash][]byte))
+
+	var (
+		a1 = common.HexToHash("0xa1")
+		a2 = common.HexToHash("0xa2")
+		a3 = common.HexToHash("0xa3")
+	)
+	accounts := map[common.Hash][]byte{
+		a1: common.CopyBytes(bottom.accountData[a1]), // Rewritten with the same value
+		a2: randomAccount(),                          // Modified
+		a3: randomAccount(),                          // Created
+	}
+	noops := snapshotDirtyAccountNoopMeter.Snapshot().Count()
+	top := bottom.Update(common.Hash{0x02}, accounts, make(map[common.Hash]map[common.Hash][]byte))
+
+	if len(accounts) != 3 {
+		t.Fatalf("input account set mutated: have %d accounts, want %d", len(accounts), 3)
+	}
+	if _, ok := top.accountData[a1]; ok {
+		t.Errorf("no-op account write retained")
+	}
+	for _, hash := range []common.Hash{a2, a3} {
+		if _, ok := top.accountData[hash]; !ok {
+			t.Errorf("account %x write dropped", hash)
+		}
+	}
+	if have := snapshotDirtyAccountNoopMeter.Snapshot().Count() - noops; have != 1 {
+		t.Errorf("no-op meter mismatch: have %d, want %d", have, 1)
+	}
+	// Dropped writes must still resolve through the parent
+	for hash, want := range accounts {
+		blob, err := top.AccountRLP(hash)
+		if err != nil {
+			t.Fatalf("failed to retrieve account %x: %v", hash, err)
+		}
+		if !bytes.Equal(blob, want) {
+			t.Errorf("account %x mismatch: have %x, want %x", hash, blob, want)
+		}
+	}
+}
+
+// Tests that the bloom headroom shrinks as entries are added and runs out once
+// the filter reaches its capacity.
+func TestBloomHeadroom(t *testing.T) {
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, make(map[common.Hash][]byte), make(map[common.Hash]map[common.Hash][]byte))
+	if have, want := layer.BloomHeadroom(), int(aggregatorItemLimit); have != want {
+		t.Fatalf("empty layer headroom mismatch: have %d, want %d", have, want)
+	}
+	child := layer.Update(common.Hash{0x02}, randomAccountSet("0xa1", "0xa2", "0xa3"), make(map[common.Hash]map[common.Hash][]byte))
+	if have, want := child.BloomHeadroom(), int(aggregatorItemLimit)-3; have != want {
+		t.Fatalf("child layer headroom mismatch: have %d, want %d", have, want)
+	}
+	for i := uint64(0); i < aggregatorItemLimit; i++ {
+		child.diffed.AddHash(i)
+	}
+	if have := child.BloomHeadroom(); have != 0 {
+		t.Fatalf("saturated layer headroom mismatch: have %d, want 0", have)
+	}
+}
+
+// Tests that raising the aggregator memory limit grows the bloom filters of the
+// new layers proportionally while keeping the targeted false positive rate.
+func TestSetAggregatorMemoryLimit(t *testing.T) {
+	defer SetAggregatorMemoryLimit(aggregatorMemoryLimit)
+
+	newLayer := func() *diffLayer {
+		return newDiffLayer(emptyLayer(), common.Hash{0x01}, make(map[common.Hash][]byte), make(map[common.Hash]map[common.Hash][]byte))
+	}
+	small := newLayer().diffed.M()
+
+	SetAggregatorMemoryLimit(4 * aggregatorMemoryLimit)
+	layer := newLayer()
+	if ratio := float64(layer.diffed.M()) / float64(small); ratio < 3.99 || ratio > 4.01 {
+		t.Fatalf("bloom size ratio mismatch: have %.3f, want 4", ratio)
+	}
+	if have := layer.diffed.K(); have != uint64(bloomFuncs) {
+		t.Fatalf("bloom funcs mismatch: have %d, want %d", have, uint64(bloomFuncs))
+	}
+	// Fill the filter up to the item limit and check the false positive rate
+	for i := uint64(0); i < aggregatorItemLimit; i++ {
+		layer.diffed.AddHash(rand.Uint64())
+	}
+	if rate := layer.diffed.FalsePosititveProbability(); math.Abs(rate-bloomTargetError) > bloomTargetError/4 {
+		t.Fatalf("false positive rate mismatch: have %.4f, want %.4f", rate, bloomTargetError)
+	}
+}
+
+// Tests that the bloom bit histogram accounts for all the set bits of the filter.
+func TestBloomBitHistogram(t *testing.T) {
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, make(map[common.Hash][]byte), make(map[common.Hash]map[common.Hash][]byte))
+	if have := layer.BloomBitHistogram(0); have != nil {
+		t.Fatalf("histogram without buckets: have %v, want nil", have)
+	}
+	for i := 0; i < 10000; i++ {
+		layer.diffed.AddHash(rand.Uint64())
+	}
+	var (
+		hist = layer.BloomBitHistogram(16)
+		sum  uint64
+		want = uint64(math.Round(layer.diffed.PreciseFilledRatio() * float64(layer.diffed.M())))
+	)
+	if len(hist) != 16 {
+		t.Fatalf("histogram bucket count mismatch: have %d, want 16", len(hist))
+	}
+	for _, count := range hist {
+		sum += count
+	}
+	if sum != want {
+		t.Fatalf("histogram set bit count mismatch: have %d, want %d", sum, want)
+	}
+}
+
+// Tests that flattening a large stack of layers periodically reports the number
+// of entries merged so far.
+func TestFlattenProgress(t *testing.T) {
+	defer func(interval uint64) { flattenProgressInterval = interval }(flattenProgressInterval)
+	flattenProgressInterval = 100
+
+	var (
+		storage = make(map[common.Hash]map[common.Hash][]byte)
+		layer   = newDiffLayer(emptyLayer(), common.Hash{0x01}, make(map[common.Hash][]byte), storage)
+	)
+	for i := 0; i < 3; i++ {
+		accounts := make(map[common.Hash][]byte)
+		for j := 0; j < 1000; j++ {
+			accounts[randomHash()] = randomAccount()
+		}
+		layer = layer.Update(common.Hash{byte(i + 2)}, accounts, storage)
+	}
+	var reports []uint64
+	layer.flattenWithProgress(func(merged uint64) {
+		reports = append(reports, merged)
+	})
+	// The bottom diff layer is merged into, so only the three above it count
+	if len(reports) != 30 {
+		t.Fatalf("progress report count mismatch: have %d, want 30", len(reports))
+	}
+	for i, merged := range reports {
+		if want := uint64(i+1) * flattenProgressInterval; merged != want {
+			t.Fatalf("progress report %d mismatch: have %d, want %d", i, merged, want)
+		}
+	}
+}
+
+// Tests that flattening records the number of merged entries, but only if there
+// is an actual diff layer parent to merge into.
+func TestFlattenMetrics(t *testing.T) {
+	storage := randomStorageSet([]string{"0xa1"}, [][]string{{"0x01", "0x02"}}, [][]string{{"0x03"}})
+
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1"), make(map[common.Hash]map[common.Hash][]byte))
+	items := snapshotFlattenItemMeter.Snapshot().Count()
+	if _, err := bottom.flatten(); err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	if have := snapshotFlattenItemMeter.Snapshot().Count() - items; have != 0 {
+		t.Fatalf("merged item count without diff parent: have %d, want 0", have)
+	}
+	top := bottom.Update(common.Hash{0x02}, randomAccountSet("0xa1", "0xa2"), storage)
+	if _, err := top.flatten(); err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	if have := snapshotFlattenItemMeter.Snapshot().Count() - items; have != 5 {
+		t.Fatalf("merged item count mismatch: have %d, want 5", have)
+	}
+}
+
+// Tests that flattening two children into the same parent reports a conflict on
+// the second attempt instead of panicking.
+func TestFlattenConflict(t *testing.T) {
+	storage := make(map[common.Hash]map[common.Hash][]byte)
+
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1"), storage)
+	parent := bottom.Update(common.Hash{0x02}, randomAccountSet("0xa2"), storage)
+	first := parent.Update(common.Hash{0x03}, randomAccountSet("0xa3"), storage)
+	second := parent.Update(common.Hash{0x04}, randomAccountSet("0xa4"), storage)
+
+	if _, err := first.flatten(); err != nil {
+		t.Fatalf("failed to flatten first child: %v", err)
+	}
+	conflicts := snapshotFlattenConflictMeter.Snapshot().Count()
+	if _, err := second.flatten(); !errors.Is(err, errFlattenConflict) {
+		t.Fatalf("conflicting flatten error mismatch: have %v, want %v", err, errFlattenConflict)
+	}
+	if have := snapshotFlattenConflictMeter.Snapshot().Count() - conflicts; have != 1 {
+		t.Fatalf("flatten conflict meter mismatch: have %d, want 1", have)
+	}
+}
+
+// Tests that concurrently flattening sibling layers into the same parent lets
+// exactly one of them succeed, without the others merging any of their data.
+func TestFlattenConflictConcurrent(t *testing.T) {
+	storage := make(map[common.Hash]map[common.Hash][]byte)
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa0"), storage)
+
+	var children []*diffLayer
+	for i := 1; i <= 8; i++ {
+		children = append(children, bottom.Update(common.Hash{0x02, byte(i)}, randomAccountSet(fmt.Sprintf("0xa%d", i)), storage))
+	}
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(children))
+	)
+	for i, child := range children {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = child.flatten()
+		}()
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			if winner != -1 {
+				t.Fatalf("multiple flattens succeeded: %d and %d", winner, i)
+			}
+			winner = i
+		case !errors.Is(err, errFlattenConflict):
+			t.Fatalf("child %d: flatten error mismatch: have %v, want %v", i, err, errFlattenConflict)
+		}
+	}
+	if winner == -1 {
+		t.Fatalf("no flatten succeeded")
+	}
+	// Only the data of the winner may have been merged into the bottom layer
+	if n := len(bottom.accountData); n != 2 {
+		t.Fatalf("merged account count mismatch: have %d, want 2", n)
+	}
+	for hash := range children[winner].accountData {
+		if _, ok := bottom.accountData[hash]; !ok {
+			t.Errorf("winner account %x not merged", hash)
+		}
+	}
+}
+
+// Tests that reads missing a corrupted bloom filter are detected and repaired
+// when bloom miss verification is enabled.
+func TestBloomFalseNegative(t *testing.T) {
+	defer func(rate float64) { bloomVerifyRate = rate }(bloomVerifyRate)
+
+	var (
+		account = common.HexToHash("0xa1")
+		slot    = common.HexToHash("0x01")
+		storage = randomStorageSet([]string{"0xa1"}, [][]string{{"0x01"}}, nil)
+	)
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1"), storage)
+	top := bottom.Update(common.Hash{0x02}, randomAccountSet("0xa2"), make(map[common.Hash]map[common.Hash][]byte))
+
+	// Corrupt the bloom of the top layer, dropping all the entries
+	top.diffed, _ = bloomfilter.New(uint64(bloomSize), uint64(bloomFuncs))
+
+	// Without verification the reads fall through to the empty disk layer
+	if blob, err := top.AccountRLP(account); err != nil || len(blob) != 0 {
+		t.Fatalf("unverified account read mismatch: have %x/%v, want empty", blob, err)
+	}
+	// With verification forced on, the misses should be detected and repaired
+	SetBloomVerifyRate(1)
+
+	detected := snapshotBloomFalseNegativeCounter.Snapshot().Count()
+	blob, err := top.AccountRLP(account)
+	if err != nil {
+		t.Fatalf("failed to retrieve account: %v", err)
+	}
+	if want := bottom.accountData[account]; !bytes.Equal(blob, want) {
+		t.Errorf("repaired account mismatch: have %x, want %x", blob, want)
+	}
+	blob, err = top.Storage(account, slot)
+	if err != nil {
+		t.Fatalf("failed to retrieve slot: %v", err)
+	}
+	if want := storage[account][slot]; !bytes.Equal(blob, want) {
+		t.Errorf("repaired slot mismatch: have %x, want %x", blob, want)
+	}
+	if have := snapshotBloomFalseNegativeCounter.Snapshot().Count() - detected; have != 2 {
+		t.Errorf("false negative count mismatch: have %d, want 2", have)
+	}
+	// Genuine misses should not be reported
+	if _, err := top.AccountRLP(common.HexToHash("0xa3")); err != nil {
+		t.Fatalf("failed to retrieve missing account: %v", err)
+	}
+	if have := snapshotBloomFalseNegativeCounter.Snapshot().Count() - detected; have != 2 {
+		t.Errorf("false negative count mismatch after genuine miss: have %d, want 2", have)
+	}
+}
+
+// Tests that pinned bloom offsets make the bloom hashes reproducible regardless
+// of the random offsets chosen at startup.
+func TestPinnedBloomOffsets(t *testing.T) {
+	defer func(account, storage int) {
+		bloomAccountHasherOffset, bloomStorageHasherOffset = account, storage
+	}(bloomAccountHasherOffset, bloomStorageHasherOffset)
+
+	var (
+		account = common.HexToHash("0x0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20")
+		slot    = common.HexToHash("0xff")
+	)
+	for i := 0; i < 2; i++ {
+		// Simulate a fresh process start, randomizing the offsets before pinning
+		bloomAccountHasherOffset, bloomStorageHasherOffset = rand.Intn(25), rand.Intn(25)
+		setBloomOffsets(3, 0)
+
+		if have, want := accountBloomHash(account), uint64(0x0405060708090a0b); have != want {
+			t.Fatalf("run %d: account bloom hash mismatch: have %#x, want %#x", i, have, want)
+		}
+		if have, want := storageBloomHash(account, slot), uint64(0x0102030405060708); have != want {
+			t.Fatalf("run %d: storage bloom hash mismatch: have %#x, want %#x", i, have, want)
+		}
+	}
+}
+
+// Tests that the memory estimate of a layer grows as its sorted lists get cached
+// and that the tree size sums it across the diff layers.
+func TestDiffLayerMemory(t *testing.T) {
+	storage := randomStorageSet([]string{"0xa1"}, [][]string{{"0x01", "0x02"}}, nil)
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.Hash{0x01},
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	for i := 2; i <= 3; i++ {
+		if err := snaps.Update(common.Hash{byte(i)}, common.Hash{byte(i - 1)}, randomAccountSet("0xa1", "0xa2"), storage); err != nil {
+			t.Fatalf("failed to create diff layer %d: %v", i, err)
+		}
+	}
+	layer := snaps.Snapshot(common.Hash{0x03}).(*diffLayer)
+
+	memory := layer.Memory()
+	if memory == 0 {
+		t.Fatalf("empty memory estimate for populated layer")
+	}
+	layer.AccountList()
+	if have, want := layer.Memory(), memory+2*common.HashLength; have != want {
+		t.Fatalf("memory estimate mismatch after caching account list: have %d, want %d", have, want)
+	}
+	diffs, _, _ := snaps.Size()
+	if want := layer.Memory() + snaps.Snapshot(common.Hash{0x02}).(*diffLayer).Memory(); uint64(diffs) != want {
+		t.Fatalf("tree size mismatch: have %d, want %d", uint64(diffs), want)
+	}
+}
+
+// Tests that the bloom stats reflect the layer's filter and item count, with the
+// false positive estimate growing as the ancestors insert more items.
+func TestDiffLayerBloomStats(t *testing.T) {
+	storage := randomStorageSet([]string{"0xa1"}, [][]string{{"0x01", "0x02"}}, nil)
+	parent := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1", "0xa2"), storage)
+	child := parent.Update(common.Hash{0x02}, randomAccountSet("0xa3"), make(map[common.Hash]map[common.Hash][]byte))
+
+	stats := parent.BloomStats()
+	if stats.K != uint64(bloomFuncs) || stats.M != parent.diffed.M() {
+		t.Fatalf("bloom parameters mismatch: have K=%d M=%d, want K=%d M=%d", stats.K, stats.M, uint64(bloomFuncs), parent.diffed.M())
+	}
+	if stats.N != 4 || stats.Items != 4 {
+		t.Fatalf("parent item count mismatch: have N=%d items=%d, want 4 and 4", stats.N, stats.Items)
+	}
+	childStats := child.BloomStats()
+	if childStats.N != 5 || childStats.Items != 1 {
+		t.Fatalf("child item count mismatch: have N=%d items=%d, want 5 and 1", childStats.N, childStats.Items)
+	}
+	if childStats.Error <= stats.Error {
+		t.Fatalf("false positive estimate didn't grow: parent %v, child %v", stats.Error, childStats.Error)
+	}
+}
+
+// Tests that a failure to copy the parent bloom is recovered from by rebuilding
+// the bloom from the ancestor layers.
+func TestRebloomCopyFailure(t *testing.T) {
+	defer func(copier func(*bloomfilter.Filter) (*bloomfilter.Filter, error)) { copyBloom = copier }(copyBloom)
+
+	var (
+		base    = emptyLayer()
+		storage = make(map[common.Hash]map[common.Hash][]byte)
+		accA    = common.HexToHash("0xa1")
+		accB    = common.HexToHash("0xa2")
+		accC    = common.HexToHash("0xa3")
+	)
+	diskAcc := randomAccount()
+	rawdb.WriteAccountSnapshot(base.diskdb, accC, diskAcc)
+
+	bottom := newDiffLayer(base, common.Hash{0x01}, randomAccountSet("0xa1"), storage)
+	middle := bottom.Update(common.Hash{0x02}, randomAccountSet("0xa2"), storage)
+
+	copyBloom = func(*bloomfilter.Filter) (*bloomfilter.Filter, error) {
+		return nil, errors.New("copy failure")
+	}
+	top := middle.Update(common.Hash{0x03}, map[common.Hash][]byte{accA: nil}, storage)
+	if top.diffed == nil {
+		t.Fatalf("bloom missing after copy failure")
+	}
+	for _, hash := range []common.Hash{accA, accB} {
+		if !top.diffed.ContainsHash(accountBloomHash(hash)) {
+			t.Errorf("ancestor account %x missing from rebuilt bloom", hash)
+		}
+	}
+	for hash, want := range map[common.Hash][]byte{accA: nil, accB: middle.accountData[accB], accC: diskAcc} {
+		have, err := top.AccountRLP(hash)
+		if err != nil {
+			t.Fatalf("failed to retrieve account %x: %v", hash, err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("account %x mismatch: have %x, want %x", hash, have, want)
+		}
+	}
+}
+
+// Tests that reads served through a layer are counted per account hash prefix.
+func TestReadCountsByPrefix(t *testing.T) {
+	var (
+		accA = common.Hash{0x01, 0xaa}
+		accB = common.Hash{0x01, 0xbb}
+		accC = common.Hash{0xf0}
+		slot = common.Hash{0x02}
+	)
+	accounts := map[common.Hash][]byte{accA: randomAccount(), accB: randomAccount(), accC: randomAccount()}
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, accounts, make(map[common.Hash]map[common.Hash][]byte))
+
+	// Reads are not counted unless enabled
+	layer.Account(accA)
+	if have := layer.ReadCountsByPrefix(); have != ([256]uint64{}) {
+		t.Fatalf("reads counted while disabled")
+	}
+	defer func(enabled bool) { prefixReadCounting = enabled }(prefixReadCounting)
+	SetPrefixReadCounting(true)
+
+	layer.Account(accA)
+	layer.AccountRLP(accB)
+	layer.Account(accC)
+	layer.Storage(accC, slot)
+	layer.StorageBatch(accC, []common.Hash{slot, slot})
+	layer.Account(common.Hash{0x80}) // unknown accounts count too
+
+	want := map[byte]uint64{0x01: 2, 0x80: 1, 0xf0: 4}
+	for prefix, have := range layer.ReadCountsByPrefix() {
+		if have != want[byte(prefix)] {
+			t.Errorf("prefix %#x read count mismatch: have %d, want %d", prefix, have, want[byte(prefix)])
+		}
+	}
+}
+
+// Tests that layers are looked up by root from the queried layer down to the disk.
+func TestFindLayer(t *testing.T) {
+	base := emptyLayer()
+	base.root = common.Hash{0x01}
+
+	storage := make(map[common.Hash]map[common.Hash][]byte)
+	first := newDiffLayer(base, common.Hash{0x02}, randomAccountSet("0xa1"), storage)
+	second := first.Update(common.Hash{0x03}, randomAccountSet("0xa2"), storage)
+	third := second.Update(common.Hash{0x04}, randomAccountSet("0xa3"), storage)
+
+	for _, want := range []snapshot{base, first, second, third} {
+		if have := third.FindLayer(want.Root()); have != want {
+			t.Errorf("layer %x mismatch: have %v, want %v", want.Root(), have, want)
+		}
+	}
+	if have := third.FindLayer(common.Hash{0xff}); have != nil {
+		t.Errorf("unknown root resolved to layer %x", have.Root())
+	}
+	if have := first.FindLayer(third.Root()); have != nil {
+		t.Errorf("descendant root resolved to layer %x", have.Root())
+	}
+}
+
+// Tests that the key-value stream of a layer can be parsed back into the layer's
+// accounts and storage slots.
+func TestStreamKV(t *testing.T) {
+	accounts := randomAccountSet("0xa1", "0xa2")
+	accounts[common.HexToHash("0xa3")] = nil
+	storage := randomStorageSet([]string{"0xa1", "0xa3"}, [][]string{{"0x01", "0x02"}, nil}, [][]string{{"0x03"}, {"0x01"}})
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, accounts, storage)
+
+	var stream bytes.Buffer
+	if err := layer.StreamKV(&stream); err != nil {
+		t.Fatalf("failed to stream layer: %v", err)
+	}
+	// Parse back the stream and rebuild the layer content from it
+	keys, accData, slotData := decodeKVStream(t, stream.Bytes())
+	if !maps.EqualFunc(accData, accounts, bytes.Equal) {
+		t.Errorf("accounts mismatch: have %x, want %x", accData, accounts)
+	}
+	if !maps.EqualFunc(slotData, storage, func(a, b map[common.Hash][]byte) bool { return maps.EqualFunc(a, b, bytes.Equal) }) {
+		t.Errorf("storage mismatch: have %x, want %x", slotData, storage)
+	}
+	if !slices.IsSortedFunc(keys, bytes.Compare) {
+		t.Errorf("stream not sorted")
+	}
+}
+
+// Tests that the merged key-value stream of a chain of layers holds the topmost
+// deltas, reconstructing the state of the head from the one of the ancestor.
+func TestStreamChainKV(t *testing.T) {
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1", "0xa2", "0xa3"), randomStorageSet([]string{"0xa1"}, [][]string{{"0x01", "0x02", "0x05"}}, nil))
+
+	middleAccounts := randomAccountSet("0xa1", "0xa4")
+	middleAccounts[common.HexToHash("0xa2")] = nil
+	middle := bottom.Update(common.Hash{0x02}, middleAccounts, randomStorageSet([]string{"0xa1", "0xa4"}, [][]string{{"0x02", "0x03"}, {"0x01"}}, nil))
+
+	topAccounts := randomAccountSet("0xa1", "0xa2")
+	topAccounts[common.HexToHash("0xa4")] = nil
+	top := middle.Update(common.Hash{0x03}, topAccounts, randomStorageSet([]string{"0xa1", "0xa4"}, [][]string{{"0x03"}, nil}, [][]string{{"0x01"}, {"0x01"}}))
+
+	var stream bytes.Buffer
+	if err := top.StreamChainKV(&stream, bottom.root); err != nil {
+		t.Fatalf("failed to stream layers: %v", err)
+	}
+	keys, accData, slotData := decodeKVStream(t, stream.Bytes())
+	if !slices.IsSortedFunc(keys, bytes.Compare) {
+		t.Errorf("stream not sorted")
+	}
+	// Apply the deltas onto the ancestor's content and compare with the head
+	accounts := maps.Clone(bottom.accountData)
+	maps.Copy(accounts, accData)
+	for hash, want := range accounts {
+		have, err := top.AccountRLP(hash)
+		if err != nil {
+			t.Fatalf("failed to retrieve account %x: %v", hash, err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("account %x mismatch: have %x, want %x", hash, have, want)
+		}
+	}
+	storage := make(map[common.Hash]map[common.Hash][]byte)
+	for accountHash, slots := range bottom.storageData {
+		storage[accountHash] = maps.Clone(slots)
+	}
+	for accountHash, slots := range slotData {
+		if storage[accountHash] == nil {
+			storage[accountHash] = make(map[common.Hash][]byte)
+		}
+		maps.Copy(storage[accountHash], slots)
+	}
+	for accountHash, slots := range storage {
+		for storageHash, want := range slots {
+			have, err := top.Storage(accountHash, storageHash)
+			if err != nil {
+				t.Fatalf("failed to retrieve slot %x/%x: %v", accountHash, storageHash, err)
+			}
+			if !bytes.Equal(have, want) {
+				t.Errorf("slot %x/%x mismatch: have %x, want %x", accountHash, storageHash, have, want)
+			}
+		}
+	}
+	// The ancestor's own deltas must not be included
+	if _, ok := slotData[common.HexToHash("0xa1")][common.HexToHash("0x05")]; ok {
+		t.Errorf("ancestor slot streamed")
+	}
+	if _, ok := accData[common.HexToHash("0xa3")]; ok {
+		t.Errorf("ancestor account streamed")
+	}
+	// Streaming down to a layer not below the head should fail
+	if err := middle.StreamChainKV(io.Discard, top.root); err == nil {
+		t.Errorf("streamed down to a non-ancestor")
+	}
+}
+
+// Tests that applying a layer to a database writes its deltas and deletes the
+// tombstoned entries.
+func TestDiffLayerApplyTo(t *testing.T) {
+	var (
+		db      = rawdb.NewMemoryDatabase()
+		deleted = common.HexToHash("0xa3")
+		slot    = common.HexToHash("0x03")
+	)
+	// Populate the database with entries the layer deletes
+	rawdb.WriteAccountSnapshot(db, deleted, randomAccount())
+	rawdb.WriteStorageSnapshot(db, common.HexToHash("0xa1"), slot, []byte{0x01})
+
+	accounts := randomAccountSet("0xa1", "0xa2")
+	accounts[deleted] = nil
+	storage := randomStorageSet([]string{"0xa1"}, [][]string{{"0x01", "0x02"}}, [][]string{{"0x03"}})
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, accounts, storage)
+
+	if err := layer.ApplyTo(db); err != nil {
+		t.Fatalf("failed to apply layer: %v", err)
+	}
+	for hash, want := range accounts {
+		if have := rawdb.ReadAccountSnapshot(db, hash); !bytes.Equal(have, want) {
+			t.Errorf("account %x mismatch: have %x, want %x", hash, have, want)
+		}
+	}
+	for accountHash, slots := range storage {
+		for storageHash, want := range slots {
+			if have := rawdb.ReadStorageSnapshot(db, accountHash, storageHash); !bytes.Equal(have, want) {
+				t.Errorf("slot %x/%x mismatch: have %x, want %x", accountHash, storageHash, have, want)
+			}
+		}
+	}
+	if ok, _ := db.Has(slices.Concat(rawdb.SnapshotAccountPrefix, deleted.Bytes())); ok {
+		t.Errorf("deleted account still present")
+	}
+}
+
+// Tests that applying a sequence of layers bottom-up onto a rawdb database yields
+// the flat state of the topmost layer, as seen through a disk layer on top.
+func TestDiffLayerApplyToDiskLayer(t *testing.T) {
+	var (
+		db        = rawdb.NewMemoryDatabase()
+		dropped   = common.HexToHash("0xa3")
+		cleared   = common.HexToHash("0x02")
+		unchanged = common.HexToHash("0xa4")
+	)
+	// Start from a database with an account the layers never touch
+	rawdb.WriteAccountSnapshot(db, unchanged, randomAccount())
+
+	base := &diskLayer{diskdb: db, root: common.Hash{0x01}, cache: fastcache.New(500 * 1024)}
+	bottom := base.Update(common.Hash{0x02}, randomAccountSet("0xa1", "0xa2", "0xa3"), randomStorageSet([]string{"0xa1"}, [][]string{{"0x01", "0x02"}}, nil))
+
+	accounts := randomAccountSet("0xa2")
+	accounts[dropped] = nil
+	top := bottom.Update(common.Hash{0x03}, accounts, randomStorageSet([]string{"0xa1"}, [][]string{{"0x01"}}, [][]string{{"0x02"}}))
+
+	for _, layer := range []*diffLayer{bottom, top} {
+		if err := layer.ApplyTo(db); err != nil {
+			t.Fatalf("failed to apply layer %x: %v", layer.root, err)
+		}
+	}
+	disk := &diskLayer{diskdb: db, root: top.root, cache: fastcache.New(500 * 1024)}
+	for _, hash := range []common.Hash{common.HexToHash("0xa1"), common.HexToHash("0xa2"), dropped, unchanged} {
+		want, err := top.AccountRLP(hash)
+		if err != nil {
+			t.Fatalf("failed to read account %x from layer: %v", hash, err)
+		}
+		have, err := disk.AccountRLP(hash)
+		if err != nil {
+			t.Fatalf("failed to read account %x from disk: %v", hash, err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("account %x mismatch: have %x, want %x", hash, have, want)
+		}
+	}
+	for _, slot := range []common.Hash{common.HexToHash("0x01"), cleared} {
+		want, err := top.Storage(common.HexToHash("0xa1"), slot)
+		if err != nil {
+			t.Fatalf("failed to read slot %x from layer: %v", slot, err)
+		}
+		have, err := disk.Storage(common.HexToHash("0xa1"), slot)
+		if err != nil {
+			t.Fatalf("failed to read slot %x from disk: %v", slot, err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("slot %x mismatch: have %x, want %x", slot, have, want)
+		}
+	}
+	if have, _ := disk.Storage(common.HexToHash("0xa1"), cleared); len(have) != 0 {
+		t.Errorf("cleared slot still present: %x", have)
+	}
+}
+
+// Tests that the content hash of a diff layer only depends on its entries, not on
+// the map ordering or the layer root.
+func TestDiffLayerContentHash(t *testing.T) {
+	accounts := randomAccountSet("0xa1", "0xa2", "0xa3")
+	accounts[common.HexToHash("0xa4")] = nil
+	storage := randomStorageSet([]string{"0xa1", "0xa2"}, [][]string{{"0x01", "0x02", "0x03"}, {"0x01"}}, [][]string{{"0x04"}, nil})
+
+	// Clone the content into freshly built maps to randomize their ordering
+	accountsCopy := make(map[common.Hash][]byte)
+	for hash, blob := range accounts {
+		accountsCopy[hash] = blob
+	}
+	storageCopy := make(map[common.Hash]map[common.Hash][]byte)
+	for hash, slots := range storage {
+		storageCopy[hash] = make(map[common.Hash][]byte)
+		for key, val := range slots {
+			storageCopy[hash][key] = val
+		}
+	}
+	var (
+		a = newDiffLayer(emptyLayer(), common.Hash{0x01}, accounts, storage)
+		b = newDiffLayer(emptyLayer(), common.Hash{0x02}, accountsCopy, storageCopy)
+	)
+	hash := a.ContentHash()
+	if hash != b.ContentHash() {
+		t.Fatalf("identical layers hash mismatch: %x != %x", hash, b.ContentHash())
+	}
+	// Alter a single storage slot and ensure the hash changes
+	storageCopy[common.HexToHash("0xa2")][common.HexToHash("0x01")] = randomHash().Bytes()
+	c := newDiffLayer(emptyLayer(), common.Hash{0x02}, accountsCopy, storageCopy)
+	if hash == c.ContentHash() {
+		t.Fatalf("differing layers hash equally: %x", hash)
+	}
+	// Turn a deleted slot into a missing one and ensure the hash changes (the
+	// layer shares the maps, so the original layer is altered too)
+	delete(storage[common.HexToHash("0xa1")], common.HexToHash("0x04"))
+	if hash == a.ContentHash() {
+		t.Fatalf("deleted and missing slots hash equally: %x", hash)
+	}
+}
+
+// Tests that the storage tracking of multiple accounts is reported at once.
+func TestHasAnyStorage(t *testing.T) {
+	storage := randomStorageSet([]string{"0xa1", "0xa2"}, [][]string{{"0x01"}, nil}, [][]string{nil, {"0x01"}})
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1", "0xa2", "0xa3"), storage)
+
+	var (
+		accounts = []common.Hash{common.HexToHash("0xa1"), common.HexToHash("0xa2"), common.HexToHash("0xa3"), common.HexToHash("0xa4")}
+		want     = map[common.Hash]bool{accounts[0]: true, accounts[1]: true, accounts[2]: false, accounts[3]: false}
+	)
+	if have := layer.HasAnyStorage(accounts); !maps.Equal(have, want) {
+		t.Fatalf("storage tracking mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that only the accounts with storage entries are listed as having storage
+// changes, in sorted order.
+func TestAccountsWithStorageChanges(t *testing.T) {
+	storage := randomStorageSet([]string{"0xa3", "0xa1"}, [][]string{{"0x01"}, nil}, [][]string{nil, {"0x01"}})
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1", "0xa2", "0xa3"), storage)
+
+	want := []common.Hash{common.HexToHash("0xa1"), common.HexToHash("0xa3")}
+	if have := layer.AccountsWithStorageChanges(); !slices.Equal(have, want) {
+		t.Fatalf("storage changed accounts mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that deleted storage slots are counted as tombstones.
+func TestTombstonedSlotCount(t *testing.T) {
+	storage := randomStorageSet([]string{"0xa1", "0xa2"}, [][]string{{"0x01", "0x02"}, {"0x01"}}, [][]string{{"0x03", "0x04", "0x05"}, nil})
+	storage[common.HexToHash("0xa2")][common.HexToHash("0x02")] = []byte{}
+
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1", "0xa2"), storage)
+	for account, want := range map[string]int{"0xa1": 3, "0xa2": 1, "0xa3": 0} {
+		if have := layer.TombstonedSlotCount(common.HexToHash(account)); have != want {
+			t.Errorf("account %s tombstone count mismatch: have %d, want %d", account, have, want)
+		}
+	}
+}
+
+// Tests that storage values are bucketed into the right size classes.
+func TestStorageValueSizeHistogram(t *testing.T) {
+	storage := map[common.Hash]map[common.Hash][]byte{
+		common.HexToHash("0xa1"): {
+			common.HexToHash("0x01"): nil,
+			common.HexToHash("0x02"): make([]byte, 1),
+			common.HexToHash("0x03"): make([]byte, 32),
+		},
+		common.HexToHash("0xa2"): {
+			common.HexToHash("0x01"): make([]byte, 33),
+			common.HexToHash("0x02"): make([]byte, 100),
+			common.HexToHash("0x03"): []byte{},
+		},
+	}
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1", "0xa2"), storage)
+
+	want := map[int]int{0: 2, 32: 2, 64: 1, 128: 1}
+	if have := layer.StorageValueSizeHistogram(); !maps.Equal(have, want) {
+		t.Fatalf("histogram mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that only the deleted storage slots of an account are listed, sorted.
+func TestDeletedStorageList(t *testing.T) {
+	storage := randomStorageSet([]string{"0xa1", "0xa2"}, [][]string{{"0x01", "0x02"}, {"0x01"}}, [][]string{{"0x05", "0x03", "0x04"}, nil})
+	storage[common.HexToHash("0xa2")][common.HexToHash("0x02")] = []byte{}
+
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1", "0xa2"), storage)
+	for account, want := range map[string][]common.Hash{
+		"0xa1": {common.HexToHash("0x03"), common.HexToHash("0x04"), common.HexToHash("0x05")},
+		"0xa2": {common.HexToHash("0x02")},
+		"0xa3": nil,
+	} {
+		if have := layer.DeletedStorageList(common.HexToHash(account)); !slices.Equal(have, want) {
+			t.Errorf("account %s deleted slots mismatch: have %x, want %x", account, have, want)
+		}
+	}
+}
+
+// Tests that storage ranges are resolved across the layers, with the child
+// values shadowing the parent ones.
+func TestStorageRange(t *testing.T) {
+	parentStorage := randomStorageSet([]string{"0xa1", "0xa2"}, [][]string{{"0x01", "0x02", "0x03"}, {"0x01", "0x02"}}, nil)
+	parent := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1", "0xa2"), parentStorage)
+
+	childStorage := randomStorageSet([]string{"0xa1"}, [][]string{{"0x02", "0x04"}}, [][]string{{"0x03"}})
+	child := parent.Update(common.Hash{0x02}, randomAccountSet("0xa1"), childStorage)
+
+	var (
+		a1 = common.HexToHash("0xa1")
+		a2 = common.HexToHash("0xa2")
+	)
+	for i, tt := range []struct {
+		account     common.Hash
+		start       common.Hash
+		limit       int
+		skipDeleted bool
+		want        []string
+		values      []map[common.Hash][]byte
+	}{
+		{a1, common.Hash{}, 10, false, []string{"0x01", "0x02", "0x03", "0x04"}, []map[common.Hash][]byte{parentStorage[a1], childStorage[a1], childStorage[a1], childStorage[a1]}},
+		{a1, common.Hash{}, 10, true, []string{"0x01", "0x02", "0x04"}, []map[common.Hash][]byte{parentStorage[a1], childStorage[a1], childStorage[a1]}},
+		{a1, common.HexToHash("0x02"), 2, true, []string{"0x02", "0x04"}, []map[common.Hash][]byte{childStorage[a1], childStorage[a1]}},
+		{a1, common.HexToHash("0x05"), 10, false, nil, nil},
+		{a2, common.HexToHash("0x02"), 10, false, []string{"0x02"}, []map[common.Hash][]byte{parentStorage[a2]}},
+	} {
+		hashes, slots, err := child.StorageRange(tt.account, tt.start, tt.limit, tt.skipDeleted)
+		if err != nil {
+			t.Fatalf("test %d: failed to retrieve range: %v", i, err)
+		}
+		if len(hashes) != len(tt.want) || len(slots) != len(tt.want) {
+			t.Fatalf("test %d: range length mismatch: have %d/%d, want %d", i, len(hashes), len(slots), len(tt.want))
+		}
+		for j, want := range tt.want {
+			hash := common.HexToHash(want)
+			if hashes[j] != hash {
+				t.Errorf("test %d, slot %d: hash mismatch: have %x, want %x", i, j, hashes[j], hash)
+			}
+			if !bytes.Equal(slots[j], tt.values[j][hash]) {
+				t.Errorf("test %d, slot %d: value mismatch: have %x, want %x", i, j, slots[j], tt.values[j][hash])
+			}
+		}
+	}
+	// Ranges over a flattened layer should be rejected
+	parent.stale.Store(true)
+
+	if _, _, err := child.StorageRange(a1, common.Hash{}, 10, false); !errors.Is(err, ErrSnapshotStale) {
+		t.Errorf("stale range error mismatch: have %v, want %v", err, ErrSnapshotStale)
+	}
+}
+
+// Tests that the account differences between two sibling layers are classified
+// correctly, including accounts deleted on either side.
+func TestDiffAccounts(t *testing.T) {
+	var (
+		storage = make(map[common.Hash]map[common.Hash][]byte)
+		shared  = randomAccount()
+		parent  = newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1"), storage)
+	)
+	a := parent.Update(common.Hash{0x02}, map[common.Hash][]byte{
+		common.HexToHash("0xa1"): shared,          // Identical in both
+		common.HexToHash("0xa2"): randomAccount(), // Changed in b
+		common.HexToHash("0xa3"): randomAccount(), // Deleted in b
+		common.HexToHash("0xa4"): randomAccount(), // Missing from b
+		common.HexToHash("0xa5"): nil,             // Recreated in b
+		common.HexToHash("0xa6"): nil,             // Deleted in both
+	}, storage)
+	b := parent.Update(common.Hash{0x03}, map[common.Hash][]byte{
+		common.HexToHash("0xa1"): shared,
+		common.HexToHash("0xa2"): randomAccount(),
+		common.HexToHash("0xa3"): nil,
+		common.HexToHash("0xa5"): randomAccount(),
+		common.HexToHash("0xa6"): nil,
+		common.HexToHash("0xa7"): randomAccount(), // Missing from a
+	}, storage)
+
+	added, changed, removed := DiffAccounts(a, b)
+	if want := []common.Hash{common.HexToHash("0xa5"), common.HexToHash("0xa7")}; !slices.Equal(added, want) {
+		t.Errorf("added accounts mismatch: have %x, want %x", added, want)
+	}
+	if want := []common.Hash{common.HexToHash("0xa2")}; !slices.Equal(changed, want) {
+		t.Errorf("changed accounts mismatch: have %x, want %x", changed, want)
+	}
+	if want := []common.Hash{common.HexToHash("0xa3"), common.HexToHash("0xa4")}; !slices.Equal(removed, want) {
+		t.Errorf("removed accounts mismatch: have %x, want %x", removed, want)
+	}
+	// The comparison should be symmetric
+	added, changed, removed = DiffAccounts(b, a)
+	if want := []common.Hash{common.HexToHash("0xa3"), common.HexToHash("0xa4")}; !slices.Equal(added, want) {
+		t.Errorf("reverse added accounts mismatch: have %x, want %x", added, want)
+	}
+	if want := []common.Hash{common.HexToHash("0xa2")}; !slices.Equal(changed, want) {
+		t.Errorf("reverse changed accounts mismatch: have %x, want %x", changed, want)
+	}
+	if want := []common.Hash{common.HexToHash("0xa5"), common.HexToHash("0xa7")}; !slices.Equal(removed, want) {
+		t.Errorf("reverse removed accounts mismatch: have %x, want %x", removed, want)
+	}
+	if added, changed, removed := DiffAccounts(a, a); len(added)+len(changed)+len(removed) != 0 {
+		t.Errorf("self comparison reported differences: added %x, changed %x, removed %x", added, changed, removed)
+	}
+}
+
+// Tests that a single layer's journal entry round-trips through the journal loader.
+func TestJournalBytes(t *testing.T) {
+	base := emptyLayer()
+	base.root = common.Hash{0x01}
+
+	accounts := randomAccountSet("0xa1", "0xa2")
+	accounts[common.HexToHash("0xa3")] = nil
+	storage := randomStorageSet([]string{"0xa1"}, [][]string{{"0x01", "0x02"}}, [][]string{{"0x03"}})
+	layer := newDiffLayer(base, common.Hash{0x02}, accounts, storage)
+
+	entry, err := layer.JournalBytes()
+	if err != nil {
+		t.Fatalf("failed to journal layer: %v", err)
+	}
+	journal := new(bytes.Buffer)
+	rlp.Encode(journal, journalCurrentVersion)
+	rlp.Encode(journal, base.root)
+	journal.Write(entry)
+
+	rawdb.WriteSnapshotRoot(base.diskdb, base.root)
+	rawdb.WriteSnapshotJournal(base.diskdb, journal.Bytes())
+
+	var layers int
+	err = iterateJournal(base.diskdb, func(parent common.Hash, root common.Hash, accountData map[common.Hash][]byte, storageData map[common.Hash]map[common.Hash][]byte) error {
+		layers++
+		if parent != base.root || root != layer.root {
+			t.Errorf("layer roots mismatch: have %x->%x, want %x->%x", parent, root, base.root, layer.root)
+		}
+		if !maps.EqualFunc(accountData, accounts, bytes.Equal) {
+			t.Errorf("accounts mismatch: have %x, want %x", accountData, accounts)
+		}
+		if !maps.EqualFunc(storageData, storage, func(a, b map[common.Hash][]byte) bool { return maps.EqualFunc(a, b, bytes.Equal) }) {
+			t.Errorf("storage mismatch: have %x, want %x", storageData, storage)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to load journal: %v", err)
+	}
+	if layers != 1 {
+		t.Fatalf("loaded layer count mismatch: have %d, want 1", layers)
+	}
+}
+
+// Tests that a read descending through the diff layers bails out with a stale
+// error if a flatten concurrently invalidates one of the layers below it.
+func TestAccountRLPStaleMidWalk(t *testing.T) {
+	var (
+		acc     = common.HexToHash("0xa1")
+		storage = make(map[common.Hash]map[common.Hash][]byte)
+	)
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1"), storage)
+	middle := bottom.Update(common.Hash{0x02}, randomAccountSet("0xa2"), storage)
+	top := middle.Update(common.Hash{0x03}, randomAccountSet("0xa3"), storage)
+
+	// Hold up the walk at the middle layer while it's being flattened into the
+	// bottom one, invalidating the latter.
+	middle.lock.Lock()
+
+	count := snapshotStaleMidWalkCounter.Snapshot().Count()
+	result := make(chan error, 1)
+	go func() {
+		data, err := top.AccountRLPNoBloom(acc)
+		if err == nil {
+			err = fmt.Errorf("unexpected data %x", data)
+		}
+		result <- err
+	}()
+	if _, err := middle.flatten(); err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	middle.lock.Unlock()
+
+	if err := <-result; !errors.Is(err, ErrSnapshotStale) {
+		t.Fatalf("read error mismatch: have %v, want %v", err, ErrSnapshotStale)
+	}
+	if have := snapshotStaleMidWalkCounter.Snapshot().Count() - count; have != 1 {
+		t.Fatalf("mid-walk staleness counter mismatch: have %d, want 1", have)
+	}
+}
+
+// Tests that a batched storage read descending through the diff layers bails
+// out with a stale error if a flatten concurrently invalidates one of the layers
+// below it.
+func TestStorageBatchStaleMidWalk(t *testing.T) {
+	var (
+		acc  = common.HexToHash("0xa1")
+		slot = common.HexToHash("0x01")
+	)
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1"), randomStorageSet([]string{"0xa1"}, [][]string{{"0x01"}}, nil))
+	middle := bottom.Update(common.Hash{0x02}, randomAccountSet("0xa2"), make(map[common.Hash]map[common.Hash][]byte))
+	top := middle.Update(common.Hash{0x03}, randomAccountSet("0xa3"), make(map[common.Hash]map[common.Hash][]byte))
+
+	// Hold up the walk at the middle layer while it's being flattened into the
+	// bottom one, invalidating the latter.
+	middle.lock.Lock()
+
+	count := snapshotStaleMidWalkCounter.Snapshot().Count()
+	result := make(chan error, 1)
+	go func() {
+		_, errs := top.StorageBatch(acc, []common.Hash{slot})
+		result <- errs[0]
+	}()
+	if _, err := middle.flatten(); err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	middle.lock.Unlock()
+
+	err := <-result
+	var stale *StaleLayerError
+	if !errors.As(err, &stale) {
+		t.Fatalf("read error mismatch: have %v, want %T", err, stale)
+	}
+	if stale.Root != bottom.root {
+		t.Fatalf("stale root mismatch: have %#x, want %#x", stale.Root, bottom.root)
+	}
+	if have := snapshotStaleMidWalkCounter.Snapshot().Count() - count; have != 1 {
+		t.Fatalf("mid-walk staleness counter mismatch: have %d, want 1", have)
+	}
+}
+
+// Tests that account reads running into a layer invalidated by a concurrent
+// flattening succeed once the flattened layer is linked in, if retried.
+func TestAccountRLPRetryStale(t *testing.T) {
+	var (
+		acc     = common.HexToHash("0xa1")
+		storage = make(map[common.Hash]map[common.Hash][]byte)
+		want    = randomAccountSet("0xa1")
+	)
+	bottom := newDiffLayer(emptyLayer(), common.Hash{0x01}, want, storage)
+	middle := bottom.Update(common.Hash{0x02}, randomAccountSet("0xa2"), storage)
+	top := middle.Update(common.Hash{0x03}, randomAccountSet("0xa3"), storage)
+
+	// Flatten the middle layer into the bottom one, but don't link the result
+	// into the top layer yet, leaving it reading through a stale layer
+	flattened, err := middle.flatten()
+	if err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	if _, err := top.AccountRLPRetryStale(acc, 0); !errors.Is(err, ErrSnapshotStale) {
+		t.Fatalf("read error mismatch without retries: have %v, want %v", err, ErrSnapshotStale)
+	}
+	result := make(chan error, 1)
+	go func() {
+		data, err := top.AccountRLPRetryStale(acc, 100)
+		if err == nil && !bytes.Equal(data, want[acc]) {
+			err = fmt.Errorf("account data mismatch: have %x, want %x", data, want[acc])
+		}
+		result <- err
+	}()
+	time.Sleep(5 * staleRetryDelay)
+
+	top.lock.Lock()
+	top.parent = flattened
+	top.lock.Unlock()
+
+	if err := <-result; err != nil {
+		t.Fatalf("failed to read account with retries: %v", err)
+	}
+}
+
+// Tests that raw local account reads only return entries tracked by the layer
+// itself, not the ones inherited from its parents.
+func TestRawLocalAccount(t *testing.T) {
+	var (
+		storage = make(map[common.Hash]map[common.Hash][]byte)
+		parent  = newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1"), storage)
+		local   = randomAccountSet("0xa2")
+	)
+	local[common.HexToHash("0xa3")] = nil
+	child := parent.Update(common.Hash{0x02}, local, storage)
+
+	if data, ok := child.RawLocalAccount(common.HexToHash("0xa2")); !ok || !bytes.Equal(data, local[common.HexToHash("0xa2")]) {
+		t.Fatalf("local account mismatch: have %x (found %v), want %x", data, ok, local[common.HexToHash("0xa2")])
+	}
+	if data, ok := child.RawLocalAccount(common.HexToHash("0xa3")); !ok || len(data) != 0 {
+		t.Fatalf("local deletion mismatch: have %x (found %v), want empty", data, ok)
+	}
+	if _, ok := child.RawLocalAccount(common.HexToHash("0xa1")); ok {
+		t.Fatalf("parent account reported as local")
+	}
+	if _, ok := child.RawLocalAccount(common.HexToHash("0xa4")); ok {
+		t.Fatalf("unknown account reported as local")
+	}
+}
+
+// decodeKVStream parses a key-value stream of a layer back into its keys in
+// stream order and the accounts and storage slots they hold.
+func decodeKVStream(t *testing.T, stream []byte) ([][]byte, map[common.Hash][]byte, map[common.Hash]map[common.Hash][]byte) {
+	t.Helper()
+
+	var (
+		reader   = bytes.NewReader(stream)
+		keys     [][]byte
+		accData  = make(map[common.Hash][]byte)
+		slotData = make(map[common.Hash]map[common.Hash][]byte)
+	)
+	readItem := func() ([]byte, error) {
+		size, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		item := make([]byte, size)
+		_, err = io.ReadFull(reader, item)
+		return item, err
+	}
+	for reader.Len() > 0 {
+		key, err := readItem()
+		if err != nil {
+			t.Fatalf("failed to read key: %v", err)
+		}
+		value, err := readItem()
+		if err != nil {
+			t.Fatalf("failed to read value: %v", err)
+		}
+		if len(value) == 0 {
+			value = nil
+		}
+		keys = append(keys, key)
+
+		switch {
+		case bytes.HasPrefix(key, rawdb.SnapshotAccountPrefix) && len(key) == len(rawdb.SnapshotAccountPrefix)+common.HashLength:
+			accData[common.BytesToHash(key[len(rawdb.SnapshotAccountPrefix):])] = value
+		case bytes.HasPrefix(key, rawdb.SnapshotStoragePrefix) && len(key) == len(rawdb.SnapshotStoragePrefix)+2*common.HashLength:
+			key = key[len(rawdb.SnapshotStoragePrefix):]
+			accountHash := common.BytesToHash(key[:common.HashLength])
+			if slotData[accountHash] == nil {
+				slotData[accountHash] = make(map[common.Hash][]byte)
+			}
+			slotData[accountHash][common.BytesToHash(key[common.HashLength:])] = value
+		default:
+			t.Fatalf("unexpected key %x", key)
+		}
+	}
+	return keys, accData, slotData
+}
@@ -114,7 +114,7 @@ func (dl *diskLayer) AccountRLP(hash common.Hash) ([]byte, error) {
 	// If the layer was flattened into, consider it invalid (any live reference to
 	// the original should be marked as unusable).
 	if dl.stale {
-		return nil, ErrSnapshotStale
+		return nil, &StaleLayerError{Root: dl.root}
 	}
 	// If the layer is being generated, ensure the requested hash has already been
 	// covered by the generator.
@@ -152,7 +152,7 @@ func (dl *diskLayer) Storage(accountHash, storageHash common.Hash) ([]byte, erro
 	// If the layer was flattened into, consider it invalid (any live reference to
 	// the original should be marked as unusable).
 	if dl.stale {
-		return nil, ErrSnapshotStale
+		return nil, &StaleLayerError{Root: dl.root}
 	}
 	key := append(accountHash[:], storageHash[:]...)
 
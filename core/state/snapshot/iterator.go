@@ -82,7 +82,11 @@ type diffAccountIterator struct {
 	fail  error         // Any failures encountered (stale)
 }
 
-// AccountIterator creates an account iterator over a single diff layer.
+// AccountIterator creates an account iterator over a single diff layer, starting
+// at the given seek position. The iterator walks the layer's cached sorted list
+// of account hashes and only retrieves the account blobs on access, so it never
+// materializes the layer's content. Iteration fails with ErrSnapshotStale if the
+// layer is flattened midway; a new iterator can resume from the last position.
 func (dl *diffLayer) AccountIterator(seek common.Hash) AccountIterator {
 	// Seek out the requested starting account
 	hashes := dl.AccountList()
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	crand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
 	"testing"
@@ -553,6 +554,35 @@ func TestAccountIteratorLargeTraversal(t *testing.T) {
 // - have a live iterator on child C (parent C1 -> C2 .. CN)
 // - flattens C2 all the way into CN
 // - continues iterating
+// Tests that a single diff layer account iterator can be resumed from a seek
+// position and that it fails if the layer is flattened midway.
+func TestDiffAccountIteratorStale(t *testing.T) {
+	var (
+		storage = make(map[common.Hash]map[common.Hash][]byte)
+		parent  = newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xaa", "0xbb", "0xcc", "0xdd"), storage)
+		child   = parent.Update(common.Hash{0x02}, randomAccountSet("0xee"), storage)
+	)
+	it := parent.AccountIterator(common.HexToHash("0xbb"))
+	defer it.Release()
+
+	if !it.Next() || it.Hash() != common.HexToHash("0xbb") {
+		t.Fatalf("seeked iterator position mismatch: have %x, want %x", it.Hash(), common.HexToHash("0xbb"))
+	}
+	if !bytes.Equal(it.Account(), parent.accountData[common.HexToHash("0xbb")]) {
+		t.Fatalf("account data mismatch at %x", it.Hash())
+	}
+	// Flatten the layer from underneath the iterator and ensure it bails out
+	if _, err := child.flatten(); err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	if it.Next() {
+		t.Fatalf("stale iterator stepped forward to %x", it.Hash())
+	}
+	if err := it.Error(); !errors.Is(err, ErrSnapshotStale) {
+		t.Fatalf("iterator error mismatch: have %v, want %v", err, ErrSnapshotStale)
+	}
+}
+
 func TestAccountIteratorFlattening(t *testing.T) {
 	t.Run("fast", func(t *testing.T) {
 		testAccountIteratorFlattening(t, func(snaps *Tree, root, seek common.Hash) AccountIterator {
@@ -254,17 +254,36 @@ func (dl *diffLayer) Journal(buffer *bytes.Buffer) (common.Hash, error) {
 	if err != nil {
 		return common.Hash{}, err
 	}
+	// Everything below was journalled, persist this layer too
+	if err := dl.journal(buffer); err != nil {
+		return common.Hash{}, err
+	}
+	log.Debug("Journalled diff layer", "root", dl.root, "parent", dl.parent.Root())
+	return base, nil
+}
+
+// JournalBytes returns the journal entry of this single layer, in the exact
+// format the snapshot journal loader expects for each diff layer following the
+// journal version and disk layer root. The parent layers are not included.
+func (dl *diffLayer) JournalBytes() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	if err := dl.journal(buffer); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// journal writes the journal entry of this single layer into the buffer.
+func (dl *diffLayer) journal(buffer *bytes.Buffer) error {
 	// Ensure the layer didn't get stale
 	dl.lock.RLock()
 	defer dl.lock.RUnlock()
 
 	if dl.Stale() {
-		return common.Hash{}, ErrSnapshotStale
+		return ErrSnapshotStale
 	}
-
-	// Everything below was journalled, persist this layer too
 	if err := rlp.Encode(buffer, dl.root); err != nil {
-		return common.Hash{}, err
+		return err
 	}
 	accounts := make([]journalAccount, 0, len(dl.accountData))
 	for hash, blob := range dl.accountData {
@@ -274,7 +293,7 @@ func (dl *diffLayer) Journal(buffer *bytes.Buffer) (common.Hash, error) {
 		})
 	}
 	if err := rlp.Encode(buffer, accounts); err != nil {
-		return common.Hash{}, err
+		return err
 	}
 	storage := make([]journalStorage, 0, len(dl.storageData))
 	for hash, slots := range dl.storageData {
@@ -286,11 +305,7 @@ func (dl *diffLayer) Journal(buffer *bytes.Buffer) (common.Hash, error) {
 		}
 		storage = append(storage, journalStorage{Hash: hash, Keys: keys, Vals: vals})
 	}
-	if err := rlp.Encode(buffer, storage); err != nil {
-		return common.Hash{}, err
-	}
-	log.Debug("Journalled diff layer", "root", dl.root, "parent", dl.parent.Root())
-	return base, nil
+	return rlp.Encode(buffer, storage)
 }
 
 // journalCallback is a function which is invoked by iterateJournal, every
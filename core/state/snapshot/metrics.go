@@ -51,3 +51,9 @@ var (
 	// snapStorageCleanCounter measures time spent on deleting storages
 	snapStorageCleanCounter = metrics.NewRegisteredCounter("state/snapshot/generation/duration/storage/clean", nil)
 )
+
+// Metrics of reads tagged by their origin
+var (
+	snapEVNAccountReadMeter = metrics.NewRegisteredMeter("state/snapshot/origin/evn/account/read", nil)
+	snapEVNStorageReadMeter = metrics.NewRegisteredMeter("state/snapshot/origin/evn/storage/read", nil)
+)
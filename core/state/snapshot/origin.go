@@ -0,0 +1,69 @@
+// Copyright 2025 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ReadOrigin tags snapshot reads with the kind of request that triggered them,
+// so the read load can be accounted for separately.
+type ReadOrigin uint8
+
+const (
+	// OriginUntagged is the default origin for reads not attributed to anything.
+	OriginUntagged ReadOrigin = iota
+
+	// OriginEVN marks reads serving requests of EVN (validator) peers.
+	OriginEVN
+)
+
+// WithOrigin wraps a snapshot so that all reads through it are accounted to the
+// given origin. Untagged reads are left as is, without any wrapping overhead.
+func WithOrigin(snap Snapshot, origin ReadOrigin) Snapshot {
+	if origin != OriginEVN {
+		return snap
+	}
+	return &evnSnapshot{Snapshot: snap}
+}
+
+// evnSnapshot is a snapshot wrapper accounting reads to EVN peer requests.
+type evnSnapshot struct {
+	Snapshot
+}
+
+// Account directly retrieves the account associated with a particular hash in
+// the snapshot slim data format.
+func (s *evnSnapshot) Account(hash common.Hash) (*types.SlimAccount, error) {
+	snapEVNAccountReadMeter.Mark(1)
+	return s.Snapshot.Account(hash)
+}
+
+// AccountRLP directly retrieves the account RLP associated with a particular
+// hash in the snapshot slim data format.
+func (s *evnSnapshot) AccountRLP(hash common.Hash) ([]byte, error) {
+	snapEVNAccountReadMeter.Mark(1)
+	return s.Snapshot.AccountRLP(hash)
+}
+
+// Storage directly retrieves the storage data associated with a particular hash,
+// within a particular account.
+func (s *evnSnapshot) Storage(accountHash, storageHash common.Hash) ([]byte, error) {
+	snapEVNStorageReadMeter.Mark(1)
+	return s.Snapshot.Storage(accountHash, storageHash)
+}
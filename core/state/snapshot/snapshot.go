@@ -51,12 +51,18 @@ var (
 	snapshotDirtyAccountInexMeter  = metrics.NewRegisteredMeter("state/snapshot/dirty/account/inex", nil)
 	snapshotDirtyAccountReadMeter  = metrics.NewRegisteredMeter("state/snapshot/dirty/account/read", nil)
 	snapshotDirtyAccountWriteMeter = metrics.NewRegisteredMeter("state/snapshot/dirty/account/write", nil)
+	snapshotDirtyAccountNoopMeter  = metrics.NewRegisteredMeter("state/snapshot/dirty/account/noop", nil)
 
 	snapshotDirtyStorageHitMeter   = metrics.NewRegisteredMeter("state/snapshot/dirty/storage/hit", nil)
 	snapshotDirtyStorageMissMeter  = metrics.NewRegisteredMeter("state/snapshot/dirty/storage/miss", nil)
 	snapshotDirtyStorageInexMeter  = metrics.NewRegisteredMeter("state/snapshot/dirty/storage/inex", nil)
 	snapshotDirtyStorageReadMeter  = metrics.NewRegisteredMeter("state/snapshot/dirty/storage/read", nil)
 	snapshotDirtyStorageWriteMeter = metrics.NewRegisteredMeter("state/snapshot/dirty/storage/write", nil)
+	snapshotDirtyStorageNoopMeter  = metrics.NewRegisteredMeter("state/snapshot/dirty/storage/noop", nil)
+
+	// Gauges of the entries currently buffered across all the diff layers
+	snapshotDirtyAccountGauge = metrics.NewRegisteredGauge("state/snapshot/dirty/account/count", nil)
+	snapshotDirtyStorageGauge = metrics.NewRegisteredGauge("state/snapshot/dirty/storage/count", nil)
 
 	snapshotDirtyAccountHitDepthHist = metrics.NewRegisteredHistogram("state/snapshot/dirty/account/hit/depth", nil, metrics.NewExpDecaySample(1028, 0.015))
 
@@ -65,6 +71,18 @@ var (
 	snapshotFlushStorageItemMeter = metrics.NewRegisteredMeter("state/snapshot/flush/storage/item", nil)
 	snapshotFlushStorageSizeMeter = metrics.NewRegisteredMeter("state/snapshot/flush/storage/size", nil)
 
+	snapshotFlattenTimer     = metrics.NewRegisteredResettingTimer("state/snapshot/flatten/time", nil)
+	snapshotFlattenItemMeter = metrics.NewRegisteredMeter("state/snapshot/flatten/item", nil)
+
+	snapshotFlattenConflictMeter = metrics.NewRegisteredMeter("state/snapshot/flatten/conflict", nil)
+
+	snapshotStaleMidWalkCounter = metrics.NewRegisteredCounter("state/snapshot/stale/midwalk", nil)
+
+	snapshotPinActiveGauge   = metrics.NewRegisteredGauge("state/snapshot/pin/active", nil)
+	snapshotPinHoldTimer     = metrics.NewRegisteredResettingTimer("state/snapshot/pin/hold", nil)
+	snapshotPinLongHeldMeter = metrics.NewRegisteredMeter("state/snapshot/pin/longheld", nil)
+	snapshotPinDeferMeter    = metrics.NewRegisteredMeter("state/snapshot/pin/defer", nil)
+
 	snapshotBloomIndexTimer = metrics.NewRegisteredResettingTimer("state/snapshot/bloom/index", nil)
 	snapshotBloomErrorGauge = metrics.NewRegisteredGaugeFloat64("state/snapshot/bloom/error", nil)
 
@@ -76,11 +94,17 @@ var (
 	snapshotBloomStorageFalseHitMeter = metrics.NewRegisteredMeter("state/snapshot/bloom/storage/falsehit", nil)
 	snapshotBloomStorageMissMeter     = metrics.NewRegisteredMeter("state/snapshot/bloom/storage/miss", nil)
 
+	snapshotBloomFalseNegativeCounter = metrics.NewRegisteredCounter("state/snapshot/bloom/falsenegative", nil)
+
 	// ErrSnapshotStale is returned from data accessors if the underlying snapshot
 	// layer had been invalidated due to the chain progressing forward far enough
 	// to not maintain the layer's original state.
 	ErrSnapshotStale = errors.New("snapshot stale")
 
+	// ErrAccountNotFound is returned from account field accessors if the account
+	// doesn't exist in the snapshot, or was deleted.
+	ErrAccountNotFound = errors.New("account not found")
+
 	// ErrNotCoveredYet is returned from data accessors if the underlying snapshot
 	// is being generated currently and the requested data item is not yet in the
 	// range of accounts covered.
@@ -93,8 +117,33 @@ var (
 	// errSnapshotCycle is returned if a snapshot is attempted to be inserted
 	// that forms a cycle in the snapshot tree.
 	errSnapshotCycle = errors.New("snapshot cycle")
+
+	// errSnapshotPinned is returned if the snapshot tree is attempted to be fully
+	// flattened while some of its layers are pinned.
+	errSnapshotPinned = errors.New("snapshot layers pinned")
+
+	// errFlattenConflict is returned if a diff layer is attempted to be flattened
+	// into a parent which was already flattened into by another child.
+	errFlattenConflict = errors.New("parent diff layer is stale")
 )
 
+// StaleLayerError is returned from data accessors if a layer consulted by the read
+// had been invalidated, carrying the root of that layer. It wraps ErrSnapshotStale,
+// so checking for it via errors.Is keeps working.
+type StaleLayerError struct {
+	Root common.Hash // Root of the layer found stale
+}
+
+// Error implements the error interface.
+func (e *StaleLayerError) Error() string {
+	return fmt.Sprintf("%v: layer %#x", ErrSnapshotStale, e.Root)
+}
+
+// Unwrap returns ErrSnapshotStale, the sentinel the error is a specialization of.
+func (e *StaleLayerError) Unwrap() error {
+	return ErrSnapshotStale
+}
+
 // Snapshot represents the functionality supported by a snapshot storage layer.
 type Snapshot interface {
 	// Root returns the root hash for which this snapshot was made.
@@ -274,7 +323,9 @@ func (t *Tree) Disable() {
 		case *diffLayer:
 			// If the layer is a simple diff, simply mark as stale
 			layer.lock.Lock()
-			layer.stale.Store(true)
+			if !layer.stale.Swap(true) && !layer.merged.Load() {
+				layer.untrackDirty()
+			}
 			layer.lock.Unlock()
 
 		default:
@@ -407,15 +458,38 @@ func (t *Tree) Cap(root common.Hash, layers int) error {
 	// child for the capping and then remove it.
 	if layers == 0 {
 		// If full commit was requested, flatten the diffs and merge onto disk
-		diff.lock.RLock()
-		base := diffToDisk(diff.flatten().(*diffLayer))
-		diff.lock.RUnlock()
-
+		flattened, err := diff.flatten()
+		if err != nil {
+			return err
+		}
+		bottom := flattened.(*diffLayer)
+
+		// The flattening checked the pins of all the merged layers, but a lone
+		// bottom-most diff is returned as is and needs the check on its own
+		bottom.pinLock.Lock()
+		if bottom.pins.Load() > 0 {
+			bottom.pinLock.Unlock()
+			return errSnapshotPinned
+		}
+		bottom.lock.RLock()
+		base := diffToDisk(bottom)
+		bottom.lock.RUnlock()
+		bottom.pinLock.Unlock()
+
+		// Any layer not merged into the base is a dropped fork
+		for root, snap := range t.layers {
+			if layer, ok := snap.(*diffLayer); ok && root != base.root && !layer.Stale() && !layer.merged.Load() {
+				layer.untrackDirty()
+			}
+		}
 		// Replace the entire snapshot tree with the flat base
 		t.layers = map[common.Hash]snapshot{base.root: base}
 		return nil
 	}
-	persisted := t.cap(diff, layers)
+	persisted, err := t.cap(diff, layers)
+	if err != nil {
+		return err
+	}
 
 	// Remove any layer that is stale or links into a stale layer
 	children := make(map[common.Hash][]common.Hash)
@@ -427,6 +501,10 @@ func (t *Tree) Cap(root common.Hash, layers int) error {
 	}
 	var remove func(root common.Hash)
 	remove = func(root common.Hash) {
+		// Layers dropped without being stale or merged are forks never merged anywhere
+		if diff, ok := t.layers[root].(*diffLayer); ok && !diff.Stale() && !diff.merged.Load() {
+			diff.untrackDirty()
+		}
 		delete(t.layers, root)
 		for _, child := range children[root] {
 			remove(child)
@@ -459,14 +537,15 @@ func (t *Tree) Cap(root common.Hash, layers int) error {
 // crossed. All diffs beyond the permitted number are flattened downwards. If the
 // layer limit is reached, memory cap is also enforced (but not before).
 //
-// The method returns the new disk layer if diffs were persisted into it.
+// The method returns the new disk layer if diffs were persisted into it, or an
+// error if the flattening ran into a conflict.
 //
 // Note, the final diff layer count in general will be one more than the amount
 // requested. This happens because the bottom-most diff layer is the accumulator
 // which may or may not overflow and cascade to disk. Since this last layer's
 // survival is only known *after* capping, we need to omit it from the count if
 // we want to ensure that *at least* the requested number of diff layers remain.
-func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
+func (t *Tree) cap(diff *diffLayer, layers int) (*diskLayer, error) {
 	// Dive until we run out of layers or reach the persistent database
 	for i := 0; i < layers-1; i++ {
 		// If we still have diff layers below, continue down
@@ -474,14 +553,14 @@ func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
 			diff = parent
 		} else {
 			// Diff stack too shallow, return without modifications
-			return nil
+			return nil, nil
 		}
 	}
 	// We're out of layers, flatten anything below, stopping if it's the disk or if
 	// the memory limit is not yet exceeded.
 	switch parent := diff.parent.(type) {
 	case *diskLayer:
-		return nil
+		return nil, nil
 
 	case *diffLayer:
 		// Hold the write lock until the flattened parent is linked correctly.
@@ -492,7 +571,20 @@ func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
 
 		// Flatten the parent into the grandparent. The flattening internally obtains a
 		// write lock on grandparent.
-		flattened := parent.flatten().(*diffLayer)
+		snap, err := parent.flattenWithProgress(func(merged uint64) {
+			log.Info("Flattening snapshot layers", "root", parent.root, "merged", merged)
+		})
+		if err != nil {
+			// Flattening would invalidate pinned layers, defer it until no query
+			// pins any of them anymore
+			if errors.Is(err, errSnapshotPinned) {
+				snapshotPinDeferMeter.Mark(1)
+				log.Debug("Deferring flatten of pinned snapshot layers", "root", parent.root)
+				return nil, nil
+			}
+			return nil, err
+		}
+		flattened := snap.(*diffLayer)
 		t.layers[flattened.root] = flattened
 
 		// Invoke the hook if it's registered. Ugly hack.
@@ -500,19 +592,21 @@ func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
 			t.onFlatten()
 		}
 		diff.parent = flattened
-		if flattened.memory < aggregatorMemoryLimit {
-			// Accumulator layer is smaller than the limit, so we can abort, unless
+		if flattened.memory < aggregatorMemoryLimit && flattened.items < aggregatorItemLimit {
+			// Accumulator layer is smaller than the limits, so we can abort, unless
 			// there's a snapshot being generated currently. In that case, the trie
 			// will move from underneath the generator so we **must** merge all the
 			// partial data down into the snapshot and restart the generation.
 			if flattened.parent.(*diskLayer).genAbort == nil {
-				return nil
+				return nil, nil
 			}
 		}
 	default:
 		panic(fmt.Sprintf("unknown data layer: %T", parent))
 	}
-	// If the bottom-most layer is larger than our memory cap, persist to disk
+	// If the bottom-most layer is larger than our memory or item cap, persist to
+	// disk. The item cap protects the bloom filters from saturating with lots of
+	// tiny entries that don't weigh much memory-wise.
 	bottom := diff.parent.(*diffLayer)
 
 	bottom.lock.RLock()
@@ -521,7 +615,7 @@ func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
 
 	t.layers[base.root] = base
 	diff.parent = base
-	return base
+	return base, nil
 }
 
 // diffToDisk merges a bottom-most diff into the persistent disk layer underneath
@@ -628,6 +722,10 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 		log.Crit("Failed to write leftover snapshot", "err", err)
 	}
 	log.Debug("Journalled disk layer", "root", bottom.root, "complete", base.genMarker == nil)
+
+	// The persisted entries are not buffered in memory anymore
+	bottom.untrackDirty()
+
 	res := &diskLayer{
 		root:       bottom.root,
 		cache:      base.cache,
@@ -724,7 +822,9 @@ func (t *Tree) Rebuild(root common.Hash) {
 		case *diffLayer:
 			// If the layer is a simple diff, simply mark as stale
 			layer.lock.Lock()
-			layer.stale.Store(true)
+			if !layer.stale.Swap(true) && !layer.merged.Load() {
+				layer.untrackDirty()
+			}
 			layer.lock.Unlock()
 
 		default:
@@ -865,7 +965,7 @@ func (t *Tree) Size() (diffs common.StorageSize, buf common.StorageSize, preimag
 	var size common.StorageSize
 	for _, layer := range t.layers {
 		if layer, ok := layer.(*diffLayer); ok {
-			size += common.StorageSize(layer.memory)
+			size += common.StorageSize(layer.Memory())
 		}
 	}
 	return size, 0, 0
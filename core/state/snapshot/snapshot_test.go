@@ -17,8 +17,10 @@
 package snapshot
 
 import (
+	"bytes"
 	crand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
 	"testing"
@@ -118,10 +120,10 @@ func TestDiskLayerExternalInvalidationFullFlatten(t *testing.T) {
 		t.Fatalf("failed to merge diff layer onto disk: %v", err)
 	}
 	// Since the base layer was modified, ensure that data retrievals on the external reference fail
-	if acc, err := ref.Account(common.HexToHash("0x01")); err != ErrSnapshotStale {
+	if acc, err := ref.Account(common.HexToHash("0x01")); !errors.Is(err, ErrSnapshotStale) {
 		t.Errorf("stale reference returned account: %#x (err: %v)", acc, err)
 	}
-	if slot, err := ref.Storage(common.HexToHash("0xa1"), common.HexToHash("0xb1")); err != ErrSnapshotStale {
+	if slot, err := ref.Storage(common.HexToHash("0xa1"), common.HexToHash("0xb1")); !errors.Is(err, ErrSnapshotStale) {
 		t.Errorf("stale reference returned storage slot: %#x (err: %v)", slot, err)
 	}
 	if n := len(snaps.layers); n != 1 {
@@ -168,10 +170,10 @@ func TestDiskLayerExternalInvalidationPartialFlatten(t *testing.T) {
 		t.Fatalf("failed to merge accumulator onto disk: %v", err)
 	}
 	// Since the base layer was modified, ensure that data retrievals on the external reference fail
-	if acc, err := ref.Account(common.HexToHash("0x01")); err != ErrSnapshotStale {
+	if acc, err := ref.Account(common.HexToHash("0x01")); !errors.Is(err, ErrSnapshotStale) {
 		t.Errorf("stale reference returned account: %#x (err: %v)", acc, err)
 	}
-	if slot, err := ref.Storage(common.HexToHash("0xa1"), common.HexToHash("0xb1")); err != ErrSnapshotStale {
+	if slot, err := ref.Storage(common.HexToHash("0xa1"), common.HexToHash("0xb1")); !errors.Is(err, ErrSnapshotStale) {
 		t.Errorf("stale reference returned storage slot: %#x (err: %v)", slot, err)
 	}
 	if n := len(snaps.layers); n != 2 {
@@ -230,10 +232,10 @@ func TestDiffLayerExternalInvalidationPartialFlatten(t *testing.T) {
 		t.Fatalf("failed to flatten diff layer into accumulator: %v", err)
 	}
 	// Since the accumulator diff layer was modified, ensure that data retrievals on the external reference fail
-	if acc, err := ref.Account(common.HexToHash("0x01")); err != ErrSnapshotStale {
+	if acc, err := ref.Account(common.HexToHash("0x01")); !errors.Is(err, ErrSnapshotStale) {
 		t.Errorf("stale reference returned account: %#x (err: %v)", acc, err)
 	}
-	if slot, err := ref.Storage(common.HexToHash("0xa1"), common.HexToHash("0xb1")); err != ErrSnapshotStale {
+	if slot, err := ref.Storage(common.HexToHash("0xa1"), common.HexToHash("0xb1")); !errors.Is(err, ErrSnapshotStale) {
 		t.Errorf("stale reference returned storage slot: %#x (err: %v)", slot, err)
 	}
 	if n := len(snaps.layers); n != 3 {
@@ -242,6 +244,122 @@ func TestDiffLayerExternalInvalidationPartialFlatten(t *testing.T) {
 	}
 }
 
+// Tests that pinned layers are not flattened until their pins are released.
+func TestDiffLayerPin(t *testing.T) {
+	// Create an empty base layer and a snapshot tree out of it
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.Hash{0x01},
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	// Commit three diffs on top and pin the bottommost
+	accounts := map[common.Hash][]byte{
+		common.HexToHash("0xa1"): randomAccount(),
+	}
+	for i := 2; i <= 4; i++ {
+		if err := snaps.Update(common.Hash{byte(i)}, common.Hash{byte(i - 1)}, accounts, nil); err != nil {
+			t.Fatalf("failed to create diff layer %d: %v", i, err)
+		}
+	}
+	ref := snaps.Snapshot(common.Hash{0x02}).(*diffLayer)
+	release, err := ref.Pin()
+	if err != nil {
+		t.Fatalf("failed to pin layer: %v", err)
+	}
+
+	// Neither flattening into the pinned layer, nor a full commit may proceed
+	deferred := snapshotPinDeferMeter.Snapshot().Count()
+	if err := snaps.Cap(common.Hash{0x04}, 1); err != nil {
+		t.Fatalf("failed to cap snapshot tree: %v", err)
+	}
+	if ref.Stale() {
+		t.Fatalf("pinned layer flattened")
+	}
+	if n := len(snaps.layers); n != 4 {
+		t.Fatalf("pinned layer count mismatch: have %d, want %d", n, 4)
+	}
+	if have := snapshotPinDeferMeter.Snapshot().Count() - deferred; have != 1 {
+		t.Fatalf("deferred flatten count mismatch: have %d, want 1", have)
+	}
+	if err := snaps.Cap(common.Hash{0x04}, 0); !errors.Is(err, errSnapshotPinned) {
+		t.Fatalf("pinned full commit error mismatch: have %v, want %v", err, errSnapshotPinned)
+	}
+	// Release the pin (twice, which must be harmless) and ensure flattening resumes
+	release()
+	release()
+	if pins := ref.pins.Load(); pins != 0 {
+		t.Fatalf("pin count after release mismatch: have %d, want 0", pins)
+	}
+	if err := snaps.Cap(common.Hash{0x04}, 1); err != nil {
+		t.Fatalf("failed to cap snapshot tree: %v", err)
+	}
+	if !ref.Stale() {
+		t.Fatalf("released layer not flattened")
+	}
+	if n := len(snaps.layers); n != 3 {
+		t.Fatalf("released layer count mismatch: have %d, want %d", n, 3)
+	}
+	// Stale layers can't be pinned anymore
+	if _, err := ref.Pin(); !errors.Is(err, ErrSnapshotStale) {
+		t.Fatalf("stale layer pin error mismatch: have %v, want %v", err, ErrSnapshotStale)
+	}
+}
+
+// Tests that pinning a layer concurrently with capping the tree never lets the
+// pinned layer become stale while the pin is held.
+func TestDiffLayerPinConcurrentCap(t *testing.T) {
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.Hash{0x01},
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	accounts := map[common.Hash][]byte{
+		common.HexToHash("0xa1"): randomAccount(),
+	}
+	for i := 2; i <= 4; i++ {
+		if err := snaps.Update(common.Hash{byte(i)}, common.Hash{byte(i - 1)}, accounts, nil); err != nil {
+			t.Fatalf("failed to create diff layer %d: %v", i, err)
+		}
+	}
+	ref := snaps.Snapshot(common.Hash{0x02}).(*diffLayer)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for !ref.Stale() {
+			if err := snaps.Cap(common.Hash{0x04}, 1); err != nil {
+				t.Errorf("failed to cap snapshot tree: %v", err)
+				return
+			}
+		}
+	}()
+	for {
+		release, err := ref.Pin()
+		if err != nil {
+			if !errors.Is(err, ErrSnapshotStale) {
+				t.Fatalf("pin error mismatch: have %v, want %v", err, ErrSnapshotStale)
+			}
+			break
+		}
+		stale := ref.Stale()
+		release()
+		if stale {
+			t.Fatalf("pinned layer became stale")
+		}
+	}
+	<-done
+}
+
 // TestPostCapBasicDataAccess tests some functionality regarding capping/flattening.
 func TestPostCapBasicDataAccess(t *testing.T) {
 	// setAccount is a helper to construct a random account entry and assign it to
@@ -490,3 +608,252 @@ func TestReadStateDuringFlattening(t *testing.T) {
 		t.Fatal("Unexpected blocker")
 	}
 }
+
+// Tests that the accumulator layer is flushed to disk when it holds too many
+// items, even if its memory usage is still below the memory limit.
+func TestAccumulatorItemLimitFlush(t *testing.T) {
+	defer func(limit uint64) { aggregatorItemLimit = limit }(aggregatorItemLimit)
+	aggregatorItemLimit = 1000
+
+	// Create an empty base layer and a snapshot tree out of it
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	// Fill the first diff layer with lots of tiny (deleted) accounts
+	accounts := make(map[common.Hash][]byte)
+	for i := 0; i < int(aggregatorItemLimit); i++ {
+		accounts[randomHash()] = nil
+	}
+	if err := snaps.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), accounts, nil); err != nil {
+		t.Fatalf("failed to create a diff layer: %v", err)
+	}
+	if err := snaps.Update(common.HexToHash("0x03"), common.HexToHash("0x02"), randomAccountSet("0xa1"), nil); err != nil {
+		t.Fatalf("failed to create a diff layer: %v", err)
+	}
+	if err := snaps.Update(common.HexToHash("0x04"), common.HexToHash("0x03"), randomAccountSet("0xa2"), nil); err != nil {
+		t.Fatalf("failed to create a diff layer: %v", err)
+	}
+	if mem := snaps.layers[common.HexToHash("0x02")].(*diffLayer).memory; mem >= aggregatorMemoryLimit {
+		t.Fatalf("accumulator memory above limit: have %d, limit %d", mem, aggregatorMemoryLimit)
+	}
+	// Flatten the diff layers into the accumulator, which should push it to disk
+	if err := snaps.Cap(common.HexToHash("0x04"), 1); err != nil {
+		t.Fatalf("failed to flatten diff layer into accumulator: %v", err)
+	}
+	if _, ok := snaps.layers[common.HexToHash("0x03")].(*diskLayer); !ok {
+		t.Errorf("accumulator not flushed to disk: have %T", snaps.layers[common.HexToHash("0x03")])
+	}
+	if n := len(snaps.layers); n != 2 {
+		t.Errorf("post-cap layer count mismatch: have %d, want %d", n, 2)
+	}
+}
+
+// Tests that diff layers linking their blooms to the ones of their ancestors
+// resolve all the data correctly, including after flattening and persisting the
+// layers, and that the chain of linked blooms is bounded.
+func TestBloomOverlay(t *testing.T) {
+	defer func(enabled bool, depth int) {
+		bloomOverlay, bloomOverlayMaxDepth = enabled, depth
+	}(bloomOverlay, bloomOverlayMaxDepth)
+	SetBloomOverlay(true)
+	bloomOverlayMaxDepth = 4
+
+	// Create an empty base layer and a snapshot tree out of it
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.Hash{0x01},
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	// Stack a bunch of layers, overwriting some of the earlier accounts
+	var (
+		want   = make(map[common.Hash][]byte)
+		hashes []common.Hash
+	)
+	for i := 2; i <= 13; i++ {
+		accounts := make(map[common.Hash][]byte)
+		for j := 0; j < 16; j++ {
+			hash := randomHash()
+			accounts[hash] = randomAccount()
+			hashes = append(hashes, hash)
+		}
+		accounts[hashes[rand.Intn(len(hashes))]] = randomAccount()
+		for hash, blob := range accounts {
+			want[hash] = blob
+		}
+		if err := snaps.Update(common.Hash{byte(i)}, common.Hash{byte(i - 1)}, accounts, nil); err != nil {
+			t.Fatalf("failed to create diff layer %d: %v", i, err)
+		}
+		if links := snaps.Snapshot(common.Hash{byte(i)}).(*diffLayer).BloomStats().Links; links >= bloomOverlayMaxDepth {
+			t.Fatalf("layer %d: bloom chain too deep: have %d links, limit %d", i, links, bloomOverlayMaxDepth)
+		}
+	}
+	check := func(stage string, persisted bool) {
+		t.Helper()
+
+		head := snaps.Snapshot(common.Hash{13}).(*diffLayer)
+		for hash, blob := range want {
+			head.lock.RLock()
+			contained := head.bloomContains(accountBloomHash(hash))
+			head.lock.RUnlock()
+			if !contained && !persisted {
+				t.Fatalf("%s: account %x missing from bloom", stage, hash)
+			}
+			have, err := head.AccountRLP(hash)
+			if err != nil {
+				t.Fatalf("%s: failed to retrieve account %x: %v", stage, hash, err)
+			}
+			if !bytes.Equal(have, blob) {
+				t.Fatalf("%s: account %x mismatch: have %x, want %x", stage, hash, have, blob)
+			}
+		}
+	}
+	check("stacked", false)
+
+	// Flatten the bottom layers, keeping their blooms linked from above
+	if err := snaps.Cap(common.Hash{13}, 4); err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	check("flattened", false)
+
+	// Push the accumulator to disk, rebuilding the blooms above it
+	defer func(limit uint64) { aggregatorMemoryLimit = limit }(aggregatorMemoryLimit)
+	aggregatorMemoryLimit = 0
+
+	if err := snaps.Cap(common.Hash{13}, 2); err != nil {
+		t.Fatalf("failed to persist layers: %v", err)
+	}
+	if _, ok := snaps.layers[common.Hash{11}].(*diskLayer); !ok {
+		t.Fatalf("accumulator not persisted: have %T", snaps.layers[common.Hash{11}])
+	}
+	check("persisted", true)
+}
+
+// Tests that the gauges of dirty entries track the entries buffered across the
+// diff layers of the tree, deduplicating them on flattening and releasing them
+// on persisting or dropping the layers.
+func TestDirtyEntryGauges(t *testing.T) {
+	// Create an empty base layer and a snapshot tree out of it
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	var (
+		accounts = snapshotDirtyAccountGauge.Snapshot().Value()
+		slots    = snapshotDirtyStorageGauge.Snapshot().Value()
+	)
+	check := func(stage string, wantAccounts, wantSlots int64) {
+		t.Helper()
+
+		if have := snapshotDirtyAccountGauge.Snapshot().Value() - accounts; have != wantAccounts {
+			t.Errorf("%s: dirty account count mismatch: have %d, want %d", stage, have, wantAccounts)
+		}
+		if have := snapshotDirtyStorageGauge.Snapshot().Value() - slots; have != wantSlots {
+			t.Errorf("%s: dirty slot count mismatch: have %d, want %d", stage, have, wantSlots)
+		}
+	}
+	// Stack a chain of layers overwriting each other and a fork off the bottom
+	snaps.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), randomAccountSet("0xa1", "0xa2"), randomStorageSet([]string{"0xa1"}, [][]string{{"0x01", "0x02"}}, nil))
+	snaps.Update(common.HexToHash("0x03"), common.HexToHash("0x02"), randomAccountSet("0xa1", "0xa3"), randomStorageSet([]string{"0xa1"}, [][]string{{"0x02", "0x03"}}, nil))
+	snaps.Update(common.HexToHash("0x04"), common.HexToHash("0x02"), randomAccountSet("0xa4"), nil)
+	snaps.Update(common.HexToHash("0x05"), common.HexToHash("0x03"), randomAccountSet("0xa5"), nil)
+	check("stacked", 6, 4)
+
+	// Flatten the chain into an accumulator, dropping the fork
+	if err := snaps.Cap(common.HexToHash("0x05"), 1); err != nil {
+		t.Fatalf("failed to flatten diff layers: %v", err)
+	}
+	check("flattened", 4, 3)
+
+	// Persist all the layers, releasing every entry
+	if err := snaps.Cap(common.HexToHash("0x05"), 0); err != nil {
+		t.Fatalf("failed to persist diff layers: %v", err)
+	}
+	check("persisted", 0, 0)
+
+	// Stack a deeper chain and flatten multiple levels at once, ensuring that the
+	// intermediate layers merged along the way are not released a second time
+	snaps.Update(common.HexToHash("0x06"), common.HexToHash("0x05"), randomAccountSet("0xa1", "0xa2"), randomStorageSet([]string{"0xa1"}, [][]string{{"0x01", "0x02"}}, nil))
+	snaps.Update(common.HexToHash("0x07"), common.HexToHash("0x06"), randomAccountSet("0xa1", "0xa3"), randomStorageSet([]string{"0xa1"}, [][]string{{"0x02", "0x03"}}, nil))
+	snaps.Update(common.HexToHash("0x08"), common.HexToHash("0x07"), randomAccountSet("0xa4"), nil)
+	snaps.Update(common.HexToHash("0x09"), common.HexToHash("0x08"), randomAccountSet("0xa5"), nil)
+	check("restacked", 6, 4)
+
+	if err := snaps.Cap(common.HexToHash("0x09"), 0); err != nil {
+		t.Fatalf("failed to persist diff layers: %v", err)
+	}
+	check("repersisted", 0, 0)
+
+	// Flatten a deep chain into an accumulator below a retained layer
+	snaps.Update(common.HexToHash("0x0a"), common.HexToHash("0x09"), randomAccountSet("0xa1", "0xa2"), nil)
+	snaps.Update(common.HexToHash("0x0b"), common.HexToHash("0x0a"), randomAccountSet("0xa1", "0xa3"), nil)
+	snaps.Update(common.HexToHash("0x0c"), common.HexToHash("0x0b"), randomAccountSet("0xa4"), nil)
+	snaps.Update(common.HexToHash("0x0d"), common.HexToHash("0x0c"), randomAccountSet("0xa5"), nil)
+	check("deepened", 6, 0)
+
+	if err := snaps.Cap(common.HexToHash("0x0d"), 1); err != nil {
+		t.Fatalf("failed to flatten diff layers: %v", err)
+	}
+	check("deep flattened", 5, 0)
+
+	if err := snaps.Cap(common.HexToHash("0x0d"), 0); err != nil {
+		t.Fatalf("failed to persist diff layers: %v", err)
+	}
+	check("deep persisted", 0, 0)
+}
+
+// Tests that reads through an EVN tagged snapshot are accounted separately,
+// while untagged reads are not.
+func TestReadOriginMeters(t *testing.T) {
+	storage := randomStorageSet([]string{"0xa1"}, [][]string{{"0x01"}}, nil)
+	layer := newDiffLayer(emptyLayer(), common.Hash{0x01}, randomAccountSet("0xa1"), storage)
+
+	var (
+		accounts = snapEVNAccountReadMeter.Snapshot().Count()
+		slots    = snapEVNStorageReadMeter.Snapshot().Count()
+	)
+	untagged := WithOrigin(layer, OriginUntagged)
+	if untagged != Snapshot(layer) {
+		t.Fatalf("untagged snapshot got wrapped")
+	}
+	untagged.Account(common.HexToHash("0xa1"))
+	untagged.Storage(common.HexToHash("0xa1"), common.HexToHash("0x01"))
+
+	tagged := WithOrigin(layer, OriginEVN)
+	if _, err := tagged.Account(common.HexToHash("0xa1")); err != nil {
+		t.Fatalf("failed to read account: %v", err)
+	}
+	if _, err := tagged.AccountRLP(common.HexToHash("0xa1")); err != nil {
+		t.Fatalf("failed to read account RLP: %v", err)
+	}
+	blob, err := tagged.Storage(common.HexToHash("0xa1"), common.HexToHash("0x01"))
+	if err != nil {
+		t.Fatalf("failed to read storage: %v", err)
+	}
+	if want := storage[common.HexToHash("0xa1")][common.HexToHash("0x01")]; !bytes.Equal(blob, want) {
+		t.Fatalf("storage mismatch: have %x, want %x", blob, want)
+	}
+	if have := snapEVNAccountReadMeter.Snapshot().Count() - accounts; have != 2 {
+		t.Errorf("EVN account reads mismatch: have %d, want 2", have)
+	}
+	if have := snapEVNStorageReadMeter.Snapshot().Count() - slots; have != 1 {
+		t.Errorf("EVN storage reads mismatch: have %d, want 1", have)
+	}
+}
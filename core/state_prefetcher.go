@@ -18,8 +18,10 @@ package core
 
 import (
 	"bytes"
+	"errors"
 	"runtime"
 	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/state"
@@ -40,6 +42,16 @@ type statePrefetcher struct {
 	config     *params.ChainConfig // Chain configuration options
 	chain      *HeaderChain        // Canonical block chain
 	mevEnabled bool                // Indicate whether MEV is enabled
+
+	threads              int           // Number of prefetch workers, zero for the defaults
+	miningDispatchBuffer int           // Size of the mining prefetch dispatch buffer, zero for the worker count
+	workerStagger        time.Duration // Delay between the startup of two consecutive mining prefetch workers
+
+	txFilter        func(tx *types.Transaction, reader state.Reader) bool // Predicate deciding whether a transaction is worth prefetching, nil for all
+	abortOnOvertake bool                                                  // Whether to stop mining prefetch once the main processor catches up
+
+	activeWorkers atomic.Int32 // Number of prefetch workers currently running
+	readyWorkers  atomic.Int32 // Number of mining prefetch workers done with their state copy
 }
 
 // NewStatePrefetcher initialises a new statePrefetcher.
@@ -55,30 +67,138 @@ func (p *statePrefetcher) EnableMevMode() {
 	p.mevEnabled = true
 }
 
+// SetThreads sets the number of workers used for both block and mining prefetch.
+// More workers warm the caches faster on machines with spare cores, fewer ones
+// avoid wasting the resources of small nodes. Zero (the default) restores the
+// default worker counts, scaled by the number of CPUs for block prefetch and,
+// unless MEV is enabled, for mining prefetch too.
+func (p *statePrefetcher) SetThreads(threads int) {
+	p.threads = threads
+}
+
+// SetMiningDispatchBuffer sets the size of the channel buffer decoupling the
+// mining prefetch producer from its workers. A larger buffer smooths out bursty
+// dispatching. Zero restores the default of one slot per worker.
+func (p *statePrefetcher) SetMiningDispatchBuffer(size int) {
+	p.miningDispatchBuffer = size
+}
+
+// SetTxFilter sets a predicate deciding whether a transaction is worth being
+// prefetched, given a reader of the state it is prefetched on. Transactions
+// rejected by it are skipped, concentrating the workers on the state heavy ones.
+// Nil (the default) prefetches all transactions.
+func (p *statePrefetcher) SetTxFilter(filter func(tx *types.Transaction, reader state.Reader) bool) {
+	p.txFilter = filter
+}
+
+// SkipPlainTransfers is a prefetch transaction filter rejecting plain value
+// transfers to externally owned accounts, i.e. transactions without call data
+// and access list whose recipient has no code. These only touch the sender and
+// recipient accounts. Transfers to accounts with code are kept, as their receive
+// or fallback code may touch arbitrary state.
+func SkipPlainTransfers(tx *types.Transaction, reader state.Reader) bool {
+	if tx.To() == nil || len(tx.Data()) > 0 || len(tx.AccessList()) > 0 {
+		return true
+	}
+	account, err := reader.Account(*tx.To())
+	if err != nil {
+		return true
+	}
+	return account != nil && !bytes.Equal(account.CodeHash, types.EmptyCodeHash.Bytes())
+}
+
+// SetWorkerStagger sets the delay between the startup of two consecutive mining
+// prefetch workers. Each worker copies the state when starting, so staggering
+// them spreads the copies out instead of causing an allocation spike. Zero (the
+// default) starts all workers at once.
+func (p *statePrefetcher) SetWorkerStagger(delay time.Duration) {
+	p.workerStagger = delay
+}
+
+// SetAbortOnOvertake sets whether mining prefetch should stop dispatching once
+// the main processor reaches or passes the transactions not yet prefetched. At
+// that point prefetching can't stay ahead anymore and only competes with block
+// building for resources.
+func (p *statePrefetcher) SetAbortOnOvertake(abort bool) {
+	p.abortOnOvertake = abort
+}
+
+// blockThreads returns the number of workers to use for block prefetch.
+func (p *statePrefetcher) blockThreads() int {
+	if p.threads > 0 {
+		return p.threads
+	}
+	return max(1, 3*runtime.NumCPU()/5) // Aggressively run the prefetching
+}
+
+// miningThreads returns the number of workers to use for mining prefetch.
+func (p *statePrefetcher) miningThreads() int {
+	if p.threads > 0 {
+		return p.threads
+	}
+	// When MEV is not enabled, use more threads for local mining
+	if !p.mevEnabled {
+		return max(prefetchMiningThread, 3*runtime.NumCPU()/5)
+	}
+	return prefetchMiningThread
+}
+
+// miningDispatchBufferSize returns the dispatch buffer size to use for mining
+// prefetch with the given number of workers.
+func (p *statePrefetcher) miningDispatchBufferSize(threads int) int {
+	if p.miningDispatchBuffer > 0 {
+		return p.miningDispatchBuffer
+	}
+	return threads
+}
+
+// ActiveWorkers returns the number of prefetch workers currently running, both
+// for block and mining prefetches.
+func (p *statePrefetcher) ActiveWorkers() int {
+	return int(p.activeWorkers.Load())
+}
+
+// ReadyWorkers returns the number of mining prefetch workers that are done with
+// their startup and are ready to process transactions.
+func (p *statePrefetcher) ReadyWorkers() int {
+	return int(p.readyWorkers.Load())
+}
+
 // Prefetch processes the state changes according to the Ethereum rules by running
 // the transaction messages using the statedb, but any changes are discarded. The
 // only goal is to warm the state caches.
 func (p *statePrefetcher) Prefetch(transactions types.Transactions, header *types.Header, gasLimit uint64, statedb *state.StateDB, cfg vm.Config, interrupt *atomic.Bool) {
 	var (
-		fails   atomic.Int64
-		signer  = types.MakeSigner(p.config, header.Number, header.Time)
-		workers errgroup.Group
-		reader  = statedb.Reader()
+		fails       atomic.Int64
+		interrupted atomic.Int64
+		signer      = types.MakeSigner(p.config, header.Number, header.Time)
+		workers     errgroup.Group
+		reader      = statedb.Reader()
 	)
-	workers.SetLimit(max(1, 3*runtime.NumCPU()/5)) // Aggressively run the prefetching
+	workers.SetLimit(p.blockThreads())
 
 	// Iterate over and process the individual transactions
+	var skipped int64
 	for i, tx := range transactions {
+		if p.txFilter != nil && !p.txFilter(tx, reader) {
+			skipped++
+			continue
+		}
 		stateCpy := statedb.Copy() // closure
 		workers.Go(func() error {
+			p.activeWorkers.Add(1)
+			defer p.activeWorkers.Add(-1)
+
 			// If block precaching was interrupted, abort
 			if interrupt != nil && interrupt.Load() {
+				interrupted.Add(1)
 				return nil
 			}
 			// Preload the touched accounts and storage slots in advance
 			sender, err := types.Sender(signer, tx)
 			if err != nil {
 				fails.Add(1)
+				blockPrefetchTxsUnconvertibleMeter.Mark(1)
 				return nil
 			}
 			reader.Account(sender)
@@ -106,6 +226,7 @@ func (p *statePrefetcher) Prefetch(transactions types.Transactions, header *type
 			msg, err := TransactionToMessage(tx, signer, header.BaseFee)
 			if err != nil {
 				fails.Add(1)
+				blockPrefetchTxsUnconvertibleMeter.Mark(1)
 				return nil // Also invalid block, bail out
 			}
 			// Disable the nonce check
@@ -115,7 +236,9 @@ func (p *statePrefetcher) Prefetch(transactions types.Transactions, header *type
 
 			// We attempt to apply a transaction. The goal is not to execute
 			// the transaction successfully, rather to warm up touched data slots.
-			if _, err := ApplyMessage(evm, msg, new(GasPool).AddGas(gasLimit)); err != nil {
+			result, err := ApplyMessage(evm, msg, new(GasPool).AddGas(gasLimit))
+			markPrefetchOutcome(result, err)
+			if err != nil {
 				fails.Add(1)
 				return nil // Ugh, something went horribly wrong, bail out
 			}
@@ -126,9 +249,29 @@ func (p *statePrefetcher) Prefetch(transactions types.Transactions, header *type
 
 	blockPrefetchTxsValidMeter.Mark(int64(len(transactions)) - fails.Load())
 	blockPrefetchTxsInvalidMeter.Mark(fails.Load())
+	blockPrefetchTxsSkippedMeter.Mark(skipped)
+	blockPrefetchTxsInterruptedMeter.Mark(interrupted.Load())
 	return
 }
 
+// markPrefetchOutcome buckets the outcome of a prefetch execution into success,
+// revert, out-of-gas or any other failure, including messages that couldn't be
+// applied at all.
+func markPrefetchOutcome(result *ExecutionResult, err error) {
+	switch {
+	case err != nil:
+		blockPrefetchExecOtherMeter.Mark(1)
+	case result.Err == nil:
+		blockPrefetchExecSuccessMeter.Mark(1)
+	case errors.Is(result.Err, vm.ErrExecutionReverted):
+		blockPrefetchExecRevertMeter.Mark(1)
+	case errors.Is(result.Err, vm.ErrOutOfGas):
+		blockPrefetchExecOutOfGasMeter.Mark(1)
+	default:
+		blockPrefetchExecOtherMeter.Mark(1)
+	}
+}
+
 // PrefetchMining processes the state changes according to the Ethereum rules by running
 // the transaction messages using the statedb, but any changes are discarded. The
 // only goal is to warm the state caches. Only used for mining stage.
@@ -141,17 +284,36 @@ func (p *statePrefetcher) PrefetchMining(txs TransactionsByPriceAndNonce, header
 		signer = types.MakeSigner(p.config, header.Number, header.Time)
 	)
 
-	// When MEV is not enabled, use more threads for local mining
-	threadCount := prefetchMiningThread
-	if !p.mevEnabled {
-		threadCount = max(prefetchMiningThread, 3*runtime.NumCPU()/5)
-	}
-
-	txCh := make(chan *types.Transaction, 2*threadCount)
+	threadCount := p.miningThreads()
+	txCh := make(chan *types.Transaction, p.miningDispatchBufferSize(threadCount))
 	for i := 0; i < threadCount; i++ {
-		go func(startCh <-chan *types.Transaction, stopCh <-chan struct{}) {
+		p.activeWorkers.Add(1)
+		go func(startCh <-chan *types.Transaction, stopCh <-chan struct{}, delay time.Duration) {
+			defer p.activeWorkers.Add(-1)
+
+			// Stagger the startup to spread out the state copies
+			if delay > 0 {
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+				case <-stopCh:
+					timer.Stop()
+					return
+				}
+			}
 			newStatedb := statedb.Copy()
+
+			p.readyWorkers.Add(1)
+			defer p.readyWorkers.Add(-1)
+
 			evm := vm.NewEVM(NewEVMBlockContext(header, p.chain, nil), newStatedb, p.config, cfg)
+
+			// Abort any in-flight execution as soon as prefetching is interrupted,
+			// instead of waiting for the current transaction to finish
+			go func() {
+				<-stopCh
+				evm.Cancel()
+			}()
 			idx := 0
 			// Iterate over and process the individual transactions
 			for {
@@ -183,6 +345,7 @@ func (p *statePrefetcher) PrefetchMining(txs TransactionsByPriceAndNonce, header
 					// Convert the transaction into an executable message and pre-cache its sender
 					msg, err := TransactionToMessage(tx, signer, header.BaseFee)
 					if err != nil {
+						blockPrefetchTxsUnconvertibleMeter.Mark(1)
 						continue // Skip invalid tx from txpool
 					}
 					// Disable the nonce check
@@ -190,13 +353,27 @@ func (p *statePrefetcher) PrefetchMining(txs TransactionsByPriceAndNonce, header
 
 					idx++
 					newStatedb.SetTxContext(tx.Hash(), idx)
-					ApplyMessage(evm, msg, new(GasPool).AddGas(gasLimit))
+					result, err := ApplyMessage(evm, msg, new(GasPool).AddGas(gasLimit))
+
+					// Count the executions cut short by the interruption apart, their
+					// outcome says nothing about the transaction
+					aborted := evm.Cancelled()
+					select {
+					case <-stopCh:
+						aborted = true
+					default:
+					}
+					if aborted {
+						blockPrefetchMiningAbortedMeter.Mark(1)
+						continue
+					}
+					markPrefetchOutcome(result, err)
 
 				case <-stopCh:
 					return
 				}
 			}
-		}(txCh, interruptCh)
+		}(txCh, interruptCh, time.Duration(i)*p.workerStagger)
 	}
 	go func(txset TransactionsByPriceAndNonce) {
 		count := 0
@@ -206,19 +383,40 @@ func (p *statePrefetcher) PrefetchMining(txs TransactionsByPriceAndNonce, header
 				return
 			default:
 				if count++; count%checkInterval == 0 {
-					txset.Forward(*txCurr)
+					var (
+						curr = *txCurr
+						next = txset.PeekWithUnwrap()
+					)
+					txset.Forward(curr)
+
+					// If forwarding skipped pending transactions, the main processor
+					// already reached them before they could be prefetched
+					if p.abortOnOvertake && curr != nil && next != nil && txset.PeekWithUnwrap() != next {
+						blockPrefetchOvertakenMeter.Mark(1)
+						return
+					}
 				}
 				tx := txset.PeekWithUnwrap()
 				if tx == nil {
 					return
 				}
+				if p.txFilter != nil && !p.txFilter(tx, reader) {
+					blockPrefetchTxsSkippedMeter.Mark(1)
+					txset.Shift()
+					continue
+				}
 
 				select {
-				case <-interruptCh:
-					return
 				case txCh <- tx:
+				default:
+					// All workers are busy and the buffer is full, wait
+					blockPrefetchDispatchBlockedMeter.Mark(1)
+					select {
+					case <-interruptCh:
+						return
+					case txCh <- tx:
+					}
 				}
-
 				txset.Shift()
 			}
 		}
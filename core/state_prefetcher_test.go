@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"math/big"
 	"runtime/pprof"
 	"slices"
@@ -17,12 +18,15 @@ import (
 	"github.com/ethereum/go-ethereum/consensus/ethash"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/tracing"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/triedb"
 
 	"github.com/google/pprof/profile"
+	"github.com/holiman/uint256"
 )
 
 func TestPrefetchLeaking(t *testing.T) {
@@ -140,3 +144,510 @@ func matchesLabel(sample *profile.Sample, key, expectedValue string) bool {
 
 	return slices.Contains(values, expectedValue)
 }
+
+// newPrefetchTestEnv generates a block with the given number of value transfers
+// and returns the chain, the block and the parent state to prefetch on top of.
+func newPrefetchTestEnv(t *testing.T, txs int) (*BlockChain, *types.Block, *state.StateDB) {
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(100000000000000000)
+		gspec   = &Genesis{
+			Config:  params.TestChainConfig,
+			Alloc:   GenesisAlloc{address: {Balance: funds}},
+			BaseFee: big.NewInt(params.InitialBaseFee),
+		}
+		genesis = gspec.MustCommit(gendb, triedb.NewDatabase(gendb, nil))
+		signer  = types.LatestSigner(gspec.Config)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 1, func(i int, block *BlockGen) {
+		block.SetCoinbase(common.Address{0x00})
+		for j := 0; j < txs; j++ {
+			tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x00}, big.NewInt(1000), params.TxGas, block.header.BaseFee, nil), signer, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block.AddTx(tx)
+		}
+	})
+	db := rawdb.NewMemoryDatabase()
+	gspec.MustCommit(db, triedb.NewDatabase(db, nil))
+	chain, _ := NewBlockChain(db, gspec, ethash.NewFaker(), nil)
+	t.Cleanup(chain.Stop)
+
+	block := blocks[0]
+	parent := chain.GetHeader(block.ParentHash(), block.NumberU64()-1)
+	statedb, _ := state.New(parent.Root, chain.statedb)
+	return chain, block, statedb
+}
+
+// testTxSet is a simple slice backed TransactionsByPriceAndNonce.
+type testTxSet struct {
+	txs []*types.Transaction
+}
+
+func (s *testTxSet) PeekWithUnwrap() *types.Transaction {
+	if len(s.txs) == 0 {
+		return nil
+	}
+	return s.txs[0]
+}
+
+func (s *testTxSet) Shift() {
+	if len(s.txs) > 0 {
+		s.txs = s.txs[1:]
+	}
+}
+
+func (s *testTxSet) Forward(tx *types.Transaction) {
+	if tx == nil {
+		return
+	}
+	for i, t := range s.txs {
+		if t.Hash() == tx.Hash() {
+			s.txs = s.txs[i+1:]
+			return
+		}
+	}
+}
+
+// waitActiveWorkers waits until the prefetcher reports the given number of active
+// workers, failing the test if it doesn't happen in a reasonable amount of time.
+func waitActiveWorkers(t *testing.T, p *statePrefetcher, want int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.ActiveWorkers() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("active workers mismatch: have %d, want %d", p.ActiveWorkers(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that the active worker count returns to zero once prefetching is done
+// or interrupted.
+func TestPrefetchActiveWorkers(t *testing.T) {
+	chain, block, statedb := newPrefetchTestEnv(t, 100)
+	prefetcher := NewStatePrefetcher(chain.Config(), chain.hc)
+
+	// Completed block prefetch
+	prefetcher.Prefetch(block.Transactions(), block.Header(), block.GasLimit(), statedb.Copy(), chain.cfg.VmConfig, nil)
+	if have := prefetcher.ActiveWorkers(); have != 0 {
+		t.Fatalf("active workers after completion: have %d, want 0", have)
+	}
+	// Interrupted block prefetch
+	var interrupt atomic.Bool
+	interrupt.Store(true)
+	prefetcher.Prefetch(block.Transactions(), block.Header(), block.GasLimit(), statedb.Copy(), chain.cfg.VmConfig, &interrupt)
+	if have := prefetcher.ActiveWorkers(); have != 0 {
+		t.Fatalf("active workers after interrupt: have %d, want 0", have)
+	}
+	// Mining prefetch keeps its workers alive until interrupted
+	var (
+		stopCh = make(chan struct{})
+		txCurr *types.Transaction
+	)
+	prefetcher.EnableMevMode()
+	prefetcher.PrefetchMining(&testTxSet{txs: block.Transactions()}, block.Header(), block.GasLimit(), statedb.Copy(), chain.cfg.VmConfig, stopCh, &txCurr)
+	if have := prefetcher.ActiveWorkers(); have != prefetchMiningThread {
+		t.Fatalf("active mining workers: have %d, want %d", have, prefetchMiningThread)
+	}
+	close(stopCh)
+	waitActiveWorkers(t, prefetcher, 0)
+}
+
+// Tests that the configured worker count is honored by both block and mining
+// prefetch, without affecting the prefetch results.
+func TestPrefetchThreads(t *testing.T) {
+	chain, block, statedb := newPrefetchTestEnv(t, 20)
+	prefetcher := NewStatePrefetcher(chain.Config(), chain.hc)
+	prefetcher.EnableMevMode()
+
+	if have := prefetcher.miningThreads(); have != prefetchMiningThread {
+		t.Fatalf("default mining threads mismatch: have %d, want %d", have, prefetchMiningThread)
+	}
+	// Block prefetch processes all transactions regardless of the worker count
+	for _, threads := range []int{1, 8} {
+		prefetcher.SetThreads(threads)
+		if have := prefetcher.blockThreads(); have != threads {
+			t.Fatalf("block threads mismatch: have %d, want %d", have, threads)
+		}
+		valid := blockPrefetchTxsValidMeter.Snapshot().Count()
+		prefetcher.Prefetch(block.Transactions(), block.Header(), block.GasLimit(), statedb.Copy(), chain.cfg.VmConfig, nil)
+		if have := blockPrefetchTxsValidMeter.Snapshot().Count() - valid; have != 20 {
+			t.Fatalf("threads %d: valid txs mismatch: have %d, want 20", threads, have)
+		}
+	}
+	// Mining prefetch spawns exactly the configured number of workers
+	var (
+		stopCh = make(chan struct{})
+		txCurr *types.Transaction
+	)
+	prefetcher.SetThreads(5)
+	prefetcher.PrefetchMining(&testTxSet{txs: block.Transactions()}, block.Header(), block.GasLimit(), statedb.Copy(), chain.cfg.VmConfig, stopCh, &txCurr)
+	if have := prefetcher.ActiveWorkers(); have != 5 {
+		t.Fatalf("active mining workers: have %d, want 5", have)
+	}
+	close(stopCh)
+	waitActiveWorkers(t, prefetcher, 0)
+}
+
+// Tests that the mining dispatch buffer defaults to the worker count, can
+// be overridden, and lets the producer get ahead of slow workers by its size.
+func TestPrefetchMiningDispatchBuffer(t *testing.T) {
+	prefetcher := NewStatePrefetcher(params.TestChainConfig, nil)
+	if have, want := prefetcher.miningDispatchBufferSize(prefetchMiningThread), prefetchMiningThread; have != want {
+		t.Fatalf("default dispatch buffer mismatch: have %d, want %d", have, want)
+	}
+	prefetcher.SetMiningDispatchBuffer(256)
+	if have := prefetcher.miningDispatchBufferSize(prefetchMiningThread); have != 256 {
+		t.Fatalf("configured dispatch buffer mismatch: have %d, want 256", have)
+	}
+	prefetcher.SetMiningDispatchBuffer(0)
+	if have, want := prefetcher.miningDispatchBufferSize(prefetchMiningThread), prefetchMiningThread; have != want {
+		t.Fatalf("reset dispatch buffer mismatch: have %d, want %d", have, want)
+	}
+	// Stall a single worker on an endless loop and ensure the producer gets ahead
+	// of it by the configured buffer size before blocking
+	chain, block, statedb := newPrefetchTestEnv(t, 0)
+
+	var (
+		loop   = common.Address{0xaa}
+		key, _ = crypto.GenerateKey()
+		signer = types.LatestSigner(chain.Config())
+		txs    []*types.Transaction
+	)
+	statedb.SetCode(loop, []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0x00, byte(vm.JUMP)}, tracing.CodeChangeUnspecified)
+	for i := 0; i < 32; i++ {
+		tx, err := types.SignTx(types.NewTransaction(uint64(i), loop, common.Big0, 100_000_000_000, common.Big0, nil), signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	dispatched := func(buffer int) int {
+		prefetcher := NewStatePrefetcher(chain.Config(), chain.hc)
+		prefetcher.SetThreads(1)
+		prefetcher.SetMiningDispatchBuffer(buffer)
+
+		var (
+			stopCh  = make(chan struct{})
+			txCurr  *types.Transaction
+			txset   = &testTxSet{txs: txs}
+			blocked = blockPrefetchDispatchBlockedMeter.Snapshot().Count()
+		)
+		prefetcher.PrefetchMining(txset, block.Header(), math.MaxUint64, statedb.Copy(), vm.Config{NoBaseFee: true}, stopCh, &txCurr)
+		defer waitActiveWorkers(t, prefetcher, 0)
+		defer close(stopCh)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for blockPrefetchDispatchBlockedMeter.Snapshot().Count() == blocked {
+			if time.Now().After(deadline) {
+				t.Fatalf("buffer %d: producer never blocked", buffer)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return len(txs) - len(txset.txs)
+	}
+	small, large := dispatched(2), dispatched(16)
+	if small < 2 || small > 3 {
+		t.Errorf("small buffer dispatches mismatch: have %d, want 2-3", small)
+	}
+	if large < 16 || large > 17 {
+		t.Errorf("large buffer dispatches mismatch: have %d, want 16-17", large)
+	}
+}
+
+// Tests that mining prefetch workers start up staggered by the configured delay
+// and all of them eventually become ready.
+func TestPrefetchWorkerStagger(t *testing.T) {
+	chain, block, statedb := newPrefetchTestEnv(t, 1)
+	prefetcher := NewStatePrefetcher(chain.Config(), chain.hc)
+	prefetcher.EnableMevMode()
+
+	const stagger = 100 * time.Millisecond
+	prefetcher.SetWorkerStagger(stagger)
+
+	var (
+		stopCh = make(chan struct{})
+		txCurr *types.Transaction
+		start  = time.Now()
+	)
+	prefetcher.PrefetchMining(&testTxSet{}, block.Header(), block.GasLimit(), statedb.Copy(), chain.cfg.VmConfig, stopCh, &txCurr)
+	if have := prefetcher.ReadyWorkers(); have == prefetchMiningThread {
+		t.Fatalf("all workers ready without stagger")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for prefetcher.ReadyWorkers() != prefetchMiningThread {
+		if time.Now().After(deadline) {
+			t.Fatalf("ready workers mismatch: have %d, want %d", prefetcher.ReadyWorkers(), prefetchMiningThread)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed, want := time.Since(start), (prefetchMiningThread-1)*stagger; elapsed < want {
+		t.Fatalf("workers started too fast: took %v, want at least %v", elapsed, want)
+	}
+	close(stopCh)
+	waitActiveWorkers(t, prefetcher, 0)
+	if have := prefetcher.ReadyWorkers(); have != 0 {
+		t.Fatalf("ready workers after stop: have %d, want 0", have)
+	}
+}
+
+// Tests that transactions rejected by the prefetch filter are skipped, and that
+// all of them are prefetched without one.
+func TestPrefetchTxFilter(t *testing.T) {
+	chain, block, statedb := newPrefetchTestEnv(t, 10)
+	prefetcher := NewStatePrefetcher(chain.Config(), chain.hc)
+
+	// Without a filter all transactions are prefetched
+	var (
+		valid   = blockPrefetchTxsValidMeter.Snapshot().Count()
+		skipped = blockPrefetchTxsSkippedMeter.Snapshot().Count()
+	)
+	prefetcher.Prefetch(block.Transactions(), block.Header(), block.GasLimit(), statedb.Copy(), chain.cfg.VmConfig, nil)
+	if have := blockPrefetchTxsValidMeter.Snapshot().Count() - valid; have != 10 {
+		t.Fatalf("unfiltered valid txs mismatch: have %d, want 10", have)
+	}
+	if have := blockPrefetchTxsSkippedMeter.Snapshot().Count() - skipped; have != 0 {
+		t.Fatalf("unfiltered skipped txs mismatch: have %d, want 0", have)
+	}
+	// Plain value transfers are skipped by the filter
+	prefetcher.SetTxFilter(SkipPlainTransfers)
+
+	valid = blockPrefetchTxsValidMeter.Snapshot().Count()
+	skipped = blockPrefetchTxsSkippedMeter.Snapshot().Count()
+	prefetcher.Prefetch(block.Transactions(), block.Header(), block.GasLimit(), statedb.Copy(), chain.cfg.VmConfig, nil)
+	if have := blockPrefetchTxsValidMeter.Snapshot().Count() - valid; have != 10 {
+		t.Fatalf("filtered valid txs mismatch: have %d, want 10", have)
+	}
+	if have := blockPrefetchTxsSkippedMeter.Snapshot().Count() - skipped; have != 10 {
+		t.Fatalf("filtered skipped txs mismatch: have %d, want 10", have)
+	}
+	// Plain transfers to accounts with code are not skipped
+	var (
+		contract = common.Address{0xaa}
+		eoa      = common.Address{0xbb}
+		db       = state.NewDatabaseForTesting()
+	)
+	setup, _ := state.New(types.EmptyRootHash, db)
+	setup.SetCode(contract, []byte{byte(vm.STOP)}, tracing.CodeChangeUnspecified)
+	setup.SetBalance(eoa, uint256.NewInt(1), tracing.BalanceChangeUnspecified)
+	root, err := setup.Commit(0, false, false)
+	if err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	reader, err := db.Reader(root)
+	if err != nil {
+		t.Fatalf("failed to open state reader: %v", err)
+	}
+	for _, tt := range []struct {
+		name string
+		tx   *types.Transaction
+		want bool
+	}{
+		{"eoa transfer", types.NewTransaction(0, eoa, common.Big1, params.TxGas, common.Big0, nil), false},
+		{"missing transfer", types.NewTransaction(0, common.Address{0xcc}, common.Big1, params.TxGas, common.Big0, nil), false},
+		{"contract transfer", types.NewTransaction(0, contract, common.Big1, params.TxGas, common.Big0, nil), true},
+		{"eoa call", types.NewTransaction(0, eoa, common.Big1, params.TxGas, common.Big0, []byte{0x01}), true},
+		{"creation", types.NewContractCreation(0, common.Big0, params.TxGas, common.Big0, nil), true},
+	} {
+		if have := SkipPlainTransfers(tt.tx, reader); have != tt.want {
+			t.Errorf("%s: filter mismatch: have %v, want %v", tt.name, have, tt.want)
+		}
+	}
+}
+
+// Tests that mining prefetch workers abort the transaction being executed when
+// interrupted, instead of running it to completion.
+func TestPrefetchMiningInterruptMidExecution(t *testing.T) {
+	chain, block, statedb := newPrefetchTestEnv(t, 0)
+	prefetcher := NewStatePrefetcher(chain.Config(), chain.hc)
+	prefetcher.EnableMevMode()
+
+	// Deploy an endless loop and call it with enough gas to run for minutes
+	var (
+		loop   = common.Address{0xaa}
+		key, _ = crypto.GenerateKey()
+		signer = types.LatestSigner(chain.Config())
+	)
+	statedb.SetCode(loop, []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0x00, byte(vm.JUMP)}, tracing.CodeChangeUnspecified)
+
+	tx, err := types.SignTx(types.NewTransaction(0, loop, common.Big0, 100_000_000_000, common.Big0, nil), signer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		stopCh = make(chan struct{})
+		txCurr *types.Transaction
+		txset  = &testTxSet{txs: []*types.Transaction{tx}}
+
+		aborted  = blockPrefetchMiningAbortedMeter.Snapshot().Count()
+		outcomes = prefetchOutcomeCount()
+	)
+	prefetcher.PrefetchMining(txset, block.Header(), math.MaxUint64, statedb, vm.Config{NoBaseFee: true}, stopCh, &txCurr)
+
+	// Wait for the transaction to be picked up and executed for a while
+	time.Sleep(200 * time.Millisecond)
+	if have := prefetcher.ActiveWorkers(); have != prefetchMiningThread {
+		t.Fatalf("active mining workers: have %d, want %d", have, prefetchMiningThread)
+	}
+	close(stopCh)
+
+	deadline := time.Now().Add(time.Second)
+	for prefetcher.ActiveWorkers() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("workers not stopped after interrupt: %d still active", prefetcher.ActiveWorkers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if have := blockPrefetchMiningAbortedMeter.Snapshot().Count() - aborted; have != 1 {
+		t.Fatalf("aborted executions mismatch: have %d, want 1", have)
+	}
+	// The cancelled execution must not be bucketed as any outcome
+	if have := prefetchOutcomeCount() - outcomes; have != 0 {
+		t.Fatalf("cancelled execution outcomes mismatch: have %d, want 0", have)
+	}
+}
+
+// prefetchOutcomeCount returns the total number of prefetch executions bucketed
+// into any of the outcome meters.
+func prefetchOutcomeCount() int64 {
+	return blockPrefetchExecSuccessMeter.Snapshot().Count() +
+		blockPrefetchExecRevertMeter.Snapshot().Count() +
+		blockPrefetchExecOutOfGasMeter.Snapshot().Count() +
+		blockPrefetchExecOtherMeter.Snapshot().Count()
+}
+
+// Tests that block prefetch accounts the transactions that couldn't be converted
+// into messages and the ones skipped due to an interruption separately.
+func TestPrefetchTxCounters(t *testing.T) {
+	chain, block, statedb := newPrefetchTestEnv(t, 10)
+	prefetcher := NewStatePrefetcher(chain.Config(), chain.hc)
+
+	// Append an unsigned transaction, which has no recoverable sender
+	txs := append(slices.Clone(block.Transactions()), types.NewTransaction(0, common.Address{0xaa}, common.Big0, params.TxGas, common.Big0, nil))
+
+	var (
+		valid         = blockPrefetchTxsValidMeter.Snapshot().Count()
+		invalid       = blockPrefetchTxsInvalidMeter.Snapshot().Count()
+		unconvertible = blockPrefetchTxsUnconvertibleMeter.Snapshot().Count()
+		interrupted   = blockPrefetchTxsInterruptedMeter.Snapshot().Count()
+	)
+	prefetcher.Prefetch(txs, block.Header(), block.GasLimit(), statedb.Copy(), chain.cfg.VmConfig, nil)
+	if have := blockPrefetchTxsValidMeter.Snapshot().Count() - valid; have != 10 {
+		t.Fatalf("valid txs mismatch: have %d, want 10", have)
+	}
+	if have := blockPrefetchTxsInvalidMeter.Snapshot().Count() - invalid; have != 1 {
+		t.Fatalf("invalid txs mismatch: have %d, want 1", have)
+	}
+	if have := blockPrefetchTxsUnconvertibleMeter.Snapshot().Count() - unconvertible; have != 1 {
+		t.Fatalf("unconvertible txs mismatch: have %d, want 1", have)
+	}
+	if have := blockPrefetchTxsInterruptedMeter.Snapshot().Count() - interrupted; have != 0 {
+		t.Fatalf("interrupted txs mismatch: have %d, want 0", have)
+	}
+	// Transactions skipped due to an interruption are metered on their own, the
+	// valid meter keeps counting everything that didn't fail
+	var interrupt atomic.Bool
+	interrupt.Store(true)
+
+	valid = blockPrefetchTxsValidMeter.Snapshot().Count()
+	invalid = blockPrefetchTxsInvalidMeter.Snapshot().Count()
+	prefetcher.Prefetch(txs, block.Header(), block.GasLimit(), statedb.Copy(), chain.cfg.VmConfig, &interrupt)
+	if have := blockPrefetchTxsValidMeter.Snapshot().Count() - valid; have != 11 {
+		t.Fatalf("interrupted valid txs mismatch: have %d, want 11", have)
+	}
+	if have := blockPrefetchTxsInvalidMeter.Snapshot().Count() - invalid; have != 0 {
+		t.Fatalf("interrupted invalid txs mismatch: have %d, want 0", have)
+	}
+	if have := blockPrefetchTxsInterruptedMeter.Snapshot().Count() - interrupted; have != 11 {
+		t.Fatalf("interrupted txs mismatch: have %d, want 11", have)
+	}
+}
+
+// Tests that mining prefetch stops dispatching once the main processor overtakes
+// it, leaving the rest of the transaction set untouched.
+func TestPrefetchMiningAbortOnOvertake(t *testing.T) {
+	chain, block, statedb := newPrefetchTestEnv(t, 100)
+	prefetcher := NewStatePrefetcher(chain.Config(), chain.hc)
+	prefetcher.EnableMevMode()
+	prefetcher.SetAbortOnOvertake(true)
+
+	// Pretend the main processor is already halfway through the set
+	var (
+		stopCh = make(chan struct{})
+		txs    = block.Transactions()
+		txCurr = txs[50]
+		txset  = &testTxSet{txs: txs}
+		start  = blockPrefetchOvertakenMeter.Snapshot().Count()
+	)
+	defer close(stopCh)
+	prefetcher.PrefetchMining(txset, block.Header(), block.GasLimit(), statedb.Copy(), chain.cfg.VmConfig, stopCh, &txCurr)
+
+	deadline := time.Now().Add(time.Second)
+	for blockPrefetchOvertakenMeter.Snapshot().Count() == start {
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetch not stopped after being overtaken")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The producer stopped right after skipping past the main processor
+	if have, want := len(txset.txs), len(txs)-51; have != want {
+		t.Fatalf("remaining transactions mismatch: have %d, want %d", have, want)
+	}
+}
+
+// Tests that prefetch executions are bucketed by their outcome.
+func TestPrefetchExecutionOutcomes(t *testing.T) {
+	chain, block, statedb := newPrefetchTestEnv(t, 0)
+	prefetcher := NewStatePrefetcher(chain.Config(), chain.hc)
+
+	var (
+		reverter = common.Address{0xaa}
+		loop     = common.Address{0xbb}
+		funded   = common.Address{0xcc}
+		key, _   = crypto.GenerateKey()
+		signer   = types.LatestSigner(chain.Config())
+	)
+	statedb.SetCode(reverter, []byte{byte(vm.PUSH1), 0x00, byte(vm.PUSH1), 0x00, byte(vm.REVERT)}, tracing.CodeChangeUnspecified)
+	statedb.SetCode(loop, []byte{byte(vm.JUMPDEST), byte(vm.PUSH1), 0x00, byte(vm.JUMP)}, tracing.CodeChangeUnspecified)
+	statedb.SetBalance(crypto.PubkeyToAddress(key.PublicKey), uint256.NewInt(1), tracing.BalanceChangeUnspecified)
+
+	var txs types.Transactions
+	for _, tx := range []*types.Transaction{
+		types.NewTransaction(0, funded, common.Big1, params.TxGas, common.Big0, nil),      // success
+		types.NewTransaction(0, reverter, common.Big0, 100_000, common.Big0, nil),         // revert
+		types.NewTransaction(0, loop, common.Big0, 100_000, common.Big0, nil),             // out of gas
+		types.NewTransaction(0, funded, big.NewInt(1000), params.TxGas, common.Big0, nil), // insufficient funds
+	} {
+		signed, err := types.SignTx(tx, signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, signed)
+	}
+	var (
+		success  = blockPrefetchExecSuccessMeter.Snapshot().Count()
+		revert   = blockPrefetchExecRevertMeter.Snapshot().Count()
+		outOfGas = blockPrefetchExecOutOfGasMeter.Snapshot().Count()
+		other    = blockPrefetchExecOtherMeter.Snapshot().Count()
+	)
+	prefetcher.Prefetch(txs, block.Header(), block.GasLimit(), statedb, vm.Config{NoBaseFee: true}, nil)
+
+	for _, tt := range []struct {
+		name       string
+		have, want int64
+	}{
+		{"success", blockPrefetchExecSuccessMeter.Snapshot().Count() - success, 1},
+		{"revert", blockPrefetchExecRevertMeter.Snapshot().Count() - revert, 1},
+		{"out of gas", blockPrefetchExecOutOfGasMeter.Snapshot().Count() - outOfGas, 1},
+		{"other", blockPrefetchExecOtherMeter.Snapshot().Count() - other, 1},
+	} {
+		if tt.have != tt.want {
+			t.Errorf("%s outcome count mismatch: have %d, want %d", tt.name, tt.have, tt.want)
+		}
+	}
+}
@@ -1,7 +1,17 @@
 package vote
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/tidwall/wal"
 
@@ -14,23 +24,87 @@ import (
 const (
 	maxSizeOfRecentEntry    = 512
 	maliciousVoteSlashScope = 256
+
+	// framingFile is the file within the journal directory recording the WAL
+	// framing the journal was created with.
+	framingFile   = "FRAMING"
+	framingJSON   = "json"
+	framingBinary = "binary"
 )
 
+// degradedRetryInterval is the time to wait between two attempts to resume
+// persisting votes after the journal's disk filled up.
+var degradedRetryInterval = 30 * time.Second
+
+// JournalConfig contains the tunables of the vote journal.
+type JournalConfig struct {
+	// SyncOnWrite fsyncs the journal after every vote write. Disabling it trades
+	// durability of the most recent votes for write throughput, in which case
+	// Sync should be called explicitly before a planned restart.
+	SyncOnWrite bool
+
+	// BinaryFraming frames the journal entries in binary instead of JSON lines,
+	// reducing the per-entry overhead. The vote payload is unaffected. Existing
+	// journals refuse to open with a framing other than the one they were
+	// created with.
+	BinaryFraming bool
+
+	// OnTruncate is invoked with the new first index whenever old votes are
+	// truncated from the front of the journal, if set.
+	OnTruncate func(firstIndex uint64)
+}
+
+// DefaultJournalConfig contains the default settings for the vote journal.
+var DefaultJournalConfig = JournalConfig{
+	SyncOnWrite: true,
+}
+
 type VoteJournal struct {
 	journalPath string // file path of disk journal for saving the vote.
+	config      JournalConfig
 
-	walLog *wal.Log
+	walLog     *wal.Log
+	walOptions *wal.Options
+
+	// writeEntry appends an entry to the WAL, replaceable for testing
+	writeEntry func(walLog *wal.Log, index uint64, data []byte) error
+
+	degraded  bool         // Whether votes are kept in memory only as the disk is full
+	lastRetry time.Time    // Time of the last attempt to persist while degraded
+	lock      sync.RWMutex // Lock protecting the WAL handle and the degraded state
 
 	voteDataBuffer *lru.Cache[uint64, *types.VoteData]
 }
 
-var voteJournalErrorCounter = metrics.NewRegisteredCounter("voteJournal/error", nil)
+var (
+	voteJournalErrorCounter    = metrics.NewRegisteredCounter("voteJournal/error", nil)
+	voteJournalTruncateCounter = metrics.NewRegisteredCounter("voteJournal/truncate", nil)
+
+	voteJournalDegradedGauge      = metrics.NewRegisteredGauge("voteJournal/degraded", nil)
+	voteJournalUnpersistedCounter = metrics.NewRegisteredCounter("voteJournal/unpersisted", nil)
+)
 
 func NewVoteJournal(filePath string) (*VoteJournal, error) {
-	walLog, err := wal.Open(filePath, &wal.Options{
-		LogFormat:        wal.JSON,
+	return NewVoteJournalWithConfig(filePath, DefaultJournalConfig)
+}
+
+// NewVoteJournalWithConfig opens the vote journal at the given path using the
+// provided configuration.
+func NewVoteJournalWithConfig(filePath string, config JournalConfig) (*VoteJournal, error) {
+	framing, logFormat := framingJSON, wal.JSON
+	if config.BinaryFraming {
+		framing, logFormat = framingBinary, wal.Binary
+	}
+	if err := setupFraming(filePath, framing); err != nil {
+		log.Error("Failed to set up vote journal framing", "err", err)
+		return nil, err
+	}
+	walOptions := &wal.Options{
+		NoSync:           !config.SyncOnWrite,
+		LogFormat:        logFormat,
 		SegmentCacheSize: maxSizeOfRecentEntry,
-	})
+	}
+	walLog, err := wal.Open(filePath, walOptions)
 	if err != nil {
 		log.Error("Failed to open vote journal", "err", err)
 		return nil, err
@@ -49,7 +123,10 @@ func NewVoteJournal(filePath string) (*VoteJournal, error) {
 
 	voteJournal := &VoteJournal{
 		journalPath:    filePath,
+		config:         config,
 		walLog:         walLog,
+		walOptions:     walOptions,
+		writeEntry:     (*wal.Log).Write,
 		voteDataBuffer: lru.NewCache[uint64, *types.VoteData](maxSizeOfRecentEntry),
 	}
 
@@ -64,25 +141,147 @@ func NewVoteJournal(filePath string) (*VoteJournal, error) {
 	return voteJournal, nil
 }
 
-func (journal *VoteJournal) WriteVote(voteMessage *types.VoteEnvelope) error {
-	walLog := journal.walLog
+// setupFraming records the WAL framing of a new journal at the given path, or
+// verifies that an existing journal was created with the given framing, as the
+// WAL can't load entries framed differently. Journals predating the recording
+// are JSON framed.
+func setupFraming(path string, framing string) error {
+	blob, err := os.ReadFile(filepath.Join(path, framingFile))
+	switch {
+	case err == nil:
+		if recorded := string(blob); recorded != framing {
+			return fmt.Errorf("vote journal framing mismatch: recorded %q, configured %q", recorded, framing)
+		}
+		return nil
 
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(entries) > 0 {
+		if framing != framingJSON {
+			return fmt.Errorf("vote journal framing mismatch: recorded %q, configured %q", framingJSON, framing)
+		}
+		return nil
+	}
+	// New journal, record the framing durably before any entry is written
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(path, framingFile), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(framing); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// WriteVote persists the vote into the journal and tracks it in memory. If the
+// disk is full, the journal degrades into keeping the votes in memory only and
+// periodically retries persisting them, resuming once there's space again. Votes
+// written while degraded are not recovered after a restart.
+func (journal *VoteJournal) WriteVote(voteMessage *types.VoteEnvelope) error {
 	vote, err := json.Marshal(voteMessage)
 	if err != nil {
 		log.Error("Failed to unmarshal vote", "err", err)
 		return err
 	}
+	journal.lock.Lock()
+	truncated, err := journal.writeVote(vote)
+	journal.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	// Notify about the truncation outside of the lock, the callback may want to
+	// read the journal
+	if truncated != 0 && journal.config.OnTruncate != nil {
+		journal.config.OnTruncate(truncated)
+	}
+	journal.voteDataBuffer.Add(voteMessage.Data.TargetNumber, voteMessage.Data)
+	return nil
+}
+
+// writeVote persists the encoded vote, handling the degradation into and the
+// recovery from the disk full state. It returns the new first index of the WAL
+// if old votes were truncated.
+//
+// The caller must hold the journal lock.
+func (journal *VoteJournal) writeVote(vote []byte) (uint64, error) {
+	if journal.degraded {
+		if time.Since(journal.lastRetry) < degradedRetryInterval {
+			voteJournalUnpersistedCounter.Inc(1)
+			return 0, nil
+		}
+		journal.lastRetry = time.Now()
+
+		// A failed write may leave the WAL's in-memory state out of sync with
+		// the disk, so reload it before trying again
+		if err := journal.reopen(); err != nil {
+			log.Warn("Failed to reopen degraded vote journal", "err", err)
+			voteJournalUnpersistedCounter.Inc(1)
+			return 0, nil
+		}
+	}
+	truncated, err := journal.persistVote(vote)
+	if err != nil {
+		if !errors.Is(err, syscall.ENOSPC) {
+			return 0, err
+		}
+		if !journal.degraded {
+			journal.degraded = true
+			log.Error("Vote journal disk full, keeping votes in memory only", "retry", degradedRetryInterval)
+			voteJournalDegradedGauge.Update(1)
+		}
+		journal.lastRetry = time.Now()
+		voteJournalUnpersistedCounter.Inc(1)
+		return 0, nil
+	}
+	if journal.degraded {
+		journal.degraded = false
+		log.Info("Vote journal recovered, persisting votes again")
+		voteJournalDegradedGauge.Update(0)
+	}
+	return truncated, nil
+}
+
+// persistVote appends the encoded vote to the WAL, truncating the old votes
+// beyond the retained recent entries. It returns the new first index of the WAL
+// if old votes were truncated.
+//
+// The caller must hold the journal lock.
+func (journal *VoteJournal) persistVote(vote []byte) (uint64, error) {
+	walLog := journal.walLog
 
 	lastIndex, err := walLog.LastIndex()
 	if err != nil {
 		log.Error("Failed to get lastIndex of vote journal", "err", err)
-		return err
+		return 0, err
 	}
 
 	lastIndex += 1
-	if err = walLog.Write(lastIndex, vote); err != nil {
+	if err = journal.writeEntry(walLog, lastIndex, vote); err != nil {
 		log.Error("Failed to write vote journal", "err", err)
-		return err
+		return 0, err
 	}
 
 	firstIndex, err := walLog.FirstIndex()
@@ -91,17 +290,108 @@ func (journal *VoteJournal) WriteVote(voteMessage *types.VoteEnvelope) error {
 	}
 
 	if lastIndex-firstIndex+1 > maxSizeOfRecentEntry {
-		if err := walLog.TruncateFront(lastIndex - maxSizeOfRecentEntry + 1); err != nil {
+		newFirstIndex := lastIndex - maxSizeOfRecentEntry + 1
+		if err := walLog.TruncateFront(newFirstIndex); err != nil {
 			log.Error("Failed to truncate votes journal", "err", err)
+		} else {
+			voteJournalTruncateCounter.Inc(1)
+			return newFirstIndex, nil
 		}
 	}
+	return 0, nil
+}
+
+// reopen loads the WAL again from disk. The current WAL is only closed once the
+// new one was opened, so a failed reopen leaves the journal usable.
+//
+// The caller must hold the journal lock.
+func (journal *VoteJournal) reopen() error {
+	// A write failing midway leaves a torn entry at the end of the WAL, which
+	// would fail loading it on every attempt
+	if err := repairTail(journal.journalPath, journal.walOptions.LogFormat); err != nil {
+		return err
+	}
+	walLog, err := wal.Open(journal.journalPath, journal.walOptions)
+	if err != nil {
+		return err
+	}
+	old := journal.walLog
+	journal.walLog = walLog
 
-	journal.voteDataBuffer.Add(voteMessage.Data.TargetNumber, voteMessage.Data)
+	if err := old.Close(); err != nil {
+		log.Warn("Failed to close stale vote journal", "err", err)
+	}
 	return nil
 }
 
+// repairTail truncates the last segment of the WAL at the given path to its
+// complete entries, dropping a torn entry left behind by a partial write.
+func repairTail(path string, format wal.LogFormat) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	// Segments are named after their zero padded first index, so the last one
+	// sorts last
+	var last string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || len(name) != 20 {
+			continue
+		}
+		if _, err := strconv.ParseUint(name, 10, 64); err != nil {
+			continue
+		}
+		last = max(last, name)
+	}
+	if last == "" {
+		return nil
+	}
+	segment := filepath.Join(path, last)
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		return err
+	}
+	size := completeEntries(data, format)
+	if size == len(data) {
+		return nil
+	}
+	log.Warn("Truncating torn vote journal entry", "segment", last, "size", len(data), "valid", size)
+	return os.Truncate(segment, int64(size))
+}
+
+// completeEntries returns the length of the longest prefix of a WAL segment made
+// up of complete entries in the given framing.
+func completeEntries(data []byte, format wal.LogFormat) int {
+	if format == wal.JSON {
+		// Entries are newline terminated and never contain one themselves
+		return bytes.LastIndexByte(data, '\n') + 1
+	}
+	var pos int
+	for pos < len(data) {
+		size, n := binary.Uvarint(data[pos:])
+		if n <= 0 || uint64(len(data)-pos-n) < size {
+			break
+		}
+		pos += n + int(size)
+	}
+	return pos
+}
+
+// Degraded reports whether the journal is keeping votes in memory only, as its
+// disk filled up.
+func (journal *VoteJournal) Degraded() bool {
+	journal.lock.RLock()
+	defer journal.lock.RUnlock()
+
+	return journal.degraded
+}
+
 func (journal *VoteJournal) ReadVote(index uint64) (*types.VoteEnvelope, error) {
+	journal.lock.RLock()
 	voteMessage, err := journal.walLog.Read(index)
+	journal.lock.RUnlock()
+
 	if err != nil && err != wal.ErrNotFound {
 		log.Error("Failed to read votes journal", "err", err)
 		return nil, err
@@ -118,3 +408,60 @@ func (journal *VoteJournal) ReadVote(index uint64) (*types.VoteEnvelope, error)
 
 	return vote, nil
 }
+
+// Sync forces the journal to be flushed to disk. It's only needed if the journal
+// was opened without SyncOnWrite, e.g. right before a planned restart.
+func (journal *VoteJournal) Sync() error {
+	journal.lock.RLock()
+	defer journal.lock.RUnlock()
+
+	if err := journal.walLog.Sync(); err != nil {
+		log.Error("Failed to sync vote journal", "err", err)
+		return err
+	}
+	return nil
+}
+
+// VoteCursor iterates over the votes of a journal in index order, reading them
+// lazily one by one instead of loading everything at once.
+type VoteCursor struct {
+	journal *VoteJournal
+	next    uint64 // Index of the next entry to read
+	last    uint64 // Index of the last entry to read, captured at creation
+}
+
+// NewCursor creates a cursor over the votes currently in the journal, from the
+// first index to the last one. Votes written after the creation are not visited.
+func (journal *VoteJournal) NewCursor() *VoteCursor {
+	cursor := &VoteCursor{journal: journal, next: 1}
+
+	journal.lock.RLock()
+	defer journal.lock.RUnlock()
+
+	firstIndex, err := journal.walLog.FirstIndex()
+	if err != nil {
+		log.Error("Failed to get first index of votes journal", "err", err)
+		return cursor
+	}
+	lastIndex, err := journal.walLog.LastIndex()
+	if err != nil {
+		log.Error("Failed to get lastIndex of vote journal", "err", err)
+		return cursor
+	}
+	cursor.next, cursor.last = firstIndex, lastIndex
+	return cursor
+}
+
+// Next returns the next vote of the journal, skipping over the entries that are
+// missing or can't be decoded. The boolean is false once the cursor is exhausted.
+func (cursor *VoteCursor) Next() (*types.VoteEnvelope, bool) {
+	for cursor.next != 0 && cursor.next <= cursor.last {
+		index := cursor.next
+		cursor.next++
+
+		if vote, err := cursor.journal.ReadVote(index); err == nil && vote != nil {
+			return vote, true
+		}
+	}
+	return nil, false
+}
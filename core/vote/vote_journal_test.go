@@ -0,0 +1,456 @@
+package vote
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tidwall/wal"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func newTestVote(number uint64) *types.VoteEnvelope {
+	return &types.VoteEnvelope{
+		Data: &types.VoteData{
+			SourceNumber: number - 1,
+			SourceHash:   common.Hash{byte(number - 1)},
+			TargetNumber: number,
+			TargetHash:   common.Hash{byte(number)},
+		},
+	}
+}
+
+// Tests that votes written to a journal without per-write fsync survive a
+// reopen once the journal was explicitly synced.
+func TestVoteJournalSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "voteJournal")
+
+	journal, err := NewVoteJournalWithConfig(path, JournalConfig{SyncOnWrite: false})
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		if err := journal.WriteVote(newTestVote(i)); err != nil {
+			t.Fatalf("failed to write vote %d: %v", i, err)
+		}
+	}
+	if err := journal.Sync(); err != nil {
+		t.Fatalf("failed to sync journal: %v", err)
+	}
+	if err := journal.walLog.Close(); err != nil {
+		t.Fatalf("failed to close journal: %v", err)
+	}
+	// Reopen the journal and ensure everything was reloaded
+	journal, err = NewVoteJournal(path)
+	if err != nil {
+		t.Fatalf("failed to reopen journal: %v", err)
+	}
+	defer journal.walLog.Close()
+
+	for i := uint64(1); i <= 10; i++ {
+		vote, err := journal.ReadVote(i)
+		if err != nil {
+			t.Fatalf("failed to read vote %d: %v", i, err)
+		}
+		if vote == nil || vote.Data.TargetNumber != i {
+			t.Fatalf("vote %d mismatch: have %v", i, vote)
+		}
+		if data, ok := journal.voteDataBuffer.Get(i); !ok || data.TargetHash != (common.Hash{byte(i)}) {
+			t.Fatalf("vote %d not reloaded into buffer", i)
+		}
+	}
+}
+
+// Tests that writing past the retention window truncates the journal and that
+// the truncation is reported.
+func TestVoteJournalTruncateEvent(t *testing.T) {
+	var truncated []uint64
+	journal, err := NewVoteJournalWithConfig(filepath.Join(t.TempDir(), "voteJournal"), JournalConfig{
+		OnTruncate: func(firstIndex uint64) { truncated = append(truncated, firstIndex) },
+	})
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	defer journal.walLog.Close()
+
+	count := voteJournalTruncateCounter.Snapshot().Count()
+	for i := uint64(1); i <= maxSizeOfRecentEntry; i++ {
+		if err := journal.WriteVote(newTestVote(i)); err != nil {
+			t.Fatalf("failed to write vote %d: %v", i, err)
+		}
+	}
+	if len(truncated) != 0 {
+		t.Fatalf("journal truncated within retention window: %v", truncated)
+	}
+	for i := uint64(maxSizeOfRecentEntry + 1); i <= maxSizeOfRecentEntry+3; i++ {
+		if err := journal.WriteVote(newTestVote(i)); err != nil {
+			t.Fatalf("failed to write vote %d: %v", i, err)
+		}
+	}
+	if want := []uint64{2, 3, 4}; !slices.Equal(truncated, want) {
+		t.Fatalf("truncation events mismatch: have %v, want %v", truncated, want)
+	}
+	if have := voteJournalTruncateCounter.Snapshot().Count() - count; have != 3 {
+		t.Fatalf("truncation counter mismatch: have %d, want 3", have)
+	}
+	if first, _ := journal.walLog.FirstIndex(); first != 4 {
+		t.Fatalf("first index mismatch: have %d, want 4", first)
+	}
+}
+
+// Tests that the cursor streams all the votes of the journal in order, skipping
+// the gaps and stopping at the last index known at creation.
+func TestVoteJournalCursor(t *testing.T) {
+	journal, err := NewVoteJournal(filepath.Join(t.TempDir(), "voteJournal"))
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	defer journal.walLog.Close()
+
+	if vote, ok := journal.NewCursor().Next(); ok {
+		t.Fatalf("empty journal yielded vote %v", vote)
+	}
+	for i := uint64(1); i <= 7; i++ {
+		if i == 5 {
+			// Corrupt entry, which should be skipped over
+			if err := journal.walLog.Write(i, []byte("corrupt")); err != nil {
+				t.Fatalf("failed to write corrupt entry: %v", err)
+			}
+			continue
+		}
+		if err := journal.WriteVote(newTestVote(i)); err != nil {
+			t.Fatalf("failed to write vote %d: %v", i, err)
+		}
+	}
+	cursor := journal.NewCursor()
+
+	// Drop the first entry and append a new one after the cursor was created
+	if err := journal.walLog.TruncateFront(2); err != nil {
+		t.Fatalf("failed to truncate journal: %v", err)
+	}
+	if err := journal.WriteVote(newTestVote(8)); err != nil {
+		t.Fatalf("failed to write vote: %v", err)
+	}
+	var have []uint64
+	for {
+		vote, ok := cursor.Next()
+		if !ok {
+			break
+		}
+		have = append(have, vote.Data.TargetNumber)
+	}
+	if want := []uint64{2, 3, 4, 6, 7}; !slices.Equal(have, want) {
+		t.Fatalf("cursor votes mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that a journal created with binary framing can be written and read, and
+// that reopening it requires the recorded framing.
+func TestVoteJournalBinaryFraming(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "voteJournal")
+
+	journal, err := NewVoteJournalWithConfig(path, JournalConfig{SyncOnWrite: true, BinaryFraming: true})
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		if err := journal.WriteVote(newTestVote(i)); err != nil {
+			t.Fatalf("failed to write vote %d: %v", i, err)
+		}
+	}
+	if err := journal.walLog.Close(); err != nil {
+		t.Fatalf("failed to close journal: %v", err)
+	}
+	if blob, err := os.ReadFile(filepath.Join(path, framingFile)); err != nil || string(blob) != framingBinary {
+		t.Fatalf("recorded framing mismatch: have %q (err %v), want %q", blob, err, framingBinary)
+	}
+	// Reopening the journal with the default JSON framing must be refused
+	if _, err := NewVoteJournal(path); err == nil {
+		t.Fatalf("journal opened with mismatching framing")
+	}
+	journal, err = NewVoteJournalWithConfig(path, JournalConfig{SyncOnWrite: true, BinaryFraming: true})
+	if err != nil {
+		t.Fatalf("failed to reopen journal: %v", err)
+	}
+	defer journal.walLog.Close()
+
+	for i := uint64(1); i <= 10; i++ {
+		vote, err := journal.ReadVote(i)
+		if err != nil {
+			t.Fatalf("failed to read vote %d: %v", i, err)
+		}
+		if vote == nil || vote.Data.TargetNumber != i || vote.Data.TargetHash != (common.Hash{byte(i)}) {
+			t.Fatalf("vote %d mismatch: have %v", i, vote)
+		}
+	}
+	if err := journal.WriteVote(newTestVote(11)); err != nil {
+		t.Fatalf("failed to write vote after reopen: %v", err)
+	}
+	if vote, err := journal.ReadVote(11); err != nil || vote == nil || vote.Data.TargetNumber != 11 {
+		t.Fatalf("vote after reopen mismatch: have %v (err %v)", vote, err)
+	}
+}
+
+// Tests that journals predating the framing recording are treated as JSON framed
+// and that the framing is only recorded when a journal is created.
+func TestVoteJournalLegacyFraming(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "voteJournal")
+
+	journal, err := NewVoteJournal(path)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	if err := journal.WriteVote(newTestVote(1)); err != nil {
+		t.Fatalf("failed to write vote: %v", err)
+	}
+	journal.walLog.Close()
+
+	if err := os.Remove(filepath.Join(path, framingFile)); err != nil {
+		t.Fatalf("failed to remove framing record: %v", err)
+	}
+	if _, err := NewVoteJournalWithConfig(path, JournalConfig{SyncOnWrite: true, BinaryFraming: true}); err == nil {
+		t.Fatalf("legacy journal opened with binary framing")
+	}
+	journal, err = NewVoteJournal(path)
+	if err != nil {
+		t.Fatalf("failed to reopen legacy journal: %v", err)
+	}
+	defer journal.walLog.Close()
+
+	if vote, err := journal.ReadVote(1); err != nil || vote == nil || vote.Data.TargetNumber != 1 {
+		t.Fatalf("legacy vote mismatch: have %v (err %v)", vote, err)
+	}
+	if _, err := os.Stat(filepath.Join(path, framingFile)); !os.IsNotExist(err) {
+		t.Fatalf("framing recorded on reopen: %v", err)
+	}
+}
+
+// Tests that the journal keeps votes in memory only while its disk is full and
+// resumes persisting them once there's space again.
+func TestVoteJournalDiskFull(t *testing.T) {
+	defer func(interval time.Duration) { degradedRetryInterval = interval }(degradedRetryInterval)
+	degradedRetryInterval = time.Hour
+
+	journal, err := NewVoteJournal(filepath.Join(t.TempDir(), "voteJournal"))
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	defer func() { journal.walLog.Close() }()
+
+	if err := journal.WriteVote(newTestVote(1)); err != nil {
+		t.Fatalf("failed to write vote: %v", err)
+	}
+	// Fill up the disk and ensure votes are retained in memory without errors
+	var attempts int
+	journal.writeEntry = func(walLog *wal.Log, index uint64, data []byte) error {
+		attempts++
+		return &os.PathError{Op: "write", Path: "segment", Err: syscall.ENOSPC}
+	}
+	for i := uint64(2); i <= 3; i++ {
+		if err := journal.WriteVote(newTestVote(i)); err != nil {
+			t.Fatalf("failed to write vote %d on full disk: %v", i, err)
+		}
+		if !journal.voteDataBuffer.Contains(i) {
+			t.Fatalf("vote %d missing from memory", i)
+		}
+	}
+	if !journal.Degraded() {
+		t.Fatalf("journal not degraded on full disk")
+	}
+	if attempts != 1 {
+		t.Fatalf("write attempts mismatch before retry interval: have %d, want 1", attempts)
+	}
+	// Free up space and ensure the journal recovers on the next retry
+	journal.writeEntry = (*wal.Log).Write
+	degradedRetryInterval = 0
+
+	if err := journal.WriteVote(newTestVote(4)); err != nil {
+		t.Fatalf("failed to write vote after recovery: %v", err)
+	}
+	if journal.Degraded() {
+		t.Fatalf("journal still degraded after recovery")
+	}
+	var have []uint64
+	for cursor := journal.NewCursor(); ; {
+		vote, ok := cursor.Next()
+		if !ok {
+			break
+		}
+		have = append(have, vote.Data.TargetNumber)
+	}
+	if want := []uint64{1, 4}; !slices.Equal(have, want) {
+		t.Fatalf("persisted votes mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that a degraded journal recovers even if the failed write left a torn
+// entry behind, by truncating it before reopening the WAL.
+func TestVoteJournalTornWrite(t *testing.T) {
+	defer func(interval time.Duration) { degradedRetryInterval = interval }(degradedRetryInterval)
+	degradedRetryInterval = 0
+
+	for _, binary := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "voteJournal")
+		journal, err := NewVoteJournalWithConfig(path, JournalConfig{SyncOnWrite: true, BinaryFraming: binary})
+		if err != nil {
+			t.Fatalf("binary %v: failed to open journal: %v", binary, err)
+		}
+		if err := journal.WriteVote(newTestVote(1)); err != nil {
+			t.Fatalf("binary %v: failed to write vote: %v", binary, err)
+		}
+		// Run out of space halfway through writing the next entry
+		torn := []byte(`{"index":"2","data":"+{`)
+		if binary {
+			torn = []byte{100, 0x7b, 0x22}
+		}
+		journal.writeEntry = func(walLog *wal.Log, index uint64, data []byte) error {
+			segment, err := os.OpenFile(filepath.Join(path, "00000000000000000001"), os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			defer segment.Close()
+
+			if _, err := segment.Write(torn); err != nil {
+				return err
+			}
+			return &os.PathError{Op: "write", Path: "segment", Err: syscall.ENOSPC}
+		}
+		if err := journal.WriteVote(newTestVote(2)); err != nil {
+			t.Fatalf("binary %v: failed to write vote on full disk: %v", binary, err)
+		}
+		if !journal.Degraded() {
+			t.Fatalf("binary %v: journal not degraded on full disk", binary)
+		}
+		// Free up space and ensure the journal recovers on the next retry
+		journal.writeEntry = (*wal.Log).Write
+		if err := journal.WriteVote(newTestVote(3)); err != nil {
+			t.Fatalf("binary %v: failed to write vote after recovery: %v", binary, err)
+		}
+		if journal.Degraded() {
+			t.Fatalf("binary %v: journal still degraded after recovery", binary)
+		}
+		journal.walLog.Close()
+
+		// Ensure the journal loads cleanly again with the recovered votes
+		journal, err = NewVoteJournalWithConfig(path, JournalConfig{SyncOnWrite: true, BinaryFraming: binary})
+		if err != nil {
+			t.Fatalf("binary %v: failed to reopen journal: %v", binary, err)
+		}
+		var have []uint64
+		for cursor := journal.NewCursor(); ; {
+			vote, ok := cursor.Next()
+			if !ok {
+				break
+			}
+			have = append(have, vote.Data.TargetNumber)
+		}
+		journal.walLog.Close()
+
+		if want := []uint64{1, 3}; !slices.Equal(have, want) {
+			t.Fatalf("binary %v: persisted votes mismatch: have %v, want %v", binary, have, want)
+		}
+	}
+}
+
+// Tests that a failed reopen of a degraded journal keeps the current WAL open,
+// so the persisted votes remain readable.
+func TestVoteJournalFailedReopen(t *testing.T) {
+	defer func(interval time.Duration) { degradedRetryInterval = interval }(degradedRetryInterval)
+	degradedRetryInterval = 0
+
+	journal, err := NewVoteJournal(filepath.Join(t.TempDir(), "voteJournal"))
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	defer func() { journal.walLog.Close() }()
+
+	if err := journal.WriteVote(newTestVote(1)); err != nil {
+		t.Fatalf("failed to write vote: %v", err)
+	}
+	journal.writeEntry = func(walLog *wal.Log, index uint64, data []byte) error {
+		return &os.PathError{Op: "write", Path: "segment", Err: syscall.ENOSPC}
+	}
+	if err := journal.WriteVote(newTestVote(2)); err != nil {
+		t.Fatalf("failed to write vote on full disk: %v", err)
+	}
+	// Make the journal unopenable and ensure the retry leaves the WAL usable
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatalf("failed to create blocker: %v", err)
+	}
+	journal.journalPath = filepath.Join(blocker, "voteJournal")
+
+	if err := journal.WriteVote(newTestVote(3)); err != nil {
+		t.Fatalf("failed to write vote on failed reopen: %v", err)
+	}
+	if vote, err := journal.ReadVote(1); err != nil || vote == nil || vote.Data.TargetNumber != 1 {
+		t.Fatalf("vote after failed reopen mismatch: have %v (err %v)", vote, err)
+	}
+	if !journal.Degraded() {
+		t.Fatalf("journal recovered despite failed reopen")
+	}
+}
+
+// Tests that reopening a degraded journal is safe against concurrent reads,
+// syncs and cursors.
+func TestVoteJournalConcurrentReopen(t *testing.T) {
+	defer func(interval time.Duration) { degradedRetryInterval = interval }(degradedRetryInterval)
+	degradedRetryInterval = 0
+
+	journal, err := NewVoteJournalWithConfig(filepath.Join(t.TempDir(), "voteJournal"), JournalConfig{SyncOnWrite: false})
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	defer func() { journal.walLog.Close() }()
+
+	if err := journal.WriteVote(newTestVote(1)); err != nil {
+		t.Fatalf("failed to write vote: %v", err)
+	}
+	// Fail every write, reopening the WAL on each subsequent attempt
+	journal.writeEntry = func(walLog *wal.Log, index uint64, data []byte) error {
+		return &os.PathError{Op: "write", Path: "segment", Err: syscall.ENOSPC}
+	}
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if vote, err := journal.ReadVote(1); err != nil || vote == nil {
+					t.Errorf("failed to read vote: %v (err %v)", vote, err)
+					return
+				}
+				if err := journal.Sync(); err != nil {
+					t.Errorf("failed to sync journal: %v", err)
+					return
+				}
+				for cursor := journal.NewCursor(); ; {
+					if _, ok := cursor.Next(); !ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	for i := uint64(2); i < 100; i++ {
+		if err := journal.WriteVote(newTestVote(i)); err != nil {
+			t.Fatalf("failed to write vote %d: %v", i, err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
@@ -337,27 +337,29 @@ func New(stack *node.Node, config *ethconfig.Config) (*Ethereum, error) {
 
 	var (
 		options = &core.BlockChainConfig{
-			TrieCleanLimit:        config.TrieCleanCache,
-			NoPrefetch:            config.NoPrefetch,
-			TrieDirtyLimit:        config.TrieDirtyCache,
-			ArchiveMode:           config.NoPruning,
-			TrieTimeLimit:         config.TrieTimeout,
-			NoTries:               noTries,
-			SnapshotLimit:         config.SnapshotCache,
-			TriesInMemory:         config.TriesInMemory,
-			Preimages:             config.Preimages,
-			StateHistory:          config.StateHistory,
-			StateScheme:           config.StateScheme,
-			PathSyncFlush:         config.PathSyncFlush,
-			EnableIncr:            config.EnableIncrSnapshots,
-			IncrHistoryPath:       config.IncrSnapshotPath,
-			IncrHistory:           config.IncrSnapshotBlockInterval,
-			IncrStateBuffer:       config.IncrSnapshotStateBuffer,
-			IncrKeptBlocks:        config.IncrSnapshotKeptBlocks,
-			UseRemoteIncrSnapshot: config.UseRemoteIncrSnapshot,
-			RemoteIncrURL:         config.RemoteIncrSnapshotURL,
-			ChainHistoryMode:      config.HistoryMode,
-			TxLookupLimit:         int64(min(config.TransactionHistory, math.MaxInt64)),
+			TrieCleanLimit:             config.TrieCleanCache,
+			NoPrefetch:                 config.NoPrefetch,
+			PrefetchThreads:            config.PrefetchThreads,
+			PrefetchSkipPlainTransfers: config.PrefetchSkipPlainTransfers,
+			TrieDirtyLimit:             config.TrieDirtyCache,
+			ArchiveMode:                config.NoPruning,
+			TrieTimeLimit:              config.TrieTimeout,
+			NoTries:                    noTries,
+			SnapshotLimit:              config.SnapshotCache,
+			TriesInMemory:              config.TriesInMemory,
+			Preimages:                  config.Preimages,
+			StateHistory:               config.StateHistory,
+			StateScheme:                config.StateScheme,
+			PathSyncFlush:              config.PathSyncFlush,
+			EnableIncr:                 config.EnableIncrSnapshots,
+			IncrHistoryPath:            config.IncrSnapshotPath,
+			IncrHistory:                config.IncrSnapshotBlockInterval,
+			IncrStateBuffer:            config.IncrSnapshotStateBuffer,
+			IncrKeptBlocks:             config.IncrSnapshotKeptBlocks,
+			UseRemoteIncrSnapshot:      config.UseRemoteIncrSnapshot,
+			RemoteIncrURL:              config.RemoteIncrSnapshotURL,
+			ChainHistoryMode:           config.HistoryMode,
+			TxLookupLimit:              int64(min(config.TransactionHistory, math.MaxInt64)),
 			VmConfig: vm.Config{
 				EnablePreimageRecording:   config.EnablePreimageRecording,
 				EnableOpcodeOptimizations: config.EnableOpcodeOptimizing,
@@ -465,10 +467,12 @@ func New(stack *node.Node, config *ethconfig.Config) (*Ethereum, error) {
 		DirectBroadcast:           config.DirectBroadcast,
 		EnableEVNFeatures:         stack.Config().EnableEVNFeatures,
 		EVNNodeIdsWhitelist:       stack.Config().P2P.EVNNodeIdsWhitelist,
+		EVNTrustedValidators:      config.PeerSet.TrustedValidators,
 		ProxyedValidatorAddresses: stack.Config().P2P.ProxyedValidatorAddresses,
 		ProxyedNodeIds:            stack.Config().P2P.ProxyedNodeIds,
 		DisablePeerTxBroadcast:    config.DisablePeerTxBroadcast,
-		PeerSet:                   newPeerSet(),
+		PeerSet:                   newPeerSetWithConfig(config.PeerSet),
+		PeerDrainTimeout:          config.PeerSet.DrainTimeout,
 		EnableQuickBlockFetching:  stack.Config().EnableQuickBlockFetching,
 	}); err != nil {
 		return nil, err
@@ -872,7 +876,7 @@ func (s *Ethereum) Start() error {
 	go s.reportRecentBlocksLoop()
 
 	// Start the connection manager
-	s.dropper.Start(s.p2pServer, func() bool { return !s.Synced() })
+	s.dropper.Start(s.p2pServer, func() bool { return !s.Synced() }, s.handler.peers.peerSendFailures)
 
 	// start log indexer
 	s.filterMaps.Start()
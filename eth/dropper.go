@@ -59,6 +59,7 @@ type dropper struct {
 	maxInboundPeers int // maximum number of inbound peers
 	peersFunc       getPeersFunc
 	syncingFunc     getSyncingFunc
+	failuresFunc    getSendFailuresFunc // Optional, prefers dropping peers failing sends
 
 	// peerDropTimer introduces churn if we are close to limit capacity.
 	// We handle Dialed and Inbound connections separately
@@ -75,6 +76,9 @@ type getPeersFunc func() []*p2p.Peer
 // Returns true while syncing, false when synced.
 type getSyncingFunc func() bool
 
+// Callback type to get the number of consecutive failed sends to a peer.
+type getSendFailuresFunc func(id string) int
+
 func newDropper(maxDialPeers, maxInboundPeers int) *dropper {
 	cm := &dropper{
 		maxDialPeers:    maxDialPeers,
@@ -88,10 +92,12 @@ func newDropper(maxDialPeers, maxInboundPeers int) *dropper {
 	return cm
 }
 
-// Start the dropper.
-func (cm *dropper) Start(srv *p2p.Server, syncingFunc getSyncingFunc) {
+// Start the dropper. The send failures callback is optional, if set, peers with
+// the most consecutive send failures are preferred when dropping.
+func (cm *dropper) Start(srv *p2p.Server, syncingFunc getSyncingFunc, failuresFunc getSendFailuresFunc) {
 	cm.peersFunc = srv.Peers
 	cm.syncingFunc = syncingFunc
+	cm.failuresFunc = failuresFunc
 	cm.wg.Add(1)
 	go cm.loop()
 }
@@ -125,6 +131,9 @@ func (cm *dropper) dropRandomPeer() bool {
 	}
 
 	droppable := slices.DeleteFunc(peers, selectDoNotDrop)
+	if cm.failuresFunc != nil {
+		droppable = mostFailingPeers(droppable, cm.failuresFunc)
+	}
 	if len(droppable) > 0 {
 		p := droppable[mrand.Intn(len(droppable))]
 		log.Debug("Dropping random peer", "inbound", p.Inbound(),
@@ -140,6 +149,29 @@ func (cm *dropper) dropRandomPeer() bool {
 	return false
 }
 
+// mostFailingPeers narrows the peers down to the ones with the most consecutive
+// send failures. If none of them failed a send, all the peers are returned.
+func mostFailingPeers(peers []*p2p.Peer, failuresFunc getSendFailuresFunc) []*p2p.Peer {
+	var (
+		worst []*p2p.Peer
+		most  int
+	)
+	for _, p := range peers {
+		failures := failuresFunc(p.ID().String())
+		switch {
+		case failures == 0 || failures < most:
+			continue
+		case failures > most:
+			worst, most = worst[:0], failures
+		}
+		worst = append(worst, p)
+	}
+	if len(worst) == 0 {
+		return peers
+	}
+	return worst
+}
+
 // randomDuration generates a random duration between min and max.
 func randomDuration(min, max time.Duration) time.Duration {
 	if min > max {
@@ -80,6 +80,15 @@ var Defaults = Config{
 	RPCTxFeeCap:            1,                                         // 1 ether
 	BlobExtraReserve:       params.DefaultExtraReserveForBlobRequests, // Extra reserve threshold for blob, blob never expires when -1 is set, default 28800
 	EnableOpcodeOptimizing: false,
+	PeerSet:                DefaultPeerSetConfig,
+}
+
+// DefaultPeerSetConfig contains the default settings of the set of connected peers.
+var DefaultPeerSetConfig = PeerSetConfig{
+	ExtensionWaitTimeout: 10 * time.Second,
+	MaxExtensionWaits:    1024,
+	MaxRegisterBackoff:   time.Minute,
+	RequestFailureWindow: 30 * time.Second,
 }
 
 //go:generate go run github.com/fjl/gencodec -type Config -formats toml -out gen_config.go
@@ -117,10 +126,16 @@ type Config struct {
 	NoPruning  bool // Whether to disable pruning and flush everything to disk
 	NoPrefetch bool // Whether to disable prefetching and only load state on demand
 
+	PrefetchThreads            int  // Number of state prefetch workers during block import, zero for the defaults
+	PrefetchSkipPlainTransfers bool // Whether to skip prefetching plain value transfers to accounts without code
+
 	DirectBroadcast     bool
 	DisableSnapProtocol bool // Whether disable snap protocol
 	RangeLimit          bool
 
+	// Peer set options
+	PeerSet PeerSetConfig
+
 	// Deprecated: use 'TransactionHistory' instead.
 	TxLookupLimit uint64 `toml:",omitempty"` // The maximum number of blocks from head whose tx indices are reserved.
 
@@ -261,6 +276,64 @@ type Config struct {
 	RemoteIncrSnapshotURL     string
 }
 
+// PeerSetConfig contains the tuning options of the set of connected peers.
+type PeerSetConfig struct {
+	// ExtensionWaitTimeout is the maximum time to wait for the snap or bsc
+	// extension of a peer to connect before dropping it as malicious. Congested
+	// networks may need a longer timeout for legitimate peers.
+	ExtensionWaitTimeout time.Duration
+
+	// MaxExtensionWaits is the maximum number of peers waiting for their snap or
+	// bsc extension concurrently. Beyond it, new waits fail fast instead of each
+	// holding a goroutine until the timeout. Zero disables the cap.
+	MaxExtensionWaits int
+
+	// RegisterRetries is the number of times an extension registration colliding
+	// with an existing or pending peer is retried, RegisterRetryDelay apart. This
+	// tolerates the overlap of a fast reconnect with the teardown of the old
+	// connection. Zero rejects collisions right away.
+	RegisterRetries    int
+	RegisterRetryDelay time.Duration
+
+	// LaggingThreshold is the total difficulty distance from the best peer beyond
+	// which a peer is considered lagging and skipped as a sync source. With Parlia
+	// each block adds at most 2 to the total difficulty, so the threshold is about
+	// twice the number of blocks a peer may fall behind. Zero disables the check,
+	// leaving only peers explicitly marked by the downloader as lagging.
+	LaggingThreshold uint64
+
+	// TxBroadcastDedupWindow is the time window within which a peer is not
+	// reselected for propagating the same transaction hash, covering the lag until
+	// its known transactions are updated. Zero disables the deduplication.
+	TxBroadcastDedupWindow time.Duration
+
+	// KnownHashMemoryCap is the memory allowance in bytes of all peers' known
+	// block, transaction and vote caches combined. Exceeding it trims the caches
+	// of all peers proportionally. Zero disables the cap.
+	KnownHashMemoryCap uint64
+
+	// RegisterBackoff is the time registrations of a peer id are rejected after
+	// repeated failed ones, doubling with every further consecutive failure up to
+	// MaxRegisterBackoff. This breaks tight reconnect loops hammering the peer
+	// registration. Zero disables the backoff.
+	RegisterBackoff    time.Duration
+	MaxRegisterBackoff time.Duration
+
+	// RequestFailureWindow is the time a peer is avoided for block requests
+	// after failing one.
+	RequestFailureWindow time.Duration
+
+	// DrainTimeout is the maximum time to wait on shutdown for the connections
+	// still negotiating their extensions to settle before disconnecting all the
+	// peers, while rejecting new ones. Zero disconnects right away.
+	DrainTimeout time.Duration
+
+	// TrustedValidators are node ids manually marked as trusted validators. With
+	// the EVN features enabled, they are always flagged as EVN peers, regardless
+	// of the on-chain validator set and the whitelist.
+	TrustedValidators []enode.ID
+}
+
 // CreateConsensusEngine creates a consensus engine for the given chain config.
 // Clique is allowed for now to live standalone, but ethash is forbidden and can
 // only exist on already merged networks.
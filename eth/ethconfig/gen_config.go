@@ -18,81 +18,84 @@ import (
 // MarshalTOML marshals as TOML.
 func (c Config) MarshalTOML() (interface{}, error) {
 	type Config struct {
-		Genesis                   *core.Genesis `toml:",omitempty"`
-		NetworkId                 uint64
-		SyncMode                  SyncMode
-		DisablePeerTxBroadcast    bool
-		EVNNodeIDsToAdd           []enode.ID
-		EVNNodeIDsToRemove        []enode.ID
-		HistoryMode               history.HistoryMode
-		EthDiscoveryURLs          []string
-		SnapDiscoveryURLs         []string
-		BscDiscoveryURLs          []string
-		NoPruning                 bool
-		NoPrefetch                bool
-		DirectBroadcast           bool
-		DisableSnapProtocol       bool
-		RangeLimit                bool
-		TxLookupLimit             uint64 `toml:",omitempty"`
-		TransactionHistory        uint64 `toml:",omitempty"`
-		BlockHistory              uint64 `toml:",omitempty"`
-		LogHistory                uint64 `toml:",omitempty"`
-		LogNoHistory              bool   `toml:",omitempty"`
-		LogExportCheckpoints      string
-		StateHistory              uint64                 `toml:",omitempty"`
-		StateScheme               string                 `toml:",omitempty"`
-		PathSyncFlush             bool                   `toml:",omitempty"`
-		DisableTxIndexer          bool                   `toml:",omitempty"`
-		RequiredBlocks            map[uint64]common.Hash `toml:"-"`
-		SkipBcVersionCheck        bool                   `toml:"-"`
-		DatabaseHandles           int                    `toml:"-"`
-		DatabaseCache             int
-		DatabaseFreezer           string
-		DatabaseEra               string
-		PruneAncientData          bool
-		TrieCleanCache            int
-		TrieDirtyCache            int
-		TrieTimeout               time.Duration
-		SnapshotCache             int
-		TriesInMemory             uint64
-		TriesVerifyMode           core.VerifyMode
-		Preimages                 bool
-		FilterLogCacheSize        int
-		LogQueryLimit             int
-		Miner                     minerconfig.Config
-		TxPool                    legacypool.Config
-		BlobPool                  blobpool.Config
-		GPO                       gasprice.Config
-		EnablePreimageRecording   bool
-		EnableWitnessStats        bool
-		StatelessSelfValidation   bool
-		EnableStateSizeTracking   bool
-		VMTrace                   string
-		VMTraceJsonConfig         string
-		RPCGasCap                 uint64
-		RPCEVMTimeout             time.Duration
-		RPCTxFeeCap               float64
-		OverridePassedForkTime    *uint64       `toml:",omitempty"`
-		OverrideLorentz           *uint64       `toml:",omitempty"`
-		OverrideMaxwell           *uint64       `toml:",omitempty"`
-		OverrideFermi             *uint64       `toml:",omitempty"`
-		OverrideOsaka             *uint64       `toml:",omitempty"`
-		OverrideMendel            *uint64       `toml:",omitempty"`
-		OverridePasteur           *uint64       `toml:",omitempty"`
-		OverrideBPO1              *uint64       `toml:",omitempty"`
-		OverrideBPO2              *uint64       `toml:",omitempty"`
-		OverrideVerkle            *uint64       `toml:",omitempty"`
-		TxSyncDefaultTimeout      time.Duration `toml:",omitempty"`
-		TxSyncMaxTimeout          time.Duration `toml:",omitempty"`
-		BlobExtraReserve          uint64
-		EnableOpcodeOptimizing    bool
-		EnableIncrSnapshots       bool
-		IncrSnapshotPath          string
-		IncrSnapshotBlockInterval uint64
-		IncrSnapshotStateBuffer   uint64
-		IncrSnapshotKeptBlocks    uint64
-		UseRemoteIncrSnapshot     bool
-		RemoteIncrSnapshotURL     string
+		Genesis                    *core.Genesis `toml:",omitempty"`
+		NetworkId                  uint64
+		SyncMode                   SyncMode
+		DisablePeerTxBroadcast     bool
+		EVNNodeIDsToAdd            []enode.ID
+		EVNNodeIDsToRemove         []enode.ID
+		HistoryMode                history.HistoryMode
+		EthDiscoveryURLs           []string
+		SnapDiscoveryURLs          []string
+		BscDiscoveryURLs           []string
+		NoPruning                  bool
+		NoPrefetch                 bool
+		PrefetchThreads            int
+		PrefetchSkipPlainTransfers bool
+		DirectBroadcast            bool
+		DisableSnapProtocol        bool
+		RangeLimit                 bool
+		PeerSet                    PeerSetConfig
+		TxLookupLimit              uint64 `toml:",omitempty"`
+		TransactionHistory         uint64 `toml:",omitempty"`
+		BlockHistory               uint64 `toml:",omitempty"`
+		LogHistory                 uint64 `toml:",omitempty"`
+		LogNoHistory               bool   `toml:",omitempty"`
+		LogExportCheckpoints       string
+		StateHistory               uint64                 `toml:",omitempty"`
+		StateScheme                string                 `toml:",omitempty"`
+		PathSyncFlush              bool                   `toml:",omitempty"`
+		DisableTxIndexer           bool                   `toml:",omitempty"`
+		RequiredBlocks             map[uint64]common.Hash `toml:"-"`
+		SkipBcVersionCheck         bool                   `toml:"-"`
+		DatabaseHandles            int                    `toml:"-"`
+		DatabaseCache              int
+		DatabaseFreezer            string
+		DatabaseEra                string
+		PruneAncientData           bool
+		TrieCleanCache             int
+		TrieDirtyCache             int
+		TrieTimeout                time.Duration
+		SnapshotCache              int
+		TriesInMemory              uint64
+		TriesVerifyMode            core.VerifyMode
+		Preimages                  bool
+		FilterLogCacheSize         int
+		LogQueryLimit              int
+		Miner                      minerconfig.Config
+		TxPool                     legacypool.Config
+		BlobPool                   blobpool.Config
+		GPO                        gasprice.Config
+		EnablePreimageRecording    bool
+		EnableWitnessStats         bool
+		StatelessSelfValidation    bool
+		EnableStateSizeTracking    bool
+		VMTrace                    string
+		VMTraceJsonConfig          string
+		RPCGasCap                  uint64
+		RPCEVMTimeout              time.Duration
+		RPCTxFeeCap                float64
+		OverridePassedForkTime     *uint64       `toml:",omitempty"`
+		OverrideLorentz            *uint64       `toml:",omitempty"`
+		OverrideMaxwell            *uint64       `toml:",omitempty"`
+		OverrideFermi              *uint64       `toml:",omitempty"`
+		OverrideOsaka              *uint64       `toml:",omitempty"`
+		OverrideMendel             *uint64       `toml:",omitempty"`
+		OverridePasteur            *uint64       `toml:",omitempty"`
+		OverrideBPO1               *uint64       `toml:",omitempty"`
+		OverrideBPO2               *uint64       `toml:",omitempty"`
+		OverrideVerkle             *uint64       `toml:",omitempty"`
+		TxSyncDefaultTimeout       time.Duration `toml:",omitempty"`
+		TxSyncMaxTimeout           time.Duration `toml:",omitempty"`
+		BlobExtraReserve           uint64
+		EnableOpcodeOptimizing     bool
+		EnableIncrSnapshots        bool
+		IncrSnapshotPath           string
+		IncrSnapshotBlockInterval  uint64
+		IncrSnapshotStateBuffer    uint64
+		IncrSnapshotKeptBlocks     uint64
+		UseRemoteIncrSnapshot      bool
+		RemoteIncrSnapshotURL      string
 	}
 	var enc Config
 	enc.Genesis = c.Genesis
@@ -107,9 +110,12 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.BscDiscoveryURLs = c.BscDiscoveryURLs
 	enc.NoPruning = c.NoPruning
 	enc.NoPrefetch = c.NoPrefetch
+	enc.PrefetchThreads = c.PrefetchThreads
+	enc.PrefetchSkipPlainTransfers = c.PrefetchSkipPlainTransfers
 	enc.DirectBroadcast = c.DirectBroadcast
 	enc.DisableSnapProtocol = c.DisableSnapProtocol
 	enc.RangeLimit = c.RangeLimit
+	enc.PeerSet = c.PeerSet
 	enc.TxLookupLimit = c.TxLookupLimit
 	enc.TransactionHistory = c.TransactionHistory
 	enc.BlockHistory = c.BlockHistory
@@ -176,81 +182,84 @@ func (c Config) MarshalTOML() (interface{}, error) {
 // UnmarshalTOML unmarshals from TOML.
 func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	type Config struct {
-		Genesis                   *core.Genesis `toml:",omitempty"`
-		NetworkId                 *uint64
-		SyncMode                  *SyncMode
-		DisablePeerTxBroadcast    *bool
-		EVNNodeIDsToAdd           []enode.ID
-		EVNNodeIDsToRemove        []enode.ID
-		HistoryMode               *history.HistoryMode
-		EthDiscoveryURLs          []string
-		SnapDiscoveryURLs         []string
-		BscDiscoveryURLs          []string
-		NoPruning                 *bool
-		NoPrefetch                *bool
-		DirectBroadcast           *bool
-		DisableSnapProtocol       *bool
-		RangeLimit                *bool
-		TxLookupLimit             *uint64 `toml:",omitempty"`
-		TransactionHistory        *uint64 `toml:",omitempty"`
-		BlockHistory              *uint64 `toml:",omitempty"`
-		LogHistory                *uint64 `toml:",omitempty"`
-		LogNoHistory              *bool   `toml:",omitempty"`
-		LogExportCheckpoints      *string
-		StateHistory              *uint64                `toml:",omitempty"`
-		StateScheme               *string                `toml:",omitempty"`
-		PathSyncFlush             *bool                  `toml:",omitempty"`
-		DisableTxIndexer          *bool                  `toml:",omitempty"`
-		RequiredBlocks            map[uint64]common.Hash `toml:"-"`
-		SkipBcVersionCheck        *bool                  `toml:"-"`
-		DatabaseHandles           *int                   `toml:"-"`
-		DatabaseCache             *int
-		DatabaseFreezer           *string
-		DatabaseEra               *string
-		PruneAncientData          *bool
-		TrieCleanCache            *int
-		TrieDirtyCache            *int
-		TrieTimeout               *time.Duration
-		SnapshotCache             *int
-		TriesInMemory             *uint64
-		TriesVerifyMode           *core.VerifyMode
-		Preimages                 *bool
-		FilterLogCacheSize        *int
-		LogQueryLimit             *int
-		Miner                     *minerconfig.Config
-		TxPool                    *legacypool.Config
-		BlobPool                  *blobpool.Config
-		GPO                       *gasprice.Config
-		EnablePreimageRecording   *bool
-		EnableWitnessStats        *bool
-		StatelessSelfValidation   *bool
-		EnableStateSizeTracking   *bool
-		VMTrace                   *string
-		VMTraceJsonConfig         *string
-		RPCGasCap                 *uint64
-		RPCEVMTimeout             *time.Duration
-		RPCTxFeeCap               *float64
-		OverridePassedForkTime    *uint64        `toml:",omitempty"`
-		OverrideLorentz           *uint64        `toml:",omitempty"`
-		OverrideMaxwell           *uint64        `toml:",omitempty"`
-		OverrideFermi             *uint64        `toml:",omitempty"`
-		OverrideOsaka             *uint64        `toml:",omitempty"`
-		OverrideMendel            *uint64        `toml:",omitempty"`
-		OverridePasteur           *uint64        `toml:",omitempty"`
-		OverrideBPO1              *uint64        `toml:",omitempty"`
-		OverrideBPO2              *uint64        `toml:",omitempty"`
-		OverrideVerkle            *uint64        `toml:",omitempty"`
-		TxSyncDefaultTimeout      *time.Duration `toml:",omitempty"`
-		TxSyncMaxTimeout          *time.Duration `toml:",omitempty"`
-		BlobExtraReserve          *uint64
-		EnableOpcodeOptimizing    *bool
-		EnableIncrSnapshots       *bool
-		IncrSnapshotPath          *string
-		IncrSnapshotBlockInterval *uint64
-		IncrSnapshotStateBuffer   *uint64
-		IncrSnapshotKeptBlocks    *uint64
-		UseRemoteIncrSnapshot     *bool
-		RemoteIncrSnapshotURL     *string
+		Genesis                    *core.Genesis `toml:",omitempty"`
+		NetworkId                  *uint64
+		SyncMode                   *SyncMode
+		DisablePeerTxBroadcast     *bool
+		EVNNodeIDsToAdd            []enode.ID
+		EVNNodeIDsToRemove         []enode.ID
+		HistoryMode                *history.HistoryMode
+		EthDiscoveryURLs           []string
+		SnapDiscoveryURLs          []string
+		BscDiscoveryURLs           []string
+		NoPruning                  *bool
+		NoPrefetch                 *bool
+		PrefetchThreads            *int
+		PrefetchSkipPlainTransfers *bool
+		DirectBroadcast            *bool
+		DisableSnapProtocol        *bool
+		RangeLimit                 *bool
+		PeerSet                    *PeerSetConfig
+		TxLookupLimit              *uint64 `toml:",omitempty"`
+		TransactionHistory         *uint64 `toml:",omitempty"`
+		BlockHistory               *uint64 `toml:",omitempty"`
+		LogHistory                 *uint64 `toml:",omitempty"`
+		LogNoHistory               *bool   `toml:",omitempty"`
+		LogExportCheckpoints       *string
+		StateHistory               *uint64                `toml:",omitempty"`
+		StateScheme                *string                `toml:",omitempty"`
+		PathSyncFlush              *bool                  `toml:",omitempty"`
+		DisableTxIndexer           *bool                  `toml:",omitempty"`
+		RequiredBlocks             map[uint64]common.Hash `toml:"-"`
+		SkipBcVersionCheck         *bool                  `toml:"-"`
+		DatabaseHandles            *int                   `toml:"-"`
+		DatabaseCache              *int
+		DatabaseFreezer            *string
+		DatabaseEra                *string
+		PruneAncientData           *bool
+		TrieCleanCache             *int
+		TrieDirtyCache             *int
+		TrieTimeout                *time.Duration
+		SnapshotCache              *int
+		TriesInMemory              *uint64
+		TriesVerifyMode            *core.VerifyMode
+		Preimages                  *bool
+		FilterLogCacheSize         *int
+		LogQueryLimit              *int
+		Miner                      *minerconfig.Config
+		TxPool                     *legacypool.Config
+		BlobPool                   *blobpool.Config
+		GPO                        *gasprice.Config
+		EnablePreimageRecording    *bool
+		EnableWitnessStats         *bool
+		StatelessSelfValidation    *bool
+		EnableStateSizeTracking    *bool
+		VMTrace                    *string
+		VMTraceJsonConfig          *string
+		RPCGasCap                  *uint64
+		RPCEVMTimeout              *time.Duration
+		RPCTxFeeCap                *float64
+		OverridePassedForkTime     *uint64        `toml:",omitempty"`
+		OverrideLorentz            *uint64        `toml:",omitempty"`
+		OverrideMaxwell            *uint64        `toml:",omitempty"`
+		OverrideFermi              *uint64        `toml:",omitempty"`
+		OverrideOsaka              *uint64        `toml:",omitempty"`
+		OverrideMendel             *uint64        `toml:",omitempty"`
+		OverridePasteur            *uint64        `toml:",omitempty"`
+		OverrideBPO1               *uint64        `toml:",omitempty"`
+		OverrideBPO2               *uint64        `toml:",omitempty"`
+		OverrideVerkle             *uint64        `toml:",omitempty"`
+		TxSyncDefaultTimeout       *time.Duration `toml:",omitempty"`
+		TxSyncMaxTimeout           *time.Duration `toml:",omitempty"`
+		BlobExtraReserve           *uint64
+		EnableOpcodeOptimizing     *bool
+		EnableIncrSnapshots        *bool
+		IncrSnapshotPath           *string
+		IncrSnapshotBlockInterval  *uint64
+		IncrSnapshotStateBuffer    *uint64
+		IncrSnapshotKeptBlocks     *uint64
+		UseRemoteIncrSnapshot      *bool
+		RemoteIncrSnapshotURL      *string
 	}
 	var dec Config
 	if err := unmarshal(&dec); err != nil {
@@ -292,6 +301,12 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.NoPrefetch != nil {
 		c.NoPrefetch = *dec.NoPrefetch
 	}
+	if dec.PrefetchThreads != nil {
+		c.PrefetchThreads = *dec.PrefetchThreads
+	}
+	if dec.PrefetchSkipPlainTransfers != nil {
+		c.PrefetchSkipPlainTransfers = *dec.PrefetchSkipPlainTransfers
+	}
 	if dec.DirectBroadcast != nil {
 		c.DirectBroadcast = *dec.DirectBroadcast
 	}
@@ -301,6 +316,9 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.RangeLimit != nil {
 		c.RangeLimit = *dec.RangeLimit
 	}
+	if dec.PeerSet != nil {
+		c.PeerSet = *dec.PeerSet
+	}
 	if dec.TxLookupLimit != nil {
 		c.TxLookupLimit = *dec.TxLookupLimit
 	}
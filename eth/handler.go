@@ -141,9 +141,11 @@ type handlerConfig struct {
 	DirectBroadcast           bool
 	DisablePeerTxBroadcast    bool
 	PeerSet                   *peerSet
+	PeerDrainTimeout          time.Duration // Time to let in-flight peer connections settle on shutdown
 	EnableQuickBlockFetching  bool
 	EnableEVNFeatures         bool
 	EVNNodeIdsWhitelist       []enode.ID
+	EVNTrustedValidators      []enode.ID
 	ProxyedValidatorAddresses []common.Address
 	ProxyedNodeIds            []enode.ID
 }
@@ -176,6 +178,7 @@ type handler struct {
 	blockFetcher   *fetcher.BlockFetcher
 	txFetcher      *fetcher.TxFetcher
 	peers          *peerSet
+	peerDrain      time.Duration
 	txBroadcastKey [16]byte
 
 	eventMux       *event.TypeMux
@@ -221,6 +224,7 @@ func newHandler(config *handlerConfig) (*handler, error) {
 		votepool:                   config.VotePool,
 		chain:                      config.Chain,
 		peers:                      config.PeerSet,
+		peerDrain:                  config.PeerDrainTimeout,
 		txBroadcastKey:             newBroadcastChoiceKey(),
 		peersPerIP:                 make(map[string]int),
 		requiredBlocks:             config.RequiredBlocks,
@@ -237,6 +241,11 @@ func newHandler(config *handlerConfig) (*handler, error) {
 	for _, nodeID := range config.EVNNodeIdsWhitelist {
 		h.evnNodeIdsWhitelistMap[nodeID] = struct{}{}
 	}
+	if config.EnableEVNFeatures {
+		for _, nodeID := range config.EVNTrustedValidators {
+			h.peers.addTrustedValidator(nodeID)
+		}
+	}
 	for _, address := range config.ProxyedValidatorAddresses {
 		h.proxyedValidatorAddressMap[address] = struct{}{}
 	}
@@ -335,11 +344,7 @@ func newHandler(config *handlerConfig) (*handler, error) {
 		h.BroadcastBlock(block, propagate)
 	}
 
-	fetchRangeBlocks := func(peer string, startHeight uint64, startHash common.Hash, count uint64) ([]*types.Block, error) {
-		p := h.peers.peer(peer)
-		if p == nil {
-			return nil, errors.New("peer not found")
-		}
+	requestRangeBlocks := func(p *ethPeer, startHeight uint64, startHash common.Hash, count uint64) ([]*types.Block, error) {
 		if p.bscExt == nil {
 			return nil, fmt.Errorf("peer does not support bsc protocol, peer: %v", p.ID())
 		}
@@ -371,6 +376,27 @@ func newHandler(config *handlerConfig) (*handler, error) {
 		}
 		return blocks, err
 	}
+	fetchRangeBlocks := func(peer string, startHeight uint64, startHash common.Hash, count uint64) ([]*types.Block, error) {
+		p := h.peers.peer(peer)
+		if p == nil {
+			return nil, errors.New("peer not found")
+		}
+		blocks, err := requestRangeBlocks(p, startHeight, startHash, count)
+		if err == nil {
+			return blocks, nil
+		}
+		// The request failed, avoid the peer for a while and retry once from the
+		// best peer that did not fail a request recently
+		h.peers.markRequestFailure(peer)
+		if alt := h.peers.peerForBlockRequest(startHash); alt != nil && alt.bscExt != nil && alt.bscExt.Version() >= bsc.Bsc2 {
+			log.Debug("Retrying range blocks request", "failed", peer, "peer", alt.ID(), "err", err)
+			if blocks, altErr := requestRangeBlocks(alt, startHeight, startHash, count); altErr == nil {
+				return blocks, nil
+			}
+			h.peers.markRequestFailure(alt.ID())
+		}
+		return nil, err
+	}
 
 	if !config.EnableQuickBlockFetching {
 		fetchRangeBlocks = nil
@@ -426,6 +452,7 @@ func (h *handler) protoTracker() {
 			active--
 		case <-updateTicker.C:
 			h.peers.setProxyedPeers(h.proxyedNodeIdsMap)
+			h.peers.trimKnownHashes()
 			if h.enableEVNFeatures && h.synced.Load() {
 				// add onchain validator p2p node list later, it will enable the direct broadcast + no tx broadcast feature
 				// here check & enable peer broadcast features periodically, and it's a simple way to handle the peer change and the list change scenarios.
@@ -801,8 +828,13 @@ func (h *handler) Stop() {
 	// Disconnect existing sessions.
 	// This also closes the gate for any new registrations on the peer set.
 	// sessions which are already established but not added to h.peers yet
-	// will exit when they try to register.
-	h.peers.close()
+	// will exit when they try to register, unless given time to settle by
+	// draining the peer set.
+	if h.peerDrain > 0 {
+		h.peers.drain(h.peerDrain)
+	} else {
+		h.peers.close()
+	}
 	h.wg.Wait()
 
 	log.Info("Ethereum protocol stopped")
@@ -818,7 +850,6 @@ func (h *handler) BroadcastBlock(block *types.Block, propagate bool) {
 		}
 	}
 	hash := block.Hash()
-	peers := h.peers.peersWithoutBlock(hash)
 
 	// If propagation is requested, send to a subset of the peer
 	if propagate {
@@ -831,68 +862,31 @@ func (h *handler) BroadcastBlock(block *types.Block, propagate bool) {
 			return
 		}
 
-		// Broadcast the block to peers based on broadcast strategy.
-		totalPeers := len(peers)
-
-		// Step 1: Select target peers for initial broadcast.
-		limit := totalPeers
-		if !h.directBroadcast &&
-			!(h.networkID == 714 /*RialtoChainConfig.ChainID*/ && block.NumberU64() == 1) { // Populate TD from every receiver on startup to establish proper sync.
-			limit = int(math.Sqrt(float64(totalPeers)))
-		}
-
-		// Step 2: Broadcast to selected peers.
-		transferPeersCnt := limit
-		for _, peer := range peers[:limit] {
+		// Broadcast the block to a subset of the peers based on broadcast strategy,
+		// populating TD from every receiver on startup to establish proper sync.
+		all := h.directBroadcast ||
+			(h.networkID == 714 /*RialtoChainConfig.ChainID*/ && block.NumberU64() == 1)
+		direct, announce, suppressed := h.peers.peersForBlockPropagation(hash, all, h.needFullBroadcastInEVN(block))
+		for _, peer := range direct {
 			log.Debug("Broadcast block to peer",
 				"hash", hash, "peer", peer.ID(),
 				"EVNPeerFlag", peer.EVNPeerFlag.Load(),
+				"ProxyedPeerFlag", peer.ProxyedPeerFlag.Load(),
 			)
 			peer.AsyncSendNewBlock(block, td)
 		}
-
-		// Step 3: Handle proxyed peers.
-		proxyedPeersCnt := 0
-		if len(h.proxyedNodeIdsMap) > 0 {
-			for _, peer := range peers[limit:] {
-				if peer.ProxyedPeerFlag.Load() {
-					log.Debug("Broadcast block to proxyed peer",
-						"hash", hash, "peer", peer.ID(),
-						"EVNPeerFlag", peer.EVNPeerFlag.Load(),
-					)
-					peer.AsyncSendNewBlock(block, td)
-					proxyedPeersCnt++
-				}
-			}
-		}
-
-		// Step 4: Handle EVN peers if full broadcast is required.
-		evnPeersCnt := 0
-		if h.needFullBroadcastInEVN(block) {
-			for _, peer := range peers[limit:] {
-				if !peer.ProxyedPeerFlag.Load() && peer.EVNPeerFlag.Load() {
-					log.Debug("Broadcast block to EVN peer",
-						"hash", hash, "peer", peer.ID(),
-						"EVNPeerFlag", peer.EVNPeerFlag.Load(),
-					)
-					peer.AsyncSendNewBlock(block, td)
-					evnPeersCnt++
-				}
-			}
-		}
-
-		// Step 5: Log summary.
 		log.Debug("Propagated block",
 			"hash", hash,
-			"recipients", transferPeersCnt,
-			"proxyed", proxyedPeersCnt,
-			"evn", evnPeersCnt,
+			"recipients", len(direct),
+			"announce", len(announce),
+			"suppressedEVN", suppressed,
 			"duration", common.PrettyDuration(time.Since(block.ReceivedAt)),
 		)
 		return
 	}
 	// Otherwise if the block is indeed in our own chain, announce it
 	if h.chain.HasBlock(hash, block.NumberU64()) {
+		peers := h.peers.peersWithoutBlock(hash)
 		for _, peer := range peers {
 			log.Debug("Announced block to peer", "hash", hash, "peer", peer.ID(),
 				"EVNPeerFlag", peer.EVNPeerFlag.Load())
@@ -1031,8 +1025,9 @@ func (h *handler) BroadcastVote(vote *types.VoteEnvelope) {
 		voteMap = make(map[*ethPeer]*types.VoteEnvelope) // Set peer->hash to transfer directly
 	)
 
-	// Broadcast vote to a batch of peers not knowing about it
-	peers := h.peers.peersWithoutVote(vote.Hash())
+	// Broadcast vote to a batch of peers not knowing about it. EVN peers are
+	// kept, they are deliberately sent the votes directly below.
+	peers := h.peers.peersWithoutVote(vote.Hash(), false)
 	headBlock := h.chain.CurrentBlock()
 	currentTD := h.chain.GetTd(headBlock.Hash(), headBlock.Number.Uint64())
 	for _, peer := range peers {
@@ -18,8 +18,10 @@ package eth
 
 import (
 	"net"
+	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/eth/protocols/bsc"
 	"github.com/ethereum/go-ethereum/eth/protocols/eth"
 	"github.com/ethereum/go-ethereum/eth/protocols/snap"
@@ -43,6 +45,19 @@ type ethPeer struct {
 	*eth.Peer
 	snapExt *snapPeer // Satellite `snap` connection
 	bscExt  *bscPeer  // Satellite `bsc` connection
+
+	registered   mclock.AbsTime // Time the peer was registered into the peer set
+	sendFailures atomic.Int32   // Number of consecutive failed sends, reset on success
+}
+
+// markSend records the outcome of a send to the peer. Failures are counted until
+// the next successful send, which resets the counter.
+func (p *ethPeer) markSend(err error) {
+	if err != nil {
+		p.sendFailures.Add(1)
+	} else if p.sendFailures.Load() != 0 {
+		p.sendFailures.Store(0)
+	}
 }
 
 // info gathers and returns some `eth` protocol metadata known about a peer.
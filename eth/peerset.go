@@ -17,13 +17,21 @@
 package eth
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
+	"maps"
+	"math"
 	"math/big"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
 	"github.com/ethereum/go-ethereum/eth/protocols/bsc"
 	"github.com/ethereum/go-ethereum/eth/protocols/eth"
 	"github.com/ethereum/go-ethereum/eth/protocols/snap"
@@ -38,6 +46,10 @@ var (
 	// from the peer set after it has been terminated.
 	errPeerSetClosed = errors.New("peerset closed")
 
+	// errPeerSetDraining is returned if a new peer is attempted to be added to
+	// the peer set while it's draining the in-flight connections before closing.
+	errPeerSetDraining = errors.New("peerset draining")
+
 	// errPeerAlreadyRegistered is returned if a peer is attempted to be added
 	// to the peer set, but one with the same id already exists.
 	errPeerAlreadyRegistered = errors.New("peer already registered")
@@ -56,18 +68,59 @@ var (
 	// errBscWithoutEth is returned if a peer attempts to connect only on the
 	// bsc protocol without advertising the eth main protocol.
 	errBscWithoutEth = errors.New("peer connected on bsc without compatible eth support")
+
+	// errTooManyExtensionWaits is returned if a peer attempts to wait for its
+	// extension while the maximum number of concurrent waits is reached.
+	errTooManyExtensionWaits = errors.New("too many concurrent extension waits")
+
+	// errHeadRefreshTimeout is returned if a peer doesn't answer a head refresh
+	// request in time.
+	errHeadRefreshTimeout = errors.New("peer head refresh timeout")
+
+	// errInvalidHeadRefresh is returned if a peer answers a head refresh request
+	// with headers not continuing its previously known head.
+	errInvalidHeadRefresh = errors.New("invalid peer head refresh response")
+
+	// errRegistrationBackoff is returned if a peer is attempted to be added to the
+	// peer set while its id is backing off after repeated failed registrations.
+	errRegistrationBackoff = errors.New("peer registration backing off")
 )
 
 const (
-	// extensionWaitTimeout is the maximum allowed time for the extension wait to
-	// complete before dropping the connection as malicious.
-	extensionWaitTimeout = 10 * time.Second
-	tryWaitTimeout       = 100 * time.Millisecond
+	tryWaitTimeout = 100 * time.Millisecond
+
+	// drainPollInterval is the interval at which a draining peer set checks if
+	// all the pending extension waits resolved.
+	drainPollInterval = 50 * time.Millisecond
+
+	// knownHashEntrySize is the approximate memory used by a single entry of a
+	// peer's known hash caches, including the set overhead.
+	knownHashEntrySize = 64
+
+	// registerBackoffFailures is the number of consecutive failed registrations
+	// of a peer id after which further registrations are backed off.
+	registerBackoffFailures = 2
+
+	// headRefreshAmount is the maximum number of headers requested past a peer's
+	// known head when refreshing it.
+	headRefreshAmount = 192
+
+	// headRefreshTimeout is the maximum time to wait for a peer to answer a head
+	// refresh request.
+	headRefreshTimeout = 5 * time.Second
 )
 
 var (
 	evnWhiteListPeerGuage        = metrics.NewRegisteredGauge("evn/peer/whiteList", nil)
 	evnOnchainValidatorPeerGuage = metrics.NewRegisteredGauge("evn/peer/onchainValidator", nil)
+
+	// Time spent waiting for the satellite protocols of a peer to connect
+	snapExtensionWaitTimer = metrics.NewRegisteredResettingTimer("eth/peer/extension/snap/wait", nil)
+	bscExtensionWaitTimer  = metrics.NewRegisteredResettingTimer("eth/peer/extension/bsc/wait", nil)
+
+	// Satellite protocols connected ahead of their `eth` counterpart
+	snapExtensionPendingGauge = metrics.NewRegisteredGauge("eth/peer/extension/snap/pending", nil)
+	bscExtensionPendingGauge  = metrics.NewRegisteredGauge("eth/peer/extension/bsc/pending", nil)
 )
 
 // peerSet represents the collection of active peers currently participating in
@@ -77,6 +130,34 @@ type peerSet struct {
 	snapPeers int                 // Number of `snap` compatible peers for connection prioritization
 
 	validatorNodeIDsMap map[common.Address][]enode.ID
+	evnValidators       map[enode.ID]struct{} // Node ids of the on-chain validators, flagged as EVN peers
+	evnWhitelist        map[enode.ID]struct{} // Node ids of the whitelisted nodes, flagged as EVN peers
+	trustedValidators   map[enode.ID]struct{} // Node ids manually marked as trusted validators, always flagged as EVN peers
+
+	laggingThreshold *big.Int // Total difficulty distance from the best peer to consider a peer lagging
+
+	requestFailures      map[string]mclock.AbsTime // Time of the last failed block request per peer
+	requestFailureWindow time.Duration             // Time to avoid a peer for block requests after a failure
+
+	knownHashMemoryCap uint64 // Memory allowance of all peers' known hash caches, zero for unlimited
+
+	maxExtensionWaits    int           // Maximum number of concurrent extension waits, zero for unlimited
+	extensionWaitTimeout time.Duration // Maximum time to wait for the extension of a peer to connect
+
+	registerRetries    int           // Number of times to retry extension registration on id collisions
+	registerRetryDelay time.Duration // Delay between two extension registration attempts
+
+	registerBackoffs   map[string]*registerBackoff // Backoff state of the ids failing registration
+	registerBackoff    time.Duration               // Backoff after repeated failed registrations, zero to disable
+	maxRegisterBackoff time.Duration               // Maximum backoff after repeated failed registrations
+
+	broadcastDedup       map[common.Hash]*broadcastSelection // Recent peer selections for transaction propagation
+	broadcastDedupQueue  []common.Hash                       // Hashes in the dedup set, ordered by selection time
+	broadcastDedupWindow time.Duration                       // Time window to suppress reselecting a peer for the same hash, zero to disable
+	broadcastDedupLock   sync.Mutex
+
+	clock       mclock.Clock                              // Clock to track time based events with, replaceable for testing
+	observeWait func(protocol string, wait time.Duration) // Records the time waited for an extension, replaceable for testing
 
 	snapWait map[string]chan *snap.Peer // Peers connected on `eth` waiting for their snap extension
 	snapPend map[string]*snap.Peer      // Peers connected on the `snap` protocol, but not yet on `eth`
@@ -84,13 +165,36 @@ type peerSet struct {
 	bscWait map[string]chan *bsc.Peer // Peers connected on `eth` waiting for their bsc extension
 	bscPend map[string]*bsc.Peer      // Peers connected on the `bsc` protocol, but not yet on `eth`
 
-	lock   sync.RWMutex
-	closed bool
-	quitCh chan struct{} // Quit channel to signal termination
+	lock     sync.RWMutex
+	draining bool // Whether new peers are rejected while the in-flight ones settle
+	closed   bool
+	quitCh   chan struct{} // Quit channel to signal termination
 }
 
-// newPeerSet creates a new peer set to track the active participants.
+// observeExtensionWait records the time a peer spent waiting for the extension
+// of the given satellite protocol to connect.
+func observeExtensionWait(protocol string, wait time.Duration) {
+	switch protocol {
+	case snap.ProtocolName:
+		snapExtensionWaitTimer.Update(wait)
+	case bsc.ProtocolName:
+		bscExtensionWaitTimer.Update(wait)
+	}
+}
+
+// newPeerSet creates a new peer set to track the active participants, using the
+// default settings.
 func newPeerSet() *peerSet {
+	return newPeerSetWithConfig(ethconfig.DefaultPeerSetConfig)
+}
+
+// newPeerSetWithConfig creates a new peer set to track the active participants,
+// tuned by the given settings.
+func newPeerSetWithConfig(config ethconfig.PeerSetConfig) *peerSet {
+	if config.ExtensionWaitTimeout <= 0 {
+		log.Warn("Sanitizing invalid extension wait timeout", "provided", config.ExtensionWaitTimeout, "updated", ethconfig.DefaultPeerSetConfig.ExtensionWaitTimeout)
+		config.ExtensionWaitTimeout = ethconfig.DefaultPeerSetConfig.ExtensionWaitTimeout
+	}
 	return &peerSet{
 		peers:    make(map[string]*ethPeer),
 		snapWait: make(map[string]chan *snap.Peer),
@@ -98,13 +202,55 @@ func newPeerSet() *peerSet {
 		bscWait:  make(map[string]chan *bsc.Peer),
 		bscPend:  make(map[string]*bsc.Peer),
 		quitCh:   make(chan struct{}),
+
+		trustedValidators: make(map[enode.ID]struct{}),
+
+		laggingThreshold: new(big.Int).SetUint64(config.LaggingThreshold),
+
+		knownHashMemoryCap: config.KnownHashMemoryCap,
+
+		maxExtensionWaits:    config.MaxExtensionWaits,
+		extensionWaitTimeout: config.ExtensionWaitTimeout,
+
+		registerRetries:    config.RegisterRetries,
+		registerRetryDelay: config.RegisterRetryDelay,
+
+		requestFailures:      make(map[string]mclock.AbsTime),
+		requestFailureWindow: config.RequestFailureWindow,
+
+		registerBackoffs:   make(map[string]*registerBackoff),
+		registerBackoff:    config.RegisterBackoff,
+		maxRegisterBackoff: config.MaxRegisterBackoff,
+
+		broadcastDedup:       make(map[common.Hash]*broadcastSelection),
+		broadcastDedupWindow: config.TxBroadcastDedupWindow,
+
+		clock:       mclock.System{},
+		observeWait: observeExtensionWait,
 	}
 }
 
+// registerBackoff tracks the consecutive failed registrations of a peer id.
+type registerBackoff struct {
+	failures int            // Number of consecutive failed registrations
+	until    mclock.AbsTime // Time until which registrations are rejected
+}
+
+// broadcastSelection tracks the peers recently selected for propagating a hash.
+type broadcastSelection struct {
+	time  mclock.AbsTime      // Time of the first selection within the window
+	peers map[string]struct{} // Peers selected within the window
+}
+
 // registerSnapExtension unblocks an already connected `eth` peer waiting for its
 // `snap` extension, or if no such peer exists, tracks the extension for the time
 // being until the `eth` main protocol starts looking for it.
 func (ps *peerSet) registerSnapExtension(peer *snap.Peer) error {
+	return ps.retryRegister(func() error { return ps.tryRegisterSnapExtension(peer) })
+}
+
+// tryRegisterSnapExtension makes a single attempt at registering a `snap` extension.
+func (ps *peerSet) tryRegisterSnapExtension(peer *snap.Peer) error {
 	// Reject the peer if it advertises `snap` without `eth` as `snap` is only a
 	// satellite protocol meaningful with the chain selection of `eth`
 	if !peer.RunningCap(eth.ProtocolName, eth.ProtocolVersions) {
@@ -127,7 +273,11 @@ func (ps *peerSet) registerSnapExtension(peer *snap.Peer) error {
 		wait <- peer
 		return nil
 	}
+	if ps.draining {
+		return errPeerSetDraining // only in-flight connections are accepted while draining
+	}
 	ps.snapPend[id] = peer
+	snapExtensionPendingGauge.Inc(1)
 	return nil
 }
 
@@ -135,6 +285,11 @@ func (ps *peerSet) registerSnapExtension(peer *snap.Peer) error {
 // `bsc` extension, or if no such peer exists, tracks the extension for the time
 // being until the `eth` main protocol starts looking for it.
 func (ps *peerSet) registerBscExtension(peer *bsc.Peer) error {
+	return ps.retryRegister(func() error { return ps.tryRegisterBscExtension(peer) })
+}
+
+// tryRegisterBscExtension makes a single attempt at registering a `bsc` extension.
+func (ps *peerSet) tryRegisterBscExtension(peer *bsc.Peer) error {
 	// Reject the peer if it advertises `bsc` without `eth` as `bsc` is only a
 	// satellite protocol meaningful with the chain selection of `eth`
 	if !peer.RunningCap(eth.ProtocolName, eth.ProtocolVersions) {
@@ -157,10 +312,32 @@ func (ps *peerSet) registerBscExtension(peer *bsc.Peer) error {
 		wait <- peer
 		return nil
 	}
+	if ps.draining {
+		return errPeerSetDraining // only in-flight connections are accepted while draining
+	}
 	ps.bscPend[id] = peer
+	bscExtensionPendingGauge.Inc(1)
 	return nil
 }
 
+// retryRegister runs the registration attempt, retrying it as configured as long
+// as it fails due to an id collision.
+func (ps *peerSet) retryRegister(register func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := register()
+		if !errors.Is(err, errPeerAlreadyRegistered) || attempt >= ps.registerRetries {
+			return err
+		}
+		timer := time.NewTimer(ps.registerRetryDelay)
+		select {
+		case <-timer.C:
+		case <-ps.quitCh:
+			timer.Stop()
+			return err
+		}
+	}
+}
+
 // waitSnapExtension blocks until all satellite protocols are connected and tracked
 // by the peerset.
 func (ps *peerSet) waitSnapExtension(peer *eth.Peer) (*snap.Peer, error) {
@@ -183,20 +360,33 @@ func (ps *peerSet) waitSnapExtension(peer *eth.Peer) (*snap.Peer, error) {
 	// If `snap` already connected, retrieve the peer from the pending set
 	if snap, ok := ps.snapPend[id]; ok {
 		delete(ps.snapPend, id)
+		snapExtensionPendingGauge.Dec(1)
 
 		ps.lock.Unlock()
 		return snap, nil
 	}
-	// Otherwise wait for `snap` to connect concurrently
+	// Otherwise wait for `snap` to connect concurrently, if not draining and not
+	// too many peers do
+	if ps.draining {
+		ps.lock.Unlock()
+		return nil, errPeerSetDraining
+	}
+	if ps.extensionWaitsFull() {
+		ps.lock.Unlock()
+		return nil, errTooManyExtensionWaits
+	}
 	wait := make(chan *snap.Peer)
 	ps.snapWait[id] = wait
+	timeout := ps.extensionWaitTimeout
 	ps.lock.Unlock()
 
+	start := ps.clock.Now()
 	select {
 	case peer := <-wait:
+		ps.observeWait(snap.ProtocolName, ps.clock.Now().Sub(start))
 		return peer, nil
 
-	case <-time.After(extensionWaitTimeout):
+	case <-time.After(timeout):
 		ps.lock.Lock()
 		delete(ps.snapWait, id)
 		ps.lock.Unlock()
@@ -210,6 +400,23 @@ func (ps *peerSet) waitSnapExtension(peer *eth.Peer) (*snap.Peer, error) {
 	}
 }
 
+// pendingExtensions returns the number of snap and bsc extensions connected
+// ahead of their `eth` counterpart and still waiting for it.
+func (ps *peerSet) pendingExtensions() (snap int, bsc int) {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return len(ps.snapPend), len(ps.bscPend)
+}
+
+// extensionWaitsFull returns whether the maximum number of concurrent extension
+// waits is reached.
+//
+// The caller must hold the peerset lock.
+func (ps *peerSet) extensionWaitsFull() bool {
+	return ps.maxExtensionWaits > 0 && len(ps.snapWait)+len(ps.bscWait) >= ps.maxExtensionWaits
+}
+
 // waitBscExtension blocks until all satellite protocols are connected and tracked
 // by the peerset.
 func (ps *peerSet) waitBscExtension(peer *eth.Peer) (*bsc.Peer, error) {
@@ -232,20 +439,33 @@ func (ps *peerSet) waitBscExtension(peer *eth.Peer) (*bsc.Peer, error) {
 	// If `bsc` already connected, retrieve the peer from the pending set
 	if bsc, ok := ps.bscPend[id]; ok {
 		delete(ps.bscPend, id)
+		bscExtensionPendingGauge.Dec(1)
 
 		ps.lock.Unlock()
 		return bsc, nil
 	}
-	// Otherwise wait for `bsc` to connect concurrently
+	// Otherwise wait for `bsc` to connect concurrently, if not draining and not
+	// too many peers do
+	if ps.draining {
+		ps.lock.Unlock()
+		return nil, errPeerSetDraining
+	}
+	if ps.extensionWaitsFull() {
+		ps.lock.Unlock()
+		return nil, errTooManyExtensionWaits
+	}
 	wait := make(chan *bsc.Peer)
 	ps.bscWait[id] = wait
+	timeout := ps.extensionWaitTimeout
 	ps.lock.Unlock()
 
+	start := ps.clock.Now()
 	select {
 	case peer := <-wait:
+		ps.observeWait(bsc.ProtocolName, ps.clock.Now().Sub(start))
 		return peer, nil
 
-	case <-time.After(extensionWaitTimeout):
+	case <-time.After(timeout):
 		// could be deadlock, so we use TryLock to avoid it.
 		if ps.lock.TryLock() {
 			delete(ps.bscWait, id)
@@ -285,12 +505,24 @@ func (ps *peerSet) registerPeer(peer *eth.Peer, ext *snap.Peer, bscExt *bsc.Peer
 	if ps.closed {
 		return errPeerSetClosed
 	}
+	// While draining, only accept peers whose extensions were already in flight
+	if ps.draining && ext == nil && bscExt == nil {
+		return errPeerSetDraining
+	}
 	id := peer.ID()
+	now := ps.clock.Now()
+	if backoff, ok := ps.registerBackoffs[id]; ok && now < backoff.until {
+		return errRegistrationBackoff
+	}
 	if _, ok := ps.peers[id]; ok {
+		ps.markRegisterFailure(id, now)
 		return errPeerAlreadyRegistered
 	}
+	delete(ps.registerBackoffs, id)
+
 	eth := &ethPeer{
-		Peer: peer,
+		Peer:       peer,
+		registered: now,
 	}
 	if ext != nil {
 		eth.snapExt = &snapPeer{ext}
@@ -298,11 +530,51 @@ func (ps *peerSet) registerPeer(peer *eth.Peer, ext *snap.Peer, bscExt *bsc.Peer
 	}
 	if bscExt != nil {
 		eth.bscExt = &bscPeer{bscExt}
+		bscExt.SetSendObserver(eth.markSend)
+	}
+	peer.SetSendObserver(eth.markSend)
+	if ps.isEVNNode(peer.NodeID()) {
+		eth.EVNPeerFlag.Store(true)
 	}
 	ps.peers[id] = eth
 	return nil
 }
 
+// markRegisterFailure records a failed registration of the given peer id. Once
+// registerBackoffFailures consecutive registrations failed, further ones of it
+// are backed off for a time doubling with every additional failure. Failures
+// long after the previous backoff expired start over.
+//
+// The caller must hold the peerset lock.
+func (ps *peerSet) markRegisterFailure(id string, now mclock.AbsTime) {
+	if ps.registerBackoff == 0 {
+		return
+	}
+	// Drop the state of any id whose backoff expired long ago, it would start
+	// over on its next failure anyway
+	for other, backoff := range ps.registerBackoffs {
+		if now.Sub(backoff.until) > ps.maxRegisterBackoff {
+			delete(ps.registerBackoffs, other)
+		}
+	}
+	backoff, ok := ps.registerBackoffs[id]
+	if !ok {
+		backoff = new(registerBackoff)
+		ps.registerBackoffs[id] = backoff
+	}
+	backoff.failures++
+	if backoff.failures < registerBackoffFailures {
+		backoff.until = now
+		return
+	}
+	delay := ps.registerBackoff
+	for i := registerBackoffFailures; i < backoff.failures && delay < ps.maxRegisterBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, ps.maxRegisterBackoff)
+	backoff.until = now.Add(delay)
+}
+
 // unregisterPeer removes a remote peer from the active set, disabling any further
 // actions to/from that particular entity.
 func (ps *peerSet) unregisterPeer(id string) error {
@@ -314,6 +586,7 @@ func (ps *peerSet) unregisterPeer(id string) error {
 		return errPeerNotRegistered
 	}
 	delete(ps.peers, id)
+	delete(ps.requestFailures, id)
 	if peer.snapExt != nil {
 		ps.snapPeers--
 	}
@@ -328,6 +601,123 @@ func (ps *peerSet) peer(id string) *ethPeer {
 	return ps.peers[id]
 }
 
+// peerUptime returns the time elapsed since the given peer was registered, or
+// zero if the peer is unknown. Short uptimes reveal peers flapping connections.
+func (ps *peerSet) peerUptime(id string) time.Duration {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	peer, ok := ps.peers[id]
+	if !ok {
+		return 0
+	}
+	return ps.clock.Now().Sub(peer.registered)
+}
+
+// peersByUptime returns all the registered peers sorted by how long they have
+// been connected, longest first, with ties broken by id. Long lived peers are
+// less likely to be eclipse attackers, so they are preferred for propagation.
+func (ps *peerSet) peersByUptime() []*ethPeer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	list := make([]*ethPeer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		list = append(list, p)
+	}
+	slices.SortFunc(list, func(a, b *ethPeer) int {
+		if c := cmp.Compare(a.registered, b.registered); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID(), b.ID())
+	})
+	return list
+}
+
+// PeerConnInfo is a summary of the connection to a peer, for analysing the
+// position of the node in the network topology.
+type PeerConnInfo struct {
+	ID        string        `json:"id"`        // Node id of the peer
+	Inbound   bool          `json:"inbound"`   // Whether the connection was initiated by the peer
+	Protocols []string      `json:"protocols"` // Protocols running with the peer, e.g. eth/68
+	EVN       bool          `json:"evn"`       // Whether the peer is flagged as an EVN peer
+	Uptime    time.Duration `json:"uptime"`    // Time elapsed since the peer was registered
+	Latency   time.Duration `json:"latency"`   // Mean time to answer header requests, zero if none was answered
+}
+
+// connectionMatrix returns the connection summary of all the registered peers,
+// sorted by id.
+func (ps *peerSet) connectionMatrix() []PeerConnInfo {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var (
+		now    = ps.clock.Now()
+		matrix = make([]PeerConnInfo, 0, len(ps.peers))
+	)
+	for id, p := range ps.peers {
+		info := PeerConnInfo{
+			ID:        id,
+			Inbound:   p.Peer.Peer.Inbound(),
+			Protocols: []string{fmt.Sprintf("%s/%d", eth.ProtocolName, p.Version())},
+			EVN:       p.EVNPeerFlag.Load(),
+			Uptime:    now.Sub(p.registered),
+		}
+		if p.snapExt != nil {
+			info.Protocols = append(info.Protocols, fmt.Sprintf("%s/%d", snap.ProtocolName, p.snapExt.Version()))
+		}
+		if p.bscExt != nil {
+			info.Protocols = append(info.Protocols, fmt.Sprintf("%s/%d", bsc.ProtocolName, p.bscExt.Version()))
+		}
+		if latency := p.RequestLatency(eth.GetBlockHeadersMsg); latency != nil {
+			info.Latency = time.Duration(latency.Mean())
+		}
+		matrix = append(matrix, info)
+	}
+	slices.SortFunc(matrix, func(a, b PeerConnInfo) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return matrix
+}
+
+// PeerSummary is an immutable snapshot of the state of a peer, safe to be used
+// without holding any locks or references to the live peer.
+type PeerSummary struct {
+	ID     string      // Unique identifier of the peer
+	NodeID enode.ID    // Node id of the peer
+	Head   common.Hash // Hash of the head block announced by the peer
+	TD     *big.Int    // Total difficulty announced by the peer
+	EVN    bool        // Whether the peer is flagged as an EVN peer
+	Snap   bool        // Whether the snap extension is running with the peer
+	Bsc    bool        // Whether the bsc extension is running with the peer
+}
+
+// peerInfos returns a summary of all the registered peers, sorted by id. All
+// of them are taken under the same read lock, so the result is a consistent
+// view of the peer set.
+func (ps *peerSet) peerInfos() []PeerSummary {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	infos := make([]PeerSummary, 0, len(ps.peers))
+	for id, p := range ps.peers {
+		head, td := p.Head()
+		infos = append(infos, PeerSummary{
+			ID:     id,
+			NodeID: p.NodeID(),
+			Head:   head,
+			TD:     td,
+			EVN:    p.EVNPeerFlag.Load(),
+			Snap:   p.snapExt != nil,
+			Bsc:    p.bscExt != nil,
+		})
+	}
+	slices.SortFunc(infos, func(a, b PeerSummary) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return infos
+}
+
 func (ps *peerSet) setProxyedPeers(proxyedNodeIdsMap map[enode.ID]struct{}) {
 	ps.lock.RLock()
 	peers := make([]*ethPeer, 0, len(ps.peers))
@@ -347,16 +737,11 @@ func (ps *peerSet) setProxyedPeers(proxyedNodeIdsMap map[enode.ID]struct{}) {
 }
 
 // enableEVNFeatures enables the given features for the given peers.
+//
+// If only the on-chain validators changed since the previous call, the flags of
+// just the affected peers are flipped via updateEVNFlags. Peers connecting in
+// between are flagged on registration, so they need no recompute either.
 func (ps *peerSet) enableEVNFeatures(validatorNodeIDsMap map[common.Address][]enode.ID, evnWhitelistMap map[enode.ID]struct{}) {
-	// clone current all peers, and update the validatorNodeIDsMap
-	ps.lock.Lock()
-	peers := make([]*ethPeer, 0, len(ps.peers))
-	for _, peer := range ps.peers {
-		peers = append(peers, peer)
-	}
-	ps.validatorNodeIDsMap = validatorNodeIDsMap
-	ps.lock.Unlock()
-
 	// convert to nodeID filter map, avoid too slow operation for slices.Contains
 	valNodeIDMap := make(map[enode.ID]struct{})
 	for _, nodeIDs := range validatorNodeIDsMap {
@@ -364,6 +749,51 @@ func (ps *peerSet) enableEVNFeatures(validatorNodeIDsMap map[common.Address][]en
 			valNodeIDMap[nodeID] = struct{}{}
 		}
 	}
+	ps.lock.Lock()
+	if ps.evnValidators != nil && maps.Equal(ps.evnWhitelist, evnWhitelistMap) {
+		added := make(map[enode.ID]struct{})
+		for nodeID := range valNodeIDMap {
+			if _, ok := ps.evnValidators[nodeID]; !ok {
+				added[nodeID] = struct{}{}
+			}
+		}
+		removed := make(map[enode.ID]struct{})
+		for nodeID := range ps.evnValidators {
+			if _, ok := valNodeIDMap[nodeID]; !ok {
+				removed[nodeID] = struct{}{}
+			}
+		}
+		ps.validatorNodeIDsMap = maps.Clone(validatorNodeIDsMap)
+
+		// Recount the flagged peers, as some may have come and gone since
+		var whiteListPeerCnt, onchainValidatorPeerCnt int64
+		for _, peer := range ps.peers {
+			if _, ok := evnWhitelistMap[peer.NodeID()]; ok {
+				whiteListPeerCnt++
+			}
+			if _, ok := valNodeIDMap[peer.NodeID()]; ok {
+				onchainValidatorPeerCnt++
+			}
+		}
+		ps.lock.Unlock()
+
+		evnWhiteListPeerGuage.Update(whiteListPeerCnt)
+		evnOnchainValidatorPeerGuage.Update(onchainValidatorPeerCnt)
+		if len(added) > 0 || len(removed) > 0 {
+			ps.updateEVNFlags(added, removed)
+		}
+		return
+	}
+	// clone current all peers, and update the validatorNodeIDsMap
+	peers := make([]*ethPeer, 0, len(ps.peers))
+	for _, peer := range ps.peers {
+		peers = append(peers, peer)
+	}
+	ps.validatorNodeIDsMap = maps.Clone(validatorNodeIDsMap)
+	ps.evnValidators = valNodeIDMap
+	ps.evnWhitelist = maps.Clone(evnWhitelistMap)
+	trusted := maps.Clone(ps.trustedValidators)
+	ps.lock.Unlock()
 
 	var (
 		whiteListPeerCnt        int64 = 0
@@ -373,8 +803,9 @@ func (ps *peerSet) enableEVNFeatures(validatorNodeIDsMap map[common.Address][]en
 		nodeID := peer.NodeID()
 		_, isValidatorPeer := valNodeIDMap[nodeID]
 		_, isWhitelistPeer := evnWhitelistMap[nodeID]
+		_, isTrustedPeer := trusted[nodeID]
 
-		if isValidatorPeer || isWhitelistPeer {
+		if isValidatorPeer || isWhitelistPeer || isTrustedPeer {
 			log.Debug("enable EVNPeerFlag & NoTxBroadcastFlag for", "peer", nodeID)
 			peer.EVNPeerFlag.Store(true)
 		} else {
@@ -393,6 +824,133 @@ func (ps *peerSet) enableEVNFeatures(validatorNodeIDsMap map[common.Address][]en
 	log.Info("enable EVN features", "total", len(peers), "whiteListPeerCnt", whiteListPeerCnt, "onchainValidatorPeerCnt", onchainValidatorPeerCnt)
 }
 
+// validatorPeers returns the connected peers of the given validator, resolved via
+// the node ids of the validator recorded by enableEVNFeatures. An empty list is
+// returned if the validator is unknown or none of its nodes are connected.
+func (ps *peerSet) validatorPeers(addr common.Address) []*ethPeer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return ps.connectedNodes(ps.validatorNodeIDsMap[addr])
+}
+
+// redundantValidatorConnections returns the validator addresses with more than
+// one connected peer among their node ids, along with the sorted ids of those
+// peers, revealing redundant validator links that could be trimmed.
+func (ps *peerSet) redundantValidatorConnections() map[common.Address][]string {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	redundant := make(map[common.Address][]string)
+	for addr, nodeIDs := range ps.validatorNodeIDsMap {
+		peers := ps.connectedNodes(nodeIDs)
+		if len(peers) < 2 {
+			continue
+		}
+		ids := make([]string, 0, len(peers))
+		for _, p := range peers {
+			ids = append(ids, p.ID())
+		}
+		slices.Sort(ids)
+		redundant[addr] = ids
+	}
+	return redundant
+}
+
+// connectedNodes returns the connected peers among the given node ids, each of
+// them once.
+//
+// The caller must hold the peerset lock.
+func (ps *peerSet) connectedNodes(nodeIDs []enode.ID) []*ethPeer {
+	peers := make([]*ethPeer, 0, len(nodeIDs))
+	for _, nodeID := range nodeIDs {
+		if p := ps.peers[nodeID.String()]; p != nil && !slices.Contains(peers, p) {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// addTrustedValidator manually marks the given node as a trusted validator. It is
+// flagged as an EVN peer regardless of the on-chain validator set and whitelist,
+// across all subsequent enableEVNFeatures calls.
+func (ps *peerSet) addTrustedValidator(id enode.ID) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.trustedValidators[id] = struct{}{}
+	if peer, ok := ps.peers[id.String()]; ok {
+		log.Debug("enable EVNPeerFlag & NoTxBroadcastFlag for trusted validator", "peer", id)
+		peer.EVNPeerFlag.Store(true)
+	}
+}
+
+// updateEVNFlags incrementally updates the set of on-chain validator node ids,
+// recomputing the EVNPeerFlag of only the connected peers affected by the change
+// instead of the flags of all peers like enableEVNFeatures does.
+//
+// A removed validator stays flagged if it's still an EVN peer through another
+// source, i.e. the whitelist or the trusted validators. Removed node ids are also
+// dropped from the validator node ids, added ones are only flagged as the owning
+// validator is not known here.
+func (ps *peerSet) updateEVNFlags(added, removed map[enode.ID]struct{}) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if ps.evnValidators == nil {
+		ps.evnValidators = make(map[enode.ID]struct{})
+	}
+	for nodeID := range removed {
+		delete(ps.evnValidators, nodeID)
+	}
+	if len(removed) > 0 {
+		for addr, nodeIDs := range ps.validatorNodeIDsMap {
+			nodeIDs = slices.DeleteFunc(slices.Clone(nodeIDs), func(id enode.ID) bool {
+				_, ok := removed[id]
+				return ok
+			})
+			if len(nodeIDs) == 0 {
+				delete(ps.validatorNodeIDsMap, addr)
+			} else {
+				ps.validatorNodeIDsMap[addr] = nodeIDs
+			}
+		}
+	}
+	maps.Copy(ps.evnValidators, added)
+
+	for _, ids := range []map[enode.ID]struct{}{removed, added} {
+		for nodeID := range ids {
+			peer, ok := ps.peers[nodeID.String()]
+			if !ok {
+				continue
+			}
+			if ps.isEVNNode(nodeID) {
+				log.Debug("enable EVNPeerFlag & NoTxBroadcastFlag for", "peer", nodeID)
+				peer.EVNPeerFlag.Store(true)
+			} else {
+				log.Debug("disable EVNPeerFlag for", "peer", nodeID)
+				peer.EVNPeerFlag.Store(false)
+			}
+		}
+	}
+	log.Info("update EVN flags", "added", len(added), "removed", len(removed), "validators", len(ps.evnValidators))
+}
+
+// isEVNNode reports whether the given node is an EVN peer through any of the
+// sources: the on-chain validators, the whitelist or the trusted validators.
+//
+// The caller must hold the peerset lock.
+func (ps *peerSet) isEVNNode(id enode.ID) bool {
+	if _, ok := ps.evnValidators[id]; ok {
+		return true
+	}
+	if _, ok := ps.evnWhitelist[id]; ok {
+		return true
+	}
+	_, ok := ps.trustedValidators[id]
+	return ok
+}
+
 // isProxyedValidator checks if the received block from the proxyed validator.
 func (ps *peerSet) isProxyedValidator(validator common.Address, proxyedAddressMap map[common.Address]struct{}) bool {
 	ps.lock.RLock()
@@ -410,21 +968,34 @@ func (ps *peerSet) isProxyedValidator(validator common.Address, proxyedAddressMa
 	return true
 }
 
-// headPeers retrieves a specified number list of peers.
+// headPeers retrieves the specified number of peers with the highest total
+// difficulty, sorted descending. Peers with the same total difficulty are ordered
+// by id, making the selection deterministic.
 func (ps *peerSet) headPeers(num uint) []*ethPeer {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
 
-	if num > uint(len(ps.peers)) {
-		num = uint(len(ps.peers))
+	type rankedPeer struct {
+		peer *ethPeer
+		td   *big.Int
 	}
-
-	list := make([]*ethPeer, 0, num)
+	ranked := make([]rankedPeer, 0, len(ps.peers))
 	for _, p := range ps.peers {
-		if len(list) > int(num) {
-			break
+		_, td := p.Head()
+		ranked = append(ranked, rankedPeer{peer: p, td: td})
+	}
+	slices.SortFunc(ranked, func(a, b rankedPeer) int {
+		if c := b.td.Cmp(a.td); c != 0 {
+			return c
 		}
-		list = append(list, p)
+		return strings.Compare(a.peer.ID(), b.peer.ID())
+	})
+	if num > uint(len(ranked)) {
+		num = uint(len(ranked))
+	}
+	list := make([]*ethPeer, num)
+	for i := range list {
+		list[i] = ranked[i].peer
 	}
 	return list
 }
@@ -445,6 +1016,222 @@ func (ps *peerSet) peersWithoutBlock(hash common.Hash) []*ethPeer {
 	return list
 }
 
+// peersForBlockPropagation selects the peers a block should be sent to directly
+// among the ones that don't know it yet. Unless all of them are requested, only
+// the square root of them is selected, plus the proxyed peers and, if a full EVN
+// broadcast is requested, the EVN peers. The rest of the peers are returned as
+// the ones to learn about the block through the later announcement, along with
+// the number of EVN peers among them left out of the full broadcast.
+func (ps *peerSet) peersForBlockPropagation(hash common.Hash, all bool, fullEVN bool) (direct, announce []*ethPeer, suppressed int) {
+	peers := ps.peersWithoutBlock(hash)
+
+	limit := len(peers)
+	if !all {
+		limit = int(math.Sqrt(float64(len(peers))))
+	}
+	direct = peers[:limit:limit]
+	for _, peer := range peers[limit:] {
+		switch {
+		case peer.ProxyedPeerFlag.Load():
+			direct = append(direct, peer)
+		case peer.EVNPeerFlag.Load() && fullEVN:
+			direct = append(direct, peer)
+		case peer.EVNPeerFlag.Load():
+			suppressed++
+			announce = append(announce, peer)
+		default:
+			announce = append(announce, peer)
+		}
+	}
+	return direct, announce, suppressed
+}
+
+// propagationReach returns the number of peers a block would be sent to directly
+// and announced to, along with the number of EVN peers left out of the full
+// broadcast, without propagating anything.
+func (ps *peerSet) propagationReach(hash common.Hash, all bool, fullEVN bool) (direct, announce, suppressed int) {
+	directPeers, announcePeers, suppressed := ps.peersForBlockPropagation(hash, all, fullEVN)
+	return len(directPeers), len(announcePeers), suppressed
+}
+
+// totalKnownHashMemory estimates the combined memory used by the known block,
+// transaction and vote hash caches of all peers.
+func (ps *peerSet) totalKnownHashMemory() uint64 {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return ps.knownHashMemory()
+}
+
+// knownHashMemory estimates the combined memory of the known hash caches.
+//
+// The caller must hold the peerset lock.
+func (ps *peerSet) knownHashMemory() uint64 {
+	var entries int
+	for _, p := range ps.peers {
+		entries += p.KnownHashCount()
+		if p.bscExt != nil {
+			entries += p.bscExt.KnownVoteCount()
+		}
+	}
+	return uint64(entries) * knownHashEntrySize
+}
+
+// trimKnownHashes shrinks the known hash caches of all peers proportionally if
+// their combined memory exceeds the configured cap. It returns whether trimming
+// was needed.
+func (ps *peerSet) trimKnownHashes() bool {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	if ps.knownHashMemoryCap == 0 {
+		return false
+	}
+	total := ps.knownHashMemory()
+	if total <= ps.knownHashMemoryCap {
+		return false
+	}
+	ratio := float64(ps.knownHashMemoryCap) / float64(total)
+	for _, p := range ps.peers {
+		p.TrimKnownHashes(ratio)
+		if p.bscExt != nil {
+			p.bscExt.TrimKnownVotes(ratio)
+		}
+	}
+	log.Debug("Trimmed known hash caches", "peers", len(ps.peers), "memory", total, "cap", ps.knownHashMemoryCap)
+	return true
+}
+
+// markRequestFailure records that a block request to the given peer failed, so
+// it's avoided by peerForBlockRequest for the configured failure window.
+func (ps *peerSet) markRequestFailure(id string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if _, ok := ps.peers[id]; ok {
+		ps.requestFailures[id] = ps.clock.Now()
+	}
+}
+
+// peerForBlockRequest retrieves the best peer to request the given block from,
+// skipping the ones that failed a request within the failure window. The peer
+// with the highest total difficulty is returned, or nil if there's none.
+//
+// Note, unlike peersWithoutBlock used for propagation, peers known to have the
+// block are preferred here: a peer without the block can't serve it, so they are
+// only considered if none of the peers are known to have it.
+func (ps *peerSet) peerForBlockRequest(hash common.Hash) *ethPeer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var (
+		now       = ps.clock.Now()
+		best      *ethPeer
+		bestTD    *big.Int
+		bestKnown bool
+	)
+	for id, p := range ps.peers {
+		if failed, ok := ps.requestFailures[id]; ok && now.Sub(failed) < ps.requestFailureWindow {
+			continue
+		}
+		known := p.KnownBlock(hash)
+		if bestKnown && !known {
+			continue
+		}
+		if _, td := p.Head(); best == nil || (known && !bestKnown) || td.Cmp(bestTD) > 0 {
+			best, bestTD, bestKnown = p, td, known
+		}
+	}
+	return best
+}
+
+// peerSendFailures returns the number of consecutive failed sends to the given
+// peer, which is a good indicator of a dead or congested connection.
+func (ps *peerSet) peerSendFailures(id string) int {
+	ps.lock.RLock()
+	p := ps.peers[id]
+	ps.lock.RUnlock()
+
+	if p == nil {
+		return 0
+	}
+	return int(p.sendFailures.Load())
+}
+
+// peersWithoutTransaction retrieves a list of non-EVN peers that do not have a
+// given transaction in their set of known hashes, so it might be propagated to
+// them. EVN peers are skipped as they receive transactions through dedicated
+// channels. Peers already selected for the same hash within the dedup window
+// are omitted, covering the lag until their known sets are updated.
+func (ps *peerSet) peersWithoutTransaction(hash common.Hash) []*ethPeer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	// Only track the selections if deduplication is enabled, keeping the hot
+	// broadcast path lock free otherwise
+	var selection *broadcastSelection
+	if ps.broadcastDedupWindow > 0 {
+		ps.broadcastDedupLock.Lock()
+		defer ps.broadcastDedupLock.Unlock()
+
+		now := ps.clock.Now()
+		ps.pruneBroadcastDedup(now)
+
+		if selection = ps.broadcastDedup[hash]; selection == nil {
+			selection = &broadcastSelection{time: now, peers: make(map[string]struct{})}
+			ps.broadcastDedup[hash] = selection
+			ps.broadcastDedupQueue = append(ps.broadcastDedupQueue, hash)
+		}
+	}
+	var (
+		list       = make([]*ethPeer, 0, len(ps.peers))
+		evnSkipped int
+		suppressed int
+	)
+	for id, p := range ps.peers {
+		if p.EVNPeerFlag.Load() {
+			evnSkipped++
+			continue
+		}
+		if p.KnownTransaction(hash) {
+			continue
+		}
+		if selection != nil {
+			if _, ok := selection.peers[id]; ok {
+				suppressed++
+				continue
+			}
+			selection.peers[id] = struct{}{}
+		}
+		list = append(list, p)
+	}
+	log.Debug("get peers without transaction", "hash", hash, "total", len(ps.peers), "unknown", len(list), "evnSkipped", evnSkipped, "suppressed", suppressed)
+	return list
+}
+
+// pruneBroadcastDedup drops all the peer selections which fell out of the dedup
+// window.
+//
+// The caller must hold the broadcast dedup lock.
+func (ps *peerSet) pruneBroadcastDedup(now mclock.AbsTime) {
+	var expired int
+	for _, hash := range ps.broadcastDedupQueue {
+		if now.Sub(ps.broadcastDedup[hash].time) < ps.broadcastDedupWindow {
+			break
+		}
+		delete(ps.broadcastDedup, hash)
+		expired++
+	}
+	if expired == 0 {
+		return
+	}
+	// Shift the live hashes to the front instead of reslicing, to not pin the
+	// expired ones in the backing array
+	n := copy(ps.broadcastDedupQueue, ps.broadcastDedupQueue[expired:])
+	clear(ps.broadcastDedupQueue[n:])
+	ps.broadcastDedupQueue = ps.broadcastDedupQueue[:n]
+}
+
 // allNonEVNPeers returns a slice of all registered peers that do not have
 // the EVNPeerFlag set.
 func (ps *peerSet) allNonEVNPeers() []*ethPeer {
@@ -461,21 +1248,63 @@ func (ps *peerSet) allNonEVNPeers() []*ethPeer {
 	return nonEVNPeers
 }
 
-// peersWithoutVote retrieves a list of peers that do not have a given
-// vote in their set of known hashes.
-func (ps *peerSet) peersWithoutVote(hash common.Hash) []*ethPeer {
+// peersWithoutCap retrieves a list of peers that are not running any of the given
+// versions of a protocol, e.g. to find the peers which didn't negotiate the bsc
+// extension for protocol adoption monitoring.
+func (ps *peerSet) peersWithoutCap(name string, versions []uint) []*ethPeer {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
 
 	list := make([]*ethPeer, 0, len(ps.peers))
 	for _, p := range ps.peers {
-		if p.bscExt != nil && !p.bscExt.KnownVote(hash) {
+		if !p.RunningCap(name, versions) {
 			list = append(list, p)
 		}
 	}
 	return list
 }
 
+// peersWithoutVote retrieves a list of peers that do not have a given
+// vote in their set of known hashes. If skipEVN is set, EVN peers are left
+// out similarly to peersWithoutTransaction, as they exchange votes over the
+// validator network anyway.
+func (ps *peerSet) peersWithoutVote(hash common.Hash, skipEVN bool) []*ethPeer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var (
+		list       = make([]*ethPeer, 0, len(ps.peers))
+		evnSkipped int
+	)
+	for _, p := range ps.peers {
+		if p.bscExt == nil {
+			continue
+		}
+		if skipEVN && p.EVNPeerFlag.Load() {
+			evnSkipped++
+			continue
+		}
+		if !p.bscExt.KnownVote(hash) {
+			list = append(list, p)
+		}
+	}
+	log.Debug("get peers without vote", "hash", hash, "total", len(ps.peers), "unknown", len(list), "evnSkipped", evnSkipped)
+	return list
+}
+
+// peerKnownVoteCount returns the number of votes the `bsc` extension of the peer
+// with the given id knows about, and whether the peer has such an extension.
+func (ps *peerSet) peerKnownVoteCount(id string) (int, bool) {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	p, ok := ps.peers[id]
+	if !ok || p.bscExt == nil {
+		return 0, false
+	}
+	return p.bscExt.KnownVoteCount(), true
+}
+
 // len returns if the current number of `eth` peers in the set. Since the `snap`
 // peers are tied to the existence of an `eth` connection, that will always be a
 // subset of `eth`.
@@ -494,18 +1323,169 @@ func (ps *peerSet) snapLen() int {
 	return ps.snapPeers
 }
 
+// evnPeerLen returns the current number of peers flagged as EVN peers.
+func (ps *peerSet) evnPeerLen() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var n int
+	for _, p := range ps.peers {
+		if p.EVNPeerFlag.Load() {
+			n++
+		}
+	}
+	return n
+}
+
+// medianPeerTD retrieves the median total difficulty across all non-lagging
+// peers, or nil if there are no such peers. With an even number of peers, the
+// mean of the two middle values is returned.
+func (ps *peerSet) medianPeerTD() *big.Int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var (
+		tds     = make([]*big.Int, 0, len(ps.peers))
+		highest = ps.highestTD()
+	)
+	for _, p := range ps.peers {
+		if ps.isLagging(p, highest) {
+			continue
+		}
+		_, td := p.Head()
+		tds = append(tds, td)
+	}
+	if len(tds) == 0 {
+		return nil
+	}
+	slices.SortFunc(tds, (*big.Int).Cmp)
+
+	mid := len(tds) / 2
+	if len(tds)%2 == 1 {
+		return new(big.Int).Set(tds[mid])
+	}
+	median := new(big.Int).Add(tds[mid-1], tds[mid])
+	return median.Rsh(median, 1)
+}
+
+// peerLagging returns whether the peer with the given id is considered lagging,
+// either because it was explicitly marked so, or because it is too far behind
+// the best peer.
+func (ps *peerSet) peerLagging(id string) bool {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	p, ok := ps.peers[id]
+	if !ok {
+		return false
+	}
+	return ps.isLagging(p, ps.highestTD())
+}
+
+// shardPeers partitions the non-lagging peers into n disjoint shards of nearly
+// equal size, e.g. to give each of n parallel download routines its own peers.
+// Peers are assigned in the order of their ids, so the sharding is stable for
+// the same set of peers.
+func (ps *peerSet) shardPeers(n int) [][]*ethPeer {
+	if n <= 0 {
+		return nil
+	}
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	var (
+		best  = ps.highestTD()
+		peers = make([]*ethPeer, 0, len(ps.peers))
+	)
+	for _, p := range ps.peers {
+		if !ps.isLagging(p, best) {
+			peers = append(peers, p)
+		}
+	}
+	slices.SortFunc(peers, func(a, b *ethPeer) int {
+		return strings.Compare(a.ID(), b.ID())
+	})
+	shards := make([][]*ethPeer, n)
+	for i, p := range peers {
+		shards[i%n] = append(shards[i%n], p)
+	}
+	return shards
+}
+
+// highestTD returns the highest total difficulty advertised by any peer not
+// explicitly marked as lagging, or nil if there are no such peers.
+//
+// The caller must hold the peerset lock.
+func (ps *peerSet) highestTD() *big.Int {
+	var best *big.Int
+	for _, p := range ps.peers {
+		if p.Lagging() {
+			continue
+		}
+		if _, td := p.Head(); best == nil || td.Cmp(best) > 0 {
+			best = td
+		}
+	}
+	return best
+}
+
+// isLagging returns whether the given peer is considered lagging, given the
+// currently highest total difficulty among all peers.
+//
+// The caller must hold the peerset lock.
+func (ps *peerSet) isLagging(p *ethPeer, best *big.Int) bool {
+	if p.Lagging() {
+		return true
+	}
+	if ps.laggingThreshold.Sign() == 0 || best == nil {
+		return false
+	}
+	_, td := p.Head()
+	return new(big.Int).Sub(best, td).Cmp(ps.laggingThreshold) > 0
+}
+
 // peerWithHighestTD retrieves the known peer with the currently highest total
 // difficulty, but below the given PoS switchover threshold.
 func (ps *peerSet) peerWithHighestTD() *eth.Peer {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
 
+	return ps.bestPeer(false)
+}
+
+// peerWithHighestTDAllowLagging retrieves the known peer with the currently
+// highest total difficulty like peerWithHighestTD, but falls back to the best
+// lagging peer if every peer is lagging.
+//
+// The fallback is a last resort for recovering from stalls, where all peers may
+// end up flagged lagging and sync would otherwise be unable to pick anyone. The
+// returned peer is not guaranteed to be ahead of the local chain.
+func (ps *peerSet) peerWithHighestTDAllowLagging() *eth.Peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	if peer := ps.bestPeer(false); peer != nil {
+		return peer
+	}
+	peer := ps.bestPeer(true)
+	if peer != nil {
+		log.Debug("Falling back to lagging peer with highest TD", "peer", peer.ID())
+	}
+	return peer
+}
+
+// bestPeer returns the peer with the highest total difficulty, optionally also
+// considering the lagging ones.
+//
+// The caller must hold the peerset lock.
+func (ps *peerSet) bestPeer(allowLagging bool) *eth.Peer {
 	var (
 		bestPeer *eth.Peer
 		bestTd   *big.Int
+		highest  = ps.highestTD()
 	)
 	for _, p := range ps.peers {
-		if p.Lagging() {
+		if !allowLagging && ps.isLagging(p, highest) {
 			continue
 		}
 		if _, td := p.Head(); bestPeer == nil || td.Cmp(bestTd) > 0 {
@@ -515,6 +1495,122 @@ func (ps *peerSet) peerWithHighestTD() *eth.Peer {
 	return bestPeer
 }
 
+// PeerSetHealth is a summary of the peer set's health, e.g. for readiness probes.
+type PeerSetHealth struct {
+	Peers             int      // Number of registered peers
+	HasSyncPeer       bool     // Whether at least one peer is not lagging
+	BestTD            *big.Int // Highest total difficulty among the non-lagging peers, nil if none
+	EVNPeers          int      // Number of connected peers flagged as EVN peers (validators and whitelisted nodes)
+	PendingExtensions int      // Number of peers with an unfinished snap or bsc extension negotiation
+}
+
+// health aggregates a summary of the peer set's health in a single locked pass.
+func (ps *peerSet) health() PeerSetHealth {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	health := PeerSetHealth{
+		Peers:             len(ps.peers),
+		PendingExtensions: len(ps.snapWait) + len(ps.snapPend) + len(ps.bscWait) + len(ps.bscPend),
+	}
+	highest := ps.highestTD()
+	for _, p := range ps.peers {
+		if p.EVNPeerFlag.Load() {
+			health.EVNPeers++
+		}
+		if ps.isLagging(p, highest) {
+			continue
+		}
+		health.HasSyncPeer = true
+		if _, td := p.Head(); health.BestTD == nil || td.Cmp(health.BestTD) > 0 {
+			health.BestTD = td
+		}
+	}
+	return health
+}
+
+// refreshPeerHead requests the headers following the cached head of the given
+// peer and advances its head and total difficulty to the last one returned. It
+// blocks until the peer answers, giving a fresh view of the peer's chain before
+// critical sync decisions.
+func (ps *peerSet) refreshPeerHead(id string) error {
+	p := ps.peer(id)
+	if p == nil {
+		return errPeerNotRegistered
+	}
+	head, td := p.Head()
+
+	resCh := make(chan *eth.Response)
+	req, err := p.RequestHeadersByHash(head, headRefreshAmount, 0, false, resCh)
+	if err != nil {
+		return err
+	}
+	defer req.Close()
+
+	timeout := time.NewTimer(headRefreshTimeout)
+	defer timeout.Stop()
+
+	var headers []*types.Header
+	select {
+	case res := <-resCh:
+		res.Done <- nil
+		headers = *res.Res.(*eth.BlockHeadersRequest)
+	case <-timeout.C:
+		return errHeadRefreshTimeout
+	case <-ps.quitCh:
+		return errPeerSetClosed
+	}
+	// The response must start at the cached head and form a chain from there
+	if len(headers) == 0 || headers[0].Hash() != head {
+		return errInvalidHeadRefresh
+	}
+	for i := 1; i < len(headers); i++ {
+		if headers[i].ParentHash != headers[i-1].Hash() {
+			return errInvalidHeadRefresh
+		}
+		td.Add(td, headers[i].Difficulty)
+	}
+	if len(headers) > 1 {
+		p.SetHead(headers[len(headers)-1].Hash(), td)
+	}
+	return nil
+}
+
+// drain stops accepting new peers and waits up to the given timeout for the
+// pending extension waits to resolve, letting the in-flight connections finish
+// their handshake before all peers are disconnected. Blocked extension waits
+// still pending when the timeout expires are aborted by the closing.
+func (ps *peerSet) drain(timeout time.Duration) {
+	ps.lock.Lock()
+	ps.draining = true
+	ps.lock.Unlock()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		ps.lock.RLock()
+		pending := len(ps.snapWait) + len(ps.bscWait)
+		ps.lock.RUnlock()
+
+		if pending == 0 {
+			break
+		}
+		select {
+		case <-ticker.C:
+			continue
+		case <-deadline.C:
+			log.Warn("Peer set drain timed out", "pending", pending)
+		case <-ps.quitCh:
+		}
+		break
+	}
+	ps.close()
+}
+
 // close disconnects all peers.
 func (ps *peerSet) close() {
 	ps.lock.Lock()
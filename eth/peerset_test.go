@@ -1,13 +1,28 @@
 package eth
 
 import (
+	"errors"
+	"io"
+	"math/big"
 	"reflect"
 	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/mclock"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/eth/ethconfig"
+	"github.com/ethereum/go-ethereum/eth/protocols/bsc"
+	"github.com/ethereum/go-ethereum/eth/protocols/eth"
+	"github.com/ethereum/go-ethereum/eth/protocols/snap"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/params"
 )
 
 // mockPeer is a simplified p2p.Peer for testing purposes
@@ -351,3 +366,1542 @@ func existProxyedValidator(ps *mockPeerSet, address common.Address, proxyedList
 func contains(slice []string, str string) bool {
 	return slices.Contains(slice, str)
 }
+
+// handshakeTestChain is a genesis-only chain to run `eth` handshakes against.
+type handshakeTestChain struct {
+	genesis *types.Block
+}
+
+func (c *handshakeTestChain) Config() *params.ChainConfig  { return params.TestChainConfig }
+func (c *handshakeTestChain) Genesis() *types.Block        { return c.genesis }
+func (c *handshakeTestChain) CurrentHeader() *types.Header { return c.genesis.Header() }
+
+// newTestEthPeer creates an `eth` peer with the given node id byte, advertising
+// a head with the given total difficulty. The total difficulty is negotiated in
+// a handshake with a remote peer, as it would be on a live connection. The peer
+// is closed when the test ends.
+func newTestEthPeer(t *testing.T, id byte, td int64, caps ...p2p.Cap) *eth.Peer {
+	t.Helper()
+
+	var (
+		chain       = &handshakeTestChain{genesis: types.NewBlockWithHeader(&types.Header{Number: common.Big0})}
+		local, sink = p2p.MsgPipe()
+		peer        = eth.NewPeer(eth.ETH68, p2p.NewPeer(enode.ID{id}, "", caps), local, nil)
+		remote      = eth.NewPeer(eth.ETH68, p2p.NewPeer(enode.ID{^id}, "", nil), sink, nil)
+		errc        = make(chan error, 1)
+	)
+	t.Cleanup(func() {
+		peer.Close()
+		remote.Close()
+		local.Close()
+		sink.Close()
+	})
+	go func() {
+		errc <- remote.Handshake(1, chain, eth.BlockRangeUpdatePacket{}, big.NewInt(td), nil)
+	}()
+	if err := peer.Handshake(1, chain, eth.BlockRangeUpdatePacket{}, common.Big0, nil); err != nil {
+		t.Fatalf("failed to run local handshake: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to run remote handshake: %v", err)
+	}
+	_, have := peer.Head()
+	peer.SetHead(common.Hash{id}, have)
+	return peer
+}
+
+// Tests that peers falling too far behind the best peer are classified as
+// lagging according to the configured threshold.
+func TestPeerSetLaggingThreshold(t *testing.T) {
+	var (
+		best    = newTestEthPeer(t, 1, 1000)
+		near    = newTestEthPeer(t, 2, 990)
+		far     = newTestEthPeer(t, 3, 900)
+		flagged = newTestEthPeer(t, 4, 2000)
+	)
+	flagged.MarkLagging()
+
+	register := func(ps *peerSet) {
+		for _, p := range []*eth.Peer{best, near, far, flagged} {
+			if err := ps.registerPeer(p, nil, nil); err != nil {
+				t.Fatalf("failed to register peer: %v", err)
+			}
+		}
+	}
+	// With the default threshold only explicitly marked peers are lagging
+	ps := newPeerSet()
+	register(ps)
+	for _, p := range []*eth.Peer{best, near, far} {
+		if ps.peerLagging(p.ID()) {
+			t.Errorf("peer %s lagging with default threshold", p.ID())
+		}
+	}
+	if !ps.peerLagging(flagged.ID()) {
+		t.Errorf("marked peer not lagging")
+	}
+	// Tighten the threshold and ensure far away peers are excluded
+	config := ethconfig.DefaultPeerSetConfig
+	config.LaggingThreshold = 20
+	ps = newPeerSetWithConfig(config)
+	register(ps)
+	for p, want := range map[*eth.Peer]bool{best: false, near: false, far: true, flagged: true} {
+		if have := ps.peerLagging(p.ID()); have != want {
+			t.Errorf("peer %s lagging mismatch: have %v, want %v", p.ID(), have, want)
+		}
+	}
+	if have := ps.peerWithHighestTD(); have != best {
+		t.Errorf("best peer mismatch: have %v, want %v", have.ID(), best.ID())
+	}
+}
+
+// Tests that the best peer selection falls back to lagging peers only if all of
+// the peers are lagging.
+func TestPeerSetPeerWithHighestTDAllowLagging(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		slow = newTestEthPeer(t, 1, 1000)
+		fast = newTestEthPeer(t, 2, 2000)
+	)
+	fast.MarkLagging()
+	for _, p := range []*eth.Peer{slow, fast} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	// Non-lagging peers are preferred, even with a lower total difficulty
+	if have := ps.peerWithHighestTDAllowLagging(); have != slow {
+		t.Errorf("best peer mismatch: have %v, want %v", have, slow.ID())
+	}
+	// With every peer lagging, only the fallback picks one
+	slow.MarkLagging()
+	if have := ps.peerWithHighestTD(); have != nil {
+		t.Errorf("best peer without fallback: have %v, want nil", have.ID())
+	}
+	if have := ps.peerWithHighestTDAllowLagging(); have != fast {
+		t.Errorf("fallback peer mismatch: have %v, want %v", have, fast.ID())
+	}
+	// Empty peer sets have no peer to fall back to
+	if have := newPeerSet().peerWithHighestTDAllowLagging(); have != nil {
+		t.Errorf("fallback peer from empty set: have %v, want nil", have.ID())
+	}
+}
+
+// Tests that the non-lagging peers are sharded into disjoint, balanced and
+// stable subsets.
+func TestPeerSetShardPeers(t *testing.T) {
+	ps := newPeerSet()
+
+	lagging := newTestEthPeer(t, 0xff, 100)
+	lagging.MarkLagging()
+	if err := ps.registerPeer(lagging, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	for i := 1; i <= 10; i++ {
+		if err := ps.registerPeer(newTestEthPeer(t, byte(i), 100), nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	if shards := ps.shardPeers(0); shards != nil {
+		t.Fatalf("shards without count: have %d, want none", len(shards))
+	}
+	shards := ps.shardPeers(3)
+	if len(shards) != 3 {
+		t.Fatalf("shard count mismatch: have %d, want 3", len(shards))
+	}
+	seen := make(map[string]bool)
+	for i, shard := range shards {
+		if len(shard) < 3 || len(shard) > 4 {
+			t.Errorf("shard %d unbalanced: have %d peers, want 3 or 4", i, len(shard))
+		}
+		for _, p := range shard {
+			if seen[p.ID()] {
+				t.Errorf("peer %s in multiple shards", p.ID())
+			}
+			if p.Peer == lagging {
+				t.Errorf("lagging peer sharded")
+			}
+			seen[p.ID()] = true
+		}
+	}
+	if len(seen) != 10 {
+		t.Fatalf("sharded peer count mismatch: have %d, want 10", len(seen))
+	}
+	if again := ps.shardPeers(3); !reflect.DeepEqual(again, shards) {
+		t.Fatalf("sharding not stable")
+	}
+}
+
+// Tests that peers are not reselected for the same transaction hash within the
+// broadcast dedup window.
+func TestPeersWithoutTransactionDedup(t *testing.T) {
+	config := ethconfig.DefaultPeerSetConfig
+	config.TxBroadcastDedupWindow = 300 * time.Millisecond
+
+	var (
+		ps    = newPeerSetWithConfig(config)
+		clock = new(mclock.Simulated)
+		hash  = common.Hash{0xff}
+	)
+	ps.clock = clock
+
+	var (
+		peer1 = newTestEthPeer(t, 1, 0)
+		peer2 = newTestEthPeer(t, 2, 0)
+	)
+	for _, p := range []*eth.Peer{peer1, peer2} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	if peers := ps.peersWithoutTransaction(hash); len(peers) != 2 {
+		t.Fatalf("initial selection mismatch: have %d peers, want 2", len(peers))
+	}
+	// Rapid requeries within the window should be suppressed
+	clock.Run(100 * time.Millisecond)
+	if peers := ps.peersWithoutTransaction(hash); len(peers) != 0 {
+		t.Fatalf("requery within window: have %d peers, want 0", len(peers))
+	}
+	// A newly connected peer should still be selected
+	peer3 := newTestEthPeer(t, 3, 0)
+	if err := ps.registerPeer(peer3, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	if peers := ps.peersWithoutTransaction(hash); len(peers) != 1 || peers[0].Peer != peer3 {
+		t.Fatalf("new peer selection mismatch: have %v", peers)
+	}
+	// Different hashes are not affected
+	if peers := ps.peersWithoutTransaction(common.Hash{0xfe}); len(peers) != 3 {
+		t.Fatalf("other hash selection mismatch: have %d peers, want 3", len(peers))
+	}
+	// After the window expires all peers can be selected again
+	clock.Run(300 * time.Millisecond)
+	if peers := ps.peersWithoutTransaction(hash); len(peers) != 3 {
+		t.Fatalf("requery after window: have %d peers, want 3", len(peers))
+	}
+	// Without a window (the default) nothing is suppressed nor tracked
+	ps = newPeerSet()
+	for _, p := range []*eth.Peer{peer1, peer2, peer3} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if peers := ps.peersWithoutTransaction(hash); len(peers) != 3 {
+			t.Fatalf("requery without window: have %d peers, want 3", len(peers))
+		}
+	}
+	if len(ps.broadcastDedup) != 0 || len(ps.broadcastDedupQueue) != 0 {
+		t.Fatalf("selections tracked without window: %d tracked, %d queued", len(ps.broadcastDedup), len(ps.broadcastDedupQueue))
+	}
+}
+
+// Tests that the number of votes known by a peer's `bsc` extension is reported.
+func TestPeerKnownVoteCount(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		plain    = newTestEthPeer(t, 1, 100)
+		voter    = newTestEthPeer(t, 2, 100)
+		app, net = p2p.MsgPipe()
+	)
+	defer app.Close()
+	defer net.Close()
+
+	ext := bsc.NewPeer(bsc.Bsc2, voter.Peer, app)
+	defer ext.Close()
+
+	if err := ps.registerPeer(plain, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	if err := ps.registerPeer(voter, nil, ext); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	if _, ok := ps.peerKnownVoteCount(plain.ID()); ok {
+		t.Errorf("peer without bsc extension reported a vote count")
+	}
+	// Broadcast a few votes, which marks them as known by the peer
+	go func() {
+		for {
+			msg, err := net.ReadMsg()
+			if err != nil {
+				return
+			}
+			msg.Discard()
+		}
+	}()
+	votes := make([]*types.VoteEnvelope, 3)
+	for i := range votes {
+		votes[i] = &types.VoteEnvelope{Data: &types.VoteData{TargetNumber: uint64(i + 1)}}
+	}
+	ext.AsyncSendVotes(votes)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count, ok := ps.peerKnownVoteCount(voter.ID())
+		if !ok {
+			t.Fatalf("peer with bsc extension reported no vote count")
+		}
+		if count == len(votes) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("known vote count mismatch: have %d, want %d", count, len(votes))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that incremental EVN updates only flip the flags of the affected peers.
+func TestPeerSetUpdateEVNFlags(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		validator = newTestEthPeer(t, 1, 100)
+		joining   = newTestEthPeer(t, 2, 100)
+		whitelist = newTestEthPeer(t, 3, 100)
+		other     = newTestEthPeer(t, 4, 100)
+	)
+	for _, p := range []*eth.Peer{validator, joining, whitelist, other} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	ps.enableEVNFeatures(
+		map[common.Address][]enode.ID{{0x01}: {validator.Node().ID()}},
+		map[enode.ID]struct{}{whitelist.Node().ID(): {}},
+	)
+	check := func(want map[*eth.Peer]bool) {
+		t.Helper()
+		for p, flag := range want {
+			if have := ps.peer(p.ID()).EVNPeerFlag.Load(); have != flag {
+				t.Errorf("peer %s EVN flag mismatch: have %v, want %v", p.ID(), have, flag)
+			}
+		}
+	}
+	check(map[*eth.Peer]bool{validator: true, joining: false, whitelist: true, other: false})
+
+	// Rotate the validator out and another one in. Flip the flag of an untouched
+	// peer by hand to ensure it's not recomputed.
+	ps.peer(other.ID()).EVNPeerFlag.Store(true)
+	ps.updateEVNFlags(
+		map[enode.ID]struct{}{joining.Node().ID(): {}},
+		map[enode.ID]struct{}{validator.Node().ID(): {}},
+	)
+	check(map[*eth.Peer]bool{validator: false, joining: true, whitelist: true, other: true})
+
+	if _, ok := ps.evnValidators[validator.Node().ID()]; ok {
+		t.Errorf("removed validator still tracked")
+	}
+	if _, ok := ps.evnValidators[joining.Node().ID()]; !ok {
+		t.Errorf("added validator not tracked")
+	}
+	if peers := ps.validatorPeers(common.Address{0x01}); len(peers) != 0 {
+		t.Errorf("removed validator still resolvable: %v", peers)
+	}
+}
+
+// Tests that repeated EVN feature updates with only the on-chain validators
+// changed flip the affected peers only, and that peers connecting in between are
+// flagged on registration.
+func TestPeerSetEnableEVNFeaturesIncremental(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		validator = newTestEthPeer(t, 1, 100)
+		joining   = newTestEthPeer(t, 2, 100)
+		other     = newTestEthPeer(t, 3, 100)
+		late      = newTestEthPeer(t, 4, 100)
+	)
+	for _, p := range []*eth.Peer{validator, joining, other} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	ps.enableEVNFeatures(map[common.Address][]enode.ID{{0x01}: {validator.Node().ID(), late.Node().ID()}}, nil)
+
+	// A validator node connecting later is flagged right away
+	if err := ps.registerPeer(late, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	if !ps.peer(late.ID()).EVNPeerFlag.Load() {
+		t.Fatalf("late validator peer not flagged on registration")
+	}
+	// Rotate a validator node out and another one in. Flip the flag of an untouched
+	// peer by hand to ensure it's not recomputed.
+	ps.peer(other.ID()).EVNPeerFlag.Store(true)
+	ps.enableEVNFeatures(map[common.Address][]enode.ID{{0x01}: {joining.Node().ID(), late.Node().ID()}}, nil)
+
+	for p, want := range map[*eth.Peer]bool{validator: false, joining: true, other: true, late: true} {
+		if have := ps.peer(p.ID()).EVNPeerFlag.Load(); have != want {
+			t.Errorf("peer %s EVN flag mismatch: have %v, want %v", p.ID(), have, want)
+		}
+	}
+	if peers := ps.validatorPeers(common.Address{0x01}); len(peers) != 2 {
+		t.Errorf("validator peers mismatch: have %d, want 2", len(peers))
+	}
+	// A whitelist change recomputes all the flags
+	ps.enableEVNFeatures(map[common.Address][]enode.ID{{0x01}: {joining.Node().ID(), late.Node().ID()}}, map[enode.ID]struct{}{validator.Node().ID(): {}})
+
+	for p, want := range map[*eth.Peer]bool{validator: true, joining: true, other: false, late: true} {
+		if have := ps.peer(p.ID()).EVNPeerFlag.Load(); have != want {
+			t.Errorf("peer %s EVN flag mismatch after whitelist change: have %v, want %v", p.ID(), have, want)
+		}
+	}
+}
+
+// Tests that removing a validator which is an EVN peer through another source
+// too keeps it flagged.
+func TestPeerSetUpdateEVNFlagsMultiSource(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		whitelisted = newTestEthPeer(t, 1, 100)
+		trusted     = newTestEthPeer(t, 2, 100)
+		plain       = newTestEthPeer(t, 3, 100)
+	)
+	for _, p := range []*eth.Peer{whitelisted, trusted, plain} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	ps.addTrustedValidator(trusted.Node().ID())
+	ps.enableEVNFeatures(
+		map[common.Address][]enode.ID{
+			{0x01}: {whitelisted.Node().ID()},
+			{0x02}: {trusted.Node().ID()},
+			{0x03}: {plain.Node().ID()},
+		},
+		map[enode.ID]struct{}{whitelisted.Node().ID(): {}},
+	)
+	ps.updateEVNFlags(nil, map[enode.ID]struct{}{
+		whitelisted.Node().ID(): {},
+		trusted.Node().ID():     {},
+		plain.Node().ID():       {},
+	})
+	for p, want := range map[*eth.Peer]bool{whitelisted: true, trusted: true, plain: false} {
+		if have := ps.peer(p.ID()).EVNPeerFlag.Load(); have != want {
+			t.Errorf("peer %s EVN flag mismatch: have %v, want %v", p.ID(), have, want)
+		}
+	}
+}
+
+// Tests that extension registrations colliding with a peer that's going away are
+// retried if configured so.
+func TestPeerSetRegisterRetry(t *testing.T) {
+	old := newTestEthPeer(t, 1, 100, p2p.Cap{Name: eth.ProtocolName, Version: eth.ETH68})
+	ext := bsc.NewPeer(bsc.Bsc2, old.Peer, nil)
+	defer ext.Close()
+
+	// Without retries the collision is rejected right away
+	ps := newPeerSet()
+	if err := ps.registerPeer(old, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	if err := ps.registerBscExtension(ext); !errors.Is(err, errPeerAlreadyRegistered) {
+		t.Fatalf("colliding registration error mismatch: have %v, want %v", err, errPeerAlreadyRegistered)
+	}
+	// With retries, the registration succeeds once the old peer is torn down
+	config := ethconfig.DefaultPeerSetConfig
+	config.RegisterRetries, config.RegisterRetryDelay = 50, 10*time.Millisecond
+	ps = newPeerSetWithConfig(config)
+	if err := ps.registerPeer(old, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ps.unregisterPeer(old.ID())
+	}()
+	if err := ps.registerBscExtension(ext); err != nil {
+		t.Fatalf("failed to register extension after retries: %v", err)
+	}
+	ps.lock.RLock()
+	_, ok := ps.bscPend[ext.ID()]
+	ps.lock.RUnlock()
+	if !ok {
+		t.Fatalf("extension not tracked as pending")
+	}
+}
+
+// Tests that peers which recently failed a block request are skipped in favor
+// of others until the failure window passes.
+func TestPeerForBlockRequest(t *testing.T) {
+	config := ethconfig.DefaultPeerSetConfig
+	config.RequestFailureWindow = time.Second
+
+	clock := new(mclock.Simulated)
+	ps := newPeerSetWithConfig(config)
+	ps.clock = clock
+
+	var (
+		best  = newTestEthPeer(t, 1, 200)
+		other = newTestEthPeer(t, 2, 100)
+		hash  = common.Hash{0xff}
+	)
+	for _, p := range []*eth.Peer{best, other} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	if have := ps.peerForBlockRequest(hash); have == nil || have.Peer != best {
+		t.Fatalf("selected peer mismatch: have %v, want %s", have, best.ID())
+	}
+	ps.markRequestFailure(best.ID())
+	if have := ps.peerForBlockRequest(hash); have == nil || have.Peer != other {
+		t.Fatalf("selected peer mismatch after failure: have %v, want %s", have, other.ID())
+	}
+	ps.markRequestFailure(other.ID())
+	if have := ps.peerForBlockRequest(hash); have != nil {
+		t.Fatalf("selected failed peer %s", have.ID())
+	}
+	clock.Run(time.Second)
+	if have := ps.peerForBlockRequest(hash); have == nil || have.Peer != best {
+		t.Fatalf("selected peer mismatch after window: have %v, want %s", have, best.ID())
+	}
+}
+
+// Tests that the uptime of peers is tracked from their registration.
+func TestPeerSetPeerUptime(t *testing.T) {
+	clock := new(mclock.Simulated)
+	ps := newPeerSet()
+	ps.clock = clock
+
+	var (
+		old   = newTestEthPeer(t, 1, 100)
+		fresh = newTestEthPeer(t, 2, 100)
+	)
+	if err := ps.registerPeer(old, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	clock.Run(time.Minute)
+	if err := ps.registerPeer(fresh, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	clock.Run(time.Second)
+
+	if have := ps.peerUptime(old.ID()); have != time.Minute+time.Second {
+		t.Fatalf("old peer uptime mismatch: have %v, want %v", have, time.Minute+time.Second)
+	}
+	if have := ps.peerUptime(fresh.ID()); have != time.Second {
+		t.Fatalf("fresh peer uptime mismatch: have %v, want %v", have, time.Second)
+	}
+	ps.unregisterPeer(old.ID())
+	if have := ps.peerUptime(old.ID()); have != 0 {
+		t.Fatalf("unregistered peer uptime mismatch: have %v, want 0", have)
+	}
+}
+
+// Tests that peers not running a given protocol are listed.
+func TestPeerSetPeersWithoutCap(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		ethProto = p2p.Protocol{Name: eth.ProtocolName, Version: eth.ETH68, Length: 17}
+		bscProto = p2p.Protocol{Name: bsc.ProtocolName, Version: bsc.Bsc1, Length: 2}
+		ethCap   = p2p.Cap{Name: eth.ProtocolName, Version: eth.ETH68}
+		bscCap   = p2p.Cap{Name: bsc.ProtocolName, Version: bsc.Bsc1}
+		protos   = []p2p.Protocol{ethProto, bscProto}
+
+		full    = eth.NewPeer(eth.ETH68, p2p.NewPeerWithProtocols(enode.ID{1}, protos, "", []p2p.Cap{ethCap, bscCap}), nil, nil)
+		plain   = eth.NewPeer(eth.ETH68, p2p.NewPeerWithProtocols(enode.ID{2}, protos, "", []p2p.Cap{ethCap}), nil, nil)
+		unknown = eth.NewPeer(eth.ETH68, p2p.NewPeerWithProtocols(enode.ID{3}, protos, "", []p2p.Cap{ethCap, {Name: bsc.ProtocolName, Version: 0}}), nil, nil)
+	)
+	for _, p := range []*eth.Peer{full, plain, unknown} {
+		defer p.Close()
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	var have []string
+	for _, p := range ps.peersWithoutCap(bsc.ProtocolName, bsc.ProtocolVersions) {
+		have = append(have, p.ID())
+	}
+	slices.Sort(have)
+	if want := []string{plain.ID(), unknown.ID()}; !slices.Equal(have, want) {
+		t.Fatalf("peers without bsc mismatch: have %v, want %v", have, want)
+	}
+	if have := ps.peersWithoutCap(eth.ProtocolName, eth.ProtocolVersions); len(have) != 0 {
+		t.Fatalf("peers without eth mismatch: have %d, want 0", len(have))
+	}
+}
+
+// Tests that the block propagation reach matches the peer selection of an actual
+// propagation under the various broadcast strategies.
+func TestPeerSetPropagationReach(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		hash  = common.Hash{0xff}
+		peers []*eth.Peer
+	)
+	for i := 0; i < 9; i++ {
+		peer := newTestEthPeer(t, byte(i+1), 100)
+		if err := ps.registerPeer(peer, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+		peers = append(peers, peer)
+	}
+
+	check := func(name string, all, fullEVN bool, direct, announce, suppressed int) {
+		t.Helper()
+
+		d, a, s := ps.propagationReach(hash, all, fullEVN)
+		if d != direct || a != announce || s != suppressed {
+			t.Errorf("%s: reach mismatch: have %d/%d/%d, want %d/%d/%d", name, d, a, s, direct, announce, suppressed)
+		}
+		directPeers, announcePeers, s := ps.peersForBlockPropagation(hash, all, fullEVN)
+		if len(directPeers) != direct || len(announcePeers) != announce || s != suppressed {
+			t.Errorf("%s: selection mismatch: have %d/%d/%d, want %d/%d/%d", name, len(directPeers), len(announcePeers), s, direct, announce, suppressed)
+		}
+	}
+	check("plain", false, false, 3, 6, 0)
+	check("all", true, false, 9, 0, 0)
+
+	for _, peer := range peers {
+		peer.EVNPeerFlag.Store(true)
+	}
+	check("evn", false, false, 3, 6, 6)
+	check("evn full", false, true, 9, 0, 0)
+
+	for _, peer := range peers {
+		peer.EVNPeerFlag.Store(false)
+		peer.ProxyedPeerFlag.Store(true)
+	}
+	check("proxyed", false, false, 9, 0, 0)
+}
+
+// Tests that manually trusted validators are flagged as EVN peers even if they
+// are not part of the on-chain validator set.
+func TestPeerSetTrustedValidator(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		validator = newTestEthPeer(t, 1, 100)
+		trusted   = newTestEthPeer(t, 2, 100)
+		other     = newTestEthPeer(t, 3, 100)
+	)
+	for _, p := range []*eth.Peer{validator, trusted, other} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	ps.addTrustedValidator(trusted.Node().ID())
+	if !ps.peer(trusted.ID()).EVNPeerFlag.Load() {
+		t.Fatalf("trusted validator not flagged on addition")
+	}
+	// The manual entry must survive recomputing the flags from the on-chain set
+	for i := 0; i < 2; i++ {
+		ps.enableEVNFeatures(map[common.Address][]enode.ID{{0x01}: {validator.Node().ID()}}, nil)
+		for p, want := range map[*eth.Peer]bool{validator: true, trusted: true, other: false} {
+			if have := ps.peer(p.ID()).EVNPeerFlag.Load(); have != want {
+				t.Errorf("round %d: peer %s EVN flag mismatch: have %v, want %v", i, p.ID(), have, want)
+			}
+		}
+	}
+	// Incremental removals don't affect trusted validators either
+	ps.updateEVNFlags(nil, map[enode.ID]struct{}{trusted.Node().ID(): {}})
+	if !ps.peer(trusted.ID()).EVNPeerFlag.Load() {
+		t.Fatalf("trusted validator unflagged by incremental removal")
+	}
+}
+
+// Tests that the known hash memory estimate tracks the peers' caches, and that
+// exceeding the cap trims all caches proportionally.
+func TestPeerSetKnownHashMemoryCap(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		small = newTestEthPeer(t, 1, 100)
+		large = newTestEthPeer(t, 2, 100)
+	)
+	for i := 0; i < 100; i++ {
+		small.MarkTransaction(common.Hash{0x01, byte(i)})
+	}
+	for i := 0; i < 300; i++ {
+		large.MarkTransaction(common.Hash{0x02, byte(i), byte(i >> 8)})
+	}
+	for _, p := range []*eth.Peer{small, large} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	if have, want := ps.totalKnownHashMemory(), uint64(400*knownHashEntrySize); have != want {
+		t.Fatalf("known hash memory mismatch: have %d, want %d", have, want)
+	}
+	// Without a cap nothing is trimmed
+	if ps.trimKnownHashes() {
+		t.Fatalf("trimmed known hashes without a cap")
+	}
+	// Halve the allowance and ensure both peers are trimmed proportionally
+	config := ethconfig.DefaultPeerSetConfig
+	config.KnownHashMemoryCap = 200 * knownHashEntrySize
+	ps = newPeerSetWithConfig(config)
+	for _, p := range []*eth.Peer{small, large} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	if !ps.trimKnownHashes() {
+		t.Fatalf("known hashes not trimmed above the cap")
+	}
+	if have := small.KnownHashCount(); have != 50 {
+		t.Errorf("small peer known hashes mismatch: have %d, want 50", have)
+	}
+	if have := large.KnownHashCount(); have != 150 {
+		t.Errorf("large peer known hashes mismatch: have %d, want 150", have)
+	}
+	if ps.trimKnownHashes() {
+		t.Fatalf("trimmed known hashes within the cap")
+	}
+}
+
+// Tests that the median total difficulty is computed over the non-lagging peers,
+// for both odd and even peer counts.
+func TestPeerSetMedianTD(t *testing.T) {
+	ps := newPeerSet()
+	if have := ps.medianPeerTD(); have != nil {
+		t.Fatalf("empty peer set median: have %v, want nil", have)
+	}
+	register := func(id byte, td int64) *eth.Peer {
+		peer := newTestEthPeer(t, id, td)
+		if err := ps.registerPeer(peer, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+		return peer
+	}
+	register(1, 300)
+	register(2, 100)
+	register(3, 200)
+	if have := ps.medianPeerTD(); have == nil || have.Int64() != 200 {
+		t.Fatalf("odd median mismatch: have %v, want 200", have)
+	}
+	register(4, 250)
+	if have := ps.medianPeerTD(); have == nil || have.Int64() != 225 {
+		t.Fatalf("even median mismatch: have %v, want 225", have)
+	}
+	// Lagging peers are excluded from the median
+	register(5, 5000).MarkLagging()
+	if have := ps.medianPeerTD(); have == nil || have.Int64() != 225 {
+		t.Fatalf("median with lagging peer mismatch: have %v, want 225", have)
+	}
+}
+
+// flakyMsgRW is a message stream whose writes fail while toggled to.
+type flakyMsgRW struct {
+	fail atomic.Bool
+}
+
+func (rw *flakyMsgRW) ReadMsg() (p2p.Msg, error) {
+	return p2p.Msg{}, io.EOF
+}
+
+func (rw *flakyMsgRW) WriteMsg(msg p2p.Msg) error {
+	msg.Discard()
+	if rw.fail.Load() {
+		return errors.New("write failed")
+	}
+	return nil
+}
+
+// Tests that consecutive send failures are counted per peer, reset on success
+// and make the failing peers preferred for dropping.
+func TestPeerSetSendFailures(t *testing.T) {
+	ps := newPeerSet()
+
+	newPeer := func(id byte) (*eth.Peer, *flakyMsgRW) {
+		rw := new(flakyMsgRW)
+		peer := eth.NewPeer(eth.ETH68, p2p.NewPeer(enode.ID{id}, "", nil), rw, nil)
+		t.Cleanup(peer.Close)
+		return peer, rw
+	}
+	var (
+		healthy, _     = newPeer(1)
+		flaky, flakyRW = newPeer(2)
+		dead, deadRW   = newPeer(3)
+		peers          = []*p2p.Peer{healthy.Peer, flaky.Peer, dead.Peer}
+	)
+	for _, p := range []*eth.Peer{healthy, flaky, dead} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	if have := mostFailingPeers(peers, ps.peerSendFailures); len(have) != len(peers) {
+		t.Fatalf("drop candidates without failures mismatch: have %d, want %d", len(have), len(peers))
+	}
+	// Fail the sends on the broken connections
+	flakyRW.fail.Store(true)
+	deadRW.fail.Store(true)
+
+	flaky.SendNewBlockHashes(nil, nil)
+	for i := 0; i < 3; i++ {
+		dead.SendNewBlockHashes(nil, nil)
+	}
+	healthy.SendNewBlockHashes(nil, nil)
+
+	for _, tt := range []struct {
+		peer *eth.Peer
+		want int
+	}{{healthy, 0}, {flaky, 1}, {dead, 3}} {
+		if have := ps.peerSendFailures(tt.peer.ID()); have != tt.want {
+			t.Fatalf("peer %s send failures mismatch: have %d, want %d", tt.peer.ID(), have, tt.want)
+		}
+	}
+	if have := mostFailingPeers(peers, ps.peerSendFailures); len(have) != 1 || have[0] != dead.Peer {
+		t.Fatalf("drop candidates mismatch: have %v, want [%s]", have, dead.ID())
+	}
+	// A successful send resets the counter
+	deadRW.fail.Store(false)
+	dead.SendNewBlockHashes(nil, nil)
+	if have := ps.peerSendFailures(dead.ID()); have != 0 {
+		t.Fatalf("send failures after success mismatch: have %d, want 0", have)
+	}
+	if have := mostFailingPeers(peers, ps.peerSendFailures); len(have) != 1 || have[0] != flaky.Peer {
+		t.Fatalf("drop candidates after reset mismatch: have %v, want [%s]", have, flaky.ID())
+	}
+}
+
+// Tests that refreshing a peer's head fetches the headers past its cached head
+// and advances the head and total difficulty to the latest one.
+func TestPeerSetRefreshPeerHead(t *testing.T) {
+	t.Parallel()
+
+	// Create a serving handler with a few blocks and a local client handler
+	server := newTestHandlerWithBlocks(10)
+	defer server.close()
+	client := newTestHandler()
+	defer client.close()
+
+	p2pSrc, p2pSink := p2p.MsgPipe()
+	defer p2pSrc.Close()
+	defer p2pSink.Close()
+
+	src := eth.NewPeer(eth.ETH68, p2p.NewPeerPipe(enode.ID{1}, "", nil, p2pSrc), p2pSrc, client.txpool)
+	sink := eth.NewPeer(eth.ETH68, p2p.NewPeerPipe(enode.ID{2}, "", nil, p2pSink), p2pSink, server.txpool)
+	defer src.Close()
+	defer sink.Close()
+
+	go server.handler.runEthPeer(sink, func(peer *eth.Peer) error {
+		return eth.Handle((*ethHandler)(server.handler), peer)
+	})
+	var (
+		genesis = server.chain.Genesis()
+		head    = server.chain.CurrentBlock()
+		td      = server.chain.GetTd(head.Hash(), head.Number.Uint64())
+	)
+	if err := src.Handshake(1, server.chain, eth.BlockRangeUpdatePacket{}, server.chain.GetTd(genesis.Hash(), 0), nil); err != nil {
+		t.Fatalf("failed to run protocol handshake: %v", err)
+	}
+	go eth.Handle((*ethHandler)(client.handler), src)
+
+	// Register the server with a stale head and refresh it
+	ps := newPeerSet()
+	if err := ps.registerPeer(src, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	src.SetHead(genesis.Hash(), server.chain.GetTd(genesis.Hash(), 0))
+
+	if err := ps.refreshPeerHead(src.ID()); err != nil {
+		t.Fatalf("failed to refresh peer head: %v", err)
+	}
+	if hash, have := src.Head(); hash != head.Hash() || have.Cmp(td) != 0 {
+		t.Fatalf("refreshed head mismatch: have %x/%v, want %x/%v", hash, have, head.Hash(), td)
+	}
+	if err := ps.refreshPeerHead("unknown"); !errors.Is(err, errPeerNotRegistered) {
+		t.Fatalf("unknown peer refresh error mismatch: have %v, want %v", err, errPeerNotRegistered)
+	}
+}
+
+// Tests that the health summary reflects the state of the peer set.
+func TestPeerSetHealth(t *testing.T) {
+	ps := newPeerSet()
+
+	// An empty peer set is unhealthy
+	if have := ps.health(); have.HasSyncPeer || have.BestTD != nil || have.Peers != 0 {
+		t.Fatalf("empty peer set health mismatch: have %+v", have)
+	}
+	var (
+		validator = newTestEthPeer(t, 1, 100)
+		lagging   = newTestEthPeer(t, 2, 200)
+	)
+	for _, p := range []*eth.Peer{validator, lagging} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	validator.EVNPeerFlag.Store(true)
+	lagging.MarkLagging()
+	ps.bscWait["pending"] = make(chan *bsc.Peer)
+
+	// A peer set with a single non-lagging peer is healthy
+	want := PeerSetHealth{Peers: 2, HasSyncPeer: true, BestTD: big.NewInt(100), EVNPeers: 1, PendingExtensions: 1}
+	if have := ps.health(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("healthy peer set mismatch: have %+v, want %+v", have, want)
+	}
+	// A peer set with only lagging peers is unhealthy
+	validator.MarkLagging()
+	want = PeerSetHealth{Peers: 2, HasSyncPeer: false, BestTD: nil, EVNPeers: 1, PendingExtensions: 1}
+	if have := ps.health(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("unhealthy peer set mismatch: have %+v, want %+v", have, want)
+	}
+}
+
+// Tests that extension waits beyond the configured cap fail fast instead of
+// blocking.
+func TestPeerSetMaxExtensionWaits(t *testing.T) {
+	config := ethconfig.DefaultPeerSetConfig
+	config.MaxExtensionWaits = 2
+	ps := newPeerSetWithConfig(config)
+
+	var (
+		snapCap = p2p.Cap{Name: snap.ProtocolName, Version: snap.SNAP1}
+		bscCap  = p2p.Cap{Name: bsc.ProtocolName, Version: bsc.Bsc1}
+		errc    = make(chan error, 2)
+	)
+	// Saturate the cap with a snap and a bsc wait
+	go func() {
+		_, err := ps.waitSnapExtension(newTestEthPeer(t, 1, 100, snapCap))
+		errc <- err
+	}()
+	go func() {
+		_, err := ps.waitBscExtension(newTestEthPeer(t, 2, 100, bscCap))
+		errc <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for ps.health().PendingExtensions != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("extension waits not pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Any further wait must fail immediately
+	start := time.Now()
+	if _, err := ps.waitSnapExtension(newTestEthPeer(t, 3, 100, snapCap)); !errors.Is(err, errTooManyExtensionWaits) {
+		t.Fatalf("excess snap wait error mismatch: have %v, want %v", err, errTooManyExtensionWaits)
+	}
+	if _, err := ps.waitBscExtension(newTestEthPeer(t, 4, 100, bscCap)); !errors.Is(err, errTooManyExtensionWaits) {
+		t.Fatalf("excess bsc wait error mismatch: have %v, want %v", err, errTooManyExtensionWaits)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("excess waits blocked for %v", elapsed)
+	}
+	// Release the pending waits
+	ps.close()
+	for i := 0; i < 2; i++ {
+		if err := <-errc; !errors.Is(err, errPeerSetClosed) {
+			t.Fatalf("pending wait error mismatch: have %v, want %v", err, errPeerSetClosed)
+		}
+	}
+}
+
+// Tests that the time spent waiting for a satellite protocol to connect is
+// recorded once the extension arrives.
+func TestPeerSetExtensionWaitTimers(t *testing.T) {
+	clock := new(mclock.Simulated)
+	ps := newPeerSet()
+	ps.clock = clock
+
+	// Record the waits locally, the global timers are no-ops with metrics disabled
+	var (
+		waits     = make(map[string][]time.Duration)
+		waitsLock sync.Mutex
+	)
+	ps.observeWait = func(protocol string, wait time.Duration) {
+		waitsLock.Lock()
+		defer waitsLock.Unlock()
+		waits[protocol] = append(waits[protocol], wait)
+	}
+	var (
+		ethCap  = p2p.Cap{Name: eth.ProtocolName, Version: eth.ETH68}
+		snapCap = p2p.Cap{Name: snap.ProtocolName, Version: snap.SNAP1}
+		bscCap  = p2p.Cap{Name: bsc.ProtocolName, Version: bsc.Bsc1}
+
+		snapPeer = newTestEthPeer(t, 1, 100, ethCap, snapCap)
+		bscPeer  = newTestEthPeer(t, 2, 100, ethCap, bscCap)
+		errc     = make(chan error, 2)
+	)
+
+	go func() {
+		_, err := ps.waitSnapExtension(snapPeer)
+		errc <- err
+	}()
+	go func() {
+		_, err := ps.waitBscExtension(bscPeer)
+		errc <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for ps.health().PendingExtensions != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("extension waits not pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Deliver the extensions with a delay
+	delay := 250 * time.Millisecond
+	clock.Run(delay)
+
+	if err := ps.registerSnapExtension(snap.NewPeer(snap.SNAP1, snapPeer.Peer, nil)); err != nil {
+		t.Fatalf("failed to register snap extension: %v", err)
+	}
+	if err := ps.registerBscExtension(bsc.NewPeer(bsc.Bsc1, bscPeer.Peer, nil)); err != nil {
+		t.Fatalf("failed to register bsc extension: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("extension wait failed: %v", err)
+		}
+	}
+	for _, protocol := range []string{snap.ProtocolName, bsc.ProtocolName} {
+		have := waits[protocol]
+		if len(have) != 1 {
+			t.Errorf("%s wait count mismatch: have %d, want 1", protocol, len(have))
+			continue
+		}
+		if have[0] < delay {
+			t.Errorf("%s wait duration too short: have %v, want >= %v", protocol, have[0], delay)
+		}
+	}
+}
+
+// Tests that extensions connecting ahead of their `eth` counterpart are counted
+// as pending until the counterpart consumes them.
+func TestPeerSetPendingExtensions(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		ethCap  = p2p.Cap{Name: eth.ProtocolName, Version: eth.ETH68}
+		snapCap = p2p.Cap{Name: snap.ProtocolName, Version: snap.SNAP1}
+		bscCap  = p2p.Cap{Name: bsc.ProtocolName, Version: bsc.Bsc1}
+
+		snapPeer = newTestEthPeer(t, 1, 100, ethCap, snapCap)
+		bscPeer  = newTestEthPeer(t, 2, 100, ethCap, bscCap)
+
+		snapGauge = snapExtensionPendingGauge.Snapshot().Value()
+		bscGauge  = bscExtensionPendingGauge.Snapshot().Value()
+	)
+	check := func(wantSnap, wantBsc int) {
+		t.Helper()
+
+		if snap, bsc := ps.pendingExtensions(); snap != wantSnap || bsc != wantBsc {
+			t.Fatalf("pending extensions mismatch: have (%d, %d), want (%d, %d)", snap, bsc, wantSnap, wantBsc)
+		}
+		if have := snapExtensionPendingGauge.Snapshot().Value() - snapGauge; have != int64(wantSnap) {
+			t.Fatalf("pending snap gauge mismatch: have %d, want %d", have, wantSnap)
+		}
+		if have := bscExtensionPendingGauge.Snapshot().Value() - bscGauge; have != int64(wantBsc) {
+			t.Fatalf("pending bsc gauge mismatch: have %d, want %d", have, wantBsc)
+		}
+	}
+	check(0, 0)
+
+	if err := ps.registerSnapExtension(snap.NewPeer(snap.SNAP1, snapPeer.Peer, nil)); err != nil {
+		t.Fatalf("failed to register snap extension: %v", err)
+	}
+	if err := ps.registerBscExtension(bsc.NewPeer(bsc.Bsc1, bscPeer.Peer, nil)); err != nil {
+		t.Fatalf("failed to register bsc extension: %v", err)
+	}
+	check(1, 1)
+
+	if _, err := ps.waitSnapExtension(snapPeer); err != nil {
+		t.Fatalf("failed to consume snap extension: %v", err)
+	}
+	check(0, 1)
+
+	if _, err := ps.waitBscExtension(bscPeer); err != nil {
+		t.Fatalf("failed to consume bsc extension: %v", err)
+	}
+	check(0, 0)
+}
+
+// Tests that repeated duplicate registrations of a peer id back off for an
+// increasing time, and that the backoff resets after a successful registration.
+func TestPeerSetRegisterBackoff(t *testing.T) {
+	peer := newTestEthPeer(t, 1, 100)
+
+	// The backoff is disabled by default
+	ps := newPeerSet()
+	if err := ps.registerPeer(peer, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := ps.registerPeer(peer, nil, nil); !errors.Is(err, errPeerAlreadyRegistered) {
+			t.Fatalf("attempt %d: duplicate registration error mismatch: have %v, want %v", i, err, errPeerAlreadyRegistered)
+		}
+	}
+	config := ethconfig.DefaultPeerSetConfig
+	config.RegisterBackoff, config.MaxRegisterBackoff = time.Second, 4*time.Second
+
+	clock := new(mclock.Simulated)
+	ps = newPeerSetWithConfig(config)
+	ps.clock = clock
+	if err := ps.registerPeer(peer, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	// A single failure should not back off
+	if err := ps.registerPeer(peer, nil, nil); !errors.Is(err, errPeerAlreadyRegistered) {
+		t.Fatalf("duplicate registration error mismatch: have %v, want %v", err, errPeerAlreadyRegistered)
+	}
+	// Hammer the registration, the backoff should double up to the cap
+	for i, backoff := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if err := ps.registerPeer(peer, nil, nil); !errors.Is(err, errPeerAlreadyRegistered) {
+			t.Fatalf("attempt %d: duplicate registration error mismatch: have %v, want %v", i, err, errPeerAlreadyRegistered)
+		}
+		if err := ps.registerPeer(peer, nil, nil); !errors.Is(err, errRegistrationBackoff) {
+			t.Fatalf("attempt %d: rapid registration error mismatch: have %v, want %v", i, err, errRegistrationBackoff)
+		}
+		clock.Run(backoff - time.Millisecond)
+		if err := ps.registerPeer(peer, nil, nil); !errors.Is(err, errRegistrationBackoff) {
+			t.Fatalf("attempt %d: registration error mismatch before backoff expiry: have %v, want %v", i, err, errRegistrationBackoff)
+		}
+		clock.Run(time.Millisecond)
+	}
+	// Once the backoff expired, a successful registration should reset it
+	if err := ps.unregisterPeer(peer.ID()); err != nil {
+		t.Fatalf("failed to unregister peer: %v", err)
+	}
+	if err := ps.registerPeer(peer, nil, nil); err != nil {
+		t.Fatalf("failed to register peer after backoff: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := ps.registerPeer(peer, nil, nil); !errors.Is(err, errPeerAlreadyRegistered) {
+			t.Fatalf("attempt %d: backoff not reset by successful registration: have %v, want %v", i, err, errPeerAlreadyRegistered)
+		}
+	}
+	// Ids failing and never coming back should be pruned once their backoff
+	// expired long enough ago
+	other := newTestEthPeer(t, 2, 100)
+	if err := ps.registerPeer(other, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	clock.Run(10 * time.Second)
+	if err := ps.registerPeer(other, nil, nil); !errors.Is(err, errPeerAlreadyRegistered) {
+		t.Fatalf("duplicate registration error mismatch: have %v, want %v", err, errPeerAlreadyRegistered)
+	}
+	if _, ok := ps.registerBackoffs[peer.ID()]; ok {
+		t.Errorf("expired backoff not pruned")
+	}
+}
+
+// Tests that the head peers are the ones with the highest total difficulty, in
+// descending order with ties broken by id, capped at the requested count.
+func TestPeerSetHeadPeers(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		low   = newTestEthPeer(t, 1, 100)
+		high  = newTestEthPeer(t, 2, 300)
+		tieA  = newTestEthPeer(t, 3, 200)
+		tieB  = newTestEthPeer(t, 4, 200)
+		peers = []*eth.Peer{low, high, tieA, tieB}
+	)
+	for _, p := range peers {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	want := []string{high.ID(), tieA.ID(), tieB.ID(), low.ID()}
+	if tieB.ID() < tieA.ID() {
+		want[1], want[2] = want[2], want[1]
+	}
+	for _, num := range []uint{0, 1, 3, 4, 10} {
+		var have []string
+		for _, p := range ps.headPeers(num) {
+			have = append(have, p.ID())
+		}
+		if n := min(int(num), len(peers)); !slices.Equal(have, want[:n]) {
+			t.Errorf("head peers mismatch for %d: have %v, want %v", num, have, want[:n])
+		}
+	}
+}
+
+// Tests that validators connected through more than one of their node ids are
+// reported as redundant connections.
+func TestPeerSetRedundantValidatorConnections(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		first  = newTestEthPeer(t, 1, 100)
+		second = newTestEthPeer(t, 2, 100)
+		single = newTestEthPeer(t, 3, 100)
+	)
+	for _, p := range []*eth.Peer{first, second, single} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	ps.enableEVNFeatures(map[common.Address][]enode.ID{
+		{0x01}: {first.Node().ID(), second.Node().ID()},
+		{0x02}: {single.Node().ID(), {0xff}},
+	}, nil)
+
+	have := ps.redundantValidatorConnections()
+	want := map[common.Address][]string{
+		{0x01}: {first.ID(), second.ID()},
+	}
+	slices.Sort(want[common.Address{0x01}])
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("redundant connections mismatch: have %v, want %v", have, want)
+	}
+	// Dropping one of the connections should resolve the redundancy
+	if err := ps.unregisterPeer(second.ID()); err != nil {
+		t.Fatalf("failed to unregister peer: %v", err)
+	}
+	if have := ps.redundantValidatorConnections(); len(have) != 0 {
+		t.Fatalf("redundant connections reported after drop: %v", have)
+	}
+}
+
+// Tests that the connected peers of a validator are resolved via its node ids.
+func TestPeerSetValidatorPeers(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		validator = newTestEthPeer(t, 1, 100)
+		proxy     = newTestEthPeer(t, 2, 100)
+		other     = newTestEthPeer(t, 3, 100)
+	)
+	for _, p := range []*eth.Peer{validator, proxy, other} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	if peers := ps.validatorPeers(common.Address{0x01}); peers == nil || len(peers) != 0 {
+		t.Fatalf("peers of unknown validator mismatch: have %v, want empty list", peers)
+	}
+	ps.enableEVNFeatures(map[common.Address][]enode.ID{
+		{0x01}: {validator.Node().ID(), proxy.Node().ID(), {0xff}},
+		{0x02}: {{0xfe}},
+	}, nil)
+
+	var have []string
+	for _, p := range ps.validatorPeers(common.Address{0x01}) {
+		have = append(have, p.ID())
+	}
+	slices.Sort(have)
+	want := []string{validator.ID(), proxy.ID()}
+	slices.Sort(want)
+	if !slices.Equal(have, want) {
+		t.Fatalf("validator peers mismatch: have %v, want %v", have, want)
+	}
+	if peers := ps.validatorPeers(common.Address{0x02}); peers == nil || len(peers) != 0 {
+		t.Fatalf("peers of disconnected validator mismatch: have %v, want empty list", peers)
+	}
+}
+
+// Tests that the EVN peer count follows the flags of the connected peers as they
+// churn between EVN feature updates.
+func TestPeerSetEVNPeerLen(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		validator = newTestEthPeer(t, 1, 100)
+		plain     = newTestEthPeer(t, 2, 100)
+		trusted   = newTestEthPeer(t, 3, 100)
+	)
+	for _, p := range []*eth.Peer{validator, plain} {
+		if err := ps.registerPeer(p, nil, nil); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	if n := ps.evnPeerLen(); n != 0 {
+		t.Fatalf("EVN peer count mismatch before enabling: have %d, want 0", n)
+	}
+	ps.enableEVNFeatures(map[common.Address][]enode.ID{{0x01}: {validator.Node().ID()}}, nil)
+	if n := ps.evnPeerLen(); n != 1 {
+		t.Fatalf("EVN peer count mismatch after enabling: have %d, want 1", n)
+	}
+	if err := ps.registerPeer(trusted, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	ps.addTrustedValidator(trusted.Node().ID())
+	if n := ps.evnPeerLen(); n != 2 {
+		t.Fatalf("EVN peer count mismatch after trusting: have %d, want 2", n)
+	}
+	if err := ps.unregisterPeer(validator.ID()); err != nil {
+		t.Fatalf("failed to unregister peer: %v", err)
+	}
+	if n := ps.evnPeerLen(); n != 1 {
+		t.Fatalf("EVN peer count mismatch after drop: have %d, want 1", n)
+	}
+}
+
+// Tests that the connection matrix summarises the protocols, EVN status and
+// uptime of every registered peer.
+func TestPeerSetConnectionMatrix(t *testing.T) {
+	clock := new(mclock.Simulated)
+	ps := newPeerSet()
+	ps.clock = clock
+
+	var (
+		ethCap  = p2p.Cap{Name: eth.ProtocolName, Version: eth.ETH68}
+		snapCap = p2p.Cap{Name: snap.ProtocolName, Version: snap.SNAP1}
+		bscCap  = p2p.Cap{Name: bsc.ProtocolName, Version: bsc.Bsc1}
+
+		plain     = newTestEthPeer(t, 1, 100)
+		snapped   = newTestEthPeer(t, 2, 100, ethCap, snapCap)
+		validator = newTestEthPeer(t, 3, 100, ethCap, bscCap)
+	)
+	if err := ps.registerPeer(plain, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	clock.Run(time.Minute)
+	if err := ps.registerPeer(snapped, snap.NewPeer(snap.SNAP1, snapped.Peer, nil), nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	clock.Run(time.Minute)
+	if err := ps.registerPeer(validator, nil, bsc.NewPeer(bsc.Bsc1, validator.Peer, nil)); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	ps.addTrustedValidator(validator.Node().ID())
+	clock.Run(time.Minute)
+
+	want := []PeerConnInfo{
+		{ID: plain.ID(), Protocols: []string{"eth/68"}, Uptime: 3 * time.Minute},
+		{ID: snapped.ID(), Protocols: []string{"eth/68", "snap/1"}, Uptime: 2 * time.Minute},
+		{ID: validator.ID(), Protocols: []string{"eth/68", "bsc/1"}, EVN: true, Uptime: time.Minute},
+	}
+	slices.SortFunc(want, func(a, b PeerConnInfo) int { return strings.Compare(a.ID, b.ID) })
+
+	if have := ps.connectionMatrix(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("connection matrix mismatch:\nhave %+v\nwant %+v", have, want)
+	}
+}
+
+// Tests that peers are ordered by their connection age, longest connected first
+// with ties broken by id.
+func TestPeerSetPeersByUptime(t *testing.T) {
+	clock := new(mclock.Simulated)
+	ps := newPeerSet()
+	ps.clock = clock
+
+	var (
+		fresh  = newTestEthPeer(t, 1, 100)
+		oldest = newTestEthPeer(t, 2, 100)
+		tieA   = newTestEthPeer(t, 3, 100)
+		tieB   = newTestEthPeer(t, 4, 100)
+	)
+	register := func(peers ...*eth.Peer) {
+		for _, p := range peers {
+			if err := ps.registerPeer(p, nil, nil); err != nil {
+				t.Fatalf("failed to register peer: %v", err)
+			}
+		}
+		clock.Run(time.Minute)
+	}
+	register(oldest)
+	register(tieA, tieB)
+	register(fresh)
+
+	want := []string{oldest.ID(), tieA.ID(), tieB.ID(), fresh.ID()}
+	if tieB.ID() < tieA.ID() {
+		want[1], want[2] = want[2], want[1]
+	}
+	var have []string
+	for _, p := range ps.peersByUptime() {
+		have = append(have, p.ID())
+	}
+	if !slices.Equal(have, want) {
+		t.Fatalf("peer order mismatch: have %v, want %v", have, want)
+	}
+}
+
+// Tests that peer summaries reflect the state of the peers at the time they were
+// taken, and are unaffected by later changes.
+func TestPeerSetPeerInfos(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		ethCap  = p2p.Cap{Name: eth.ProtocolName, Version: eth.ETH68}
+		snapCap = p2p.Cap{Name: snap.ProtocolName, Version: snap.SNAP1}
+		bscCap  = p2p.Cap{Name: bsc.ProtocolName, Version: bsc.Bsc1}
+
+		plain     = newTestEthPeer(t, 1, 100)
+		snapped   = newTestEthPeer(t, 2, 200, ethCap, snapCap)
+		validator = newTestEthPeer(t, 3, 300, ethCap, bscCap)
+	)
+	if err := ps.registerPeer(plain, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	if err := ps.registerPeer(snapped, snap.NewPeer(snap.SNAP1, snapped.Peer, nil), nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	if err := ps.registerPeer(validator, nil, bsc.NewPeer(bsc.Bsc1, validator.Peer, nil)); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	ps.addTrustedValidator(validator.Node().ID())
+
+	want := []PeerSummary{
+		{ID: plain.ID(), NodeID: enode.ID{1}, Head: common.Hash{1}, TD: big.NewInt(100)},
+		{ID: snapped.ID(), NodeID: enode.ID{2}, Head: common.Hash{2}, TD: big.NewInt(200), Snap: true},
+		{ID: validator.ID(), NodeID: enode.ID{3}, Head: common.Hash{3}, TD: big.NewInt(300), EVN: true, Bsc: true},
+	}
+	slices.SortFunc(want, func(a, b PeerSummary) int { return strings.Compare(a.ID, b.ID) })
+
+	have := ps.peerInfos()
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("peer summaries mismatch:\nhave %+v\nwant %+v", have, want)
+	}
+	// Later head updates must not leak into the taken summaries
+	plain.SetHead(common.Hash{0xff}, big.NewInt(1000))
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("peer summaries changed after head update:\nhave %+v\nwant %+v", have, want)
+	}
+}
+
+// Tests that the extension wait timeout is configurable, letting slow extensions
+// register successfully with a longer timeout.
+func TestPeerSetExtensionWaitTimeout(t *testing.T) {
+	bscCap := p2p.Cap{Name: bsc.ProtocolName, Version: bsc.Bsc1}
+	ethCap := p2p.Cap{Name: eth.ProtocolName, Version: eth.ETH68}
+
+	for _, tt := range []struct {
+		timeout time.Duration
+		err     error
+	}{
+		{50 * time.Millisecond, errPeerWaitTimeout},
+		{5 * time.Second, nil},
+	} {
+		config := ethconfig.DefaultPeerSetConfig
+		config.ExtensionWaitTimeout = tt.timeout
+		ps := newPeerSetWithConfig(config)
+
+		peer := newTestEthPeer(t, 1, 100, ethCap, bscCap)
+		errc := make(chan error, 1)
+		go func() {
+			_, err := ps.waitBscExtension(peer)
+			errc <- err
+		}()
+		// Bring up the extension slower than the short timeout allows
+		time.Sleep(250 * time.Millisecond)
+		if err := ps.registerBscExtension(bsc.NewPeer(bsc.Bsc1, peer.Peer, nil)); err != nil {
+			t.Fatalf("timeout %v: failed to register bsc extension: %v", tt.timeout, err)
+		}
+		if err := <-errc; !errors.Is(err, tt.err) {
+			t.Errorf("timeout %v: wait error mismatch: have %v, want %v", tt.timeout, err, tt.err)
+		}
+		ps.close()
+	}
+}
+
+// Tests that EVN peers are only left out of the vote propagation if requested,
+// and that peers without a bsc extension are never selected.
+func TestPeerSetPeersWithoutVoteSkipEVN(t *testing.T) {
+	ps := newPeerSet()
+
+	var (
+		hash  = common.Hash{0xff}
+		plain = newTestEthPeer(t, 1, 100)
+		voter = newTestEthPeer(t, 2, 100)
+		evn   = newTestEthPeer(t, 3, 100)
+	)
+	if err := ps.registerPeer(plain, nil, nil); err != nil {
+		t.Fatalf("failed to register peer: %v", err)
+	}
+	for _, p := range []*eth.Peer{voter, evn} {
+		if err := ps.registerPeer(p, nil, bsc.NewPeer(bsc.Bsc1, p.Peer, nil)); err != nil {
+			t.Fatalf("failed to register peer: %v", err)
+		}
+	}
+	ps.addTrustedValidator(evn.Node().ID())
+
+	for _, tt := range []struct {
+		skipEVN bool
+		want    []string
+	}{
+		{false, []string{voter.ID(), evn.ID()}},
+		{true, []string{voter.ID()}},
+	} {
+		var have []string
+		for _, p := range ps.peersWithoutVote(hash, tt.skipEVN) {
+			have = append(have, p.ID())
+		}
+		slices.Sort(have)
+		slices.Sort(tt.want)
+		if !slices.Equal(have, tt.want) {
+			t.Errorf("skipEVN=%v: peers without vote mismatch: have %v, want %v", tt.skipEVN, have, tt.want)
+		}
+	}
+}
+
+// Tests that draining the peer set rejects new peers while letting in-flight
+// extension waits complete, and that waits outliving the timeout are aborted.
+func TestPeerSetDrain(t *testing.T) {
+	var (
+		ethCap = p2p.Cap{Name: eth.ProtocolName, Version: eth.ETH68}
+		bscCap = p2p.Cap{Name: bsc.ProtocolName, Version: bsc.Bsc1}
+	)
+	// waitPending starts an extension wait for the peer, returning once it is
+	// tracked by the peer set.
+	waitPending := func(ps *peerSet, peer *eth.Peer) <-chan error {
+		errc := make(chan error, 1)
+		go func() {
+			ext, err := ps.waitBscExtension(peer)
+			if err == nil {
+				err = ps.registerPeer(peer, nil, ext)
+			}
+			errc <- err
+		}()
+		for {
+			ps.lock.RLock()
+			_, ok := ps.bscWait[peer.ID()]
+			ps.lock.RUnlock()
+			if ok {
+				return errc
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// In-flight waits resolving within the timeout are registered
+	ps := newPeerSet()
+	inflight := newTestEthPeer(t, 1, 100, ethCap, bscCap)
+	errc := waitPending(ps, inflight)
+
+	done := make(chan struct{})
+	go func() {
+		ps.drain(5 * time.Second)
+		close(done)
+	}()
+	for {
+		ps.lock.RLock()
+		draining := ps.draining
+		ps.lock.RUnlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ps.registerPeer(newTestEthPeer(t, 2, 100), nil, nil); !errors.Is(err, errPeerSetDraining) {
+		t.Fatalf("new peer registration error mismatch: have %v, want %v", err, errPeerSetDraining)
+	}
+	if _, err := ps.waitBscExtension(newTestEthPeer(t, 3, 100, ethCap, bscCap)); !errors.Is(err, errPeerSetDraining) {
+		t.Fatalf("new extension wait error mismatch: have %v, want %v", err, errPeerSetDraining)
+	}
+	if err := ps.registerBscExtension(bsc.NewPeer(bsc.Bsc1, inflight.Peer, nil)); err != nil {
+		t.Fatalf("failed to register in-flight bsc extension: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("in-flight peer failed to register: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("drain not finished after the pending waits resolved")
+	}
+	select {
+	case <-ps.quitCh:
+	default:
+		t.Fatalf("peer set not closed after draining")
+	}
+	// Waits outliving the drain timeout are aborted by the closing
+	ps = newPeerSet()
+	errc = waitPending(ps, newTestEthPeer(t, 4, 100, ethCap, bscCap))
+
+	ps.drain(100 * time.Millisecond)
+	select {
+	case err := <-errc:
+		if !errors.Is(err, errPeerSetClosed) {
+			t.Fatalf("stuck wait error mismatch: have %v, want %v", err, errPeerSetClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("stuck wait not aborted by drain")
+	}
+}
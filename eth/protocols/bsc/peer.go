@@ -1,6 +1,7 @@
 package bsc
 
 import (
+	"sync/atomic"
 	"time"
 
 	"errors"
@@ -44,6 +45,24 @@ type Peer struct {
 	version   uint              // Protocol version negotiated
 	logger    log.Logger        // Contextual logger with the peer id injected
 	term      chan struct{}     // Termination channel to stop the broadcasters
+
+	sendObserver atomic.Pointer[func(error)] // Optional callback notified of the outcome of every send
+}
+
+// observedRW is a message stream reporting the outcome of every message written
+// to the peer to its send observer, if any.
+type observedRW struct {
+	p2p.MsgReadWriter
+	peer *Peer
+}
+
+// WriteMsg implements p2p.MsgWriter, notifying the send observer of the result.
+func (rw *observedRW) WriteMsg(msg p2p.Msg) error {
+	err := rw.MsgReadWriter.WriteMsg(msg)
+	if observer := rw.peer.sendObserver.Load(); observer != nil {
+		(*observer)(err)
+	}
+	return err
 }
 
 // NewPeer create a wrapper for a network connection and negotiated protocol
@@ -62,6 +81,7 @@ func NewPeer(version uint, p *p2p.Peer, rw p2p.MsgReadWriter) *Peer {
 		logger:        log.New("peer", id[:8]),
 		term:          make(chan struct{}),
 	}
+	peer.rw = &observedRW{MsgReadWriter: rw, peer: peer}
 	peer.dispatcher = NewDispatcher(peer)
 	go peer.broadcastVotes()
 	return peer
@@ -72,6 +92,12 @@ func (p *Peer) ID() string {
 	return p.id
 }
 
+// SetSendObserver sets a callback notified of the outcome of every message sent
+// to the peer, including the write errors of the underlying connection.
+func (p *Peer) SetSendObserver(observer func(err error)) {
+	p.sendObserver.Store(&observer)
+}
+
 // Version retrieves the peer's negotiated `bsc` protocol version.
 func (p *Peer) Version() uint {
 	return p.version
@@ -94,6 +120,17 @@ func (p *Peer) KnownVote(hash common.Hash) bool {
 	return p.knownVotes.contains(hash)
 }
 
+// KnownVoteCount returns the number of votes known to be known by this peer.
+func (p *Peer) KnownVoteCount() int {
+	return p.knownVotes.len()
+}
+
+// TrimKnownVotes shrinks the known vote set to the given ratio of its current
+// size, dropping arbitrary entries.
+func (p *Peer) TrimKnownVotes(ratio float64) {
+	p.knownVotes.trim(int(float64(p.knownVotes.len()) * ratio))
+}
+
 // markVotes marks votes as known for the peer, ensuring that they
 // will never be repropagated to this particular peer.
 func (p *Peer) markVotes(votes []*types.VoteEnvelope) {
@@ -187,6 +224,18 @@ func (k *knownCache) contains(hash common.Hash) bool {
 	return k.hashes.Contains(hash)
 }
 
+// len returns the number of elements in the set.
+func (k *knownCache) len() int {
+	return k.hashes.Cardinality()
+}
+
+// trim drops arbitrary elements until the set holds at most size elements.
+func (k *knownCache) trim(size int) {
+	for k.hashes.Cardinality() > max(0, size) {
+		k.hashes.Pop()
+	}
+}
+
 // RequestBlocksByRange send GetBlocksByRangeMsg by request start block hash
 func (p *Peer) RequestBlocksByRange(startHeight uint64, startHash common.Hash, count uint64) ([]*BlockData, error) {
 	requestID := p.dispatcher.GenRequestID()
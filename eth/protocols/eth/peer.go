@@ -26,6 +26,7 @@ import (
 	mapset "github.com/deckarep/golang-set/v2"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/tracker"
@@ -88,11 +89,29 @@ type Peer struct {
 	reqCancel   chan *cancel   // Dispatch channel to cancel pending requests and untrack them
 	resDispatch chan *response // Dispatch channel to fulfil pending requests and untrack them
 
+	sendObserver atomic.Pointer[func(error)] // Optional callback notified of the outcome of every send
+
 	term   chan struct{} // Termination channel to stop the broadcasters
 	txTerm chan struct{} // Termination channel to stop the tx broadcasters
 	lock   sync.RWMutex  // Mutex protecting the internal fields
 }
 
+// observedRW is a message stream reporting the outcome of every message written
+// to the peer to its send observer, if any.
+type observedRW struct {
+	p2p.MsgReadWriter
+	peer *Peer
+}
+
+// WriteMsg implements p2p.MsgWriter, notifying the send observer of the result.
+func (rw *observedRW) WriteMsg(msg p2p.Msg) error {
+	err := rw.MsgReadWriter.WriteMsg(msg)
+	if observer := rw.peer.sendObserver.Load(); observer != nil {
+		(*observer)(err)
+	}
+	return err
+}
+
 // NewPeer creates a wrapper for a network connection and negotiated  protocol
 // version.
 func NewPeer(version uint, p *p2p.Peer, rw p2p.MsgReadWriter, txpool TxPool) *Peer {
@@ -117,6 +136,8 @@ func NewPeer(version uint, p *p2p.Peer, rw p2p.MsgReadWriter, txpool TxPool) *Pe
 		term:            make(chan struct{}),
 		txTerm:          make(chan struct{}),
 	}
+	peer.rw = &observedRW{MsgReadWriter: rw, peer: peer}
+
 	// Start up all the broadcasters
 	go peer.broadcastBlocks()
 	go peer.broadcastTransactions()
@@ -143,6 +164,12 @@ func (p *Peer) CloseTxBroadcast() {
 	}
 }
 
+// SetSendObserver sets a callback notified of the outcome of every message sent
+// to the peer, including the write errors of the underlying connection.
+func (p *Peer) SetSendObserver(observer func(err error)) {
+	p.sendObserver.Store(&observer)
+}
+
 // ID retrieves the peer's unique identifier.
 func (p *Peer) ID() string {
 	return p.id
@@ -189,6 +216,26 @@ func (p *Peer) KnownBlock(hash common.Hash) bool {
 	return p.knownBlocks.Contains(hash)
 }
 
+// RequestLatency returns the time it took the peer to answer the requests with
+// the given message code (e.g. GetBlockBodiesMsg), or nil if none was answered
+// yet. Latencies are only recorded if metrics are enabled.
+func (p *Peer) RequestLatency(code uint64) *metrics.TimerSnapshot {
+	return p.tracker.Latency(code)
+}
+
+// KnownHashCount returns the number of block and transaction hashes known to be
+// known by the peer.
+func (p *Peer) KnownHashCount() int {
+	return p.knownBlocks.Cardinality() + p.knownTxs.Cardinality()
+}
+
+// TrimKnownHashes shrinks the known block and transaction hash sets to the given
+// ratio of their current sizes, dropping arbitrary entries.
+func (p *Peer) TrimKnownHashes(ratio float64) {
+	p.knownBlocks.Trim(int(float64(p.knownBlocks.Cardinality()) * ratio))
+	p.knownTxs.Trim(int(float64(p.knownTxs.Cardinality()) * ratio))
+}
+
 // BlockRange returns the latest announced block range.
 // This will be nil for peers below protocol version eth/69.
 func (p *Peer) BlockRange() *BlockRangeUpdatePacket {
@@ -552,3 +599,10 @@ func (k *knownCache) Contains(hash common.Hash) bool {
 func (k *knownCache) Cardinality() int {
 	return k.hashes.Cardinality()
 }
+
+// Trim drops arbitrary elements until the set holds at most size elements.
+func (k *knownCache) Trim(size int) {
+	for k.hashes.Cardinality() > max(0, size) {
+		k.hashes.Pop()
+	}
+}
@@ -32,6 +32,7 @@ import (
 const (
 	forceSyncCycle      = 10 * time.Second // Time interval to force syncs, even if few peers are available
 	defaultMinSyncPeers = 5                // Amount of peers desired to start syncing
+	syncStallTimeout    = 30 * time.Second // Time without head progress after which lagging peers are synced from
 )
 
 // syncTransactions starts sending all currently pending transactions to the given peer.
@@ -65,6 +66,9 @@ type chainSyncer struct {
 	warned      time.Time
 	peerEventCh chan struct{}
 	doneCh      chan error // non-nil when sync is running
+
+	progressHead uint64    // Local head number at the last observed progress
+	progressTime time.Time // Time of the last observed local head progress
 }
 
 // chainSyncOp is a scheduled sync operation.
@@ -158,7 +162,21 @@ func (cs *chainSyncer) nextSyncOp() *chainSyncOp {
 	// clients to direct the chain head to sync to.
 	peer := cs.handler.peers.peerWithHighestTD()
 	if peer == nil {
-		return nil
+		// If all peers are lagging and the local head stopped progressing, settle
+		// for the best of them as a last resort instead of not syncing at all.
+		if !cs.stalled(cs.handler.chain.CurrentBlock().Number.Uint64(), time.Now()) {
+			return nil
+		}
+		if peer = cs.handler.peers.peerWithHighestTDAllowLagging(); peer == nil {
+			return nil
+		}
+		// The cached head of a lagging peer is likely stale, refresh it before
+		// deciding whether and how far to sync from it. This blocks the syncer up
+		// to the refresh timeout, which is fine as the local head stalled anyway.
+		if err := cs.handler.peers.refreshPeerHead(peer.ID()); err != nil {
+			log.Debug("Failed to refresh lagging peer head", "peer", peer.ID(), "err", err)
+		}
+		log.Debug("Syncing from lagging peer after stall", "peer", peer.ID())
 	}
 	mode, ourTD := cs.modeAndLocalHead()
 	op := peerToSyncOp(mode, peer)
@@ -200,6 +218,21 @@ func (cs *chainSyncer) nextSyncOp() *chainSyncOp {
 	return op
 }
 
+// stalled reports whether the local head did not progress for syncStallTimeout.
+// A detected stall restarts the timeout, so the lagging peers are only retried
+// once per stall period.
+func (cs *chainSyncer) stalled(head uint64, now time.Time) bool {
+	if cs.progressTime.IsZero() || head != cs.progressHead {
+		cs.progressHead, cs.progressTime = head, now
+		return false
+	}
+	if now.Sub(cs.progressTime) < syncStallTimeout {
+		return false
+	}
+	cs.progressTime = now
+	return true
+}
+
 func peerToSyncOp(mode downloader.SyncMode, p *eth.Peer) *chainSyncOp {
 	peerHead, peerTD := p.Head()
 	return &chainSyncOp{mode: mode, peer: p, td: peerTD, head: peerHead}
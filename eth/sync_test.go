@@ -205,3 +205,35 @@ func checkChainWithBlobs(t *testing.T, chain *core.BlockChain, preCancunBlks, po
 	require.NotNil(t, block, preCancunBlks+postCancunBlks)
 	require.NotNil(t, chain.GetSidecarsByHash(block.Hash()), preCancunBlks+postCancunBlks)
 }
+
+// Tests that a sync stall is only detected once the local head did not progress
+// for the stall timeout, and is reported at most once per stall period.
+func TestChainSyncerStalled(t *testing.T) {
+	var (
+		cs  = new(chainSyncer)
+		now = time.Now()
+	)
+	if cs.stalled(10, now) {
+		t.Fatalf("stall detected on first observation")
+	}
+	if cs.stalled(10, now.Add(syncStallTimeout-time.Second)) {
+		t.Fatalf("stall detected before the timeout")
+	}
+	// Progressing heads restart the timeout
+	if cs.stalled(11, now.Add(syncStallTimeout)) {
+		t.Fatalf("stall detected despite head progress")
+	}
+	if cs.stalled(11, now.Add(2*syncStallTimeout-time.Second)) {
+		t.Fatalf("stall detected before the restarted timeout")
+	}
+	if !cs.stalled(11, now.Add(2*syncStallTimeout)) {
+		t.Fatalf("stall not detected after the timeout")
+	}
+	// A detected stall is only reported again after another period
+	if cs.stalled(11, now.Add(2*syncStallTimeout+time.Second)) {
+		t.Fatalf("stall reported twice within a period")
+	}
+	if !cs.stalled(11, now.Add(3*syncStallTimeout)) {
+		t.Fatalf("stall not reported after another period")
+	}
+}
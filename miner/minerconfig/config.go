@@ -72,6 +72,12 @@ type Config struct {
 	MaxWaitProposalInSecs  *uint64        `toml:",omitempty"` // The maximum time to wait for the proposal to be done, it's aimed to prevent validator being slashed when restarting
 	DisableVoteAttestation bool           // Whether to skip assembling vote attestation
 
+	PrefetchThreads            int           // Number of state prefetch workers while mining, zero for the defaults
+	PrefetchDispatchBuffer     int           // Size of the mining prefetch dispatch buffer, zero for the worker count
+	PrefetchWorkerStagger      time.Duration // Delay between the startup of two consecutive mining prefetch workers
+	PrefetchSkipPlainTransfers bool          // Whether to skip prefetching plain value transfers to accounts without code
+	PrefetchAbortOnOvertake    bool          // Whether to stop mining prefetch once block building catches up with it
+
 	Mev MevConfig // Mev configuration
 }
 
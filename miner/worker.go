@@ -254,6 +254,13 @@ func newWorker(config *minerconfig.Config, engine consensus.Engine, eth Backend,
 	}
 	chainConfig := eth.BlockChain().Config()
 	prefetcher := core.NewStatePrefetcher(chainConfig, eth.BlockChain().HeadChain())
+	prefetcher.SetThreads(config.PrefetchThreads)
+	prefetcher.SetMiningDispatchBuffer(config.PrefetchDispatchBuffer)
+	prefetcher.SetWorkerStagger(config.PrefetchWorkerStagger)
+	prefetcher.SetAbortOnOvertake(config.PrefetchAbortOnOvertake)
+	if config.PrefetchSkipPlainTransfers {
+		prefetcher.SetTxFilter(core.SkipPlainTransfers)
+	}
 	if config.Mev.Enabled != nil && *config.Mev.Enabled {
 		prefetcher.EnableMevMode()
 	}
@@ -20,6 +20,7 @@ import (
 	"crypto/ecdsa"
 	"encoding"
 	"fmt"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/mclock"
@@ -148,6 +149,15 @@ type Config struct {
 
 	PeerFilterPatterns []string
 
+	// DialTimeout is the timeout for establishing outbound connections. Zero
+	// defaults to 15 seconds. High-latency networks may need a longer timeout
+	// not to drop reachable peers.
+	DialTimeout time.Duration `toml:",omitempty"`
+
+	// PeerLatencySLA is the peer latency above which a measurement is counted as
+	// an SLA breach. Zero defaults to 500ms.
+	PeerLatencySLA time.Duration `toml:",omitempty"`
+
 	clock mclock.Clock
 }
 
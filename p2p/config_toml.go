@@ -4,6 +4,7 @@ package p2p
 
 import (
 	"crypto/ecdsa"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
@@ -45,6 +46,8 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		EnableMsgEvents           bool
 		Logger                    log.Logger `toml:"-"`
 		PeerFilterPatterns        []string
+		DialTimeout               time.Duration `toml:",omitempty"`
+		PeerLatencySLA            time.Duration `toml:",omitempty"`
 	}
 	var enc Config
 	enc.PrivateKey = c.PrivateKey
@@ -75,6 +78,8 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.EnableMsgEvents = c.EnableMsgEvents
 	enc.Logger = c.Logger
 	enc.PeerFilterPatterns = c.PeerFilterPatterns
+	enc.DialTimeout = c.DialTimeout
+	enc.PeerLatencySLA = c.PeerLatencySLA
 	return &enc, nil
 }
 
@@ -109,6 +114,8 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		EnableMsgEvents           *bool
 		Logger                    log.Logger `toml:"-"`
 		PeerFilterPatterns        []string
+		DialTimeout               *time.Duration `toml:",omitempty"`
+		PeerLatencySLA            *time.Duration `toml:",omitempty"`
 	}
 	var dec Config
 	if err := unmarshal(&dec); err != nil {
@@ -198,5 +205,11 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.PeerFilterPatterns != nil {
 		c.PeerFilterPatterns = dec.PeerFilterPatterns
 	}
+	if dec.DialTimeout != nil {
+		c.DialTimeout = *dec.DialTimeout
+	}
+	if dec.PeerLatencySLA != nil {
+		c.PeerLatencySLA = *dec.PeerLatencySLA
+	}
 	return nil
 }
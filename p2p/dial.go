@@ -137,6 +137,7 @@ type dialConfig struct {
 	netRestrict    *netutil.Netlist // IP netrestrict list, disabled if nil
 	resolver       nodeResolver
 	dialer         NodeDialer
+	dialTimeout    time.Duration // timeout for establishing a connection
 	log            log.Logger
 	clock          mclock.Clock
 	rand           *mrand.Rand
@@ -146,6 +147,9 @@ func (cfg dialConfig) withDefaults() dialConfig {
 	if cfg.maxActiveDials == 0 {
 		cfg.maxActiveDials = defaultMaxPendingPeers
 	}
+	if cfg.dialTimeout == 0 {
+		cfg.dialTimeout = defaultDialTimeout
+	}
 	if cfg.log == nil {
 		cfg.log = log.Root()
 	}
@@ -615,14 +619,24 @@ func (t *dialTask) resolve(d *dialScheduler) bool {
 // dial performs the actual connection attempt.
 func (t *dialTask) dial(d *dialScheduler, dest *enode.Node) error {
 	dialMeter.Mark(1)
-	fd, err := d.dialer.Dial(d.ctx, dest)
+	start := d.clock.Now()
+	ctx, cancel := context.WithTimeout(d.ctx, d.dialTimeout)
+	fd, err := d.dialer.Dial(ctx, dest)
+	cancel()
 	if err != nil {
 		addr, _ := dest.TCPEndpoint()
 		d.log.Trace("Dial error", "id", dest.ID(), "addr", addr, "conn", t.flags, "err", cleanupDialErr(err))
-		dialConnectionError.Mark(1)
-		return &dialError{err}
+		if isDialTimeout(err) {
+			dialTimeoutError.Mark(1)
+		} else {
+			dialConnectionError.Mark(1)
+		}
+		err = &dialError{err}
+	} else {
+		err = d.setupFunc(newMeteredConn(fd), t.flags, dest)
 	}
-	return d.setupFunc(newMeteredConn(fd), t.flags, dest)
+	markDialLatency(err, time.Duration(d.clock.Now()-start))
+	return err
 }
 
 func (t *dialTask) String() string {
@@ -631,6 +645,16 @@ func (t *dialTask) String() string {
 	return fmt.Sprintf("%v %x %v:%d", t.flags, id[:8], node.IPAddr(), node.TCP())
 }
 
+// isDialTimeout reports whether the dial error is due to the connection attempt
+// timing out.
+func isDialTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 func cleanupDialErr(err error) error {
 	if netErr, ok := err.(*net.OpError); ok && netErr.Op == "dial" {
 		return netErr.Err
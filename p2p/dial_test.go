@@ -31,6 +31,7 @@ import (
 	"github.com/ethereum/go-ethereum/common/mclock"
 	"github.com/ethereum/go-ethereum/internal/testlog"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/netutil"
 )
@@ -699,3 +700,76 @@ func (t *dialTestResolver) Resolve(n *enode.Node) *enode.Node {
 	t.calls = append(t.calls, n.ID())
 	return t.answers[n.ID()]
 }
+
+// This test checks that dial durations are recorded into the timer matching the
+// outcome of the dial.
+func TestMarkDialLatency(t *testing.T) {
+	metrics.Enable()
+
+	tests := []struct {
+		err   error
+		timer *metrics.Timer
+	}{
+		{nil, dialSuccessLatency},
+		{&dialError{errors.New("connection refused")}, dialConnectionErrorLatency},
+		{DiscTooManyPeers, dialTooManyPeersLatency},
+		{DiscAlreadyConnected, dialAlreadyConnectedLatency},
+		{DiscSelf, dialSelfLatency},
+		{DiscUselessPeer, dialUselessPeerLatency},
+		{DiscUnexpectedIdentity, dialUnexpectedIdentityLatency},
+		{&protoHandshakeError{errors.New("EOF")}, dialProtoHandshakeErrorLatency},
+		{errEncHandshakeError, dialEncHandshakeErrorLatency},
+		{errors.New("unknown"), dialOtherErrorLatency},
+	}
+	for i, test := range tests {
+		before := test.timer.Snapshot()
+		markDialLatency(test.err, time.Duration(i+1)*time.Second)
+
+		after := test.timer.Snapshot()
+		if have := after.Count() - before.Count(); have != 1 {
+			t.Errorf("test %d (%v): timer count mismatch: have %d, want 1", i, test.err, have)
+		}
+		if have, want := after.Max(), int64(time.Duration(i+1)*time.Second); have < want {
+			t.Errorf("test %d (%v): duration not recorded: max %d, want at least %d", i, test.err, have, want)
+		}
+	}
+}
+
+// slowDialer is a NodeDialer that never connects, returning only once the dial
+// context is done.
+type slowDialer struct{}
+
+func (slowDialer) Dial(ctx context.Context, n *enode.Node) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// This test checks that dials are aborted after the configured timeout and
+// metered as timeouts.
+func TestDialTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	d := &dialScheduler{
+		dialConfig: dialConfig{dialer: slowDialer{}, dialTimeout: timeout}.withDefaults(),
+		ctx:        context.Background(),
+	}
+	var (
+		timeouts = dialTimeoutError.Snapshot().Count()
+		others   = dialConnectionError.Snapshot().Count()
+		task     = newDialTask(newNode(uintID(1), "127.0.0.1:30303"), dynDialedConn)
+		start    = time.Now()
+	)
+	err := task.dial(d, task.dest())
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Fatalf("dial aborted before the timeout: took %v, want at least %v", elapsed, timeout)
+	}
+	if _, ok := err.(*dialError); !ok || !isDialTimeout(err.(*dialError).error) {
+		t.Fatalf("dial error mismatch: have %v, want timeout", err)
+	}
+	if have := dialTimeoutError.Snapshot().Count() - timeouts; have != 1 {
+		t.Fatalf("timeout meter mismatch: have %d, want 1", have)
+	}
+	if have := dialConnectionError.Snapshot().Count() - others; have != 0 {
+		t.Fatalf("connection error meter mismatch: have %d, want 0", have)
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/rlp"
 )
@@ -42,9 +43,10 @@ type Msg struct {
 	Payload    io.Reader
 	ReceivedAt time.Time
 
-	meterCap  Cap    // Protocol name and version for egress metering
-	meterCode uint64 // Message within protocol for egress metering
-	meterSize uint32 // Compressed message size for ingress metering
+	meterCap    Cap            // Protocol name and version for egress metering
+	meterCode   uint64         // Message within protocol for egress metering
+	meterSize   uint32         // Compressed message size for ingress metering
+	meterEgress *metrics.Meter // Protocol traffic meter for egress metering, nil if disabled
 }
 
 // Decode parses the RLP content of a message into
@@ -21,6 +21,9 @@ package p2p
 import (
 	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/metrics"
 )
@@ -44,12 +47,17 @@ var (
 	ingressTrafficMeter = metrics.NewRegisteredMeter("p2p/ingress", nil)
 	egressTrafficMeter  = metrics.NewRegisteredMeter("p2p/egress", nil)
 
+	// number of metered connections not yet closed, growing if they are leaked
+	activeMeteredConnGauge = metrics.NewRegisteredGauge("p2p/conns/active", nil)
+
 	// general ingress/egress connection meters
 	serveMeter          = metrics.NewRegisteredMeter("p2p/serves", nil)
 	serveSuccessMeter   = metrics.NewRegisteredMeter("p2p/serves/success", nil)
 	dialMeter           = metrics.NewRegisteredMeter("p2p/dials", nil)
 	dialSuccessMeter    = metrics.NewRegisteredMeter("p2p/dials/success", nil)
-	dialConnectionError = metrics.NewRegisteredMeter("p2p/dials/error/connection", nil) // dial timeout; no route to host; connection refused; network is unreachable
+	dialConnectionError = metrics.NewRegisteredMeter("p2p/dials/error/connection", nil)         // no route to host; connection refused; network is unreachable
+	dialTimeoutError    = metrics.NewRegisteredMeter("p2p/dials/error/connection/timeout", nil) // dial timeout
+	dialTimeoutGauge    = metrics.NewRegisteredGauge("p2p/dials/timeout", nil)                  // configured dial timeout in milliseconds
 
 	// count peers that stayed connected for at least 1 min
 	serve1MinSuccessMeter = metrics.NewRegisteredMeter("p2p/serves/success/1min", nil)
@@ -67,6 +75,18 @@ var (
 	// capture the rest of errors that are not handled by the above meters
 	dialOtherError = metrics.NewRegisteredMeter("p2p/dials/error/other", nil)
 
+	// dial duration timers, bucketed by outcome
+	dialSuccessLatency             = metrics.NewRegisteredTimer("p2p/dials/latency/success", nil)
+	dialConnectionErrorLatency     = metrics.NewRegisteredTimer("p2p/dials/latency/error/connection", nil)
+	dialTooManyPeersLatency        = metrics.NewRegisteredTimer("p2p/dials/latency/error/saturated", nil)
+	dialAlreadyConnectedLatency    = metrics.NewRegisteredTimer("p2p/dials/latency/error/known", nil)
+	dialSelfLatency                = metrics.NewRegisteredTimer("p2p/dials/latency/error/self", nil)
+	dialUselessPeerLatency         = metrics.NewRegisteredTimer("p2p/dials/latency/error/useless", nil)
+	dialUnexpectedIdentityLatency  = metrics.NewRegisteredTimer("p2p/dials/latency/error/id/unexpected", nil)
+	dialEncHandshakeErrorLatency   = metrics.NewRegisteredTimer("p2p/dials/latency/error/rlpx/enc", nil)
+	dialProtoHandshakeErrorLatency = metrics.NewRegisteredTimer("p2p/dials/latency/error/rlpx/proto", nil)
+	dialOtherErrorLatency          = metrics.NewRegisteredTimer("p2p/dials/latency/error/other", nil)
+
 	// handshake error meters for inbound connections
 	serveTooManyPeers        = metrics.NewRegisteredMeter("p2p/serves/error/saturated", nil)
 	serveAlreadyConnected    = metrics.NewRegisteredMeter("p2p/serves/error/known", nil)
@@ -81,8 +101,60 @@ var (
 
 	normalPeerLatencyStat = metrics.NewRegisteredTimer("p2p/peers/normal/latency", nil)
 	evnPeerLatencyStat    = metrics.NewRegisteredTimer("p2p/peers/evn/latency", nil)
+
+	// count latency measurements exceeding the configured peer latency SLA
+	normalPeerLatencyBreachCounter = metrics.NewRegisteredCounter("p2p/peers/latency/breach/normal", nil)
+	evnPeerLatencyBreachCounter    = metrics.NewRegisteredCounter("p2p/peers/latency/breach/evn", nil)
 )
 
+// errorMeter is a custom mapping of an error to the meter counting it.
+type errorMeter struct {
+	err   error
+	meter *metrics.Meter
+}
+
+var (
+	customErrorMeterLock   sync.RWMutex
+	customDialErrorMeters  []errorMeter // Custom dial error meters, in registration order
+	customServeErrorMeters []errorMeter // Custom serve error meters, in registration order
+)
+
+// RegisterDialErrorMeter registers a meter counting the dial errors matching the
+// given one (as per errors.Is) which are not covered by a built-in meter, instead
+// of them ending up as other errors. Mappings are matched in registration order.
+func RegisterDialErrorMeter(err error, meter *metrics.Meter) {
+	customErrorMeterLock.Lock()
+	defer customErrorMeterLock.Unlock()
+
+	customDialErrorMeters = append(customDialErrorMeters, errorMeter{err: err, meter: meter})
+}
+
+// RegisterServeErrorMeter registers a meter counting the errors of inbound
+// connections matching the given one (as per errors.Is) which are not covered by
+// a built-in meter, instead of them ending up as other errors. Mappings are
+// matched in registration order.
+func RegisterServeErrorMeter(err error, meter *metrics.Meter) {
+	customErrorMeterLock.Lock()
+	defer customErrorMeterLock.Unlock()
+
+	customServeErrorMeters = append(customServeErrorMeters, errorMeter{err: err, meter: meter})
+}
+
+// markCustomError marks the first of the custom meters matching the error,
+// returning whether any did.
+func markCustomError(meters *[]errorMeter, err error) bool {
+	customErrorMeterLock.RLock()
+	defer customErrorMeterLock.RUnlock()
+
+	for _, m := range *meters {
+		if errors.Is(err, m.err) {
+			m.meter.Mark(1)
+			return true
+		}
+	}
+	return false
+}
+
 // markDialError matches errors that occur while setting up a dial connection to the
 // corresponding meter. We don't maintain meters for evert possible error, just for
 // the most interesting ones.
@@ -109,11 +181,47 @@ func markDialError(err error) {
 		dialProtoHandshakeError.Mark(1)
 	case errors.Is(err, errEncHandshakeError):
 		dialEncHandshakeError.Mark(1)
+	case markCustomError(&customDialErrorMeters, err):
+		// Counted by the matching custom meter
 	default:
 		dialOtherError.Mark(1)
 	}
 }
 
+// markDialLatency records how long a dial took before succeeding or failing,
+// using the same error classification as markDialError, plus a bucket for dials
+// that couldn't even establish a connection.
+func markDialLatency(err error, elapsed time.Duration) {
+	var (
+		reason       DiscReason
+		handshakeErr *protoHandshakeError
+		connErr      *dialError
+	)
+	d := errors.As(err, &reason)
+	switch {
+	case err == nil:
+		dialSuccessLatency.Update(elapsed)
+	case errors.As(err, &connErr):
+		dialConnectionErrorLatency.Update(elapsed)
+	case d && reason == DiscTooManyPeers:
+		dialTooManyPeersLatency.Update(elapsed)
+	case d && reason == DiscAlreadyConnected:
+		dialAlreadyConnectedLatency.Update(elapsed)
+	case d && reason == DiscSelf:
+		dialSelfLatency.Update(elapsed)
+	case d && reason == DiscUselessPeer:
+		dialUselessPeerLatency.Update(elapsed)
+	case d && reason == DiscUnexpectedIdentity:
+		dialUnexpectedIdentityLatency.Update(elapsed)
+	case errors.As(err, &handshakeErr):
+		dialProtoHandshakeErrorLatency.Update(elapsed)
+	case errors.Is(err, errEncHandshakeError):
+		dialEncHandshakeErrorLatency.Update(elapsed)
+	default:
+		dialOtherErrorLatency.Update(elapsed)
+	}
+}
+
 // markServeError matches errors that occur while serving an inbound connection
 // to the corresponding meter.
 func markServeError(err error) {
@@ -139,6 +247,8 @@ func markServeError(err error) {
 		serveProtoHandshakeError.Mark(1)
 	case errors.Is(err, errEncHandshakeError):
 		serveEncHandshakeError.Mark(1)
+	case markCustomError(&customServeErrorMeters, err):
+		// Counted by the matching custom meter
 	default:
 		serveOtherError.Mark(1)
 	}
@@ -148,6 +258,8 @@ func markServeError(err error) {
 // inbound and outbound network traffic.
 type meteredConn struct {
 	net.Conn
+
+	closed atomic.Bool // Whether the connection was closed, to only count it once
 }
 
 // newMeteredConn creates a new metered connection, bumps the ingress or egress
@@ -157,6 +269,7 @@ func newMeteredConn(conn net.Conn) net.Conn {
 	if !metrics.Enabled() {
 		return conn
 	}
+	activeMeteredConnGauge.Inc(1)
 	return &meteredConn{Conn: conn}
 }
 
@@ -175,3 +288,12 @@ func (c *meteredConn) Write(b []byte) (n int, err error) {
 	egressTrafficMeter.Mark(int64(n))
 	return n, err
 }
+
+// Close delegates a close to the underlying connection, untracking it from the
+// active metered connections the first time around.
+func (c *meteredConn) Close() error {
+	if !c.closed.Swap(true) {
+		activeMeteredConnGauge.Dec(1)
+	}
+	return c.Conn.Close()
+}
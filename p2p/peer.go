@@ -49,6 +49,10 @@ const (
 	pingInterval = 15 * time.Second
 
 	slowPeerLatencyThreshold = 500
+
+	// defaultPeerLatencySLA is the default latency above which a peer is deemed
+	// to breach the latency expectations.
+	defaultPeerLatencySLA = 500 * time.Millisecond
 )
 
 const (
@@ -124,7 +128,8 @@ type Peer struct {
 	testPipe       *MsgPipeRW // for testing
 	testRemoteAddr string     // for testing
 
-	latency atomic.Int64 // mill second latency, estimated by ping msg
+	latency    atomic.Int64  // mill second latency, estimated by ping msg
+	latencySLA time.Duration // latency above which the peer is counted as a breach
 
 	// it indicates the peer is in the validator network, it will directly broadcast when miner/sentry broadcast mined block,
 	// and won't broadcast any txs between EVN peers.
@@ -290,15 +295,16 @@ func (p *Peer) Lifetime() mclock.AbsTime {
 func newPeer(log log.Logger, conn *conn, protocols []Protocol) *Peer {
 	protomap := matchProtocols(protocols, conn.caps, conn)
 	p := &Peer{
-		rw:       conn,
-		running:  protomap,
-		created:  mclock.Now(),
-		disc:     make(chan DiscReason),
-		protoErr: make(chan error, len(protomap)+1), // protocols + pingLoop
-		closed:   make(chan struct{}),
-		pingRecv: make(chan struct{}, 16),
-		pongRecv: make(chan struct{}, 16),
-		log:      log.New("id", conn.node.ID(), "conn", conn.flags),
+		rw:         conn,
+		running:    protomap,
+		created:    mclock.Now(),
+		disc:       make(chan DiscReason),
+		protoErr:   make(chan error, len(protomap)+1), // protocols + pingLoop
+		closed:     make(chan struct{}),
+		pingRecv:   make(chan struct{}, 16),
+		pongRecv:   make(chan struct{}, 16),
+		log:        log.New("id", conn.node.ID(), "conn", conn.flags),
+		latencySLA: defaultPeerLatencySLA,
 	}
 	return p
 }
@@ -389,15 +395,7 @@ func (p *Peer) pingLoop() {
 			// estimate latency here, it also includes tiny msg encode/decode, io wait time
 			latency := (time.Now().UnixMilli() - startPing.Load()) / 2
 			if latency > 0 {
-				p.latency.Store(latency)
-				if p.EVNPeerFlag.Load() {
-					evnPeerLatencyStat.Update(time.Duration(latency))
-				} else {
-					normalPeerLatencyStat.Update(time.Duration(latency))
-				}
-				if latency > slowPeerLatencyThreshold {
-					log.Debug("find a too slow peer", "id", p.ID(), "peer", p.RemoteAddr(), "latency", latency)
-				}
+				p.recordLatency(latency)
 			}
 		case <-p.closed:
 			return
@@ -405,6 +403,32 @@ func (p *Peer) pingLoop() {
 	}
 }
 
+// recordLatency stores a new latency estimate (in milliseconds) of the peer and
+// updates the latency metrics, counting it as a breach if it exceeds the SLA.
+func (p *Peer) recordLatency(latency int64) {
+	p.latency.Store(latency)
+
+	var (
+		evn      = p.EVNPeerFlag.Load()
+		duration = time.Duration(latency) * time.Millisecond
+	)
+	if evn {
+		evnPeerLatencyStat.Update(duration)
+	} else {
+		normalPeerLatencyStat.Update(duration)
+	}
+	if duration > p.latencySLA {
+		if evn {
+			evnPeerLatencyBreachCounter.Inc(1)
+		} else {
+			normalPeerLatencyBreachCounter.Inc(1)
+		}
+	}
+	if latency > slowPeerLatencyThreshold {
+		log.Debug("find a too slow peer", "id", p.ID(), "peer", p.RemoteAddr(), "latency", latency)
+	}
+}
+
 func (p *Peer) readLoop(errc chan<- error) {
 	defer p.wg.Done()
 	for {
@@ -453,6 +477,9 @@ func (p *Peer) handle(msg Msg) error {
 			metrics.GetOrRegisterMeter(m, nil).Mark(int64(msg.meterSize))
 			metrics.GetOrRegisterMeter(m+"/packets", nil).Mark(1)
 		}
+		if proto.ingress != nil {
+			proto.ingress.Mark(int64(msg.meterSize))
+		}
 		select {
 		case proto.in <- msg:
 			return nil
@@ -527,6 +554,13 @@ func (p *Peer) startProtocols(writeStart <-chan struct{}, writeErr chan<- error)
 		proto.closed = p.closed
 		proto.wstart = writeStart
 		proto.werr = writeErr
+
+		// Meter the traffic of each protocol on top of the connection totals, all
+		// versions of a protocol sharing the same meters, e.g. p2p/ingress/snap
+		if metrics.Enabled() {
+			proto.ingress = metrics.GetOrRegisterMeter(ingressMeterName+"/"+proto.Name, nil)
+			proto.egress = metrics.GetOrRegisterMeter(egressMeterName+"/"+proto.Name, nil)
+		}
 		var rw MsgReadWriter = proto
 		if p.events != nil {
 			rw = newMsgEventer(rw, p.events, p.ID(), proto.Name, p.Info().Network.RemoteAddress, p.Info().Network.LocalAddress)
@@ -565,6 +599,9 @@ type protoRW struct {
 	werr   chan<- error    // for write results
 	offset uint64
 	w      MsgWriter
+
+	ingress *metrics.Meter // Meter for the inbound traffic of the protocol, nil if disabled
+	egress  *metrics.Meter // Meter for the outbound traffic of the protocol, nil if disabled
 }
 
 func (rw *protoRW) WriteMsg(msg Msg) (err error) {
@@ -573,6 +610,7 @@ func (rw *protoRW) WriteMsg(msg Msg) (err error) {
 	}
 	msg.meterCap = rw.cap()
 	msg.meterCode = msg.Code
+	msg.meterEgress = rw.egress
 
 	msg.Code += rw.offset
 
@@ -29,6 +29,7 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/ethereum/go-ethereum/p2p/enr"
 )
@@ -146,6 +147,64 @@ func TestPeerProtoReadMsg(t *testing.T) {
 	}
 }
 
+// Tests that the traffic of each protocol is accounted to its own meters.
+func TestPeerProtoTrafficMeters(t *testing.T) {
+	metrics.Enable()
+
+	var (
+		ingress = metrics.GetOrRegisterMeter(ingressMeterName+"/metertest", nil)
+		egress  = metrics.GetOrRegisterMeter(egressMeterName+"/metertest", nil)
+		other   = metrics.GetOrRegisterMeter(ingressMeterName+"/othertest", nil)
+
+		ingressBefore = ingress.Snapshot().Count()
+		egressBefore  = egress.Snapshot().Count()
+	)
+	protos := []Protocol{
+		{
+			Name:   "metertest",
+			Length: 5,
+			Run: func(peer *Peer, rw MsgReadWriter) error {
+				if err := ExpectMsg(rw, 2, []uint{1}); err != nil {
+					t.Error(err)
+				}
+				if err := Send(rw, 3, []uint{2}); err != nil {
+					t.Errorf("write error: %v", err)
+				}
+				return nil
+			},
+		},
+		{
+			Name:   "othertest",
+			Length: 5,
+			Run: func(peer *Peer, rw MsgReadWriter) error {
+				<-peer.closed
+				return nil
+			},
+		},
+	}
+	closer, rw, _, errc := testPeer(protos)
+	defer closer()
+
+	Send(rw, baseProtocolLength+2, []uint{1})
+	if err := ExpectMsg(rw, baseProtocolLength+3, []uint{2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-errc:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("peer did not terminate")
+	}
+	if have := ingress.Snapshot().Count() - ingressBefore; have <= 0 {
+		t.Errorf("protocol ingress not metered: have %d", have)
+	}
+	if have := egress.Snapshot().Count() - egressBefore; have <= 0 {
+		t.Errorf("protocol egress not metered: have %d", have)
+	}
+	if have := other.Snapshot().Count(); have != 0 {
+		t.Errorf("idle protocol ingress metered: have %d", have)
+	}
+}
+
 func TestPeerProtoEncodeMsg(t *testing.T) {
 	proto := Protocol{
 		Name:   "a",
@@ -360,3 +419,70 @@ func TestMatchProtocols(t *testing.T) {
 		}
 	}
 }
+
+// Tests that latency estimates are recorded into the timer matching the EVN flag
+// of the peer, converted from milliseconds.
+func TestPeerLatencyStats(t *testing.T) {
+	metrics.Enable()
+
+	// Swap in fresh timers, not polluted by other tests
+	normal, evn := normalPeerLatencyStat, evnPeerLatencyStat
+	defer func() { normalPeerLatencyStat, evnPeerLatencyStat = normal, evn }()
+	normalPeerLatencyStat, evnPeerLatencyStat = metrics.NewTimer(), metrics.NewTimer()
+
+	peer := NewPeer(randomID(), "test", nil)
+	peer.recordLatency(40)
+	peer.EVNPeerFlag.Store(true)
+	peer.recordLatency(20)
+
+	for _, tt := range []struct {
+		name  string
+		timer *metrics.Timer
+		want  time.Duration
+	}{
+		{"normal", normalPeerLatencyStat, 40 * time.Millisecond},
+		{"evn", evnPeerLatencyStat, 20 * time.Millisecond},
+	} {
+		have := tt.timer.Snapshot()
+		if count := have.Count(); count != 1 {
+			t.Errorf("%s latency count mismatch: have %d, want 1", tt.name, count)
+		}
+		if max := time.Duration(have.Max()); max != tt.want {
+			t.Errorf("%s latency mismatch: have %v, want %v", tt.name, max, tt.want)
+		}
+	}
+}
+
+// Tests that only latencies above the configured SLA are counted as breaches,
+// separately for EVN and normal peers.
+func TestPeerLatencySLABreach(t *testing.T) {
+	peer := NewPeer(randomID(), "test", nil)
+	peer.latencySLA = 100 * time.Millisecond
+
+	var (
+		normal = normalPeerLatencyBreachCounter.Snapshot().Count()
+		evn    = evnPeerLatencyBreachCounter.Snapshot().Count()
+	)
+	for _, latency := range []int64{10, 100, 101, 500} {
+		peer.recordLatency(latency)
+	}
+	if have, want := normalPeerLatencyBreachCounter.Snapshot().Count()-normal, int64(2); have != want {
+		t.Errorf("normal breach count mismatch: have %d, want %d", have, want)
+	}
+	if have := evnPeerLatencyBreachCounter.Snapshot().Count() - evn; have != 0 {
+		t.Errorf("evn breach count mismatch: have %d, want 0", have)
+	}
+	if have := peer.latency.Load(); have != 500 {
+		t.Errorf("latency mismatch: have %d, want 500", have)
+	}
+	peer.EVNPeerFlag.Store(true)
+	for _, latency := range []int64{50, 150} {
+		peer.recordLatency(latency)
+	}
+	if have := evnPeerLatencyBreachCounter.Snapshot().Count() - evn; have != 1 {
+		t.Errorf("evn breach count mismatch: have %d, want 1", have)
+	}
+	if have, want := normalPeerLatencyBreachCounter.Snapshot().Count()-normal, int64(2); have != want {
+		t.Errorf("normal breach count mismatch: have %d, want %d", have, want)
+	}
+}
@@ -592,13 +592,18 @@ func (srv *Server) setupDialScheduler() {
 		log:            srv.Logger,
 		netRestrict:    srv.NetRestrict,
 		dialer:         srv.Dialer,
+		dialTimeout:    srv.DialTimeout,
 		clock:          srv.clock,
 	}
 	if srv.discv4 != nil {
 		config.resolver = srv.discv4
 	}
+	if config.dialTimeout == 0 {
+		config.dialTimeout = defaultDialTimeout
+	}
+	dialTimeoutGauge.Update(config.dialTimeout.Milliseconds())
 	if config.dialer == nil {
-		config.dialer = tcpDialer{&net.Dialer{Timeout: defaultDialTimeout}}
+		config.dialer = tcpDialer{&net.Dialer{Timeout: config.dialTimeout}}
 	}
 	srv.dialsched = newDialScheduler(config, srv.discmix, srv.SetupConn)
 	for _, n := range srv.StaticNodes {
@@ -1053,6 +1058,9 @@ func (srv *Server) checkpoint(c *conn, stage chan<- *conn) error {
 
 func (srv *Server) launchPeer(c *conn) *Peer {
 	p := newPeer(srv.log, c, srv.Protocols)
+	if srv.PeerLatencySLA > 0 {
+		p.latencySLA = srv.PeerLatencySLA
+	}
 	if srv.EnableMsgEvents {
 		// If message events are enabled, pass the peerFeed
 		// to the peer.
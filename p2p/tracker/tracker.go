@@ -78,6 +78,8 @@ type Tracker struct {
 	expire  *list.List          // Linked list tracking the expiration order
 	wake    *time.Timer         // Timer tracking the expiration of the next item
 
+	latencies map[uint64]*metrics.Timer // Response latencies of the peer per request type
+
 	lock sync.Mutex // Lock protecting from concurrent updates
 }
 
@@ -85,11 +87,12 @@ type Tracker struct {
 // fill certain requests and how individual peers perform.
 func New(cap p2p.Cap, peerID string, timeout time.Duration) *Tracker {
 	return &Tracker{
-		cap:     cap,
-		peer:    peerID,
-		timeout: timeout,
-		pending: make(map[uint64]*Request),
-		expire:  list.New(),
+		cap:       cap,
+		peer:      peerID,
+		timeout:   timeout,
+		pending:   make(map[uint64]*Request),
+		expire:    list.New(),
+		latencies: make(map[uint64]*metrics.Timer),
 	}
 }
 
@@ -193,6 +196,10 @@ func (t *Tracker) Stop() {
 	}
 	clear(t.pending)
 	t.expire = nil
+
+	for _, timer := range t.latencies {
+		timer.Stop()
+	}
 }
 
 // Fulfil fills a pending request, if any is available, reporting on various metrics.
@@ -235,10 +242,37 @@ func (t *Tracker) Fulfil(resp Response) error {
 	if metrics.Enabled() {
 		t.trackedGauge(req.ReqCode).Dec(1)
 		t.waitHistogram(req.ReqCode).Update(time.Since(req.time).Microseconds())
+		t.latencyTimer(req.ReqCode).UpdateSince(req.time)
 	}
 	return nil
 }
 
+// Latency returns the response latencies of the tracked peer for the requests of
+// the given message code, or nil if none was fulfilled yet. Contrary to the wait
+// histograms aggregating all peers, this allows spotting if a single peer is slow
+// to serve a specific type of data.
+func (t *Tracker) Latency(code uint64) *metrics.TimerSnapshot {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	timer, ok := t.latencies[code]
+	if !ok {
+		return nil
+	}
+	return timer.Snapshot()
+}
+
+// latencyTimer returns the peer's response latency timer for the given request
+// message code, creating it if needed. The caller must hold the lock.
+func (t *Tracker) latencyTimer(code uint64) *metrics.Timer {
+	timer, ok := t.latencies[code]
+	if !ok {
+		timer = metrics.NewTimer()
+		t.latencies[code] = timer
+	}
+	return timer
+}
+
 func (t *Tracker) trackedGauge(code uint64) *metrics.Gauge {
 	name := fmt.Sprintf("%s/%s/%d/%#02x", trackedGaugeName, t.cap.Name, t.cap.Version, code)
 	return metrics.GetOrRegisterGauge(name, nil)
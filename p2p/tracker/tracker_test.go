@@ -62,3 +62,43 @@ func TestMetricsOnStop(t *testing.T) {
 		t.Fatalf("gauge2 value after stop: got %d, want 0", gauge2.Snapshot().Value())
 	}
 }
+
+// This checks that the response latencies are recorded per request type.
+func TestLatencyPerRequestType(t *testing.T) {
+	metrics.Enable()
+
+	cap := p2p.Cap{Name: "test", Version: 1}
+	tr := New(cap, "peer1", time.Minute)
+	defer tr.Stop()
+
+	// Track and fulfil a number of requests with different ReqCodes.
+	var id uint64
+	for i := 0; i < 3; i++ {
+		tr.Track(Request{ID: id, ReqCode: 0x01, RespCode: 0x02, Size: 1})
+		if err := tr.Fulfil(Response{ID: id, MsgCode: 0x02, Size: 1}); err != nil {
+			t.Fatalf("failed to fulfil request %d: %v", id, err)
+		}
+		id++
+	}
+	tr.Track(Request{ID: id, ReqCode: 0x03, RespCode: 0x04, Size: 1})
+	time.Sleep(10 * time.Millisecond)
+	if err := tr.Fulfil(Response{ID: id, MsgCode: 0x04, Size: 1}); err != nil {
+		t.Fatalf("failed to fulfil request %d: %v", id, err)
+	}
+	// Track a request without fulfilling it, it must not be recorded.
+	tr.Track(Request{ID: id + 1, ReqCode: 0x05, RespCode: 0x06, Size: 1})
+
+	if have := tr.Latency(0x01).Count(); have != 3 {
+		t.Fatalf("latency count mismatch for 0x01: got %d, want 3", have)
+	}
+	latency := tr.Latency(0x03)
+	if have := latency.Count(); have != 1 {
+		t.Fatalf("latency count mismatch for 0x03: got %d, want 1", have)
+	}
+	if have := time.Duration(latency.Max()); have < 10*time.Millisecond {
+		t.Fatalf("latency too low for 0x03: got %v, want at least 10ms", have)
+	}
+	if latency := tr.Latency(0x05); latency != nil {
+		t.Fatalf("latency recorded for unfulfilled request: got %d samples", latency.Count())
+	}
+}
@@ -104,6 +104,9 @@ func (t *rlpxTransport) WriteMsg(msg Msg) error {
 		metrics.GetOrRegisterMeter(m, nil).Mark(int64(msg.meterSize))
 		metrics.GetOrRegisterMeter(m+"/packets", nil).Mark(1)
 	}
+	if msg.meterEgress != nil {
+		msg.meterEgress.Mark(int64(msg.meterSize))
+	}
 	return nil
 }
 